@@ -2,7 +2,12 @@
 package config
 
 import (
+	"SciCommon/configsource"
+	"SciCommon/secret"
 	"fmt"
+	"path"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator"
@@ -17,11 +22,73 @@ type MQConfig struct {
 	CACertFile           string        `mapstructure:"ca_cert_file" yaml:"ca_cert_file"`
 	Timeout              time.Duration `mapstructure:"timeout"      yaml:"timeout"`
 	ConfirmTimeout       time.Duration `mapstructure:"confirm_timeout" yaml:"confirm_timeout"`
+	MaxInFlight          int           `mapstructure:"max_in_flight" yaml:"max_in_flight" validate:"gte=0"` // 同時等待確認的訊息上限，0 為預設 32
+	Mandatory            bool          `mapstructure:"mandatory" yaml:"mandatory"`                          // 沒有 Queue 可接收的訊息由 broker 退回，視為發送失敗
 	DeadLetterExchange   string        `mapstructure:"dead_letter_exchange" yaml:"dead_letter_exchange"`
 	DeadLetterQueue      string        `mapstructure:"dead_letter_queue" yaml:"dead_letter_queue"`
 	DeadLetterRoutingKey string        `mapstructure:"dead_letter_routing_key" yaml:"dead_letter_routing_key"`
 	PrimaryExchange      string        `mapstructure:"primary_exchange" yaml:"primary_exchange"`
 	PrimaryQueue         string        `mapstructure:"primary_queue" yaml:"primary_queue"`
+	Publisher            string        `mapstructure:"publisher" yaml:"publisher"`               // rabbitmq(預設) / file；memory 只供測試與 dry-run
+	CaptureFile          string        `mapstructure:"capture_file" yaml:"capture_file"`         // publisher = file 時寫入的 NDJSON 路徑
+	FactoryID            string        `mapstructure:"factory_id" yaml:"factory_id"`             // 工廠代號，放在訊息 AppId 供 Consumer 辨識
+	ReceiptExchange      string        `mapstructure:"receipt_exchange" yaml:"receipt_exchange"` // Consumer 回執使用的 Exchange
+	ReceiptQueue         string        `mapstructure:"receipt_queue" yaml:"receipt_queue"`       // 本廠回執 Queue，留空表示不等待回執（broker 確認即標記）
+	DmlStreams           []DmlStream   `mapstructure:"dml_streams" yaml:"dml_streams"`
+	DmlStreamColumn      string        `mapstructure:"dml_stream_column" yaml:"dml_stream_column"` // BITaskInfo 中存放 stream 名稱的欄位，優先於 dml_streams.tables
+	Compression          string        `mapstructure:"compression" yaml:"compression"`             // 訊息 Body 壓縮：none(預設) / gzip / zstd
+	SigningKeyID         string        `mapstructure:"signing_key_id" yaml:"signing_key_id"`       // 簽章金鑰代號，Consumer 依此查詢金鑰
+	SigningSecret        string        `mapstructure:"signing_secret" yaml:"signing_secret"`       // 本廠 HMAC-SHA256 金鑰（base64，至少 32 bytes），留空表示不簽章
+	EncryptionSecret     string        `mapstructure:"encryption_secret" yaml:"encryption_secret"` // AES-256-GCM 金鑰（base64，32 bytes），留空表示不加密 Body
+}
+
+// 訊息 Body 的壓縮方式，對應 mq.compression 與 AMQP ContentEncoding
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// DmlStream 為一組獨立的 DML 分流，有自己的 RoutingKey 與 Queue；
+// 同一張表只會走一個 stream，Consumer 逐一處理，表內順序不變
+type DmlStream struct {
+	Name   string   `mapstructure:"name"   yaml:"name" validate:"required"`
+	Queue  string   `mapstructure:"queue"  yaml:"queue"`  // 留空則為 <primary_queue>.<name>
+	Tables []string `mapstructure:"tables" yaml:"tables"` // 走這個 stream 的資料表
+}
+
+// QueueName 回傳 stream 使用的 Queue 名稱
+func (s DmlStream) QueueName(primaryQueue string) string {
+	if s.Queue != "" {
+		return s.Queue
+	}
+	return primaryQueue + "." + s.Name
+}
+
+// stream 名稱會放進 RoutingKey 與 Queue 名稱，只允許英數、底線與連字號
+var streamNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validateDmlStreams 檢查 stream 名稱合法、不重複，且每張表只屬於一個 stream
+func validateDmlStreams(streams []DmlStream) error {
+	names := make(map[string]bool, len(streams))
+	tables := make(map[string]string)
+	for _, s := range streams {
+		if !streamNamePattern.MatchString(s.Name) {
+			return fmt.Errorf("dml_streams 名稱 %q 只允許英數、底線與連字號", s.Name)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("dml_streams 名稱 %q 重複", s.Name)
+		}
+		names[s.Name] = true
+		for _, t := range s.Tables {
+			key := strings.ToLower(t)
+			if other, ok := tables[key]; ok {
+				return fmt.Errorf("資料表 %s 同時屬於 stream %q 與 %q", t, other, s.Name)
+			}
+			tables[key] = s.Name
+		}
+	}
+	return nil
 }
 
 type DBConfig struct {
@@ -36,28 +103,285 @@ type DBConfig struct {
 	QueryTimeout time.Duration `mapstructure:"query_timeout" yaml:"query_timeout"` // 新增的 query_timeout
 }
 
+// Server 回傳 host\instance 形式的 SQL Server 名稱（沒有 instance 時只有 host），用於訊息信封與 log
+func (c DBConfig) Server() string {
+	if c.Instance == "" || strings.Contains(c.Host, `\`) {
+		return c.Host
+	}
+	return c.Host + `\` + c.Instance
+}
+
+// DmlLogGenerate 的資料來源
+const (
+	DmlSourceBIStatus       = "bistatus"        // 掃描 BIStatus = 'New' 與 _History 表（預設）
+	DmlSourceChangeTracking = "change_tracking" // 讀取 SQL Server Change Tracking，不更動來源資料列
+)
+
+// DmlSourceConfig 設定各資料表 DmlLog 的產生方式，方便逐廠、逐表遷移
+type DmlSourceConfig struct {
+	Default string            `mapstructure:"default" yaml:"default"`
+	Tables  map[string]string `mapstructure:"tables"  yaml:"tables"` // key 為資料表名稱（不分大小寫）
+	// BIStatus 來源每個 chunk 認領的筆數，0 表示使用預設值
+	ChunkSize int `mapstructure:"chunk_size" yaml:"chunk_size" validate:"gte=0"`
+}
+
+// SourceFor 回傳指定資料表使用的來源
+func (c DmlSourceConfig) SourceFor(table string) string {
+	for name, src := range c.Tables {
+		if strings.EqualFold(name, table) {
+			return src
+		}
+	}
+	if c.Default != "" {
+		return c.Default
+	}
+	return DmlSourceBIStatus
+}
+
 type PrometheusConfig struct {
 	MetricsPort int `mapstructure:"metrics_port"     yaml:"metrics_port"`
 }
 
+// 喚醒 DML 迴圈的方式
+const (
+	PollWakeNone          = ""               // 只依間隔輪詢
+	PollWakeServiceBroker = "service_broker" // DmlLog 觸發器送訊息到 Service Broker Queue，收到即立即處理
+)
+
+// PollConfig 為 DDL / DML 迴圈的自適應輪詢設定：
+// 撈到資料時立即再跑，沒有資料時從 process_*_interval 倍增到 *_max_interval
+type PollConfig struct {
+	DdlMaxInterval time.Duration `mapstructure:"ddl_max_interval" yaml:"ddl_max_interval"` // 留空則固定為 process_ddl_interval
+	DmlMaxInterval time.Duration `mapstructure:"dml_max_interval" yaml:"dml_max_interval"` // 留空則固定為 process_dml_interval
+	Wake           string        `mapstructure:"wake"             yaml:"wake"`             // "" 或 service_broker
+	WakeQueue      string        `mapstructure:"wake_queue"       yaml:"wake_queue"`       // wake = service_broker 時接收通知的 Queue
+}
+
+// ResilienceConfig 為批次失敗時的重試與熔斷設定，0 表示使用預設值
+type ResilienceConfig struct {
+	RetryBase          time.Duration `mapstructure:"retry_base"           yaml:"retry_base"`                         // 暫時性錯誤第一次重試的等待上限，之後倍增並加上 jitter
+	RetryMax           time.Duration `mapstructure:"retry_max"            yaml:"retry_max"`                          // 暫時性錯誤重試等待的上限
+	BreakerThreshold   int           `mapstructure:"breaker_threshold"    yaml:"breaker_threshold" validate:"gte=0"` // DB、MQ 連續失敗幾次後熔斷
+	BreakerOpenTimeout time.Duration `mapstructure:"breaker_open_timeout" yaml:"breaker_open_timeout"`               // 熔斷後多久放行試探
+	PoisonWait         time.Duration `mapstructure:"poison_wait"          yaml:"poison_wait"`                        // 資料或設定錯誤後等待多久再試
+}
+
+// BatchConfig 為每個批次（一則 MQ 訊息）的上限，0 表示使用預設值；
+// 撈出的 Log 超過 max_bytes 時依序拆成多個批次，每個批次至少一筆
+type BatchConfig struct {
+	DdlMaxRows int `mapstructure:"ddl_max_rows" yaml:"ddl_max_rows" validate:"gte=0"` // 一次撈取的 DdlLog 筆數，預設 10000
+	DmlMaxRows int `mapstructure:"dml_max_rows" yaml:"dml_max_rows" validate:"gte=0"` // 一次撈取的 DmlLog 筆數，預設 1000
+	MaxBytes   int `mapstructure:"max_bytes"    yaml:"max_bytes"    validate:"gte=0"` // 單一訊息 Body 壓縮前的大小上限，預設 4 MiB
+}
+
+// DDL 過濾規則的動作
+const (
+	DdlFilterAllow = "allow" // 送到 TPE
+	DdlFilterDeny  = "deny"  // 不送出，於 DdlLog.FilterReason 記錄原因
+)
+
+// DdlFilterConfig 為 DdlLog 的過濾規則：依序比對 rules，第一條符合的規則決定 allow 或 deny，
+// 都不符合時依 default；未設定任何規則且 default 為 allow 時不過濾
+type DdlFilterConfig struct {
+	Default string    `mapstructure:"default" yaml:"default"` // allow(預設) / deny
+	Rules   []DdlRule `mapstructure:"rules"   yaml:"rules"`
+}
+
+// Enabled 回傳是否需要過濾
+func (c DdlFilterConfig) Enabled() bool {
+	return len(c.Rules) > 0 || c.Default == DdlFilterDeny
+}
+
+// DdlRule 為一條過濾規則，有設定的條件都符合才算符合；比對不分大小寫，可使用 * 萬用字元（例如 DROP_*）
+type DdlRule struct {
+	Name         string   `mapstructure:"name"           yaml:"name"`           // 記錄在 FilterReason，留空時以序號表示
+	Action       string   `mapstructure:"action"         yaml:"action"`         // allow / deny
+	EventTypes   []string `mapstructure:"event_types"    yaml:"event_types"`    // EVENTDATA 的 EventType，例如 ALTER_TABLE
+	Schemas      []string `mapstructure:"schemas"        yaml:"schemas"`        // SchemaName
+	Objects      []string `mapstructure:"objects"        yaml:"objects"`        // ObjectName
+	ObjectTypes  []string `mapstructure:"object_types"   yaml:"object_types"`   // ObjectType，例如 TABLE、VIEW
+	Logins       []string `mapstructure:"logins"         yaml:"logins"`         // LoginName
+	BITaskTables bool     `mapstructure:"bi_task_tables" yaml:"bi_task_tables"` // 只符合 BITaskInfo 中的資料表
+}
+
+// validate 檢查動作與萬用字元格式
+func (c DdlFilterConfig) validate() error {
+	switch c.Default {
+	case "", DdlFilterAllow, DdlFilterDeny:
+	default:
+		return fmt.Errorf("ddl_filter.default 不支援 %q", c.Default)
+	}
+	for i, r := range c.Rules {
+		if r.Action != DdlFilterAllow && r.Action != DdlFilterDeny {
+			return fmt.Errorf("ddl_filter.rules[%d].action 只能是 allow 或 deny，實際 %q", i, r.Action)
+		}
+		for _, patterns := range [][]string{r.EventTypes, r.Schemas, r.Objects, r.ObjectTypes, r.Logins} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("ddl_filter.rules[%d] 的 %q 格式錯誤：%w", i, pattern, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// 保留期限到期的資料處理方式
+const (
+	RetentionModeDelete  = "delete"  // 直接刪除（預設）
+	RetentionModeArchive = "archive" // 搬到 <資料表>_Archive 後刪除
+)
+
+// RetentionConfig 為 DdlLog、DmlLog、批次紀錄與 _History 表的保留設定，只清理已完成且超過天數的資料；
+// 天數為 0 表示不清理該類資料
+type RetentionConfig struct {
+	Enabled           bool          `mapstructure:"enabled"             yaml:"enabled"`
+	DryRun            bool          `mapstructure:"dry_run"             yaml:"dry_run"`                       // 只統計可清理的筆數，不刪除
+	Mode              string        `mapstructure:"mode"                yaml:"mode"`                          // delete(預設) / archive
+	LogDays           int           `mapstructure:"log_days"            yaml:"log_days" validate:"gte=0"`     // 已被 TPE 接收的 DdlLog / DmlLog 保留天數
+	BatchDays         int           `mapstructure:"batch_days"          yaml:"batch_days" validate:"gte=0"`   // 已完成（Marked、Failed）的批次紀錄保留天數
+	HistoryDays       int           `mapstructure:"history_days"        yaml:"history_days" validate:"gte=0"` // _History 表中 BIStatus = 'Complete' 資料的保留天數
+	HistoryDateColumn string        `mapstructure:"history_date_column" yaml:"history_date_column"`           // _History 表判斷天數的時間欄位，設定 history_days 時必填
+	ChunkSize         int           `mapstructure:"chunk_size"          yaml:"chunk_size" validate:"gte=0"`   // 每次 DELETE 的筆數，預設 5000
+	ChunkPause        time.Duration `mapstructure:"chunk_pause"         yaml:"chunk_pause"`                   // 每個 chunk 之間的間隔，降低鎖定與 log 壓力
+	WindowStart       string        `mapstructure:"window_start"        yaml:"window_start"`                  // 離峰時段起，格式 15:04，留空表示不限時段
+	WindowEnd         string        `mapstructure:"window_end"          yaml:"window_end"`                    // 離峰時段迄（不含），可跨午夜
+	Interval          time.Duration `mapstructure:"interval"            yaml:"interval"`                      // 檢查是否需要清理的間隔，預設 1h
+}
+
+// validate 檢查清理方式與離峰時段格式
+func (c RetentionConfig) validate() error {
+	switch c.Mode {
+	case "", RetentionModeDelete, RetentionModeArchive:
+	default:
+		return fmt.Errorf("retention.mode 不支援 %q", c.Mode)
+	}
+	if c.HistoryDays > 0 && c.HistoryDateColumn == "" {
+		return fmt.Errorf("設定 retention.history_days 時必須設定 retention.history_date_column")
+	}
+	if (c.WindowStart == "") != (c.WindowEnd == "") {
+		return fmt.Errorf("retention.window_start 與 window_end 必須同時設定")
+	}
+	for _, s := range []string{c.WindowStart, c.WindowEnd} {
+		if _, err := time.Parse("15:04", s); s != "" && err != nil {
+			return fmt.Errorf("retention 離峰時段 %q 格式應為 15:04", s)
+		}
+	}
+	return nil
+}
+
+// OpsConfig 為維運 HTTP 服務（/metrics、/healthz、/readyz、/admin/*）的設定
+type OpsConfig struct {
+	Port            int           `mapstructure:"port"             yaml:"port"`             // 留空沿用 prometheus.metrics_port，兩者皆為 0 時不啟動
+	MaxBatchAge     time.Duration `mapstructure:"max_batch_age"    yaml:"max_batch_age"`    // 任一迴圈超過此時間沒有成功的批次時 /readyz 回報未就緒，0 使用預設值
+	BacklogInterval time.Duration `mapstructure:"backlog_interval" yaml:"backlog_interval"` // 統計未處理 DdlLog / DmlLog 的間隔，0 使用預設值
+	AdminToken      string        `mapstructure:"admin_token"      yaml:"admin_token"`      // 管理 API（/admin/*）的 Bearer token，留空表示不開放
+}
+
+// MinAdminTokenLen 為 ops.admin_token 的最短長度
+const MinAdminTokenLen = 16
+
+// ListenPort 回傳維運服務的埠號，未設定 ops.port 時沿用 prometheus.metrics_port
+func (c *Config) ListenPort() int {
+	if c.Ops.Port != 0 {
+		return c.Ops.Port
+	}
+	return c.Prometheus.MetricsPort
+}
+
 // Config 是整個服務的設定容器
 type Config struct {
-	MQ                     MQConfig         `mapstructure:"mq"`
-	DB                     DBConfig         `mapstructure:"db"`
-	Prometheus             PrometheusConfig `mapstructure:"prometheus"`
-	ProcessDdlInterval     time.Duration    `mapstructure:"process_ddl_interval" validate:"required"`
-	ProcessDmlInterval     time.Duration    `mapstructure:"process_dml_interval" validate:"required"`
-	ProcessTimeout         time.Duration    `mapstructure:"process_timeout" validate:"required"`
-	DmlLogGenerateInterval time.Duration    `mapstructure:"dml_log_generate_interval"`
+	MQ         MQConfig         `mapstructure:"mq"`
+	DB         DBConfig         `mapstructure:"db"`
+	Prometheus PrometheusConfig `mapstructure:"prometheus"`
+	Ops        OpsConfig        `mapstructure:"ops"`
+	Poll       PollConfig       `mapstructure:"poll"`
+	Resilience ResilienceConfig `mapstructure:"resilience"`
+	Batch      BatchConfig      `mapstructure:"batch"`
+	Retention  RetentionConfig  `mapstructure:"retention"`
+	DdlFilter  DdlFilterConfig  `mapstructure:"ddl_filter"`
+	// 最低記錄級別：debug、info（預設）、warn、error
+	LogLevel string `mapstructure:"log_level" validate:"omitempty,oneof=debug info warn error"`
+	// 收到關機訊號後等待進行中批次完成的時間，逾時才取消
+	ShutdownTimeout        time.Duration   `mapstructure:"shutdown_timeout"`
+	ProcessDdlInterval     time.Duration   `mapstructure:"process_ddl_interval" validate:"required"`
+	ProcessDmlInterval     time.Duration   `mapstructure:"process_dml_interval" validate:"required"`
+	ProcessTimeout         time.Duration   `mapstructure:"process_timeout" validate:"required"`
+	DmlLogGenerateInterval time.Duration   `mapstructure:"dml_log_generate_interval"`
+	DmlSource              DmlSourceConfig `mapstructure:"dml_source"`
+	// 多工廠模式下，每個工廠合併後的完整設定（由 factories 產生，不直接從檔案解析）
+	Sources []Config `mapstructure:"-"`
 }
 
-// LoadConfig 從指定檔案路徑讀取設定，並支援 ENV 覆寫，最後進行欄位驗證
-func LoadConfig(path string) (*Config, error) {
+// LoadConfig 依序讀取設定檔（後面的覆寫前面的，例如 base + 工廠設定），並支援 ENV 覆寫，
+// 展開 ${env:...}、${file:...}、${secret:...} 秘密參照，最後進行欄位驗證
+func LoadConfig(files ...string) (*Config, error) {
+	// 1. 讀檔
+	v, err := readFiles(files)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. 解析到 struct
+	var cfg Config
+	if err := v.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("解析設定失敗: %w", err)
+	}
+	providers := Secrets.Providers()
+	if err := secret.Resolve(&cfg, "mapstructure", providers); err != nil {
+		return nil, err
+	}
+
+	// 2.1 多工廠：factories 中每一項以頂層設定為基底，覆寫各自的 db、mq、間隔…
+	if v.IsSet("factories") {
+		sources, err := loadFactorySources(v, providers)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Sources = sources
+		return &cfg, nil
+	}
+
+	// 3. 驗證必填欄位
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// EffectiveSettings 回傳合併設定檔與 ENV 後、遮蔽敏感欄位的有效設定；
+// 多工廠時 factories 為每個工廠合併後的完整設定
+func EffectiveSettings(files ...string) (map[string]interface{}, error) {
+	v, err := readFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	settings := v.AllSettings()
+	if v.IsSet("factories") {
+		merged, err := factorySettings(v)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, len(merged))
+		for i, m := range merged {
+			list[i] = m
+		}
+		settings["factories"] = list
+	}
+	return configsource.RedactSettings(settings), nil
+}
+
+// readFiles 建立 viper、綁定 ENV，依序讀入並深度合併設定檔
+func readFiles(files []string) (*viper.Viper, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("讀取設定檔失敗: 未指定設定檔")
+	}
 	v := viper.New()
-	v.SetConfigFile(path) // 例如 "config/config.yaml"
 	v.SetConfigType("yaml")
 	v.AutomaticEnv() // 支援以 ENV 覆寫
-	v.SetEnvPrefix("FtyBiProducer")
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_")) // db.host 對應 FTYBIPRODUCER_DB_HOST
 
 	// 綁定 ENV 變數（可按需增減）
 	v.BindEnv("mq.amqp_url")
@@ -72,6 +396,18 @@ func LoadConfig(path string) (*Config, error) {
 	v.BindEnv("mq.primary_exchange")
 	v.BindEnv("mq.primary_queue")
 	v.BindEnv("mq.confirm_timeout")
+	v.BindEnv("mq.max_in_flight")
+	v.BindEnv("mq.mandatory")
+	v.BindEnv("mq.publisher")
+	v.BindEnv("mq.capture_file")
+	v.BindEnv("mq.factory_id")
+	v.BindEnv("mq.receipt_exchange")
+	v.BindEnv("mq.receipt_queue")
+	v.BindEnv("mq.dml_stream_column")
+	v.BindEnv("mq.compression")
+	v.BindEnv("mq.signing_key_id")
+	v.BindEnv("mq.signing_secret")
+	v.BindEnv("mq.encryption_secret")
 
 	v.BindEnv("db.host")
 	v.BindEnv("db.instance")
@@ -84,28 +420,191 @@ func LoadConfig(path string) (*Config, error) {
 	v.BindEnv("db.query_timeout")
 
 	v.BindEnv("prometheus.metrics_port")
+	v.BindEnv("ops.port")
+	v.BindEnv("ops.max_batch_age")
+	v.BindEnv("ops.backlog_interval")
+	v.BindEnv("ops.admin_token")
+	v.BindEnv("poll.ddl_max_interval")
+	v.BindEnv("poll.dml_max_interval")
+	v.BindEnv("poll.wake")
+	v.BindEnv("poll.wake_queue")
+	v.BindEnv("resilience.retry_base")
+	v.BindEnv("resilience.retry_max")
+	v.BindEnv("resilience.breaker_threshold")
+	v.BindEnv("resilience.breaker_open_timeout")
+	v.BindEnv("resilience.poison_wait")
+	v.BindEnv("batch.ddl_max_rows")
+	v.BindEnv("batch.dml_max_rows")
+	v.BindEnv("batch.max_bytes")
+	v.BindEnv("retention.enabled")
+	v.BindEnv("retention.dry_run")
+	v.BindEnv("retention.mode")
+	v.BindEnv("retention.log_days")
+	v.BindEnv("retention.batch_days")
+	v.BindEnv("retention.history_days")
+	v.BindEnv("shutdown_timeout")
+	v.BindEnv("log_level")
+	v.BindEnv("ddl_filter.default")
 
 	v.BindEnv("process_ddl_interval")
 	v.BindEnv("process_dml_interval")
 	v.BindEnv("process_timeout")
 	v.BindEnv("dml_log_generate_interval")
+	v.BindEnv("dml_source.default")
+	v.BindEnv("dml_source.chunk_size")
 
-	// 1. 讀檔
-	if err := v.ReadInConfig(); err != nil {
-		return nil, fmt.Errorf("讀取設定檔失敗: %w", err)
+	for i, f := range files {
+		v.SetConfigFile(f) // 例如 "config/config.base.yaml"、"config/config.prod_PH1.yaml"
+		read := v.MergeInConfig
+		if i == 0 {
+			read = v.ReadInConfig
+		}
+		if err := read(); err != nil {
+			return nil, fmt.Errorf("讀取設定檔 %s 失敗: %w", f, err)
+		}
 	}
+	return v, nil
+}
 
-	// 2. 解析到 struct
-	var cfg Config
-	if err := v.Unmarshal(&cfg); err != nil {
-		return nil, fmt.Errorf("解析設定失敗: %w", err)
+// FactorySources 回傳要處理的工廠設定；未設定 factories 時只有頂層設定本身
+func (c *Config) FactorySources() []Config {
+	if len(c.Sources) > 0 {
+		return c.Sources
 	}
+	return []Config{*c}
+}
 
-	// 3. 驗證必填欄位
-	validate := validator.New()
-	if err := validate.Struct(&cfg); err != nil {
-		return nil, fmt.Errorf("設定驗證失敗: %w", err)
+// loadFactorySources 把 factories 的每一項深度合併到頂層設定上，解析並驗證
+func loadFactorySources(v *viper.Viper, providers secret.Providers) ([]Config, error) {
+	merged, err := factorySettings(v)
+	if err != nil {
+		return nil, err
 	}
 
-	return &cfg, nil
+	sources := make([]Config, 0, len(merged))
+	seen := make(map[string]bool, len(merged))
+	for i, settings := range merged {
+		fv := viper.New()
+		if err := fv.MergeConfigMap(settings); err != nil {
+			return nil, fmt.Errorf("合併 factories[%d] 設定失敗: %w", i, err)
+		}
+		var src Config
+		if err := fv.Unmarshal(&src); err != nil {
+			return nil, fmt.Errorf("解析 factories[%d] 設定失敗: %w", i, err)
+		}
+		if err := secret.Resolve(&src, "mapstructure", providers); err != nil {
+			return nil, fmt.Errorf("factories[%d] %w", i, err)
+		}
+		id := src.MQ.FactoryID
+		if id == "" {
+			return nil, fmt.Errorf("設定驗證失敗: factories[%d] 缺少 mq.factory_id", i)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("設定驗證失敗: factories 中 factory_id %q 重複", id)
+		}
+		seen[id] = true
+		if err := src.validate(); err != nil {
+			return nil, fmt.Errorf("factories[%d](%s) %w", i, id, err)
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// factorySettings 回傳 factories 每一項與頂層設定深度合併後的設定 map
+func factorySettings(v *viper.Viper) ([]map[string]interface{}, error) {
+	items, ok := v.Get("factories").([]interface{})
+	if !ok || len(items) == 0 {
+		return nil, fmt.Errorf("設定驗證失敗: factories 必須是非空的清單")
+	}
+	base := v.AllSettings()
+	delete(base, "factories")
+
+	merged := make([]map[string]interface{}, 0, len(items))
+	for i, item := range items {
+		overlay, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("設定驗證失敗: factories[%d] 格式錯誤", i)
+		}
+		fv := viper.New()
+		// MergeConfigMap 會沿用並修改巢狀 map，每個工廠都要用自己的複本
+		if err := fv.MergeConfigMap(copySettings(base)); err != nil {
+			return nil, fmt.Errorf("合併 factories[%d] 設定失敗: %w", i, err)
+		}
+		if err := fv.MergeConfigMap(overlay); err != nil {
+			return nil, fmt.Errorf("合併 factories[%d] 設定失敗: %w", i, err)
+		}
+		merged = append(merged, fv.AllSettings())
+	}
+	return merged, nil
+}
+
+// copySettings 深度複製設定 map
+func copySettings(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if sub, ok := v.(map[string]interface{}); ok {
+			out[k] = copySettings(sub)
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// validate 檢查必填欄位與列舉值
+func (c *Config) validate() error {
+	validate := validator.New()
+	if err := validate.Struct(c); err != nil {
+		return fmt.Errorf("設定驗證失敗: %w", err)
+	}
+	if err := validateDmlStreams(c.MQ.DmlStreams); err != nil {
+		return fmt.Errorf("設定驗證失敗: %w", err)
+	}
+	if d := c.DmlSource.Default; d != "" && d != DmlSourceBIStatus && d != DmlSourceChangeTracking {
+		return fmt.Errorf("設定驗證失敗: dml_source.default 不支援 %q", d)
+	}
+	// memory publisher 只把訊息留在記憶體，批次仍會標記為 Marked，只供單元測試與 dry-run 由程式指定
+	switch c.MQ.Publisher {
+	case "", "rabbitmq", "file":
+	case "memory":
+		return fmt.Errorf("設定驗證失敗: mq.publisher = memory 會丟棄訊息，只供測試與 dry-run 使用")
+	default:
+		return fmt.Errorf("設定驗證失敗: mq.publisher 不支援 %q", c.MQ.Publisher)
+	}
+	switch c.MQ.Compression {
+	case "", CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return fmt.Errorf("設定驗證失敗: mq.compression 不支援 %q", c.MQ.Compression)
+	}
+	if err := c.Retention.validate(); err != nil {
+		return fmt.Errorf("設定驗證失敗: %w", err)
+	}
+	if err := c.DdlFilter.validate(); err != nil {
+		return fmt.Errorf("設定驗證失敗: %w", err)
+	}
+	if c.MQ.SigningSecret != "" && c.MQ.SigningKeyID == "" {
+		return fmt.Errorf("設定驗證失敗: 設定 mq.signing_secret 時必須設定 mq.signing_key_id")
+	}
+	if c.MQ.EncryptionSecret != "" && c.MQ.SigningSecret == "" {
+		return fmt.Errorf("設定驗證失敗: 設定 mq.encryption_secret 時必須同時設定 mq.signing_secret")
+	}
+	if t := c.Ops.AdminToken; t != "" && len(t) < MinAdminTokenLen {
+		return fmt.Errorf("設定驗證失敗: ops.admin_token 至少需 %d 個字元", MinAdminTokenLen)
+	}
+	switch c.Poll.Wake {
+	case PollWakeNone:
+	case PollWakeServiceBroker:
+		if c.Poll.WakeQueue == "" {
+			return fmt.Errorf("設定驗證失敗: poll.wake = %s 時必須設定 poll.wake_queue", PollWakeServiceBroker)
+		}
+	default:
+		return fmt.Errorf("設定驗證失敗: poll.wake 不支援 %q", c.Poll.Wake)
+	}
+	for table, src := range c.DmlSource.Tables {
+		if src != DmlSourceBIStatus && src != DmlSourceChangeTracking {
+			return fmt.Errorf("設定驗證失敗: dml_source.tables.%s 不支援 %q", table, src)
+		}
+	}
+	return nil
 }
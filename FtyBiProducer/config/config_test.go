@@ -0,0 +1,144 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.test.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("寫入設定檔失敗: %v", err)
+	}
+	return path
+}
+
+// TestLoadConfig_Factories 驗證 factories 以頂層設定為基底深度合併
+func TestLoadConfig_Factories(t *testing.T) {
+	path := writeConfig(t, `
+process_ddl_interval: "60s"
+process_dml_interval: "1s"
+process_timeout: "30s"
+dml_log_generate_interval: "10s"
+mq:
+  primary_exchange: "bi_main_exchange"
+  primary_queue: "ddl_dml_main_queue"
+db:
+  user: "SCIMIS"
+  name: "POWERBIReportData"
+factories:
+  - mq:
+      factory_id: "ESP"
+      receipt_queue: "bi_receipt_ESP"
+    db:
+      host: "SYSTEM2016BK"
+  - mq:
+      factory_id: "HZG"
+    db:
+      host: "newerp-bak.hzg.com.cn"
+    process_dml_interval: "5s"
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig 失敗: %v", err)
+	}
+	sources := cfg.FactorySources()
+	if len(sources) != 2 {
+		t.Fatalf("預期 2 個工廠，實際 %d", len(sources))
+	}
+	esp, hzg := sources[0], sources[1]
+	if esp.MQ.FactoryID != "ESP" || esp.DB.Host != "SYSTEM2016BK" || esp.DB.User != "SCIMIS" || esp.MQ.PrimaryQueue != "ddl_dml_main_queue" {
+		t.Fatalf("ESP 合併結果不符：%+v", esp)
+	}
+	if esp.MQ.ReceiptQueue != "bi_receipt_ESP" || hzg.MQ.ReceiptQueue != "" {
+		t.Fatalf("receipt_queue 不應互相影響：%q %q", esp.MQ.ReceiptQueue, hzg.MQ.ReceiptQueue)
+	}
+	if esp.ProcessDmlInterval != time.Second || hzg.ProcessDmlInterval != 5*time.Second {
+		t.Fatalf("間隔覆寫不符：%s %s", esp.ProcessDmlInterval, hzg.ProcessDmlInterval)
+	}
+}
+
+// TestLoadConfig_FactoriesDuplicateID 驗證 factory_id 重複時回傳錯誤
+func TestLoadConfig_FactoriesDuplicateID(t *testing.T) {
+	path := writeConfig(t, `
+process_ddl_interval: "60s"
+process_dml_interval: "1s"
+process_timeout: "30s"
+factories:
+  - mq: {factory_id: "PH1"}
+  - mq: {factory_id: "PH1"}
+`)
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("factory_id 重複應回傳錯誤")
+	}
+}
+
+// TestLoadConfig_Single 驗證未設定 factories 時只有頂層設定
+func TestLoadConfig_Single(t *testing.T) {
+	path := writeConfig(t, `
+process_ddl_interval: "60s"
+process_dml_interval: "1s"
+process_timeout: "30s"
+mq:
+  factory_id: "PH1"
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig 失敗: %v", err)
+	}
+	if sources := cfg.FactorySources(); len(sources) != 1 || sources[0].MQ.FactoryID != "PH1" {
+		t.Fatalf("單一工廠結果不符：%+v", sources)
+	}
+}
+
+// TestLoadConfig_MemoryPublisherRejected 驗證設定檔不可使用會丟棄訊息的 memory publisher
+func TestLoadConfig_MemoryPublisherRejected(t *testing.T) {
+	path := writeConfig(t, `
+process_ddl_interval: "60s"
+process_dml_interval: "1s"
+process_timeout: "30s"
+mq:
+  factory_id: "PH1"
+  publisher: "memory"
+`)
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "mq.publisher") {
+		t.Fatalf("預期 mq.publisher 驗證失敗，實際 %v", err)
+	}
+}
+
+// TestDiff 驗證重新載入時只套用可即時變更的設定，需重新連線的設定維持原值
+func TestDiff(t *testing.T) {
+	old := Config{ProcessDmlInterval: time.Second, DB: DBConfig{Host: "PMSDB"}, Batch: BatchConfig{DmlMaxRows: 1000}}
+	old.MQ.DmlStreams = []DmlStream{{Name: "orders"}}
+	next := old
+	next.LogLevel = "debug"
+	next.ProcessDmlInterval = 5 * time.Second
+	next.Batch.DmlMaxRows = 500
+	next.DB.Host = "PMSDB2"
+	next.MQ.DmlStreams = []DmlStream{{Name: "orders"}, {Name: "stock"}}
+
+	changes := Diff(old, next)
+	if want := []string{"batch.dml_max_rows", "log_level", "process_dml_interval"}; !reflect.DeepEqual(changes.Live, want) {
+		t.Fatalf("可即時套用的設定預期 %v，實際 %v", want, changes.Live)
+	}
+	if want := []string{"db.host", "mq.dml_streams"}; !reflect.DeepEqual(changes.Deferred, want) {
+		t.Fatalf("需重新啟動的設定預期 %v，實際 %v", want, changes.Deferred)
+	}
+
+	// 套用後只剩需重新啟動的差異
+	applied := old.WithReloadable(next)
+	if after := Diff(applied, next); len(after.Live) != 0 || !reflect.DeepEqual(after.Deferred, changes.Deferred) {
+		t.Fatalf("WithReloadable 未套用全部可即時變更的設定：%+v", after)
+	}
+	if applied.DB.Host != "PMSDB" || len(applied.MQ.DmlStreams) != 1 {
+		t.Fatalf("需重新連線的設定不應套用：%+v", applied)
+	}
+	if !Diff(next, next).Empty() {
+		t.Fatal("相同設定不應有差異")
+	}
+}
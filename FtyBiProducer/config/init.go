@@ -39,11 +39,10 @@ func InitGormDB(dbCfg DBConfig) (*gorm.DB, error) {
 		int(dbCfg.QueryTimeout.Seconds()),
 	)
 
-	// 4. 開始連線
+	// 4. 開始連線；錯誤只帶主機與資料庫，不帶含密碼的 DSN
 	db, err := gorm.Open(sqlserver.Open(dsn), &gorm.Config{})
 	if err != nil {
-		// 印出 DSN 方便 debug，但請小心不要在正式環境曝光密碼
-		return nil, fmt.Errorf("連接 SQL Server 失敗: %w, DSN: %s", err, dsn)
+		return nil, fmt.Errorf("連接 SQL Server %s（資料庫 %s、帳號 %s）失敗: %w", pathHost, dbCfg.Name, dbCfg.User, err)
 	}
 	return db, nil
 }
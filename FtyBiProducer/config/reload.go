@@ -0,0 +1,49 @@
+// 設定檔熱重載：監看設定檔，比對新舊設定，只有不需要重新連線的設定可在執行中套用
+package config
+
+import "SciCommon/reload"
+
+// reloadableKeys 為可在執行中套用的設定（需與 WithReloadable 一致），其餘（DB、MQ 連線、憑證、分流…）需重新啟動
+var reloadableKeys = []string{
+	"log_level",
+	"process_ddl_interval",
+	"process_dml_interval",
+	"process_timeout",
+	"dml_log_generate_interval",
+	"poll.ddl_max_interval",
+	"poll.dml_max_interval",
+	"batch.ddl_max_rows",
+	"batch.dml_max_rows",
+	"batch.max_bytes",
+}
+
+// Reloadable 回傳設定鍵是否可在執行中套用
+func Reloadable(key string) bool {
+	for _, k := range reloadableKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// WithReloadable 回傳 c 套用 next 中可即時變更的設定後的結果，其餘維持 c 的值
+func (c Config) WithReloadable(next Config) Config {
+	c.LogLevel = next.LogLevel
+	c.ProcessDdlInterval = next.ProcessDdlInterval
+	c.ProcessDmlInterval = next.ProcessDmlInterval
+	c.ProcessTimeout = next.ProcessTimeout
+	c.DmlLogGenerateInterval = next.DmlLogGenerateInterval
+	c.Poll.DdlMaxInterval = next.Poll.DdlMaxInterval
+	c.Poll.DmlMaxInterval = next.Poll.DmlMaxInterval
+	c.Batch = next.Batch
+	return c
+}
+
+// Changes 為新舊設定的差異
+type Changes = reload.Changes
+
+// Diff 比較兩份設定（以 mapstructure 鍵名表示，例如 batch.dml_max_rows），依是否可即時套用分類
+func Diff(old, next Config) Changes {
+	return reload.Diff(old, next, Reloadable)
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"SciCommon/redact"
+	"SciCommon/secret"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLoadConfig_SecretRefs 驗證 ${secret:...}、${env:...}、${file:...} 在載入時展開，且展開後的值在 log 中遮蔽
+func TestLoadConfig_SecretRefs(t *testing.T) {
+	dir := t.TempDir()
+	key, err := secret.GenerateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FTYBIPRODUCER_MASTER_KEY", key)
+	t.Setenv("FTYBIPRODUCER_SECRETS_FILE", filepath.Join(dir, "secrets.enc.json"))
+	t.Setenv("TEST_MQ_PASSWORD", "mq-p@ss")
+
+	// 1. 建立加密秘密檔與掛載的 secret 檔
+	store, err := Secrets.OpenStore()
+	if err != nil {
+		t.Fatalf("開啟加密秘密檔失敗: %v", err)
+	}
+	if err := store.Set("db.password", "db-secret-27128299"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(); err != nil {
+		t.Fatalf("寫入加密秘密檔失敗: %v", err)
+	}
+	tokenFile := filepath.Join(dir, "admin_token")
+	if err := os.WriteFile(tokenFile, []byte("admin-token-0123456789\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := os.ReadFile(filepath.Join(dir, "secrets.enc.json"))
+	if strings.Contains(string(raw), "db-secret-27128299") {
+		t.Fatal("加密秘密檔不應包含明文")
+	}
+
+	// 2. 載入設定
+	path := writeConfig(t, `
+process_ddl_interval: "60s"
+process_dml_interval: "1s"
+process_timeout: "30s"
+mq:
+  factory_id: "PH1"
+  amqp_url: "amqps://bi:${env:TEST_MQ_PASSWORD}@pmsap:5671/"
+db:
+  password: "${secret:db.password}"
+ops:
+  admin_token: "${file:`+filepath.ToSlash(tokenFile)+`}"
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig 失敗: %v", err)
+	}
+	if cfg.DB.Password != "db-secret-27128299" || cfg.MQ.AMQPURL != "amqps://bi:mq-p@ss@pmsap:5671/" ||
+		cfg.Ops.AdminToken != "admin-token-0123456789" {
+		t.Fatalf("秘密參照未展開：%q %q %q", cfg.DB.Password, cfg.MQ.AMQPURL, cfg.Ops.AdminToken)
+	}
+
+	// 3. log 中遮蔽
+	line := redact.String("連線失敗 " + cfg.MQ.AMQPURL + " " + cfg.DB.Password + " token=" + cfg.Ops.AdminToken)
+	for _, s := range []string{"mq-p@ss", "db-secret-27128299", "admin-token-0123456789"} {
+		if strings.Contains(line, s) {
+			t.Fatalf("log 未遮蔽 %q：%s", s, line)
+		}
+	}
+}
+
+// TestLoadConfig_SecretMissing 驗證參照不存在的秘密值時載入失敗，錯誤指出設定鍵
+func TestLoadConfig_SecretMissing(t *testing.T) {
+	path := writeConfig(t, `
+process_ddl_interval: "60s"
+process_dml_interval: "1s"
+process_timeout: "30s"
+db:
+  password: "${env:FTYBIPRODUCER_TEST_UNSET}"
+`)
+	_, err := LoadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "db.password") {
+		t.Fatalf("預期指出 db.password 的錯誤，實際: %v", err)
+	}
+}
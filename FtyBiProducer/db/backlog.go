@@ -0,0 +1,39 @@
+// 未處理 Log 的統計，供監控判斷工廠是否卡住
+package db
+
+import (
+	"FtyBiProducer/model"
+	"context"
+	"database/sql"
+
+	"gorm.io/gorm"
+)
+
+// Backlog 為尚未被 TPE 接收（ReceivedByTPE = 0）的 Log 筆數與最舊的 GenerateDate，被 ddl_filter 排除的 DdlLog 不計入
+type Backlog struct {
+	Count              int64
+	OldestGenerateDate sql.NullTime
+}
+
+// GetDdlBacklog 統計未處理的 DdlLog
+func GetDdlBacklog(ctx context.Context, db *gorm.DB) (Backlog, error) {
+	return getBacklog(ctx, db, &model.DdlLog{}, "ReceivedByTPE = ? AND FilterReason IS NULL")
+}
+
+// GetDmlBacklog 統計未處理的 DmlLog（所有 stream）
+func GetDmlBacklog(ctx context.Context, db *gorm.DB) (Backlog, error) {
+	return getBacklog(ctx, db, &model.DmlLog{}, "ReceivedByTPE = ?")
+}
+
+func getBacklog(ctx context.Context, db *gorm.DB, logModel interface{}, where string) (Backlog, error) {
+	var b Backlog
+	row := db.WithContext(ctx).
+		Model(logModel).
+		Select("COUNT_BIG(*), MIN(GenerateDate)").
+		Where(where, false).
+		Row()
+	if err := row.Scan(&b.Count, &b.OldestGenerateDate); err != nil {
+		return Backlog{}, err
+	}
+	return b, nil
+}
@@ -0,0 +1,65 @@
+// 批次順序：每個批次帶同一 stream 內遞增的序號與前一個批次的 SerialNoTo，供 TpeBiConsumer 偵測缺漏、重複與亂序
+package db
+
+import (
+	"FtyBiProducer/model"
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// 批次順序新增的欄位，啟動時若資料表缺少則補上
+var batchOrderColumns = []string{"Sequence", "PrevSerialNoTo"}
+
+// EnsureLogBatchOrderColumns 為 LogBatchDdlRecord / LogBatchDmlRecord 補上 Sequence、PrevSerialNoTo 欄位，
+// 既有資料維持 NULL（視為沒有序號）
+func EnsureLogBatchOrderColumns(ctx context.Context, db *gorm.DB) error {
+	migrator := db.WithContext(ctx).Migrator()
+	for _, m := range []interface{}{&model.LogBatchDdlRecord{}, &model.LogBatchDmlRecord{}} {
+		for _, col := range batchOrderColumns {
+			if migrator.HasColumn(m, col) {
+				continue
+			}
+			if err := migrator.AddColumn(m, col); err != nil {
+				return fmt.Errorf("新增欄位 %s 失敗: %w", col, err)
+			}
+		}
+	}
+	return nil
+}
+
+// BatchOrder 為新批次的序號與前一個批次的 SerialNoTo
+type BatchOrder struct {
+	Sequence       int64
+	PrevSerialNoTo int64
+}
+
+// NextDdlBatchOrder 回傳從 from 開始的新 DDL 批次的順序
+func NextDdlBatchOrder(ctx context.Context, db *gorm.DB, from int64) (BatchOrder, error) {
+	return nextBatchOrder(db.WithContext(ctx).Model(&model.LogBatchDdlRecord{}), from)
+}
+
+// NextDmlBatchOrder 回傳指定 stream 從 from 開始的新 DML 批次的順序；各 stream 的序號各自遞增
+func NextDmlBatchOrder(ctx context.Context, db *gorm.DB, stream string, from int64) (BatchOrder, error) {
+	return nextBatchOrder(whereStream(db.WithContext(ctx).Model(&model.LogBatchDmlRecord{}), stream), from)
+}
+
+// nextBatchOrder 只看輪詢產生的批次（replay 批次不排序）：
+//  1. Sequence 為目前最大序號 + 1，發送失敗的批次也佔用序號，序號只增不減
+//  2. PrevSerialNoTo 為 from 之前、未發送失敗的最後一個批次的 SerialNoTo；
+//     失敗批次的範圍由新批次重新涵蓋，新批次會接在失敗批次之前的批次後面
+func nextBatchOrder(tx *gorm.DB, from int64) (BatchOrder, error) {
+	var order BatchOrder
+	err := tx.
+		Select(`COALESCE(MAX(Sequence), 0) AS Sequence,
+			COALESCE(MAX(CASE WHEN (Status IS NULL OR Status <> ?) AND SerialNoTo < ? THEN SerialNoTo END), 0) AS PrevSerialNoTo`,
+			model.BatchStatusFailed, from).
+		Where("(Origin IS NULL OR Origin <> ?)", model.BatchOriginReplay).
+		Scan(&order).Error
+	if err != nil {
+		return BatchOrder{}, err
+	}
+	order.Sequence++
+	return order, nil
+}
@@ -0,0 +1,106 @@
+// 以 BIStatus 產生 DmlLog 的整批（set-based）操作
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// dmlLogInsertRows 為單一 INSERT ... VALUES 最多的筆數（SQL Server 上限 1000 列，參數上限 2100）
+const dmlLogInsertRows = 1000
+
+// chunkTable 為暫存本次認領資料列的 temp table，只存在於 transaction 所在的連線
+const chunkTable = "#BIChunk"
+
+// physLocColumn 為沒有主鍵的資料表認領時記錄資料列實體位置（%%physloc%%）的欄位，回傳前移除
+const physLocColumn = "__BIPhysLoc"
+
+// QuoteIdent 以 [] 包住 SQL Server 識別字
+func QuoteIdent(name string) string {
+	return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+}
+
+// ClaimNewRows 在 tx 內以 UPDLOCK/READPAST 認領最多 limit 筆 BIStatus = 'New' 的資料列，
+// 複製到 temp table 後回傳；必須搭配同一個 tx 的 CompleteClaimedRows 使用。
+// 沒有主鍵的資料表另外記錄每列的 %%physloc%%，完全相同的資料列也只會更新被認領的那幾筆
+func ClaimNewRows(ctx context.Context, tx *gorm.DB, table string, columnTypes []gorm.ColumnType, limit int) ([]map[string]interface{}, error) {
+	tx = tx.WithContext(ctx)
+	if err := tx.Exec("IF OBJECT_ID('tempdb.." + chunkTable + "') IS NOT NULL DROP TABLE " + chunkTable).Error; err != nil {
+		return nil, err
+	}
+	selectList := "*"
+	if !hasPrimaryKey(columnTypes) {
+		selectList = "%%physloc%% AS " + QuoteIdent(physLocColumn) + ", *"
+	}
+	claim := fmt.Sprintf("SELECT TOP (%d) %s INTO %s FROM %s WITH (UPDLOCK, READPAST) WHERE BIStatus = 'New'",
+		limit, selectList, chunkTable, QuoteIdent(table))
+	if err := tx.Exec(claim).Error; err != nil {
+		return nil, err
+	}
+	var rows []map[string]interface{}
+	if err := tx.Raw("SELECT * FROM " + chunkTable).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		delete(row, physLocColumn)
+	}
+	return rows, nil
+}
+
+// CompleteClaimedRows 以一個 UPDATE 把已認領的資料列改為 Complete，並移除 temp table。
+// 有主鍵時以主鍵關聯，否則以認領時記錄的 %%physloc%% 關聯（認領的資料列持有 UPDLOCK，位置不會變動）
+func CompleteClaimedRows(ctx context.Context, tx *gorm.DB, table string, columnTypes []gorm.ColumnType) (int64, error) {
+	var conds []string
+	for _, ct := range columnTypes {
+		if isPK, _ := ct.PrimaryKey(); isPK {
+			col := QuoteIdent(ct.Name())
+			conds = append(conds, fmt.Sprintf("T.%s = C.%s", col, col))
+		}
+	}
+	if len(conds) == 0 {
+		conds = append(conds, "T.%%physloc%% = C."+QuoteIdent(physLocColumn))
+	}
+
+	tx = tx.WithContext(ctx)
+	update := fmt.Sprintf("UPDATE T SET BIStatus = 'Complete' FROM %s AS T INNER JOIN %s AS C ON %s WHERE T.BIStatus = 'New'",
+		QuoteIdent(table), chunkTable, strings.Join(conds, " AND "))
+	res := tx.Exec(update)
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	if err := tx.Exec("DROP TABLE " + chunkTable).Error; err != nil {
+		return 0, err
+	}
+	return res.RowsAffected, nil
+}
+
+// hasPrimaryKey 回傳欄位中是否有主鍵
+func hasPrimaryKey(columnTypes []gorm.ColumnType) bool {
+	for _, ct := range columnTypes {
+		if isPK, _ := ct.PrimaryKey(); isPK {
+			return true
+		}
+	}
+	return false
+}
+
+// InsertDmlLogJSON 以多列 INSERT 寫入 DmlLog 並標上 stream，每個 statement 最多 1000 筆
+func InsertDmlLogJSON(ctx context.Context, tx *gorm.DB, stream string, jsonList []string) error {
+	tx = tx.WithContext(ctx)
+	for start := 0; start < len(jsonList); start += dmlLogInsertRows {
+		end := min(start+dmlLogInsertRows, len(jsonList))
+		part := jsonList[start:end]
+		values := strings.TrimSuffix(strings.Repeat("(?,?),", len(part)), ",")
+		args := make([]interface{}, 0, len(part)*2)
+		for _, js := range part {
+			args = append(args, js, stream)
+		}
+		if err := tx.Exec("INSERT INTO [DmlLog]([JSON],[Stream])VALUES"+values, args...).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
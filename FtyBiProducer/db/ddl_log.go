@@ -4,21 +4,120 @@ package db
 import (
 	"FtyBiProducer/model"
 	"context"
+	"fmt"
 
 	"gorm.io/gorm"
 )
 
-// 找出未處理的DdlLog (ReceivedByTPE = False)
-func GetUnprocessedDdlLogs(ctx context.Context, db *gorm.DB) ([]model.DdlLog, error) {
+// DdlBatchSize 為未設定 batch.ddl_max_rows 時，一次撈取的 DdlLog 筆數上限
+const DdlBatchSize = 10000
+
+// 找出未處理的DdlLog (ReceivedByTPE = False，且未被 ddl_filter 排除)，最多 limit 筆
+func GetUnprocessedDdlLogs(ctx context.Context, db *gorm.DB, limit int) ([]model.DdlLog, error) {
 	var unProcessDdlLog []model.DdlLog
-	const batchSize = 10000
-	if err := db.WithContext(ctx).Where("ReceivedByTPE = ?", false).Order("SerialNo").Limit(batchSize).Find(&unProcessDdlLog).Error; err != nil {
+	held := heldBatches(db, &model.LogBatchDdlRecord{})
+	if err := db.WithContext(ctx).Where("ReceivedByTPE = ? AND FilterReason IS NULL AND NOT EXISTS (?)", false, inHeldRange("DdlLog", held)).Order("SerialNo").Limit(limit).Find(&unProcessDdlLog).Error; err != nil {
 		return nil, err
 	}
+	if len(unProcessDdlLog) == 0 {
+		return unProcessDdlLog, nil
+	}
 
+	// 新批次不能跨過處理中或被拒絕的批次，只取到下一個佔用範圍之前
+	cut, err := nextHeldSerialNoFrom(ctx, heldBatches(db, &model.LogBatchDdlRecord{}), unProcessDdlLog[0].SerialNo, unProcessDdlLog[len(unProcessDdlLog)-1].SerialNo)
+	if err != nil {
+		return nil, err
+	}
+	for i, l := range unProcessDdlLog {
+		if cut > 0 && l.SerialNo >= cut {
+			return unProcessDdlLog[:i], nil
+		}
+	}
 	return unProcessDdlLog, nil
 }
 
+// heldBatches 查詢仍佔用範圍（處理中或被拒絕）的批次；每次組查詢都要重新呼叫，不可共用同一個 *gorm.DB
+func heldBatches(db *gorm.DB, batchModel interface{}) *gorm.DB {
+	return db.Model(batchModel).Where("Status IN ?", model.BatchStatusHoldRange)
+}
+
+// inHeldRange 為 NOT EXISTS 用的子查詢：Log 落在 held 批次的範圍內，讓等待回執的批次不會在下一輪被重複撈出；
+// 只排除這些批次自己的範圍，較低範圍中發送失敗待重新涵蓋的 Log 仍會撈出
+func inHeldRange(logTable string, held *gorm.DB) *gorm.DB {
+	return held.Select("1").Where(logTable + ".SerialNo BETWEEN SerialNoFrom AND SerialNoTo")
+}
+
+// nextHeldSerialNoFrom 回傳 from ~ to 之間第一個 held 批次的 SerialNoFrom，沒有時為 0
+func nextHeldSerialNoFrom(ctx context.Context, held *gorm.DB, from, to int64) (int64, error) {
+	var cut int64
+	if err := held.WithContext(ctx).
+		Select("ISNULL(MIN(SerialNoFrom), 0)").
+		Where("SerialNoFrom > ? AND SerialNoFrom <= ?", from, to).
+		Scan(&cut).Error; err != nil {
+		return 0, err
+	}
+	return cut, nil
+}
+
+// GetUnprocessedDdlLogsInRange 找出 SerialNo 介於 from ~ to 且尚未處理、未被 ddl_filter 排除的 DdlLog，用於恢復既有批次
+func GetUnprocessedDdlLogsInRange(ctx context.Context, db *gorm.DB, from, to int64) ([]model.DdlLog, error) {
+	var ddlLogs []model.DdlLog
+	if err := db.WithContext(ctx).
+		Where("SerialNo BETWEEN ? AND ? AND ReceivedByTPE = ? AND FilterReason IS NULL", from, to, false).
+		Order("SerialNo").
+		Find(&ddlLogs).Error; err != nil {
+		return nil, err
+	}
+	return ddlLogs, nil
+}
+
+// GetDdlLogsForReplay 依 LogRange 撈取 SerialNo 大於 afterSerialNo 的 DdlLog（不論是否已處理），最多 limit 筆
+func GetDdlLogsForReplay(ctx context.Context, db *gorm.DB, r LogRange, afterSerialNo int64, limit int) ([]model.DdlLog, error) {
+	var ddlLogs []model.DdlLog
+	if err := r.apply(db.WithContext(ctx)).
+		Where("SerialNo > ?", afterSerialNo).
+		Order("SerialNo").
+		Limit(limit).
+		Find(&ddlLogs).Error; err != nil {
+		return nil, err
+	}
+	return ddlLogs, nil
+}
+
+// CountDdlLogsInRange 計算 SerialNo 介於 from ~ to 的 DdlLog 筆數（不論是否已處理）
+func CountDdlLogsInRange(ctx context.Context, db *gorm.DB, from, to int64) (int64, error) {
+	var cnt int64
+	if err := db.WithContext(ctx).
+		Model(&model.DdlLog{}).
+		Where("SerialNo BETWEEN ? AND ?", from, to).
+		Count(&cnt).Error; err != nil {
+		return 0, err
+	}
+	return cnt, nil
+}
+
+// EnsureDdlFilterColumn 為 DdlLog 補上 FilterReason 欄位，既有資料維持 NULL
+func EnsureDdlFilterColumn(ctx context.Context, db *gorm.DB) error {
+	migrator := db.WithContext(ctx).Migrator()
+	if migrator.HasColumn(&model.DdlLog{}, "FilterReason") {
+		return nil
+	}
+	if err := migrator.AddColumn(&model.DdlLog{}, "FilterReason"); err != nil {
+		return fmt.Errorf("新增欄位 FilterReason 失敗: %w", err)
+	}
+	return nil
+}
+
+// MarkDdlFiltered 將被過濾的 DdlLog 記錄原因，之後不會再被撈出；
+// 沒有送到 TPE，ReceivedByTPE 維持 false
+func MarkDdlFiltered(ctx context.Context, db *gorm.DB, serialNos []int64, reason string) error {
+	return db.WithContext(ctx).
+		Model(&model.DdlLog{}).
+		Where("SerialNo IN ?", serialNos).
+		Update("FilterReason", reason).
+		Error
+}
+
 // MarkDdlProcessedByBatch 將指定 SerialNo 的 ReceivedByTPE 設為 true
 func MarkDdlProcessedByBatch(ctx context.Context, db *gorm.DB, batchID int64) error {
 	// 1. 撈出那筆 LogBatchDdlRecord
@@ -29,10 +128,10 @@ func MarkDdlProcessedByBatch(ctx context.Context, db *gorm.DB, batchID int64) er
 		return err
 	}
 
-	// 2. 在 ProcessFrom ~ ProcessTo 範圍內，一次更新所有 DdlLog
+	// 2. 在 ProcessFrom ~ ProcessTo 範圍內，一次更新所有 DdlLog；範圍內被 ddl_filter 排除的沒有送出，不標記
 	if err := db.WithContext(ctx).
 		Model(&model.DdlLog{}).
-		Where("SerialNo BETWEEN ? AND ?", rec.SerialNoFrom, rec.SerialNoTo).
+		Where("SerialNo BETWEEN ? AND ? AND FilterReason IS NULL", rec.SerialNoFrom, rec.SerialNoTo).
 		Update("ReceivedByTPE", true).
 		Error; err != nil {
 		return err
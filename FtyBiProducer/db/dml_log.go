@@ -9,24 +9,98 @@ import (
 	"gorm.io/gorm"
 )
 
-// 找出未處理的DdlLog (ReceivedByTPE = False)
-func GetUnprocessedDmlLogs(ctx context.Context, db *gorm.DB) ([]model.DmlLog, error) {
+// DmlBatchSize 為未設定 batch.dml_max_rows 時，一次撈取的 DmlLog 筆數上限
+const DmlBatchSize = 1000
+
+// 找出指定 stream 未處理的DmlLog (ReceivedByTPE = False)，最多 limit 筆
+func GetUnprocessedDmlLogs(ctx context.Context, db *gorm.DB, stream string, limit int) ([]model.DmlLog, error) {
 	var unProcessDdlLog []model.DmlLog
-	const batchSize = 1000
 
-	if err := db.WithContext(ctx).Where("ReceivedByTPE = ?", false).Order("SerialNo").Limit(batchSize).Find(&unProcessDdlLog).Error; err != nil {
+	held := whereStream(heldBatches(db, &model.LogBatchDmlRecord{}), stream)
+	if err := whereStream(db.WithContext(ctx), stream).Where("ReceivedByTPE = ? AND NOT EXISTS (?)", false, inHeldRange("DmlLog", held)).Order("SerialNo").Limit(limit).Find(&unProcessDdlLog).Error; err != nil {
 		return nil, err
 	}
+	if len(unProcessDdlLog) == 0 {
+		return unProcessDdlLog, nil
+	}
 
-	// 把所有換行都換成字面上的 \n
-	for i := range unProcessDdlLog {
-		unProcessDdlLog[i].JSON = strings.ReplaceAll(unProcessDdlLog[i].JSON, "\n", `\\n`)
-		// 如果還有 \r，也可以：
-		unProcessDdlLog[i].JSON = strings.ReplaceAll(unProcessDdlLog[i].JSON, "\r", `\\r`)
+	// 新批次不能跨過處理中或被拒絕的批次，只取到下一個佔用範圍之前
+	held = whereStream(heldBatches(db, &model.LogBatchDmlRecord{}), stream)
+	cut, err := nextHeldSerialNoFrom(ctx, held, unProcessDdlLog[0].SerialNo, unProcessDdlLog[len(unProcessDdlLog)-1].SerialNo)
+	if err != nil {
+		return nil, err
 	}
+	for i, l := range unProcessDdlLog {
+		if cut > 0 && l.SerialNo >= cut {
+			unProcessDdlLog = unProcessDdlLog[:i]
+			break
+		}
+	}
+
+	escapeDmlLogNewlines(unProcessDdlLog)
 	return unProcessDdlLog, nil
 }
 
+// GetUnprocessedDmlLogsInRange 找出指定 stream 中 SerialNo 介於 from ~ to 且尚未處理的 DmlLog，用於恢復既有批次
+func GetUnprocessedDmlLogsInRange(ctx context.Context, db *gorm.DB, stream string, from, to int64) ([]model.DmlLog, error) {
+	var dmlLogs []model.DmlLog
+	if err := whereStream(db.WithContext(ctx), stream).
+		Where("SerialNo BETWEEN ? AND ? AND ReceivedByTPE = ?", from, to, false).
+		Order("SerialNo").
+		Find(&dmlLogs).Error; err != nil {
+		return nil, err
+	}
+	escapeDmlLogNewlines(dmlLogs)
+	return dmlLogs, nil
+}
+
+// GetDmlLogsForReplay 依 LogRange 撈取 SerialNo 大於 afterSerialNo 的 DmlLog（不論是否已處理），最多 limit 筆
+func GetDmlLogsForReplay(ctx context.Context, db *gorm.DB, r LogRange, afterSerialNo int64, limit int) ([]model.DmlLog, error) {
+	var dmlLogs []model.DmlLog
+	if err := r.apply(db.WithContext(ctx)).
+		Where("SerialNo > ?", afterSerialNo).
+		Order("SerialNo").
+		Limit(limit).
+		Find(&dmlLogs).Error; err != nil {
+		return nil, err
+	}
+	escapeDmlLogNewlines(dmlLogs)
+	return dmlLogs, nil
+}
+
+// escapeDmlLogNewlines 把所有換行都換成字面上的 \n
+func escapeDmlLogNewlines(logs []model.DmlLog) {
+	for i := range logs {
+		logs[i].JSON = strings.ReplaceAll(logs[i].JSON, "\n", `\\n`)
+		// 如果還有 \r，也可以：
+		logs[i].JSON = strings.ReplaceAll(logs[i].JSON, "\r", `\\r`)
+	}
+}
+
+// CountDmlLogsInRange 計算 SerialNo 介於 from ~ to 的 DmlLog 筆數（不論是否已處理）
+func CountDmlLogsInRange(ctx context.Context, db *gorm.DB, from, to int64) (int64, error) {
+	var cnt int64
+	if err := db.WithContext(ctx).
+		Model(&model.DmlLog{}).
+		Where("SerialNo BETWEEN ? AND ?", from, to).
+		Count(&cnt).Error; err != nil {
+		return 0, err
+	}
+	return cnt, nil
+}
+
+// GetMaxDmlSerialNo 回傳 DmlLog 目前最大的 SerialNo，沒有資料時為 0
+func GetMaxDmlSerialNo(ctx context.Context, db *gorm.DB) (int64, error) {
+	var maxSerialNo int64
+	if err := db.WithContext(ctx).
+		Model(&model.DmlLog{}).
+		Select("COALESCE(MAX(SerialNo), 0)").
+		Scan(&maxSerialNo).Error; err != nil {
+		return 0, err
+	}
+	return maxSerialNo, nil
+}
+
 // MarkDmlProcessedByBatch 將指定 SerialNo 的 ReceivedByTPE 設為 true
 func MarkDmlProcessedByBatch(ctx context.Context, db *gorm.DB, batchID int64) error {
 	// 1. 撈出那筆 LogBatchDmlRecord
@@ -39,8 +113,8 @@ func MarkDmlProcessedByBatch(ctx context.Context, db *gorm.DB, batchID int64) er
 	}
 
 	//  2. 分批更新：在 ProcessFrom ~ ProcessTo 範圍內，一次更新所有 DmlLog
-	res := db.WithContext(ctx).
-		Model(&model.DmlLog{}).
+	//     不同 stream 的 SerialNo 會交錯，只標記同一個 stream 的 Log
+	res := whereStream(db.WithContext(ctx).Model(&model.DmlLog{}), rec.Stream).
 		Where("SerialNo BETWEEN ? AND ? AND ReceivedByTPE = ?", rec.SerialNoFrom, rec.SerialNoTo, false).
 		Update("ReceivedByTPE", true)
 	if err := res.Error; err != nil {
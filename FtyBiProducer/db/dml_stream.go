@@ -0,0 +1,32 @@
+// DML stream 分流的欄位與查詢條件
+package db
+
+import (
+	"FtyBiProducer/model"
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// EnsureDmlStreamColumns 為 DmlLog / LogBatchDmlRecord 補上 Stream 欄位，既有資料維持 NULL（預設 stream）
+func EnsureDmlStreamColumns(ctx context.Context, db *gorm.DB) error {
+	migrator := db.WithContext(ctx).Migrator()
+	for _, m := range []interface{}{&model.DmlLog{}, &model.LogBatchDmlRecord{}} {
+		if migrator.HasColumn(m, "Stream") {
+			continue
+		}
+		if err := migrator.AddColumn(m, "Stream"); err != nil {
+			return fmt.Errorf("新增欄位 Stream 失敗: %w", err)
+		}
+	}
+	return nil
+}
+
+// whereStream 加上 stream 條件；預設 stream 也涵蓋新增欄位前留下的 NULL
+func whereStream(tx *gorm.DB, stream string) *gorm.DB {
+	if stream == model.DefaultDmlStream {
+		return tx.Where("(Stream = '' OR Stream IS NULL)")
+	}
+	return tx.Where("Stream = ?", stream)
+}
@@ -0,0 +1,62 @@
+// Change Tracking 版本查詢與更新
+package db
+
+import (
+	"FtyBiProducer/model"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrChangeTrackingDisabled 表示資料庫或資料表尚未啟用 Change Tracking
+var ErrChangeTrackingDisabled = errors.New("change tracking 未啟用")
+
+// ErrSyncVersionExpired 表示保存的版本已早於最小有效版本，變更已被清除，需要完整重新同步
+var ErrSyncVersionExpired = errors.New("change tracking 版本已過期")
+
+// EnsureDmlSyncVersionTable 建立 DmlSyncVersion（不存在時）
+func EnsureDmlSyncVersionTable(ctx context.Context, db *gorm.DB) error {
+	return db.WithContext(ctx).AutoMigrate(&model.DmlSyncVersion{})
+}
+
+// GetDmlSyncVersion 取得資料表上次同步到的版本，ok = false 表示尚未同步過
+func GetDmlSyncVersion(ctx context.Context, db *gorm.DB, tableName string) (version int64, ok bool, err error) {
+	var rec model.DmlSyncVersion
+	err = db.WithContext(ctx).Where("TableName = ?", tableName).Take(&rec).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return rec.LastVersion, true, nil
+}
+
+// SaveDmlSyncVersion 寫入資料表已同步的版本，應與 DmlLog 寫入在同一個 transaction
+func SaveDmlSyncVersion(ctx context.Context, tx *gorm.DB, tableName string, version int64) error {
+	rec := model.DmlSyncVersion{
+		Table:       tableName,
+		LastVersion: version,
+		UpdateTime:  time.Now(),
+	}
+	return tx.WithContext(ctx).Save(&rec).Error
+}
+
+// GetChangeTrackingVersions 取得資料庫目前版本與資料表的最小有效版本
+func GetChangeTrackingVersions(ctx context.Context, db *gorm.DB, tableName string) (current, minValid int64, err error) {
+	var cur, min sql.NullInt64
+	row := db.WithContext(ctx).
+		Raw("SELECT CHANGE_TRACKING_CURRENT_VERSION(), CHANGE_TRACKING_MIN_VALID_VERSION(OBJECT_ID(?))", tableName).
+		Row()
+	if err := row.Scan(&cur, &min); err != nil {
+		return 0, 0, err
+	}
+	if !cur.Valid || !min.Valid {
+		return 0, 0, fmt.Errorf("%s：%w", tableName, ErrChangeTrackingDisabled)
+	}
+	return cur.Int64, min.Int64, nil
+}
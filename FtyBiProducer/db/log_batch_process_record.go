@@ -3,16 +3,47 @@ package db
 
 import (
 	"FtyBiProducer/model"
+	"FtyBiProducer/resilience"
 	"context"
+	"errors"
+	"fmt"
+	"time"
 
 	"gorm.io/gorm"
 )
 
+// ErrInvalidBatchTransition 表示批次目前的狀態不允許轉換到目標狀態
+var ErrInvalidBatchTransition = errors.New("批次狀態轉換不合法")
+
+// 狀態機新增的欄位，啟動時若資料表缺少則補上
+var batchStatusColumns = []string{"Status", "PublishedTime", "ConfirmedTime", "MarkedTime", "FailedTime", "RejectedTime", "ErrorMsg", "Origin"}
+
+// EnsureLogBatchStatusColumns 為 LogBatchDdlRecord / LogBatchDmlRecord 補上狀態欄位
+// 只新增缺少的欄位，不會變更既有欄位
+func EnsureLogBatchStatusColumns(ctx context.Context, db *gorm.DB) error {
+	migrator := db.WithContext(ctx).Migrator()
+	for _, m := range []interface{}{&model.LogBatchDdlRecord{}, &model.LogBatchDmlRecord{}} {
+		for _, col := range batchStatusColumns {
+			if migrator.HasColumn(m, col) {
+				continue
+			}
+			if err := migrator.AddColumn(m, col); err != nil {
+				return fmt.Errorf("新增欄位 %s 失敗: %w", col, err)
+			}
+		}
+	}
+	return nil
+}
+
 // 寫入批次處理紀錄
 func InsertLogBatchDdlRecord(ctx context.Context, db *gorm.DB, record *model.LogBatchDdlRecord) (int64, error) {
 
 	// InsertLogBatchProcessRecord 建立一筆處理紀錄並回傳 ID
 	// 明確跳過 ProcessTime 欄位
+	record.Status = model.BatchStatusCreated
+	if record.Origin == "" {
+		record.Origin = model.BatchOriginPoll
+	}
 	if err := db.WithContext(ctx).
 		Omit("ProcessTime").
 		Create(record).
@@ -26,6 +57,10 @@ func InsertLogBatchDmlRecord(ctx context.Context, db *gorm.DB, record *model.Log
 
 	// InsertLogBatchProcessRecord 建立一筆處理紀錄並回傳 ID
 	// 明確跳過 ProcessTime 欄位
+	record.Status = model.BatchStatusCreated
+	if record.Origin == "" {
+		record.Origin = model.BatchOriginPoll
+	}
 	if err := db.WithContext(ctx).
 		Omit("ProcessTime").
 		Create(record).
@@ -35,3 +70,100 @@ func InsertLogBatchDmlRecord(ctx context.Context, db *gorm.DB, record *model.Log
 
 	return record.LogBatchDmlRecordID, nil
 }
+
+// UpdateLogBatchDdlStatus 將 DDL 批次轉換到 status，並寫入對應的時間欄位
+func UpdateLogBatchDdlStatus(ctx context.Context, db *gorm.DB, batchID int64, status model.BatchStatus, errMsg string) error {
+	return updateBatchStatus(ctx, db, &model.LogBatchDdlRecord{}, "LogBatchDdlRecordID", batchID, status, errMsg)
+}
+
+// UpdateLogBatchDmlStatus 將 DML 批次轉換到 status，並寫入對應的時間欄位
+func UpdateLogBatchDmlStatus(ctx context.Context, db *gorm.DB, batchID int64, status model.BatchStatus, errMsg string) error {
+	return updateBatchStatus(ctx, db, &model.LogBatchDmlRecord{}, "LogBatchDmlRecordID", batchID, status, errMsg)
+}
+
+func updateBatchStatus(ctx context.Context, db *gorm.DB, m interface{}, idColumn string, batchID int64, status model.BatchStatus, errMsg string) error {
+	updates := map[string]interface{}{"Status": status}
+	if col := status.TimeColumn(); col != "" {
+		updates[col] = time.Now()
+	}
+	if errMsg != "" {
+		// ErrorMsg 欄位長度有限，超過的部分截掉
+		if r := []rune(errMsg); len(r) > 1000 {
+			errMsg = string(r[:1000])
+		}
+		updates["ErrorMsg"] = errMsg
+	}
+
+	res := db.WithContext(ctx).
+		Model(m).
+		Where(idColumn+" = ? AND Status IN ?", batchID, model.BatchStatusFrom[status]).
+		Updates(updates)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		// 狀態已被其他流程改變，重試也不會成功
+		return resilience.Poison(fmt.Errorf("%w: BatchID=%d → %s", ErrInvalidBatchTransition, batchID, status))
+	}
+	return nil
+}
+
+// GetPendingLogBatchDdlRecords 找出停在中間狀態的 DDL 批次，依 ID 排序
+func GetPendingLogBatchDdlRecords(ctx context.Context, db *gorm.DB) ([]model.LogBatchDdlRecord, error) {
+	var records []model.LogBatchDdlRecord
+	if err := db.WithContext(ctx).
+		Where("Status IN ?", model.BatchStatusPending).
+		Order("LogBatchDdlRecordID").
+		Find(&records).Error; err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// GetPendingLogBatchDmlRecords 找出停在中間狀態的 DML 批次，依 ID 排序
+func GetPendingLogBatchDmlRecords(ctx context.Context, db *gorm.DB) ([]model.LogBatchDmlRecord, error) {
+	var records []model.LogBatchDmlRecord
+	if err := db.WithContext(ctx).
+		Where("Status IN ?", model.BatchStatusPending).
+		Order("LogBatchDmlRecordID").
+		Find(&records).Error; err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// GetLogBatchDdlRecord 依 BatchID 取得 DDL 批次紀錄
+func GetLogBatchDdlRecord(ctx context.Context, db *gorm.DB, batchID int64) (*model.LogBatchDdlRecord, error) {
+	var rec model.LogBatchDdlRecord
+	if err := db.WithContext(ctx).First(&rec, "LogBatchDdlRecordID = ?", batchID).Error; err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// GetLogBatchDmlRecord 依 BatchID 取得 DML 批次紀錄
+func GetLogBatchDmlRecord(ctx context.Context, db *gorm.DB, batchID int64) (*model.LogBatchDmlRecord, error) {
+	var rec model.LogBatchDmlRecord
+	if err := db.WithContext(ctx).First(&rec, "LogBatchDmlRecordID = ?", batchID).Error; err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// GetLogBatchDdlStatus 依 BatchID 取得 DDL 批次目前的狀態
+func GetLogBatchDdlStatus(ctx context.Context, db *gorm.DB, batchID int64) (model.BatchStatus, error) {
+	rec, err := GetLogBatchDdlRecord(ctx, db, batchID)
+	if err != nil {
+		return "", err
+	}
+	return rec.Status, nil
+}
+
+// GetLogBatchDmlStatus 依 BatchID 取得 DML 批次目前的狀態
+func GetLogBatchDmlStatus(ctx context.Context, db *gorm.DB, batchID int64) (model.BatchStatus, error) {
+	rec, err := GetLogBatchDmlRecord(ctx, db, batchID)
+	if err != nil {
+		return "", err
+	}
+	return rec.Status, nil
+}
@@ -0,0 +1,37 @@
+// 重送時撈取 Log 的範圍條件
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LogRange 描述重送要涵蓋的 Log，SerialNo 與 GenerateDate 條件可併用，零值表示不限制
+type LogRange struct {
+	SerialNoFrom int64
+	SerialNoTo   int64
+	GenerateFrom time.Time // 含
+	GenerateTo   time.Time // 不含
+}
+
+// IsEmpty 表示沒有任何條件，重送時不允許（避免整張表重送）
+func (r LogRange) IsEmpty() bool {
+	return r.SerialNoFrom == 0 && r.SerialNoTo == 0 && r.GenerateFrom.IsZero() && r.GenerateTo.IsZero()
+}
+
+func (r LogRange) apply(tx *gorm.DB) *gorm.DB {
+	if r.SerialNoFrom > 0 {
+		tx = tx.Where("SerialNo >= ?", r.SerialNoFrom)
+	}
+	if r.SerialNoTo > 0 {
+		tx = tx.Where("SerialNo <= ?", r.SerialNoTo)
+	}
+	if !r.GenerateFrom.IsZero() {
+		tx = tx.Where("GenerateDate >= ?", r.GenerateFrom)
+	}
+	if !r.GenerateTo.IsZero() {
+		tx = tx.Where("GenerateDate < ?", r.GenerateTo)
+	}
+	return tx
+}
@@ -0,0 +1,99 @@
+// 保留期限：統計與分段刪除（或搬移）已完成且過期的資料
+package db
+
+import (
+	"FtyBiProducer/model"
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ArchiveSuffix 為 archive 模式下搬移目的資料表的後綴
+const ArchiveSuffix = "_Archive"
+
+// PurgeTarget 為一張要清理的資料表：DateColumn 早於 cutoff 且符合 Where 的資料列才會被清理
+type PurgeTarget struct {
+	Table      string
+	DateColumn string
+	Where      string        // 額外條件，只放固定的 SQL，值以 Args 傳入
+	Args       []interface{} // Where 的參數
+}
+
+// PurgeStats 為符合清理條件的筆數與最舊的時間
+type PurgeStats struct {
+	Count  int64
+	Oldest sql.NullTime
+}
+
+// LogPurgeTargets 回傳已被 TPE 接收的 DdlLog / DmlLog，以及被 ddl_filter 排除的 DdlLog
+func LogPurgeTargets() []PurgeTarget {
+	return []PurgeTarget{
+		{Table: model.DdlLog{}.TableName(), DateColumn: "GenerateDate", Where: "ReceivedByTPE = ? OR FilterReason IS NOT NULL", Args: []interface{}{true}},
+		{Table: model.DmlLog{}.TableName(), DateColumn: "GenerateDate", Where: "ReceivedByTPE = ?", Args: []interface{}{true}},
+	}
+}
+
+// BatchPurgeTargets 回傳已完成的批次紀錄；Rejected 與處理中的批次仍佔用範圍，不會清理。
+// 導入狀態機前的舊紀錄（Status 為 NULL）視為已完成
+func BatchPurgeTargets() []PurgeTarget {
+	done := []model.BatchStatus{model.BatchStatusMarked, model.BatchStatusFailed}
+	return []PurgeTarget{
+		{Table: model.LogBatchDdlRecord{}.TableName(), DateColumn: "ProcessTime", Where: "Status IN ? OR Status IS NULL", Args: []interface{}{done}},
+		{Table: model.LogBatchDmlRecord{}.TableName(), DateColumn: "ProcessTime", Where: "Status IN ? OR Status IS NULL", Args: []interface{}{done}},
+	}
+}
+
+// HistoryPurgeTarget 回傳 _History 表中已寫入 DmlLog（BIStatus = 'Complete'）的資料列
+func HistoryPurgeTarget(table, dateColumn string) PurgeTarget {
+	return PurgeTarget{Table: table, DateColumn: dateColumn, Where: "BIStatus = ?", Args: []interface{}{"Complete"}}
+}
+
+// where 組出清理條件與參數
+func (t PurgeTarget) where(cutoff time.Time) (string, []interface{}) {
+	cond := QuoteIdent(t.DateColumn) + " < ?"
+	args := []interface{}{cutoff}
+	if t.Where != "" {
+		cond += " AND (" + t.Where + ")"
+		args = append(args, t.Args...)
+	}
+	return cond, args
+}
+
+// CountPurgeable 統計早於 cutoff 且符合條件的筆數與最舊的時間
+func CountPurgeable(ctx context.Context, db *gorm.DB, t PurgeTarget, cutoff time.Time) (PurgeStats, error) {
+	cond, args := t.where(cutoff)
+	query := fmt.Sprintf("SELECT COUNT_BIG(*), MIN(%s) FROM %s WHERE %s", QuoteIdent(t.DateColumn), QuoteIdent(t.Table), cond)
+	var s PurgeStats
+	if err := db.WithContext(ctx).Raw(query, args...).Row().Scan(&s.Count, &s.Oldest); err != nil {
+		return PurgeStats{}, err
+	}
+	return s, nil
+}
+
+// PurgeChunk 刪除最多 limit 筆符合條件的資料列並回傳筆數；archive 時以 OUTPUT 在同一個 statement 搬到 <Table>_Archive
+func PurgeChunk(ctx context.Context, db *gorm.DB, t PurgeTarget, cutoff time.Time, limit int, archive bool) (int64, error) {
+	cond, args := t.where(cutoff)
+	output := ""
+	if archive {
+		output = " OUTPUT DELETED.* INTO " + QuoteIdent(t.Table+ArchiveSuffix)
+	}
+	stmt := fmt.Sprintf("DELETE TOP (%d) FROM %s%s WHERE %s", limit, QuoteIdent(t.Table), output, cond)
+	res := db.WithContext(ctx).Exec(stmt, args...)
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	return res.RowsAffected, nil
+}
+
+// EnsureArchiveTable 在 <table>_Archive 不存在時依 table 的欄位建立；
+// 以 UNION ALL 建立可避免複製 IDENTITY 屬性，OUTPUT INTO 才能寫入原本的 SerialNo
+func EnsureArchiveTable(ctx context.Context, db *gorm.DB, table string) error {
+	archive := table + ArchiveSuffix
+	src := QuoteIdent(table)
+	stmt := fmt.Sprintf("IF OBJECT_ID(?, 'U') IS NULL SELECT * INTO %s FROM %s WHERE 1 = 0 UNION ALL SELECT * FROM %s WHERE 1 = 0",
+		QuoteIdent(archive), src, src)
+	return db.WithContext(ctx).Exec(stmt, archive).Error
+}
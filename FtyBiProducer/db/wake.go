@@ -0,0 +1,50 @@
+// 以 SQL Server Service Broker 等待 DmlLog 新增的通知
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// waitNotificationSQL 等待 Queue 中的訊息並全部取出，EndDialog / Error 訊息順便結束對話，
+// 回傳取出的訊息數；逾時沒有訊息時回傳 0
+const waitNotificationSQL = `
+DECLARE @msgs TABLE (h UNIQUEIDENTIFIER, t NVARCHAR(256));
+WAITFOR (RECEIVE conversation_handle, message_type_name FROM %s INTO @msgs), TIMEOUT ?;
+DECLARE @h UNIQUEIDENTIFIER;
+DECLARE ended CURSOR LOCAL FAST_FORWARD FOR
+	SELECT DISTINCT h FROM @msgs
+	WHERE t IN (N'http://schemas.microsoft.com/SQL/ServiceBroker/EndDialog', N'http://schemas.microsoft.com/SQL/ServiceBroker/Error');
+OPEN ended;
+FETCH NEXT FROM ended INTO @h;
+WHILE @@FETCH_STATUS = 0
+BEGIN
+	END CONVERSATION @h;
+	FETCH NEXT FROM ended INTO @h;
+END
+CLOSE ended;
+DEALLOCATE ended;
+SELECT COUNT(*) FROM @msgs;`
+
+// WaitDmlLogNotification 最多等待 timeout，回傳期間收到的通知數
+func WaitDmlLogNotification(ctx context.Context, db *gorm.DB, queue string, timeout time.Duration) (int, error) {
+	var n int
+	sql := fmt.Sprintf(waitNotificationSQL, quoteQualified(queue))
+	if err := db.WithContext(ctx).Raw(sql, timeout.Milliseconds()).Row().Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// quoteQualified 逐段加上中括號，例如 dbo.DmlLogNotifyQueue -> [dbo].[DmlLogNotifyQueue]
+func quoteQualified(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = QuoteIdent(p)
+	}
+	return strings.Join(parts, ".")
+}
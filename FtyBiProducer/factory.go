@@ -0,0 +1,715 @@
+// 單一工廠的初始化與排程，多工廠時每個工廠各自一份，互不影響
+package main
+
+import (
+	"FtyBiProducer/config"
+	dbLayer "FtyBiProducer/db"
+	"FtyBiProducer/metrics"
+	"FtyBiProducer/model"
+	mq "FtyBiProducer/mq"
+	"FtyBiProducer/ops"
+	"FtyBiProducer/resilience"
+	"FtyBiProducer/schedule"
+	"FtyBiProducer/service"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// factoryRetryInterval 為工廠初始化（DB、MQ 連線）失敗後重試的間隔
+const factoryRetryInterval = 30 * time.Second
+
+// defaultRetentionInterval 為未設定 retention.interval 時檢查是否需要清理的間隔
+const defaultRetentionInterval = time.Hour
+
+// defaultPoisonWait 為資料或設定錯誤後再試前的等待，未設定 resilience.poison_wait 時使用
+const defaultPoisonWait = 5 * time.Minute
+
+// factoryApp 為單一工廠的 Publisher、資料庫與 Processor
+type factoryApp struct {
+	id            string
+	cfg           config.Config
+	sugar         *zap.SugaredLogger
+	publisher     mq.Publisher
+	db            *gorm.DB
+	proc          *service.Processor
+	receiptSource mq.ReceiptSource
+	status        *ops.FactoryStatus // 回報給 /readyz 的狀態，replay 時為 nil
+	dbBreaker     *resilience.Breaker
+	mqBreaker     *resilience.Breaker
+	live          *liveConfig // 設定檔重新載入後的設定，replay、purge、snapshot 時為 nil
+	// inflight 為執行中批次使用的 Context，收到關機訊號後延遲 shutdown_timeout 才取消；nil 時直接使用排程的 ctx
+	inflight context.Context
+}
+
+// openFactory 建立工廠的 Publisher、資料庫連線與 Processor，失敗時釋放已建立的資源
+func openFactory(ctx context.Context, cfg config.Config, sugar *zap.SugaredLogger) (app *factoryApp, err error) {
+	app = &factoryApp{id: cfg.MQ.FactoryID, cfg: cfg, sugar: sugar}
+	app.dbBreaker = app.newBreaker("db")
+	app.mqBreaker = app.newBreaker("mq")
+	defer func() {
+		if err != nil {
+			app.Close()
+			app = nil
+		}
+	}()
+
+	// 1. 建立 Publisher（預設 RabbitMQ，可於 mq.publisher 改為 file 以 capture 到磁碟）
+	if app.publisher, err = mq.NewPublisher(cfg.MQ); err != nil {
+		return app, fmt.Errorf("MQ 初始化失敗：%w", err)
+	}
+
+	// 2. 初始化資料庫
+	if app.db, err = config.InitGormDB(cfg.DB); err != nil {
+		return app, fmt.Errorf("初始化資料庫失敗：%w", err)
+	}
+
+	// 3. 建立 Processor
+	app.proc = service.New(app.db, app.publisher)
+	app.proc.SetFactory(app.id)
+	app.proc.SetSource(cfg.DB.Server(), cfg.DB.Name)
+	app.proc.SetBatchLimits(cfg.Batch)
+	app.proc.SetCompression(cfg.MQ.Compression)
+	app.proc.SetRetention(cfg.Retention)
+
+	// 3.1 設定 receipt_queue 時，改為收到 TpeBiConsumer 回執才標記 ReceivedByTPE
+	if cfg.MQ.ReceiptQueue != "" {
+		src, ok := app.publisher.(mq.ReceiptSource)
+		if !ok {
+			return app, fmt.Errorf("publisher %q 不支援回執，請移除 receipt_queue 設定", cfg.MQ.Publisher)
+		}
+		app.receiptSource = src
+		app.proc.SetAwaitReceipt(true)
+	}
+
+	// 3.2 確認批次紀錄有狀態欄位與順序欄位
+	if err = dbLayer.EnsureLogBatchStatusColumns(ctx, app.db); err != nil {
+		return app, fmt.Errorf("補齊批次狀態欄位失敗：%w", err)
+	}
+	if err = dbLayer.EnsureLogBatchOrderColumns(ctx, app.db); err != nil {
+		return app, fmt.Errorf("補齊批次順序欄位失敗：%w", err)
+	}
+
+	// 3.3 DML 分流：補齊 Stream 欄位，設定資料表對應的 stream
+	if err = dbLayer.EnsureDmlStreamColumns(ctx, app.db); err != nil {
+		return app, fmt.Errorf("補齊 Stream 欄位失敗：%w", err)
+	}
+	app.proc.SetDmlStreams(cfg.MQ.DmlStreams, cfg.MQ.DmlStreamColumn)
+
+	// 3.4 DDL 過濾：補齊 FilterReason 欄位，設定過濾規則
+	if err = dbLayer.EnsureDdlFilterColumn(ctx, app.db); err != nil {
+		return app, fmt.Errorf("補齊 FilterReason 欄位失敗：%w", err)
+	}
+	app.proc.SetDdlFilter(cfg.DdlFilter)
+
+	// 3.5 DmlLog 來源：有資料表使用 Change Tracking 時，確認同步版本表存在
+	app.proc.SetDmlSources(cfg.DmlSource)
+	if usesChangeTracking(cfg.DmlSource) {
+		if err = dbLayer.EnsureDmlSyncVersionTable(ctx, app.db); err != nil {
+			return app, fmt.Errorf("建立 DmlSyncVersion 失敗：%w", err)
+		}
+	}
+	return app, nil
+}
+
+// Close 釋放 Publisher 與資料庫連線
+func (a *factoryApp) Close() {
+	if a.publisher != nil {
+		a.publisher.Close()
+	}
+	if a.db != nil {
+		if sqlDB, err := a.db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}
+}
+
+// newBreaker 建立相依服務（db、mq）的熔斷器，狀態改變時記錄 log 並更新 circuit_state
+func (a *factoryApp) newBreaker(dependency string) *resilience.Breaker {
+	rc := a.cfg.Resilience
+	b := resilience.NewBreaker(dependency, rc.BreakerThreshold, rc.BreakerOpenTimeout)
+	gauge := metrics.CircuitState.WithLabelValues(a.id, dependency)
+	gauge.Set(float64(resilience.StateClosed))
+	openTimeout := b.OpenTimeout
+	b.OnStateChange = func(name string, from, to resilience.State) {
+		gauge.Set(float64(to))
+		if to == resilience.StateOpen {
+			a.sugar.Errorf("%s 連續失敗，暫停使用 %s 後再試探", name, openTimeout)
+			return
+		}
+		a.sugar.Infof("%s 熔斷器狀態 %s -> %s", name, from, to)
+	}
+	return b
+}
+
+// superviseFactory 持續執行一個工廠，初始化或恢復失敗時等待後重試，直到 ctx 結束；
+// 一個工廠的 DB 或 MQ 異常不會影響其他工廠。執行中的批次使用 inflight，關機時可以先完成；
+// 每次初始化都使用 live 目前的設定，重新載入過的間隔與批次上限不會回到舊值
+func superviseFactory(ctx, inflight context.Context, live *liveConfig, sugar *zap.SugaredLogger, status *ops.FactoryStatus) {
+	for {
+		app, err := openFactory(ctx, live.Get(), sugar)
+		if err == nil {
+			app.live = live
+			app.status = status
+			app.inflight = inflight
+			app.reportTarget()
+			err = app.run(ctx)
+			app.Close()
+		}
+		status.ClearTarget(err)
+		if ctx.Err() != nil {
+			return
+		}
+		sugar.Errorf("工廠執行失敗，%s 後重試：%v", factoryRetryInterval, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(factoryRetryInterval):
+		}
+	}
+}
+
+// reportTarget 把資料庫與 MQ 連線交給 /readyz 檢查，Processor 交給管理 API
+func (a *factoryApp) reportTarget() {
+	if a.status == nil {
+		return
+	}
+	sqlDB, err := a.db.DB()
+	if err != nil {
+		a.status.ClearTarget(err)
+		return
+	}
+	var checker ops.MQChecker
+	if hc, ok := a.publisher.(mq.HealthChecker); ok {
+		checker = hc
+	}
+	a.status.SetTarget(sqlDB, checker)
+	a.status.SetController(a.proc)
+}
+
+// run 恢復未完成的批次後啟動回執、DmlLogGenerate、DDL 與各 DML stream 線程，直到 ctx 結束
+func (a *factoryApp) run(ctx context.Context) error {
+	cfg, sugar, proc := a.cfg, a.sugar, a.proc
+
+	// 1. 恢復上次停在中間狀態的批次
+	recovered, err := proc.RecoverBatches(ctx)
+	if err != nil {
+		return fmt.Errorf("恢復未完成批次失敗（已恢復 %d 筆）：%w", recovered, err)
+	}
+	if recovered > 0 {
+		sugar.Infof("已恢復 %d 筆未完成的批次", recovered)
+	}
+
+	// 2. 用 WaitGroup 等待所有線程結束
+	var wg sync.WaitGroup
+
+	// 2.1 啟動回執接收線程，收到 Applied 才標記 Log，Rejected 的批次記錄錯誤等待人工處理
+	if a.receiptSource != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sugar.Infof("回執接收啟動，Queue=%s", cfg.MQ.ReceiptQueue)
+			err := a.receiptSource.ConsumeReceipts(ctx, func(ctx context.Context, body []byte, verifyErr error) error {
+				if verifyErr != nil {
+					sugar.Errorf("略過簽章驗證失敗的回執：%v", verifyErr)
+					return nil
+				}
+				receipt, err := proc.HandleReceipt(ctx, body)
+				if errors.Is(err, service.ErrBadReceipt) {
+					sugar.Errorf("略過無效的回執：%v", err)
+					return nil
+				}
+				if err != nil {
+					sugar.Errorf("處理回執失敗，稍後重試：%v", err)
+					return err
+				}
+				metrics.BatchReceipts.WithLabelValues(a.id, receipt.Kind, receipt.Outcome).Inc()
+				if receipt.Outcome == model.ReceiptOutcomeRejected {
+					sugar.Errorf("%s 批次 %d 被 TPE 拒絕，訊息已進 DLQ：%s", receipt.Kind, receipt.BatchID, receipt.Error)
+				}
+				return nil
+			})
+			if err != nil {
+				sugar.Errorf("回執接收結束：%v", err)
+			}
+		}()
+	}
+
+	// 2.2 啟動定時產生 DmlLog 的線程
+	var dmlLogRunning int32
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		interval := cfg.DmlLogGenerateInterval
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			// 先取得觸發與設定變更的 channel，等待期間的通知才不會遺漏
+			triggered := a.status.Triggered(ops.LoopGenerate)
+			changed := a.live.Changed()
+			select {
+			case <-ctx.Done():
+				sugar.Info("DmlLogGenerate goroutine 結束")
+				return
+			case <-ticker.C:
+			case <-triggered:
+			case <-changed:
+				// 設定檔重新載入：間隔有變更時重設 ticker
+				if next := a.settings().DmlLogGenerateInterval; next > 0 && next != interval {
+					interval = next
+					ticker.Reset(interval)
+					sugar.Infof("DmlLogGenerate 間隔調整為 %s", interval)
+				}
+				continue
+			}
+			// 管理 API 暫停中：略過，恢復時會立即觸發
+			if a.status.Paused(ops.LoopGenerate) {
+				continue
+			}
+			if !atomic.CompareAndSwapInt32(&dmlLogRunning, 0, 1) {
+				sugar.Warn("上一輪 DmlLogGenerate 尚未完成，略過此次執行")
+				continue
+			}
+			func() {
+				defer atomic.StoreInt32(&dmlLogRunning, 0)
+				// DB 熔斷中時略過，等下一個 tick
+				if _, err := a.dbBreaker.Allow(); err != nil {
+					sugar.Debugf("略過 DmlLogGenerate：%v", err)
+					return
+				}
+				err := proc.DmlLogGenerate(a.batchContext(ctx))
+				a.recordOutcome(0, err)
+				if err != nil {
+					sugar.Errorf("DmlLogGenerate 執行失敗（%s）: %v", resilience.ClassOf(err), err)
+				}
+			}()
+		}
+	}()
+
+	// 2.3 處理DDL: DdlLogProcess
+	a.status.Watch("ddl")
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		backoff := schedule.NewBackoff(a.intervals("ddl"))
+		sugar.Infof("DDL 服務啟動，沒有資料時間隔 %s ~ %s", backoff.Min, backoff.Max)
+		a.pollLoop(ctx, "ddl", "ddl", "DDL", backoff, nil, func(batchCtx context.Context, logCtn *int) error {
+			return proc.DdlLogProcess(batchCtx, logCtn)
+		})
+	}()
+
+	// 2.4 處理DML: DmlLogProcess，每個 stream 一條線程，大表不會卡住其他表；
+	//     設定 poll.wake 時，DmlLog 有新資料即喚醒所有 stream
+	var wake *schedule.Wake
+	if cfg.Poll.Wake == config.PollWakeServiceBroker {
+		wake = schedule.NewWake()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.wakeLoop(ctx, wake)
+		}()
+	}
+	for _, stream := range dmlStreamNames(cfg.MQ.DmlStreams) {
+		stream := stream
+		name, loop := "DML", "dml"
+		if stream != model.DefaultDmlStream {
+			name, loop = "DML(stream="+stream+")", "dml."+stream
+		}
+		a.status.Watch(loop)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			backoff := schedule.NewBackoff(a.intervals("dml"))
+			sugar.Infof("%s 服務啟動，沒有資料時間隔 %s ~ %s", name, backoff.Min, backoff.Max)
+			a.pollLoop(ctx, "dml", loop, name, backoff, wake, func(batchCtx context.Context, logCtn *int) error {
+				return proc.DmlLogProcess(batchCtx, stream, logCtn)
+			})
+		}()
+	}
+
+	// 2.5 定期統計未處理的 DdlLog / DmlLog，供監控發現卡住的工廠
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.backlogLoop(ctx)
+	}()
+
+	// 2.6 保留期限：離峰時段分段清理已完成且過期的資料
+	if cfg.Retention.Enabled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.retentionLoop(ctx)
+		}()
+	}
+
+	// 2.7 設定檔重新載入：把新的批次上限套用到 Processor
+	if a.live != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.reloadLoop(ctx)
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// settings 回傳目前生效的設定：設定檔重新載入後的間隔、逾時與批次上限
+func (a *factoryApp) settings() config.Config {
+	if a.live == nil {
+		return a.cfg
+	}
+	return a.live.Get()
+}
+
+// intervals 回傳 kind（ddl、dml）目前沒有資料時的最短與最長輪詢間隔
+func (a *factoryApp) intervals(kind string) (time.Duration, time.Duration) {
+	cfg := a.settings()
+	if kind == "ddl" {
+		return cfg.ProcessDdlInterval, cfg.Poll.DdlMaxInterval
+	}
+	return cfg.ProcessDmlInterval, cfg.Poll.DmlMaxInterval
+}
+
+// reloadLoop 在設定檔重新載入、批次上限有變更時套用到 Processor，直到 ctx 結束；
+// 以管理 API 調整過的上限會被設定檔的新值取代
+func (a *factoryApp) reloadLoop(ctx context.Context) {
+	applied := a.cfg.Batch
+	for {
+		// 先取得變更 channel 再比對，比對之後的變更才不會遺漏
+		changed := a.live.Changed()
+		if limits := a.settings().Batch; limits != applied {
+			a.proc.SetBatchLimits(limits)
+			if a.status.ClearBatchLimits() {
+				a.sugar.Warn("設定檔的批次上限已變更，取代以管理 API 調整過的上限")
+			}
+			a.sugar.Infof("批次上限調整為 ddl_max_rows=%d dml_max_rows=%d max_bytes=%d", limits.DdlMaxRows, limits.DmlMaxRows, limits.MaxBytes)
+			applied = limits
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+// retentionLoop 每隔 retention.interval 檢查一次，在離峰時段內執行清理，離開時段即停止，直到 ctx 結束；
+// 每段 DELETE 是獨立的 statement，關機時直接取消不需等待
+func (a *factoryApp) retentionLoop(ctx context.Context) {
+	rc := a.cfg.Retention
+	interval := rc.Interval
+	if interval <= 0 {
+		interval = defaultRetentionInterval
+	}
+	window, err := schedule.ParseWindow(rc.WindowStart, rc.WindowEnd)
+	if err != nil {
+		a.sugar.Errorf("retention 設定錯誤，不執行清理：%v", err)
+		return
+	}
+	inWindow := func() bool { return window.Contains(time.Now()) }
+	a.sugar.Infof("保留期限清理啟動，Log %d 天、批次紀錄 %d 天、_History %d 天，每 %s 檢查一次",
+		rc.LogDays, rc.BatchDays, rc.HistoryDays, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := a.dbBreaker.Allow(); err == nil && inWindow() {
+			report, err := a.proc.RunRetention(ctx, rc.DryRun, inWindow)
+			if ctx.Err() != nil {
+				return
+			}
+			a.logRetention(report, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// logRetention 記錄一次清理的結果
+func (a *factoryApp) logRetention(report *service.RetentionReport, err error) {
+	for _, t := range report.Tables {
+		if report.DryRun {
+			a.sugar.Infof("retention dry-run：%s 早於 %s 可清理 %d 筆", t.Table, t.Cutoff.Format(time.DateTime), t.Eligible)
+			continue
+		}
+		if t.Purged > 0 {
+			a.sugar.Infof("retention：%s 已%s %d 筆（早於 %s）", t.Table, retentionVerb(report.Mode), t.Purged, t.Cutoff.Format(time.DateTime))
+		}
+	}
+	if err != nil {
+		a.sugar.Errorf("retention 清理失敗：%v", err)
+	} else if report.Interrupted {
+		a.sugar.Info("retention 已離開離峰時段，剩餘資料下次再清理")
+	}
+}
+
+// retentionVerb 回傳清理方式的說明文字
+func retentionVerb(mode string) string {
+	if mode == config.RetentionModeArchive {
+		return "搬移"
+	}
+	return "刪除"
+}
+
+// backlogLoop 依 ops.backlog_interval 更新未處理筆數與最舊 GenerateDate 的指標，直到 ctx 結束
+func (a *factoryApp) backlogLoop(ctx context.Context) {
+	interval := a.cfg.Ops.BacklogInterval
+	if interval <= 0 {
+		interval = ops.DefaultBacklogInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.collectBacklog(ctx); err != nil && ctx.Err() == nil {
+			a.sugar.Warnf("統計未處理 Log 失敗：%v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collectBacklog 查詢一次未處理的 DdlLog / DmlLog 並更新指標與管理 API 的狀態
+func (a *factoryApp) collectBacklog(ctx context.Context) error {
+	queryCtx, cancel := context.WithTimeout(ctx, a.settings().ProcessTimeout)
+	defer cancel()
+	for _, kind := range []string{model.ReceiptKindDDL, model.ReceiptKindDML} {
+		get := dbLayer.GetDdlBacklog
+		if kind == model.ReceiptKindDML {
+			get = dbLayer.GetDmlBacklog
+		}
+		backlog, err := get(queryCtx, a.db)
+		if err != nil {
+			return fmt.Errorf("%s：%w", kind, err)
+		}
+		age := 0.0
+		if backlog.OldestGenerateDate.Valid {
+			age = time.Since(backlog.OldestGenerateDate.Time).Seconds()
+		}
+		metrics.UnprocessedLogs.WithLabelValues(a.id, kind).Set(float64(backlog.Count))
+		metrics.OldestUnprocessedLogAge.WithLabelValues(a.id, kind).Set(age)
+		b := ops.Backlog{Count: backlog.Count}
+		if backlog.OldestGenerateDate.Valid {
+			oldest := backlog.OldestGenerateDate.Time
+			b.OldestGenerateDate = &oldest
+		}
+		a.status.SetBacklog(kind, b)
+	}
+	return nil
+}
+
+// pollLoop 反覆執行批次處理並收集 metrics，成功時回報 loop 的最近成功時間，直到 ctx 結束；
+// 撈到資料時立即再跑，沒有資料時依 backoff 等待，wake 或管理 API 觸發時提前執行；
+// 失敗時依錯誤分類等待（見 failureWait），DB 或 MQ 熔斷中、管理 API 暫停 kind 時不執行
+func (a *factoryApp) pollLoop(ctx context.Context, kind, loop, name string, backoff *schedule.Backoff, wake *schedule.Wake, process func(ctx context.Context, logCtn *int) error) {
+	retry := resilience.NewRetry(a.cfg.Resilience.RetryBase, a.cfg.Resilience.RetryMax)
+	for {
+		if ctx.Err() != nil {
+			// 執行中的批次已在上一輪完成（或被 inflight 取消），不再開始新的批次
+			a.sugar.Info(name + "服務收到關機訊號，停止排程，服務終止。")
+			return
+		}
+
+		// 設定檔重新載入後的輪詢間隔
+		a.tuneBackoff(name, kind, backoff)
+
+		// 1. 管理 API 暫停中：等到恢復；先取得觸發 channel，之後的恢復與觸發才不會遺漏
+		triggered := a.status.Triggered(kind)
+		if a.status.Paused(kind) {
+			sleepCtx(ctx, pausedRecheck, nil, triggered)
+			continue
+		}
+
+		// 2. 相依服務熔斷中：等到可以試探再執行
+		if wait, err := a.allow(); err != nil {
+			a.sugar.Debugf("%s暫停執行，%s 後再試：%v", name, wait, err)
+			sleepCtx(ctx, wait, nil, nil)
+			continue
+		}
+
+		// 3. 執行一次批次；先取得喚醒 channel，處理期間收到的通知才不會遺漏
+		woken := wake.C()
+		logCtn, err := a.runBatch(ctx, kind, loop, name, process)
+		a.recordOutcome(logCtn, err)
+
+		// 4. 決定下一次執行前的等待；管理 API 的觸發在失敗時仍可提前重試
+		wait := backoff.Next(logCtn, err)
+		if err != nil {
+			// 失敗時不因喚醒提前重試
+			wait, woken = a.failureWait(name, err, retry), nil
+		} else {
+			retry.Reset()
+		}
+		if wait == 0 {
+			continue
+		}
+		if sleepCtx(ctx, wait, woken, triggered) {
+			backoff.Reset()
+		}
+	}
+}
+
+// tuneBackoff 在設定檔重新載入、輪詢間隔有變更時調整 backoff，下一次等待即生效
+func (a *factoryApp) tuneBackoff(name, kind string, backoff *schedule.Backoff) {
+	lo, hi := a.intervals(kind)
+	hi = max(hi, lo)
+	if lo == backoff.Min && hi == backoff.Max {
+		return
+	}
+	backoff.SetBounds(lo, hi)
+	a.sugar.Infof("%s 沒有資料時間隔調整為 %s ~ %s", name, lo, hi)
+}
+
+// runBatch 以帶 process_timeout 期限的 Context 執行一次批次並記錄 metrics
+func (a *factoryApp) runBatch(ctx context.Context, kind, loop, name string, process func(ctx context.Context, logCtn *int) error) (int, error) {
+	// 每次批次開始時，建立一個帶期限的 Context（例如 30 秒）
+	batchCtx, cancel := context.WithTimeout(a.batchContext(ctx), a.settings().ProcessTimeout)
+	// 確保在此批次結束後取消，避免 context 泄漏
+	defer cancel()
+
+	start := time.Now()
+	defer func() {
+		metrics.ProcessDuration.WithLabelValues(a.id, kind).Observe(time.Since(start).Seconds())
+	}()
+	var logCtn int
+	if err := process(batchCtx, &logCtn); err != nil {
+		class := resilience.ClassOf(err)
+		metrics.ProcessErrors.WithLabelValues(a.id, kind, class.String()).Inc()
+		a.sugar.Errorf("%s批次處理失敗（%s）：%v", name, class, err)
+		return logCtn, err
+	}
+	metrics.ProcessRuns.WithLabelValues(a.id, kind).Inc()
+	a.status.RecordSuccess(loop)
+	return logCtn, nil
+}
+
+// batchContext 回傳執行批次用的 Context：關機時不會立即取消，讓批次有 shutdown_timeout 可以完成
+func (a *factoryApp) batchContext(ctx context.Context) context.Context {
+	if a.inflight != nil {
+		return a.inflight
+	}
+	return ctx
+}
+
+// allow 確認 DB 與 MQ 熔斷器都允許呼叫，否則回傳需要等待的時間
+func (a *factoryApp) allow() (time.Duration, error) {
+	if wait, err := a.dbBreaker.Allow(); err != nil {
+		return wait, err
+	}
+	return a.mqBreaker.Allow()
+}
+
+// recordOutcome 依批次結果更新熔斷器：只有暫時性的 DB、MQ 錯誤才計入失敗；
+// 沒有撈到資料的批次沒有發送訊息，不影響 MQ 熔斷器
+func (a *factoryApp) recordOutcome(logCtn int, err error) {
+	if err == nil {
+		a.dbBreaker.Success()
+		if logCtn > 0 {
+			a.mqBreaker.Success()
+		}
+		return
+	}
+	switch resilience.ClassOf(err) {
+	case resilience.ClassTransientDB:
+		a.dbBreaker.Failure()
+	case resilience.ClassTransientMQ:
+		a.mqBreaker.Failure()
+	}
+}
+
+// failureWait 依錯誤分類決定下一次執行前的等待：暫時性錯誤以帶 jitter 的指數退避重試；
+// 資料或設定錯誤重試也不會成功，等待 resilience.poison_wait 並提示需人工處理
+func (a *factoryApp) failureWait(name string, err error, retry *resilience.Retry) time.Duration {
+	class := resilience.ClassOf(err)
+	if class.Transient() {
+		return retry.Next()
+	}
+	wait := a.cfg.Resilience.PoisonWait
+	if wait <= 0 {
+		wait = defaultPoisonWait
+	}
+	a.sugar.Errorf("%s批次發生%s錯誤，需人工處理，%s 後再試：%v", name, class, wait, err)
+	return wait
+}
+
+// pausedRecheck 為暫停中的迴圈重新確認狀態的間隔，恢復時會立即喚醒，不必等到此間隔
+const pausedRecheck = time.Minute
+
+// sleepCtx 等待 d，ctx 結束時提前返回；woken 或 triggered 觸發時回傳 true
+func sleepCtx(ctx context.Context, d time.Duration, woken, triggered <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	case <-woken:
+		return true
+	case <-triggered:
+		return true
+	}
+	return false
+}
+
+// wakeWaitTimeout 為每次等待 Service Broker 通知的最長時間
+const wakeWaitTimeout = 30 * time.Second
+
+// wakeLoop 持續等待 DmlLog 新增的 Service Broker 通知，收到後喚醒所有 DML 迴圈，直到 ctx 結束
+func (a *factoryApp) wakeLoop(ctx context.Context, wake *schedule.Wake) {
+	a.sugar.Infof("DML 喚醒啟動，Service Broker Queue=%s", a.cfg.Poll.WakeQueue)
+	for ctx.Err() == nil {
+		waitCtx, cancel := context.WithTimeout(ctx, wakeWaitTimeout+a.settings().ProcessTimeout)
+		n, err := dbLayer.WaitDmlLogNotification(waitCtx, a.db, a.cfg.Poll.WakeQueue, wakeWaitTimeout)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// 通知只是加速，失敗時迴圈仍會依間隔輪詢
+			a.sugar.Warnf("等待 Service Broker 通知失敗，%s 後重試：%v", wakeWaitTimeout, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(wakeWaitTimeout):
+			}
+			continue
+		}
+		if n > 0 {
+			wake.Broadcast()
+		}
+	}
+}
+
+// dmlStreamNames 回傳需要處理的 DML stream，預設 stream（空字串）永遠在第一個
+func dmlStreamNames(streams []config.DmlStream) []string {
+	names := []string{model.DefaultDmlStream}
+	for _, s := range streams {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+// usesChangeTracking 判斷是否有任何資料表以 Change Tracking 產生 DmlLog
+func usesChangeTracking(c config.DmlSourceConfig) bool {
+	if c.Default == config.DmlSourceChangeTracking {
+		return true
+	}
+	for _, src := range c.Tables {
+		if src == config.DmlSourceChangeTracking {
+			return true
+		}
+	}
+	return false
+}
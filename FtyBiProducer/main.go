@@ -3,23 +3,28 @@ package main
 
 import (
 	"FtyBiProducer/config"
-	"FtyBiProducer/metrics"
 	mq "FtyBiProducer/mq"
+	"FtyBiProducer/ops"
 	scilog "FtyBiProducer/scilog"
-	"FtyBiProducer/service"
+	"SciCommon/configsource"
+	"SciCommon/reload"
+	"SciCommon/secret"
 	"context"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"sync"
-	"sync/atomic"
 	"syscall"
 	"time"
 
-	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
 )
 
+// defaultShutdownTimeout 為未設定 shutdown_timeout 時，關機前等待執行中批次的時間
+const defaultShutdownTimeout = 30 * time.Second
+
 func main() {
 
 	// 1. 建立 Logger
@@ -35,183 +40,247 @@ func main() {
 	sugar := logger.Sugar()
 	sugar.Info("Logger 初始化成功")
 
+	// 2.1 解析命令列：全域參數 --config / --profile 須放在子命令之前
+	//     例如 fty-bi-producer --profile prod_PH1 replay -kind dml -from 100 -to 200
+	var sel configsource.Selection
+	fs := flag.NewFlagSet("fty-bi-producer", flag.ContinueOnError)
+	sel.RegisterFlags(fs)
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		sugar.Fatalf("參數錯誤：%v", err)
+	}
+	args := fs.Args()
+
+	// 2.2 子命令：replay 重送指定範圍後即結束，不啟動排程；purge 依 retention 設定清理一次；
+	//     snapshot 完整同步一張資料表；validate-config 只檢查設定；secrets 管理加密秘密檔，不需要載入設定
+	var replayCmd *replayCommand
+	var purgeCmd *purgeCommand
+	var snapshotCmd *snapshotCommand
+	validateOnly := false
+	if len(args) > 0 {
+		switch args[0] {
+		case "replay":
+			cmd, err := parseReplayArgs(args[1:])
+			if err != nil {
+				sugar.Fatalf("replay 參數錯誤：%v", err)
+			}
+			replayCmd = &cmd
+		case "purge":
+			cmd, err := parsePurgeArgs(args[1:])
+			if err != nil {
+				sugar.Fatalf("purge 參數錯誤：%v", err)
+			}
+			purgeCmd = &cmd
+		case "snapshot":
+			cmd, err := parseSnapshotArgs(args[1:])
+			if err != nil {
+				sugar.Fatalf("snapshot 參數錯誤：%v", err)
+			}
+			snapshotCmd = &cmd
+		case "validate-config":
+			validateOnly = true
+		case "secrets":
+			if err := secret.Run(config.Secrets, args[1:], os.Stdin, os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				logger.Sync()
+				os.Exit(1)
+			}
+			return
+		default:
+			sugar.Fatalf("未知的子命令：%s", args[0])
+		}
+	}
+
 	// 3. 建立可取消的 Context，訂閱 SIGINT 和 SIGTERM
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	// 4. 設定管理：自動尋找 config 目錄下第一個 config.*.yaml
-	matches, err := filepath.Glob("config/config.*.yaml")
+	// 4. 設定管理：依 --config / --profile / ENV 決定設定檔，base 與工廠設定依序合併
+	cfgFiles, err := config.Locator.Resolve(sel)
 	if err != nil {
-		sugar.Fatalf("尋找設定檔時發生錯誤：%v", err)
+		sugar.Fatalf("決定設定檔失敗：%v", err)
 	}
-	if len(matches) == 0 {
-		sugar.Fatalf("在 config/ 目錄下找不到任何 config.*.yaml 檔案")
+	sugar.Infof("載入設定檔：%v", cfgFiles)
+
+	// 4.1 validate-config：印出遮蔽敏感欄位後的有效設定，驗證失敗時以非 0 結束
+	if validateOnly {
+		if err := validateConfig(os.Stdout, cfgFiles); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			sugar.Errorf("設定驗證失敗：%v", err)
+			logger.Sync()
+			os.Exit(1)
+		}
+		return
 	}
-	cfgPath := matches[0]
-	sugar.Infof("載入設定檔：%s", cfgPath)
 
-	cfg, err := config.LoadConfig(cfgPath)
+	cfg, err := config.LoadConfig(cfgFiles...)
 	if err != nil {
 		sugar.Fatalf("載入設定失敗：%v", err)
 	}
+	if err := scilog.SetLevel(cfg.LogLevel); err != nil {
+		sugar.Fatalf("載入設定失敗：%v", err)
+	}
 
-	// // 5. 啟動 Metrics Server. 先啟動一個專門用來暴露 /metrics 的 HTTP 伺服器
-	// go func() {
-	// 	http.Handle("/metrics", promhttp.Handler())
-	// 	sugar.Info("Metrics 伺服器啟動，監聽 :" + strconv.Itoa(cfg.Prometheus.MetricsPort) + "/metrics")
-	// 	if err := http.ListenAndServe(":"+strconv.Itoa(cfg.Prometheus.MetricsPort), nil); err != nil {
-	// 		sugar.Fatalf("Metrics server 錯誤", zap.Error(err))
-	// 	}
-	// }()
+	// 5. 啟動維運 HTTP 服務：/metrics、/healthz、/readyz、/admin/*（子命令不啟動）
+	var opsServer *ops.Server
+	if replayCmd == nil && purgeCmd == nil && snapshotCmd == nil {
+		opsServer = ops.NewServer(cfg.Ops.MaxBatchAge)
+		opsServer.EnableAdmin(cfg.Ops.AdminToken, sugar)
+		if port := cfg.ListenPort(); port > 0 {
+			go func() {
+				sugar.Infof("維運服務啟動，監聽 :%d（/metrics、/healthz、/readyz）", port)
+				if cfg.Ops.AdminToken != "" {
+					sugar.Info("管理 API 已開放（/admin/*）")
+				}
+				if err := opsServer.ListenAndServe(ctx, port); err != nil {
+					sugar.Errorf("維運服務錯誤：%v", err)
+				}
+			}()
+		}
+	}
 
-	// 6. 建立 MQ Client
-	mqClient, err := mq.NewMQClient(cfg.MQ)
-	if err != nil {
-		sugar.Fatalf("MQ 初始化失敗：", zap.Error(err))
+	// 6. 取得要處理的工廠：未設定 factories 時只有一個
+	sources := cfg.FactorySources()
+
+	// 6.1 replay 子命令：只處理指定的工廠，執行完即結束
+	if replayCmd != nil {
+		src, err := selectFactory(sources, replayCmd.factory)
+		if err != nil {
+			sugar.Fatalf("replay 參數錯誤：%v", err)
+		}
+		// replay dry-run 不會發送，不需要連線 MQ，也不會收到回執（memory publisher 不支援回執 Queue）
+		if replayCmd.req.DryRun {
+			src.MQ.Publisher, src.MQ.ReceiptQueue = mq.PublisherMemory, ""
+		}
+		app, err := openFactory(ctx, src, sugar.With("factory", src.MQ.FactoryID))
+		if err != nil {
+			sugar.Fatalf("初始化工廠失敗：%v", err)
+		}
+		defer app.Close()
+		sugar.Infof("開始重送：%+v", replayCmd.req)
+		if err := runReplay(ctx, app.proc, replayCmd.req); err != nil {
+			sugar.Fatalf("重送失敗：%v", err)
+		}
+		sugar.Info("重送完成")
+		return
 	}
-	defer mqClient.Close()
 
-	// 7. 初始化資料庫
-	db, err := config.InitGormDB(cfg.DB)
-	if err != nil {
-		sugar.Fatalf("初始化資料庫失敗：", zap.Error(err))
+	// 6.2 purge 子命令：只處理指定的工廠，不發送訊息
+	if purgeCmd != nil {
+		src, err := selectFactory(sources, purgeCmd.factory)
+		if err != nil {
+			sugar.Fatalf("purge 參數錯誤：%v", err)
+		}
+		src.MQ.Publisher, src.MQ.ReceiptQueue = mq.PublisherMemory, ""
+		app, err := openFactory(ctx, src, sugar.With("factory", src.MQ.FactoryID))
+		if err != nil {
+			sugar.Fatalf("初始化工廠失敗：%v", err)
+		}
+		defer app.Close()
+		sugar.Infof("開始清理（dry-run=%v）", purgeCmd.dryRun)
+		if err := runPurge(ctx, app.proc, purgeCmd.dryRun); err != nil {
+			sugar.Fatalf("清理失敗：%v", err)
+		}
+		sugar.Info("清理完成")
+		return
 	}
-	defer func() {
-		if sqlDB, err := db.DB(); err == nil {
-			sqlDB.Close()
+
+	// 6.3 snapshot 子命令：只處理指定的工廠；執行中服務的 DML 照常發送，由 Consumer 暫存並依 Watermark 略過
+	if snapshotCmd != nil {
+		src, err := selectFactory(sources, snapshotCmd.factory)
+		if err != nil {
+			sugar.Fatalf("snapshot 參數錯誤：%v", err)
+		}
+		// dry-run 不會發送，不需要連線 MQ；完整同步不需要回執
+		if snapshotCmd.req.DryRun {
+			src.MQ.Publisher = mq.PublisherMemory
+		}
+		src.MQ.ReceiptQueue = ""
+		app, err := openFactory(ctx, src, sugar.With("factory", src.MQ.FactoryID))
+		if err != nil {
+			sugar.Fatalf("初始化工廠失敗：%v", err)
 		}
-	}()
+		defer app.Close()
+		sugar.Infof("開始完整同步：%+v", snapshotCmd.req)
+		if err := runSnapshot(ctx, app.proc, snapshotCmd.req); err != nil {
+			sugar.Fatalf("完整同步失敗：%v", err)
+		}
+		sugar.Info("完整同步完成")
+		return
+	}
 
-	// 8. 建立 Processor
-	proc := service.New(db, mqClient)
+	// 7. 收到關機訊號後不再開始新的批次，執行中的批次最多再給 shutdown_timeout 完成
+	shutdownTimeout := cfg.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+	inflight, cancelInflight := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelInflight()
+	stopShutdownTimer := context.AfterFunc(ctx, func() {
+		sugar.Infof("收到關機訊號，等待執行中的批次完成（最多 %s）", shutdownTimeout)
+		time.AfterFunc(shutdownTimeout, func() {
+			sugar.Warnf("超過 %s 仍有批次未完成，取消執行中的批次", shutdownTimeout)
+			cancelInflight()
+		})
+	})
+	defer stopShutdownTimer()
 
-	// 9. 用 WaitGroup 等待3條線程結束
+	// 8. 每個工廠各自一組 Publisher、DB 與排程線程，互相隔離
+	reloader := newConfigReloader(cfgFiles, cfg, sugar)
 	var wg sync.WaitGroup
-	wg.Add(3)
-
-	// 9.1 啟動定時產生 DmlLog 的線程
-	var dmlLogRunning int32
-	go func() {
-		defer wg.Done()
-		ticker := time.NewTicker(cfg.DmlLogGenerateInterval)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ctx.Done():
-				sugar.Info("DmlLogGenerate goroutine 結束")
-				return
-			case <-ticker.C:
-				if !atomic.CompareAndSwapInt32(&dmlLogRunning, 0, 1) {
-					sugar.Warn("上一輪 DmlLogGenerate 尚未完成，略過此次執行")
-					continue
-				}
-				func() {
-					defer atomic.StoreInt32(&dmlLogRunning, 0)
-					if err := proc.DmlLogGenerate(ctx); err != nil {
-						sugar.Errorf("DmlLogGenerate 執行失敗: %v", err)
-					}
-				}()
-			}
-		}
-	}()
-
-	// 10-1. Producer 1 號 處理DDL: DdlLogProcess
-	go func() {
-		defer wg.Done()
-
-		// 10-1-1. 建立 Ticker，依 ProcessDdlInterval 週期執行
-		// ticker := time.NewTicker(cfg.ProcessDdlInterval)
-		// defer ticker.Stop()
-
-		sugar.Info("DDL 服務啟動，每" + cfg.ProcessDdlInterval.String() + "秒執行一次批次處理")
-
-		// 10-1-2. 主迴圈: 呼叫 Processor 處理（序列化 + 發送），並收集 metrics，並優雅關閉
-		for {
-			select {
-			case <-ctx.Done():
-				sugar.Info("DDL服務收到關機訊號，開始清理...")
-				// TODO: 若有正在執行的批次，可考慮等待 proc.Wait(ctx) 或自訂 timeout
-				sugar.Info("DDL服務清理完成，服務終止。")
-				return
-
-			// case <-ticker.C:
-
-			default:
-				func() {
-					// 每次批次開始時，建立一個帶期限的 Context（例如 30 秒）
-					batchCtx, cancel := context.WithTimeout(ctx, cfg.ProcessTimeout)
-					// 確保在此批次結束後取消，避免 context 泄漏
-					defer cancel() // 這個 defer 屬於這個匿名函式，而不是main
-
-					// 執行一次批次
-					start := time.Now()
-					var logCtn int
-					if err := proc.DdlLogProcess(batchCtx, &logCtn); err != nil {
-						metrics.ProcessErrors.WithLabelValues("ddl").Inc()
-						sugar.Fatalf("DDL批次處理失敗：", zap.Error(err))
-					} else {
-						metrics.ProcessRuns.WithLabelValues("ddl").Inc()
-						if logCtn > 0 {
-							sugar.Info("DML批次處理完成，共%d筆", logCtn)
-						}
-					}
-					metrics.ProcessDuration.WithLabelValues("ddl").Observe(time.Since(start).Seconds())
-				}()
-			}
+	for _, src := range sources {
+		src := src
+		status := opsServer.Register(src.MQ.FactoryID)
+		live := reloader.add(src)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			factorySugar := sugar.With("factory", src.MQ.FactoryID)
+			factorySugar.Infof("工廠啟動，DB=%s\\%s", src.DB.Host, src.DB.Instance)
+			superviseFactory(ctx, inflight, live, factorySugar, status)
+			factorySugar.Info("工廠已停止")
+		}()
+	}
+	sugar.Infof("共 %d 個工廠已啟動", len(sources))
+
+	// 9. 監看設定檔：間隔、批次上限與 log_level 變更時立即套用，DB、MQ 等需重新連線的設定待重新啟動
+	if err := reload.Watch(cfgFiles, reloader.reload); err != nil {
+		sugar.Warnf("無法監看設定檔，變更需重新啟動才會生效：%v", err)
+	}
+
+	wg.Wait()
+	sugar.Info("所有工廠已停止")
+}
+
+// selectFactory 依 factory_id 選出工廠；只有一個工廠時可省略
+func selectFactory(sources []config.Config, factoryID string) (config.Config, error) {
+	if factoryID == "" {
+		if len(sources) == 1 {
+			return sources[0], nil
 		}
-	}()
-
-	// 10-2. Producer 2 號 處理DML: DmlLogProcess
-	go func() {
-		defer wg.Done()
-
-		// 10-2-1. 建立 Ticker，依 ProcessDmlInterval 週期執行
-		// ticker := time.NewTicker(cfg.ProcessDmlInterval)
-		// defer ticker.Stop()
-
-		sugar.Info("DML 服務啟動，每" + cfg.ProcessDdlInterval.String() + "秒執行一次批次處理")
-
-		// 10-2-2. 主迴圈: 呼叫 Processor 處理（序列化 + 發送），並收集 metrics，並優雅關閉
-		for {
-			select {
-			case <-ctx.Done():
-				sugar.Info("DML服務收到關機訊號，開始清理...")
-				// TODO: 若有正在執行的批次，可考慮等待 proc.Wait(ctx) 或自訂 timeout
-				sugar.Info("DML服務清理完成，服務終止。")
-				return
-
-			// case <-ticker.C:
-			default:
-				func() {
-					// 每次批次開始時，建立一個帶期限的 Context（例如 30 秒）
-					batchCtx, cancel := context.WithTimeout(ctx, cfg.ProcessTimeout)
-					// 確保在此批次結束後取消，避免 context 泄漏
-					defer cancel() // 這個 defer 屬於這個匿名函式，而不是main
-
-					// 執行一次批次
-					start := time.Now()
-					var logCtn int
-					if err := proc.DmlLogProcess(batchCtx, &logCtn); err != nil {
-						metrics.ProcessErrors.WithLabelValues("dml").Inc()
-						sugar.Fatalf("DML批次處理失敗：", zap.Error(err))
-					} else {
-						metrics.ProcessRuns.WithLabelValues("dml").Inc()
-						/* 重要性不高，先不紀錄
-						if logCtn > 0 {
-							sugar.Info("DML批次處理完成，共 " + strconv.Itoa(logCtn) + " 筆")
-						}*/
-					}
-					metrics.ProcessDuration.WithLabelValues("dml").Observe(time.Since(start).Seconds())
-				}()
-			}
+		return config.Config{}, fmt.Errorf("設定了 %d 個工廠，請以 -factory 指定", len(sources))
+	}
+	for _, src := range sources {
+		if src.MQ.FactoryID == factoryID {
+			return src, nil
 		}
-	}()
-
-	done := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
+	}
+	return config.Config{}, fmt.Errorf("找不到工廠 %q", factoryID)
+}
 
-	<-done
+// validateConfig 載入並驗證設定，將合併後的有效設定以 YAML 寫到 w（密碼、連線字串帳密已遮蔽）
+func validateConfig(w io.Writer, files []string) error {
+	if _, err := config.LoadConfig(files...); err != nil {
+		return err
+	}
+	settings, err := config.EffectiveSettings(files...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "# 設定檔：%v\n", files)
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(settings); err != nil {
+		return fmt.Errorf("輸出設定失敗：%w", err)
+	}
+	return enc.Close()
 }
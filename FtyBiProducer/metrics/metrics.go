@@ -8,14 +8,14 @@ var (
 			Name: "process_runs_total",
 			Help: "批次執行次數",
 		},
-		[]string{"type"}, // type: ddl or dml
+		[]string{"factory", "type"}, // type: ddl or dml
 	)
 	ProcessErrors = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "process_errors_total",
 			Help: "批次錯誤次數",
 		},
-		[]string{"type"},
+		[]string{"factory", "type", "class"}, // class: transient_db、transient_mq、poison、config、unknown
 	)
 	ProcessDuration = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -23,10 +23,104 @@ var (
 			Help:    "批次處理耗時（秒）",
 			Buckets: prometheus.DefBuckets,
 		},
-		[]string{"type"},
+		[]string{"factory", "type"},
+	)
+	BatchReceipts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "batch_receipts_total",
+			Help: "收到的 Consumer 回執數",
+		},
+		[]string{"factory", "type", "outcome"}, // outcome: Applied or Rejected
+	)
+	DmlGenerateRows = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dml_generate_rows_total",
+			Help: "DmlLogGenerate 寫入 DmlLog 的筆數",
+		},
+		[]string{"factory", "table"},
+	)
+	UnprocessedLogs = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "unprocessed_logs",
+			Help: "尚未被 TPE 接收的 DdlLog / DmlLog 筆數",
+		},
+		[]string{"factory", "type"},
+	)
+	OldestUnprocessedLogAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "oldest_unprocessed_log_age_seconds",
+			Help: "最舊一筆未處理 Log 的 GenerateDate 距今秒數，沒有未處理時為 0",
+		},
+		[]string{"factory", "type"},
+	)
+	LastSuccessTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "last_success_timestamp_seconds",
+			Help: "各處理迴圈最近一次成功的時間（Unix 秒）",
+		},
+		[]string{"factory", "loop"}, // loop: ddl、dml 或 dml.<stream>
+	)
+	CircuitState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "circuit_state",
+			Help: "相依服務熔斷器狀態：0 正常、1 試探中、2 熔斷",
+		},
+		[]string{"factory", "dependency"}, // dependency: db 或 mq
+	)
+	DmlGenerateRowsPerSecond = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dml_generate_rows_per_second",
+			Help: "DmlLogGenerate 最近一次處理資料表的速度（筆/秒）",
+		},
+		[]string{"factory", "table"},
+	)
+	LoopPaused = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "loop_paused",
+			Help: "處理迴圈是否由管理 API 暫停：1 暫停、0 執行中",
+		},
+		[]string{"factory", "loop"}, // loop: ddl、dml 或 generate
+	)
+	RetentionEligibleRows = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "retention_eligible_rows",
+			Help: "最近一次清理開始時，超過保留天數且可清理的筆數",
+		},
+		[]string{"factory", "table"},
+	)
+	RetentionPurgedRows = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "retention_purged_rows_total",
+			Help: "保留期限到期而刪除（或搬移）的筆數",
+		},
+		[]string{"factory", "table", "mode"}, // mode: delete 或 archive
+	)
+	RetentionLastRunTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "retention_last_run_timestamp_seconds",
+			Help: "最近一次完整清理結束的時間（Unix 秒）",
+		},
+		[]string{"factory"},
+	)
+	DdlFiltered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ddl_filtered_total",
+			Help: "被 ddl_filter 排除、不送到 TPE 的 DDL 筆數",
+		},
+		[]string{"factory", "event_type"},
+	)
+	ConfigReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "config_reloads_total",
+			Help: "設定檔變更後重新載入的次數",
+		},
+		[]string{"result"}, // result: success 或 failed（維持原設定）
 	)
 )
 
 func init() {
-	prometheus.MustRegister(ProcessRuns, ProcessErrors, ProcessDuration)
+	prometheus.MustRegister(ProcessRuns, ProcessErrors, ProcessDuration, BatchReceipts,
+		DmlGenerateRows, DmlGenerateRowsPerSecond, UnprocessedLogs, OldestUnprocessedLogAge, LastSuccessTimestamp,
+		CircuitState, LoopPaused, RetentionEligibleRows, RetentionPurgedRows, RetentionLastRunTimestamp,
+		DdlFiltered, ConfigReloads)
 }
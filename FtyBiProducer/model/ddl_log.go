@@ -8,6 +8,8 @@ type DdlLog struct {
 	XML           string    `gorm:"column:XML"`
 	ReceivedByTPE bool      `gorm:"column:ReceivedByTPE"`
 	GenerateDate  time.Time `gorm:"column:GenerateDate"`
+	// 被 ddl_filter 排除、不送到 TPE 的原因；送出的 DDL 為 NULL
+	FilterReason *string `gorm:"column:FilterReason;size:400"`
 }
 
 // TableName 明確指定資料表名稱
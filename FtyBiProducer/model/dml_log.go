@@ -1,4 +1,4 @@
-// DdlLog 結構定義
+// DmlLog 結構定義
 package model
 
 import "time"
@@ -8,8 +8,12 @@ type DmlLog struct {
 	JSON          string    `gorm:"column:JSON"`
 	ReceivedByTPE bool      `gorm:"column:ReceivedByTPE"`
 	GenerateDate  time.Time `gorm:"column:GenerateDate"`
+	Stream        string    `gorm:"column:Stream;type:varchar(50)"` // 所屬的 DML stream，空字串或 NULL 為預設 stream
 }
 
+// DefaultDmlStream 為未設定分流的資料表所屬的 stream，沿用 RoutingKeyDML 與主 Queue
+const DefaultDmlStream = ""
+
 // TableName 明確指定資料表名稱
 func (DmlLog) TableName() string {
 	return "DmlLog"
@@ -0,0 +1,16 @@
+// Change Tracking 同步版本
+package model
+
+import "time"
+
+// DmlSyncVersion 記錄每張資料表已轉入 DmlLog 的 Change Tracking 版本
+type DmlSyncVersion struct {
+	Table       string    `gorm:"column:TableName;primaryKey;type:varchar(128)"`
+	LastVersion int64     `gorm:"column:LastVersion"`
+	UpdateTime  time.Time `gorm:"column:UpdateTime;type:datetime"`
+}
+
+// TableName 明確指定資料表名稱
+func (DmlSyncVersion) TableName() string {
+	return "DmlSyncVersion"
+}
@@ -3,11 +3,87 @@ package model
 
 import "time"
 
+// BatchStatus 是批次紀錄的狀態
+// 正常流程：Created → Published → Confirmed → Marked，發送失敗則為 Failed
+// 啟用回執時，Confirmed 之後要等 TpeBiConsumer 回報套用成功才會 Marked，被拒絕則為 Rejected
+// 舊資料（導入狀態機前建立）的 Status 為 NULL，視為已完成
+type BatchStatus string
+
+const (
+	BatchStatusCreated   BatchStatus = "Created"   // 已寫入批次紀錄，尚未發送
+	BatchStatusPublished BatchStatus = "Published" // 已送出，尚未得到 broker 確認
+	BatchStatusConfirmed BatchStatus = "Confirmed" // broker 已確認，尚未標記 Log
+	BatchStatusMarked    BatchStatus = "Marked"    // Log 範圍已標記 ReceivedByTPE，批次完成
+	BatchStatusFailed    BatchStatus = "Failed"    // 發送失敗，範圍會由下一個批次重新涵蓋
+	BatchStatusRejected  BatchStatus = "Rejected"  // TpeBiConsumer 套用失敗（訊息已進 DLQ），需人工處理
+)
+
+// BatchOrigin 標示批次的來源，供稽核區分一般輪詢與人工重送
+type BatchOrigin string
+
+const (
+	BatchOriginPoll   BatchOrigin = "Poll"   // 一般輪詢產生
+	BatchOriginReplay BatchOrigin = "Replay" // replay 指令重送
+)
+
+// BatchStatusFrom 列出進入各狀態前允許的狀態，更新時以此檢查，避免狀態倒退
+// 回執可能比 broker 確認先寫回，Marked / Rejected 也允許由 Published 直接轉入
+var BatchStatusFrom = map[BatchStatus][]BatchStatus{
+	BatchStatusPublished: {BatchStatusCreated, BatchStatusPublished},
+	BatchStatusConfirmed: {BatchStatusPublished},
+	BatchStatusMarked:    {BatchStatusPublished, BatchStatusConfirmed},
+	BatchStatusFailed:    {BatchStatusCreated, BatchStatusPublished},
+	BatchStatusRejected:  {BatchStatusPublished, BatchStatusConfirmed},
+}
+
+// BatchStatusPending 為需要在啟動時恢復的中間狀態
+var BatchStatusPending = []BatchStatus{
+	BatchStatusCreated,
+	BatchStatusPublished,
+	BatchStatusConfirmed,
+}
+
+// BatchStatusHoldRange 為仍佔用 SerialNo 範圍的狀態，撈取新批次時要跳過這些範圍
+var BatchStatusHoldRange = []BatchStatus{
+	BatchStatusCreated,
+	BatchStatusPublished,
+	BatchStatusConfirmed,
+	BatchStatusRejected,
+}
+
+// TimeColumn 回傳進入此狀態時要寫入時間的欄位，Created 沿用 ProcessTime
+func (s BatchStatus) TimeColumn() string {
+	switch s {
+	case BatchStatusPublished:
+		return "PublishedTime"
+	case BatchStatusConfirmed:
+		return "ConfirmedTime"
+	case BatchStatusMarked:
+		return "MarkedTime"
+	case BatchStatusFailed:
+		return "FailedTime"
+	case BatchStatusRejected:
+		return "RejectedTime"
+	}
+	return ""
+}
+
 type LogBatchDmlRecord struct {
-	LogBatchDmlRecordID int64     `gorm:"column:LogBatchDmlRecordID;primaryKey"`
-	SerialNoFrom        int64     `gorm:"column:SerialNoFrom"`
-	SerialNoTo          int64     `gorm:"column:SerialNoTo"`
-	ProcessTime         time.Time `gorm:"column:ProcessTime->"` // 加上 -> tag，表示「只讀欄位」，GORM 不會在 INSERT 或 UPDATE 時帶這個欄位
+	LogBatchDmlRecordID int64       `gorm:"column:LogBatchDmlRecordID;primaryKey"`
+	SerialNoFrom        int64       `gorm:"column:SerialNoFrom"`
+	SerialNoTo          int64       `gorm:"column:SerialNoTo"`
+	ProcessTime         time.Time   `gorm:"column:ProcessTime->"` // 加上 -> tag，表示「只讀欄位」，GORM 不會在 INSERT 或 UPDATE 時帶這個欄位
+	Status              BatchStatus `gorm:"column:Status;type:varchar(20)"`
+	PublishedTime       *time.Time  `gorm:"column:PublishedTime;type:datetime"`
+	ConfirmedTime       *time.Time  `gorm:"column:ConfirmedTime;type:datetime"`
+	MarkedTime          *time.Time  `gorm:"column:MarkedTime;type:datetime"`
+	FailedTime          *time.Time  `gorm:"column:FailedTime;type:datetime"`
+	RejectedTime        *time.Time  `gorm:"column:RejectedTime;type:datetime"`
+	ErrorMsg            string      `gorm:"column:ErrorMsg;type:nvarchar(1000)"`
+	Origin              BatchOrigin `gorm:"column:Origin;type:varchar(20)"`
+	Stream              string      `gorm:"column:Stream;type:varchar(50)"` // 空字串或 NULL 為預設 stream
+	Sequence            int64       `gorm:"column:Sequence"`                // 同一 stream 內遞增的批次序號，replay 批次為 0
+	PrevSerialNoTo      int64       `gorm:"column:PrevSerialNoTo"`          // 前一個批次的 SerialNoTo，0 表示沒有前一個批次
 }
 
 // TableName 明確指定資料表名稱
@@ -16,13 +92,30 @@ func (LogBatchDmlRecord) TableName() string {
 }
 
 type LogBatchDdlRecord struct {
-	LogBatchDdlRecordID int64     `gorm:"column:LogBatchDdlRecordID;primaryKey"`
-	SerialNoFrom        int64     `gorm:"column:SerialNoFrom"`
-	SerialNoTo          int64     `gorm:"column:SerialNoTo"`
-	ProcessTime         time.Time `gorm:"column:ProcessTime->"` // 加上 -> tag，表示「只讀欄位」，GORM 不會在 INSERT 或 UPDATE 時帶這個欄位
+	LogBatchDdlRecordID int64       `gorm:"column:LogBatchDdlRecordID;primaryKey"`
+	SerialNoFrom        int64       `gorm:"column:SerialNoFrom"`
+	SerialNoTo          int64       `gorm:"column:SerialNoTo"`
+	ProcessTime         time.Time   `gorm:"column:ProcessTime->"` // 加上 -> tag，表示「只讀欄位」，GORM 不會在 INSERT 或 UPDATE 時帶這個欄位
+	Status              BatchStatus `gorm:"column:Status;type:varchar(20)"`
+	PublishedTime       *time.Time  `gorm:"column:PublishedTime;type:datetime"`
+	ConfirmedTime       *time.Time  `gorm:"column:ConfirmedTime;type:datetime"`
+	MarkedTime          *time.Time  `gorm:"column:MarkedTime;type:datetime"`
+	FailedTime          *time.Time  `gorm:"column:FailedTime;type:datetime"`
+	RejectedTime        *time.Time  `gorm:"column:RejectedTime;type:datetime"`
+	ErrorMsg            string      `gorm:"column:ErrorMsg;type:nvarchar(1000)"`
+	Origin              BatchOrigin `gorm:"column:Origin;type:varchar(20)"`
+	Sequence            int64       `gorm:"column:Sequence"`       // DDL 批次遞增的序號，replay 批次為 0
+	PrevSerialNoTo      int64       `gorm:"column:PrevSerialNoTo"` // 前一個批次的 SerialNoTo，0 表示沒有前一個批次
 }
 
 // TableName 明確指定資料表名稱
 func (LogBatchDdlRecord) TableName() string {
 	return "LogBatchDdlRecord"
 }
+
+// BatchProgress 為一個處理迴圈最近完成的批次與發送中的批次，供管理 API 查詢
+type BatchProgress struct {
+	LastBatchID   int64      `json:"last_batch_id,omitempty"`
+	InFlight      []int64    `json:"in_flight,omitempty"`
+	InFlightSince *time.Time `json:"in_flight_since,omitempty"`
+}
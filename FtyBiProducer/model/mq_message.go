@@ -1,12 +1,119 @@
 package model
 
+import "time"
+
 // 用於封裝message
 type DdlMessage struct {
 	BatchID int64    `json:"BatchID"`
 	XMLList []string `json:"XMLList"`
+	// 與 XMLList 一一對應的 EVENTDATA 摘要（不含 DDL 語法），Consumer 可直接依此分流；執行的語法仍以 XML 的 TSQLCommand 為準
+	Events []DdlEvent `json:"Events,omitempty"`
+}
+
+// DdlEvent 為 DDL trigger EVENTDATA() 的摘要
+type DdlEvent struct {
+	SerialNo   int64  `json:"SerialNo"`
+	EventType  string `json:"EventType,omitempty"` // 例如 ALTER_TABLE
+	SchemaName string `json:"SchemaName,omitempty"`
+	ObjectName string `json:"ObjectName,omitempty"`
+	ObjectType string `json:"ObjectType,omitempty"` // 例如 TABLE
+	LoginName  string `json:"LoginName,omitempty"`
 }
 
 type DmlMessage struct {
 	BatchID  int64    `json:"BatchID"`
 	JSONList []string `json:"JSONList"`
+	// 完整同步（snapshot 子命令）的訊息才有，一般批次為 nil
+	Snapshot *SnapshotInfo `json:"Snapshot,omitempty"`
+}
+
+// 完整同步訊息的階段
+const (
+	SnapshotPhaseStart = "Start"
+	SnapshotPhaseChunk = "Chunk"
+	SnapshotPhaseEnd   = "End"
+)
+
+// 完整同步套用到正式資料表的方式
+const (
+	SnapshotModeReconcile = "reconcile" // 刪除 staging 中沒有的資料列，再以主鍵 MERGE
+	SnapshotModeSwap      = "swap"      // 以 sp_rename 把 staging 換成正式資料表
+)
+
+// SnapshotInfo 標示完整同步的訊息：Start 與 End 之間的 Chunk 組成資料表在同一時間點的完整資料，
+// JSONList 只有 Chunk 才有，皆為 Insert
+type SnapshotInfo struct {
+	SnapshotID string    `json:"SnapshotID"`
+	TableName  string    `json:"TableName"`
+	Phase      string    `json:"Phase"`
+	Mode       string    `json:"Mode"`
+	Chunk      int       `json:"Chunk,omitempty"`  // Chunk 的序號，從 1 開始
+	Chunks     int       `json:"Chunks,omitempty"` // End 才有：Chunk 的總數
+	Rows       int64     `json:"Rows,omitempty"`   // Chunk 為該段筆數，End 為總筆數
+	TakenAt    time.Time `json:"TakenAt"`          // snapshot transaction 開始的時間
+	// snapshot transaction 內 DmlLog 最大的 SerialNo：TpeBiConsumer 在套用前暫存該資料表的 DML 異動，
+	// 套用後略過 SerialNoTo 不超過此值的批次中該資料表的異動（已包含在完整資料中）
+	Watermark int64 `json:"Watermark,omitempty"`
+}
+
+// EnvelopeSchemaVersion 為目前的信封與訊息格式版本，格式不相容時遞增；
+// TpeBiConsumer 拒絕高於自己支援版本的訊息
+const EnvelopeSchemaVersion = 1
+
+// 訊息的種類（AMQP Type），與回執的 Kind 相同
+const (
+	MessageTypeDDL = "ddl"
+	MessageTypeDML = "dml"
+)
+
+// 訊息 Body 的 ContentEncoding
+const (
+	ContentEncodingIdentity = "identity" // 未壓縮
+	ContentEncodingGzip     = "gzip"
+	ContentEncodingZstd     = "zstd"
+)
+
+// Envelope 是訊息的信封，放在 AMQP properties 與 headers，
+// Consumer 不必解開 Body 就能辨識來源工廠、資料庫與批次範圍（不同工廠的 BatchID 會重複）
+type Envelope struct {
+	MessageID       string    // AMQP MessageId，由 Publisher 發送時產生
+	FactoryID       string    // AMQP AppId 與 x-factory-id
+	SourceServer    string    // 來源 SQL Server（host\instance）
+	SourceDatabase  string    // 來源資料庫
+	MessageType     string    // AMQP Type：ddl 或 dml
+	SchemaVersion   int       // x-schema-version
+	BatchID         int64     // 同一工廠內唯一
+	Stream          string    // DML stream，預設 stream 為空字串
+	SerialNoFrom    int64     // 批次涵蓋的 SerialNo 起點
+	SerialNoTo      int64     // 批次涵蓋的 SerialNo 終點
+	CreatedAt       time.Time // AMQP Timestamp
+	ContentEncoding string    // AMQP ContentEncoding
+	ItemCount       int       // x-item-count：XMLList / JSONList 的筆數，供 Consumer 檢查訊息完整
+	UncompressedLen int       // x-uncompressed-length：壓縮前 Body 的位元組數
+	Sequence        int64     // x-sequence：同一工廠、同一 stream 內遞增的批次序號，0 表示不需排序（replay）
+	PrevSerialNoTo  int64     // x-prev-serial-no-to：前一個批次的 SerialNoTo，Consumer 據此偵測缺漏與亂序
+	SnapshotID      string    // x-snapshot-id：完整同步的識別碼，一般批次為空字串
+}
+
+// 回執的批次種類與結果
+const (
+	ReceiptKindDDL = "ddl"
+	ReceiptKindDML = "dml"
+
+	ReceiptOutcomeApplied  = "Applied"
+	ReceiptOutcomeRejected = "Rejected"
+)
+
+// ApplyReceipt 是 TpeBiConsumer 套用批次後回傳的回執
+type ApplyReceipt struct {
+	BatchID      int64     `json:"BatchID"`
+	Kind         string    `json:"Kind"`
+	FactoryID    string    `json:"FactoryID"`
+	Outcome      string    `json:"Outcome"`
+	RowsDeleted  int64     `json:"RowsDeleted"`
+	RowsUpserted int64     `json:"RowsUpserted"`
+	DdlExecuted  int       `json:"DdlExecuted"`
+	DdlSkipped   int       `json:"DdlSkipped"`
+	Error        string    `json:"Error,omitempty"`
+	AppliedAt    time.Time `json:"AppliedAt"`
 }
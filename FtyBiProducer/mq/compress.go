@@ -0,0 +1,37 @@
+// 訊息 Body 壓縮，壓縮方式放在 AMQP ContentEncoding 供 Consumer 解壓
+package mq
+
+import (
+	config "FtyBiProducer/config"
+	"FtyBiProducer/model"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstd encoder 可重複使用，EncodeAll 可同時由多個 goroutine 呼叫
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+
+// Compress 依 mq.compression 壓縮 body，回傳壓縮後的內容與 ContentEncoding；
+// none 或未設定時原樣回傳，ContentEncoding 為 identity
+func Compress(compression string, body []byte) ([]byte, string, error) {
+	switch compression {
+	case "", config.CompressionNone:
+		return body, model.ContentEncodingIdentity, nil
+	case config.CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, "", fmt.Errorf("gzip 壓縮失敗：%w", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, "", fmt.Errorf("gzip 壓縮失敗：%w", err)
+		}
+		return buf.Bytes(), model.ContentEncodingGzip, nil
+	case config.CompressionZstd:
+		return zstdEncoder.EncodeAll(body, make([]byte, 0, len(body)/4)), model.ContentEncodingZstd, nil
+	}
+	return nil, "", fmt.Errorf("不支援的壓縮方式 %q", compression)
+}
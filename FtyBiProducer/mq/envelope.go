@@ -0,0 +1,68 @@
+// 訊息信封：把 model.Envelope 放進 AMQP properties 與 headers
+package mq
+
+import (
+	"FtyBiProducer/model"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// 信封的 header 名稱；MessageId、AppId、Type、Timestamp、ContentEncoding 使用 AMQP 內建 properties
+const (
+	HeaderSchemaVersion  = "x-schema-version"
+	HeaderFactoryID      = "x-factory-id"
+	HeaderSourceServer   = "x-source-server"
+	HeaderSourceDatabase = "x-source-database"
+	HeaderBatchID        = "x-batch-id"
+	HeaderStream         = "x-stream"
+	HeaderSerialNoFrom   = "x-serial-no-from"
+	HeaderSerialNoTo     = "x-serial-no-to"
+	HeaderItemCount      = "x-item-count"
+	HeaderUncompressed   = "x-uncompressed-length"
+	HeaderSequence       = "x-sequence"
+	HeaderPrevSerialNoTo = "x-prev-serial-no-to"
+	HeaderSnapshotID     = "x-snapshot-id"
+)
+
+// envelopeHeaders 回傳信封中沒有對應 AMQP property 的欄位
+func envelopeHeaders(env model.Envelope) amqp.Table {
+	headers := amqp.Table{
+		HeaderSchemaVersion:  int32(env.SchemaVersion),
+		HeaderFactoryID:      env.FactoryID,
+		HeaderSourceServer:   env.SourceServer,
+		HeaderSourceDatabase: env.SourceDatabase,
+		HeaderBatchID:        env.BatchID,
+		HeaderStream:         env.Stream,
+		HeaderSerialNoFrom:   env.SerialNoFrom,
+		HeaderSerialNoTo:     env.SerialNoTo,
+		HeaderItemCount:      int64(env.ItemCount),
+		HeaderUncompressed:   int64(env.UncompressedLen),
+		HeaderSequence:       env.Sequence,
+		HeaderPrevSerialNoTo: env.PrevSerialNoTo,
+	}
+	// 只有完整同步的訊息帶 x-snapshot-id，一般批次的 header 與簽章維持不變
+	if env.SnapshotID != "" {
+		headers[HeaderSnapshotID] = env.SnapshotID
+	}
+	return headers
+}
+
+// publishing 依信封建立 AMQP 訊息
+func publishing(env model.Envelope, replyTo string, body []byte) amqp.Publishing {
+	encoding := env.ContentEncoding
+	if encoding == "" {
+		encoding = model.ContentEncodingIdentity
+	}
+	return amqp.Publishing{
+		Headers:         envelopeHeaders(env),
+		DeliveryMode:    amqp.Persistent,
+		ContentType:     "application/json",
+		ContentEncoding: encoding,
+		MessageId:       env.MessageID, // 用來對應被退回的訊息
+		AppId:           env.FactoryID, // 舊版 Consumer 以 AppId 辨識來源工廠
+		Type:            env.MessageType,
+		Timestamp:       env.CreatedAt,
+		ReplyTo:         replyTo, // Consumer 套用後把回執送到這裡，空字串表示不需回執
+		Body:            body,
+	}
+}
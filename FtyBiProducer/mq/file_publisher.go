@@ -0,0 +1,86 @@
+// 檔案版 Publisher，把訊息以 NDJSON 逐行寫入磁碟（capture 模式）
+package mq
+
+import (
+	"FtyBiProducer/model"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// CapturedMessage 是 NDJSON 檔案中的一行
+// body 為合法 JSON 時原樣寫入 Body，否則以 base64 寫入 BodyBase64
+type CapturedMessage struct {
+	Time       time.Time       `json:"time"`
+	RoutingKey RoutingKey      `json:"routing_key"`
+	Envelope   *model.Envelope `json:"envelope,omitempty"` // 以 Publish 寫入（沒有信封）時為 nil
+	Body       json.RawMessage `json:"body,omitempty"`
+	BodyBase64 string          `json:"body_base64,omitempty"`
+}
+
+type FilePublisher struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFilePublisher 以附加模式開啟（或建立）path
+func NewFilePublisher(path string) (*FilePublisher, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file publisher 未設定 capture_file")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("開啟 capture 檔案失敗: %w", err)
+	}
+	return &FilePublisher{file: f}, nil
+}
+
+// Publish 寫入一行並 fsync，fsync 成功即視為確認
+func (p *FilePublisher) Publish(ctx context.Context, routingKey RoutingKey, body []byte) error {
+	return p.write(ctx, CapturedMessage{Time: time.Now(), RoutingKey: routingKey}, body)
+}
+
+// PublishMessage 與 Publish 相同，另外寫入信封
+func (p *FilePublisher) PublishMessage(ctx context.Context, m Message) error {
+	env := m.Envelope
+	return p.write(ctx, CapturedMessage{Time: time.Now(), RoutingKey: m.RoutingKey, Envelope: &env}, m.Body)
+}
+
+func (p *FilePublisher) write(ctx context.Context, line CapturedMessage, body []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if sonic.Valid(body) {
+		line.Body = body
+	} else {
+		line.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+	}
+	b, err := sonic.Marshal(line)
+	if err != nil {
+		return fmt.Errorf("轉換 capture JSON 失敗: %w", err)
+	}
+	b = append(b, '\n')
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.file.Write(b); err != nil {
+		return fmt.Errorf("寫入 capture 檔案失敗: %w", err)
+	}
+	if err := p.file.Sync(); err != nil {
+		return fmt.Errorf("%w: fsync 失敗: %v", ErrNack, err)
+	}
+	return nil
+}
+
+func (p *FilePublisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.file.Close()
+}
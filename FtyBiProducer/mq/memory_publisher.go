@@ -0,0 +1,111 @@
+// 記憶體版 Publisher，供單元測試與本機除錯使用
+package mq
+
+import (
+	"FtyBiProducer/model"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FailMode 指定 MemoryPublisher 接下來要模擬的失敗種類
+type FailMode int
+
+const (
+	FailNone FailMode = iota
+	FailNack
+	FailTimeout
+)
+
+// PublishedMessage 是一筆被確認的訊息
+type PublishedMessage struct {
+	RoutingKey RoutingKey
+	Body       []byte
+	Envelope   model.Envelope
+	Time       time.Time
+}
+
+// MemoryPublisher 把訊息存在記憶體，並可指定接下來 n 次發送回傳 Nack 或逾時
+type MemoryPublisher struct {
+	mu        sync.Mutex
+	messages  []PublishedMessage
+	failMode  FailMode
+	failCount int
+	closed    bool
+}
+
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{}
+}
+
+// FailNext 讓接下來 n 次 Publish 以 mode 失敗，失敗的訊息不會被記錄
+func (p *MemoryPublisher) FailNext(mode FailMode, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failMode = mode
+	p.failCount = n
+}
+
+func (p *MemoryPublisher) Publish(ctx context.Context, routingKey RoutingKey, body []byte) error {
+	return p.PublishMessage(ctx, Message{RoutingKey: routingKey, Body: body})
+}
+
+// PublishMessage 與 Publish 相同，另外記錄信封
+func (p *MemoryPublisher) PublishMessage(ctx context.Context, m Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return fmt.Errorf("publisher 已關閉")
+	}
+
+	if p.failCount > 0 {
+		p.failCount--
+		switch p.failMode {
+		case FailNack:
+			return fmt.Errorf("%w (memory)", ErrNack)
+		case FailTimeout:
+			return ErrConfirmTimeout
+		}
+	}
+
+	// 複製 body，避免呼叫端重用 slice 影響紀錄
+	copied := make([]byte, len(m.Body))
+	copy(copied, m.Body)
+	p.messages = append(p.messages, PublishedMessage{
+		RoutingKey: m.RoutingKey,
+		Body:       copied,
+		Envelope:   m.Envelope,
+		Time:       time.Now(),
+	})
+	return nil
+}
+
+// Messages 回傳目前已確認訊息的複本
+func (p *MemoryPublisher) Messages() []PublishedMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]PublishedMessage, len(p.messages))
+	copy(out, p.messages)
+	return out
+}
+
+// Reset 清除已記錄的訊息與失敗設定
+func (p *MemoryPublisher) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.messages = nil
+	p.failMode = FailNone
+	p.failCount = 0
+}
+
+func (p *MemoryPublisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+}
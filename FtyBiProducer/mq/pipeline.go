@@ -0,0 +1,134 @@
+// 管線化發送：同一個 Channel 上可有多筆訊息同時等待確認，確認依 delivery tag 對應回各自的訊息
+package mq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DefaultMaxInFlight 為未設定 mq.max_in_flight 時，同時等待確認的訊息上限
+const DefaultMaxInFlight = 32
+
+// staleReturnAge 為被退回、但等待的呼叫端已放棄（逾時、ctx 取消）的紀錄保留時間
+const staleReturnAge = 10 * time.Minute
+
+// confirmation 為 broker 對單筆訊息的確認，實際為 *amqp.DeferredConfirmation；
+// Channel 關閉時 Done 也會關閉，Acked 為 false
+type confirmation interface {
+	Done() <-chan struct{}
+	Acked() bool
+}
+
+// pendingPublish 為已送出、等待確認的訊息
+type pendingPublish struct {
+	messageID string
+	tag       uint64
+	confirm   confirmation
+	returns   *returnTracker // mandatory 未開啟時為 nil
+	closed    func() bool    // Channel 是否已關閉，用來區分 Nack 與斷線
+	deadline  time.Time
+}
+
+// wait 等待這筆訊息的確認：Nack 回傳 ErrNack、Channel 關閉回傳 ErrNotConnected、
+// 逾時回傳 ErrConfirmTimeout，Ack 但被退回時回傳 ErrReturned
+func (p *pendingPublish) wait(ctx context.Context) error {
+	timer := time.NewTimer(time.Until(p.deadline))
+	defer timer.Stop()
+	select {
+	case <-p.confirm.Done():
+	case <-timer.C:
+		return fmt.Errorf("%w, Tag=%d", ErrConfirmTimeout, p.tag)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if !p.confirm.Acked() {
+		if p.closed() {
+			return fmt.Errorf("%w：等待確認時 Channel 關閉, Tag=%d", ErrNotConnected, p.tag)
+		}
+		return fmt.Errorf("%w, Tag=%d", ErrNack, p.tag)
+	}
+	// broker 會先送 basic.return 再送 basic.ack，收到 Ack 時退回的訊息已在 returns 中
+	if ret, ok := p.returns.take(p.messageID); ok {
+		return fmt.Errorf("%w：%d %s, Exchange=%s, RoutingKey=%s, Tag=%d",
+			ErrReturned, ret.ReplyCode, ret.ReplyText, ret.Exchange, ret.RoutingKey, p.tag)
+	}
+	return nil
+}
+
+// returnTracker 收集 mandatory 訊息被 broker 退回的通知，依 MessageId 對應
+type returnTracker struct {
+	returns <-chan amqp.Return
+	now     func() time.Time
+
+	mu       sync.Mutex
+	returned map[string]returnedMessage
+}
+
+type returnedMessage struct {
+	ret amqp.Return
+	at  time.Time
+}
+
+// newReturnTracker 在 Channel 上註冊退回通知；size 需不小於同時等待確認的訊息數，
+// 否則通知堆滿時會卡住連線的讀取
+func newReturnTracker(ch *amqp.Channel, size int) *returnTracker {
+	return newReturnTrackerFrom(ch.NotifyReturn(make(chan amqp.Return, size)))
+}
+
+func newReturnTrackerFrom(returns <-chan amqp.Return) *returnTracker {
+	return &returnTracker{returns: returns, now: time.Now, returned: make(map[string]returnedMessage)}
+}
+
+// take 取出 messageID 的退回紀錄
+func (t *returnTracker) take(messageID string) (amqp.Return, bool) {
+	if t == nil {
+		return amqp.Return{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.drainLocked()
+	r, ok := t.returned[messageID]
+	if ok {
+		delete(t.returned, messageID)
+	}
+	return r.ret, ok
+}
+
+// drain 把已收到的退回通知移進紀錄，每次發送前呼叫，避免通知堆滿
+func (t *returnTracker) drain() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.drainLocked()
+}
+
+func (t *returnTracker) drainLocked() {
+	now := t.now()
+	for {
+		select {
+		case ret, ok := <-t.returns:
+			if !ok {
+				// Channel 已關閉，之後不會再有通知
+				t.returns = nil
+				return
+			}
+			t.returned[ret.MessageId] = returnedMessage{ret: ret, at: now}
+			continue
+		default:
+		}
+		break
+	}
+	// 清除呼叫端已放棄等待的紀錄
+	for id, r := range t.returned {
+		if now.Sub(r.at) > staleReturnAge {
+			delete(t.returned, id)
+		}
+	}
+}
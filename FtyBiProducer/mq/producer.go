@@ -8,19 +8,45 @@ import (
 	"crypto/x509"
 	"fmt"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// MQClient 為 RabbitMQ 版的 Publisher，訊息以管線化方式發送：
+// 不必等前一筆確認即可送出下一筆，最多 max_in_flight 筆同時等待確認
 type MQClient struct {
-	cfg      config.MQConfig
-	conn     *amqp.Connection
-	ch       *amqp.Channel
-	queue    *amqp.Queue
-	confirms <-chan amqp.Confirmation
-	mu       sync.Mutex
+	cfg     config.MQConfig
+	conn    *amqp.Connection
+	ch      *amqp.Channel
+	queue   *amqp.Queue
+	returns *returnTracker // mandatory 時收集被退回的訊息
+	sealer  *sealer        // 未設定 signing_secret 時為 nil
+	mu      sync.Mutex
+
+	slots    chan struct{} // 等待確認的訊息數上限
+	idPrefix string        // MessageId 前綴，每次啟動不同
+	seq      atomic.Uint64
+}
+
+// maxInFlight 回傳同時等待確認的訊息上限
+func maxInFlight(cfg config.MQConfig) int {
+	if cfg.MaxInFlight > 0 {
+		return cfg.MaxInFlight
+	}
+	return DefaultMaxInFlight
+}
+
+// trackReturns 在 mandatory 時為 Channel 建立退回通知的收集器
+func trackReturns(ch *amqp.Channel, cfg config.MQConfig) *returnTracker {
+	if !cfg.Mandatory {
+		return nil
+	}
+	// 退回通知最多與等待確認的訊息一樣多，留一倍餘裕
+	return newReturnTracker(ch, 2*maxInFlight(cfg))
 }
 
 // ensureChannel creates or reuses the producer's channel safely
@@ -41,7 +67,7 @@ func (c *MQClient) ensureChannel() error {
 		return err
 	}
 	c.ch = ch
-	c.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	c.returns = trackReturns(ch, c.cfg)
 	return nil
 }
 
@@ -67,13 +93,19 @@ func (c *MQClient) Reconnect() error {
 	c.conn = newClient.conn
 	c.ch = newClient.ch
 	c.queue = newClient.queue
-	c.confirms = newClient.confirms
+	c.returns = newClient.returns
 	return nil
 }
 
 // 建立 RabbitMQ TLS、連線、Channel、宣告 Exchange...
 func NewMQClient(cfg config.MQConfig) (*MQClient, error) {
 
+	// 簽章金鑰設定錯誤時在連線前就失敗
+	sealer, err := newSealer(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("簽章設定錯誤: %w", err)
+	}
+
 	// 載入客戶端憑證與私鑰
 	clientCert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
 	if err != nil {
@@ -114,8 +146,8 @@ func NewMQClient(cfg config.MQConfig) (*MQClient, error) {
 		return nil, fmt.Errorf("開啟 Confirm 模式失敗：%w", err)
 	}
 
-	// 建立一個有緩衝的確認 channel
-	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	// mandatory 時收集被退回的訊息；確認改由每筆訊息的 DeferredConfirmation 依 delivery tag 對應
+	returns := trackReturns(ch, cfg)
 
 	// ================================
 	// 4. 宣告 Dead Letter Exchange / Queue
@@ -205,50 +237,155 @@ func NewMQClient(cfg config.MQConfig) (*MQClient, error) {
 		}
 	}
 
-	// 8. 回傳 MQClient 實例
-	return &MQClient{conn: conn, ch: ch, cfg: cfg, queue: &q, confirms: confirms}, nil
+	// 7.1 每個 DML stream 一個 Queue（同樣帶 DLX 參數），只綁定自己的 RoutingKey
+	for _, stream := range cfg.DmlStreams {
+		if err := declareStreamQueue(ch, cfg, stream, DLXArgs); err != nil {
+			return nil, err
+		}
+	}
+
+	// 8. 啟用回執時，宣告回執 Exchange / Queue，以 Queue 名稱作為 RoutingKey
+	if cfg.ReceiptQueue != "" {
+		if err := declareReceiptQueue(ch, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	// 9. 回傳 MQClient 實例
+	return &MQClient{
+		conn:     conn,
+		ch:       ch,
+		cfg:      cfg,
+		queue:    &q,
+		returns:  returns,
+		sealer:   sealer,
+		slots:    make(chan struct{}, maxInFlight(cfg)),
+		idPrefix: cfg.FactoryID + "-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+	}, nil
+}
+
+// declareStreamQueue 宣告 DML stream 的 Queue 並綁定 stream 的 RoutingKey
+func declareStreamQueue(ch *amqp.Channel, cfg config.MQConfig, stream config.DmlStream, args amqp.Table) error {
+	q, err := ch.QueueDeclare(
+		stream.QueueName(cfg.PrimaryQueue), // queue 名稱
+		true,                               // durable
+		false,                              // auto-delete
+		false,                              // exclusive
+		false,                              // no-wait
+		args,                               // 帶入 DLX 參數
+	)
+	if err != nil {
+		return fmt.Errorf("宣告 Stream Queue(%s) 失敗: %w", stream.Name, err)
+	}
+	routingKey := DmlRoutingKey(stream.Name)
+	if err := ch.QueueBind(q.Name, string(routingKey), cfg.PrimaryExchange, false, nil); err != nil {
+		return fmt.Errorf("queue RoutingKey Bind(%s) 失敗：%v", string(routingKey), err)
+	}
+	return nil
 }
 
-// 發送訊息
+// Publish 發送一筆訊息並等待 broker 確認
 func (c *MQClient) Publish(ctx context.Context, routingKey RoutingKey, body []byte) error {
+	return c.PublishBatch(ctx, []Message{{RoutingKey: routingKey, Body: body}})[0]
+}
 
-	if err := c.ensureChannel(); err != nil {
-		if err := c.Reconnect(); err != nil {
-			return err
+// PublishBatch 依序送出 msgs 後再逐筆等待確認，等待確認的訊息達 max_in_flight 時才暫停送出；
+// 任一筆送出失敗後，之後的訊息不再送出（ErrNotSent），以維持順序
+func (c *MQClient) PublishBatch(ctx context.Context, msgs []Message) []error {
+	errs := make([]error, len(msgs))
+	pending := make([]*pendingPublish, len(msgs))
+	for i, m := range msgs {
+		if i > 0 && errs[i-1] != nil {
+			errs[i] = ErrNotSent
+			continue
 		}
-		if err := c.ensureChannel(); err != nil {
-			return err
+		pending[i], errs[i] = c.send(ctx, m)
+	}
+	for i, p := range pending {
+		if p != nil {
+			errs[i] = p.wait(ctx)
 		}
 	}
+	return errs
+}
+
+// send 取得空位後送出一筆訊息，不等待確認；空位在確認（或 Channel 關閉）時釋放
+func (c *MQClient) send(ctx context.Context, m Message) (*pendingPublish, error) {
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release := func() { <-c.slots }
 
-	// 發送
-	if err := c.ch.PublishWithContext(
+	ch, returns, err := c.channel()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	returns.drain()
+
+	env := m.Envelope
+	env.MessageID = c.idPrefix + "-" + strconv.FormatUint(c.seq.Add(1), 10)
+	if env.FactoryID == "" {
+		env.FactoryID = c.cfg.FactoryID
+	}
+	msg := publishing(env, c.cfg.ReceiptQueue, m.Body)
+	if err := c.sealer.seal(&msg, time.Now()); err != nil {
+		release()
+		return nil, err
+	}
+	dc, err := ch.PublishWithDeferredConfirmWithContext(
 		ctx,
 		c.cfg.PrimaryExchange, // 改成自訂的 Exchange
-		string(routingKey),    // routingKey = queue 名稱
-		false,                 // mandatory
+		string(m.RoutingKey),  // routingKey = queue 名稱
+		c.cfg.Mandatory,       // mandatory：沒有 Queue 可接收時由 broker 退回
 		false,                 // immediate
-		amqp.Publishing{
-			DeliveryMode: amqp.Persistent,
-			ContentType:  "text/plain",
-			Body:         body,
-		}); err != nil {
-		return err
+		msg)
+	if err != nil {
+		release()
+		return nil, err
 	}
+	go func() {
+		<-dc.Done()
+		release()
+	}()
+	return &pendingPublish{
+		messageID: env.MessageID,
+		tag:       dc.DeliveryTag,
+		confirm:   dc,
+		returns:   returns,
+		closed:    ch.IsClosed,
+		deadline:  time.Now().Add(c.cfg.ConfirmTimeout),
+	}, nil
+}
 
-	// 等待 broker 回傳確認
-	select {
-	case confirm := <-c.confirms:
-		if confirm.Ack {
-			// 成功被 Queue 接收
-			return nil
+// channel 回傳可發送的 Channel 與其退回收集器，Channel 或連線關閉時先重建
+func (c *MQClient) channel() (*amqp.Channel, *returnTracker, error) {
+	if err := c.ensureChannel(); err != nil {
+		if err := c.Reconnect(); err != nil {
+			return nil, nil, err
 		}
-		return fmt.Errorf("訊息被 broker Nack, Tag=%d", confirm.DeliveryTag)
-	case <-time.After(c.cfg.ConfirmTimeout):
-		return fmt.Errorf("publisher Confirm 超時")
-	case <-ctx.Done():
-		return ctx.Err()
+		if err := c.ensureChannel(); err != nil {
+			return nil, nil, err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ch, c.returns, nil
+}
+
+// Healthy 檢查連線與 Channel 是否仍開啟
+func (c *MQClient) Healthy() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil || c.conn.IsClosed() {
+		return fmt.Errorf("%w：connection", ErrNotConnected)
+	}
+	if c.ch == nil || c.ch.IsClosed() {
+		return fmt.Errorf("%w：channel", ErrNotConnected)
 	}
+	return nil
 }
 
 func (c *MQClient) Close() {
@@ -0,0 +1,93 @@
+// Publisher 抽象與共用錯誤
+package mq
+
+import (
+	config "FtyBiProducer/config"
+	"FtyBiProducer/model"
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Publisher 是 Processor 發送訊息所依賴的介面
+// Publish 必須在訊息被確認（broker Ack、寫入磁碟…）後才回傳 nil，
+// 回傳錯誤代表此訊息未被確認，呼叫端不可標記該批次
+type Publisher interface {
+	Publish(ctx context.Context, routingKey RoutingKey, body []byte) error
+	Close()
+}
+
+// Message 為一筆要發送的訊息
+type Message struct {
+	RoutingKey RoutingKey
+	Body       []byte
+	Envelope   model.Envelope // MessageID 由 Publisher 產生，FactoryID 未填時使用 mq.factory_id
+}
+
+// MessagePublisher 是能保存信封的 Publisher，Publish 只帶 RoutingKey 與 Body
+type MessagePublisher interface {
+	PublishMessage(ctx context.Context, m Message) error
+}
+
+// BatchPublisher 是可以一次送出多筆訊息、不必逐筆等待確認的 Publisher；
+// 回傳與 msgs 等長的結果，nil 表示該筆已被確認，順序與 msgs 相同
+type BatchPublisher interface {
+	PublishBatch(ctx context.Context, msgs []Message) []error
+}
+
+// PublishBatch 以 p 發送多筆訊息：p 實作 BatchPublisher 時交給它管線化發送，
+// 否則逐筆 PublishMessage（或 Publish）；任一筆送出失敗後，之後的訊息不再送出（回傳 ErrNotSent），以維持順序
+func PublishBatch(ctx context.Context, p Publisher, msgs []Message) []error {
+	if bp, ok := p.(BatchPublisher); ok {
+		return bp.PublishBatch(ctx, msgs)
+	}
+	errs := make([]error, len(msgs))
+	for i, m := range msgs {
+		if i > 0 && errs[i-1] != nil {
+			errs[i] = ErrNotSent
+			continue
+		}
+		if mp, ok := p.(MessagePublisher); ok {
+			errs[i] = mp.PublishMessage(ctx, m)
+		} else {
+			errs[i] = p.Publish(ctx, m.RoutingKey, m.Body)
+		}
+	}
+	return errs
+}
+
+// HealthChecker 是能回報連線狀態的 Publisher，供 /readyz 檢查；
+// 不需要連線的實作（file、memory）不必實作，視為正常
+type HealthChecker interface {
+	Healthy() error
+}
+
+// 發送失敗的共用錯誤，各實作以 %w 包裝，呼叫端可用 errors.Is 判斷
+var (
+	ErrNack           = errors.New("訊息被 broker Nack")
+	ErrConfirmTimeout = errors.New("publisher Confirm 超時")
+	ErrNotConnected   = errors.New("MQ 連線或 Channel 已關閉")
+	ErrReturned       = errors.New("訊息無法路由，被 broker 退回")
+	ErrNotSent        = errors.New("前一筆訊息發送失敗，此訊息未送出")
+)
+
+// 可用的 Publisher 種類，對應設定檔 mq.publisher
+const (
+	PublisherRabbitMQ = "rabbitmq"
+	PublisherFile     = "file"
+	PublisherMemory   = "memory"
+)
+
+// NewPublisher 依設定建立對應的 Publisher，未設定時預設為 RabbitMQ
+func NewPublisher(cfg config.MQConfig) (Publisher, error) {
+	switch cfg.Publisher {
+	case "", PublisherRabbitMQ:
+		return NewMQClient(cfg)
+	case PublisherFile:
+		return NewFilePublisher(cfg.CaptureFile)
+	case PublisherMemory:
+		return NewMemoryPublisher(), nil
+	default:
+		return nil, fmt.Errorf("不支援的 publisher 種類: %s", cfg.Publisher)
+	}
+}
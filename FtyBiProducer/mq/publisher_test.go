@@ -0,0 +1,348 @@
+package mq
+
+import (
+	config "FtyBiProducer/config"
+	"FtyBiProducer/model"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/klauspost/compress/zstd"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// TestMemoryPublisher_FailNext 驗證 Nack / 逾時模擬後恢復正常發送
+func TestMemoryPublisher_FailNext(t *testing.T) {
+	p := NewMemoryPublisher()
+	ctx := context.Background()
+
+	p.FailNext(FailNack, 1)
+	if err := p.Publish(ctx, RoutingKeyDDL, []byte(`{}`)); !errors.Is(err, ErrNack) {
+		t.Fatalf("預期 ErrNack，實際: %v", err)
+	}
+	p.FailNext(FailTimeout, 1)
+	if err := p.Publish(ctx, RoutingKeyDDL, []byte(`{}`)); !errors.Is(err, ErrConfirmTimeout) {
+		t.Fatalf("預期 ErrConfirmTimeout，實際: %v", err)
+	}
+	if err := p.Publish(ctx, RoutingKeyDML, []byte(`{"BatchID":1}`)); err != nil {
+		t.Fatalf("預期不會錯誤，實際: %v", err)
+	}
+
+	msgs := p.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("預期 1 筆訊息，實際 %d 筆", len(msgs))
+	}
+	if msgs[0].RoutingKey != RoutingKeyDML || string(msgs[0].Body) != `{"BatchID":1}` {
+		t.Errorf("訊息內容不符: %+v", msgs[0])
+	}
+}
+
+// TestFilePublisher_WritesNDJSON 驗證每筆訊息寫成一行，非 JSON 內容改以 base64 保存
+func TestFilePublisher_WritesNDJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.ndjson")
+	p, err := NewFilePublisher(path)
+	if err != nil {
+		t.Fatalf("建立 FilePublisher 失敗: %v", err)
+	}
+	ctx := context.Background()
+	if err := p.Publish(ctx, RoutingKeyDDL, []byte(`{"BatchID":1,"XMLList":[]}`)); err != nil {
+		t.Fatalf("Publish 失敗: %v", err)
+	}
+	if err := p.Publish(ctx, RoutingKeyDML, []byte{0x1f, 0x8b}); err != nil {
+		t.Fatalf("Publish 失敗: %v", err)
+	}
+	p.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("開啟 capture 檔案失敗: %v", err)
+	}
+	defer f.Close()
+
+	var lines []CapturedMessage
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var m CapturedMessage
+		if err := sonic.Unmarshal(scanner.Bytes(), &m); err != nil {
+			t.Fatalf("解析第 %d 行失敗: %v", len(lines)+1, err)
+		}
+		lines = append(lines, m)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("預期 2 行，實際 %d 行", len(lines))
+	}
+	if lines[0].RoutingKey != RoutingKeyDDL || string(lines[0].Body) != `{"BatchID":1,"XMLList":[]}` {
+		t.Errorf("第 1 行內容不符: %+v", lines[0])
+	}
+	if lines[1].BodyBase64 != "H4s=" {
+		t.Errorf("第 2 行應以 base64 保存，實際: %+v", lines[1])
+	}
+}
+
+// TestPublishBatch_StopsAfterFailure 驗證不支援管線化的 Publisher 逐筆發送，失敗後不再送出後面的訊息
+func TestPublishBatch_StopsAfterFailure(t *testing.T) {
+	p := NewMemoryPublisher()
+	ctx := context.Background()
+	msgs := []Message{
+		{RoutingKey: RoutingKeyDML, Body: []byte(`{"BatchID":1}`)},
+		{RoutingKey: RoutingKeyDML, Body: []byte(`{"BatchID":2}`)},
+		{RoutingKey: RoutingKeyDML, Body: []byte(`{"BatchID":3}`)},
+	}
+
+	errs := PublishBatch(ctx, p, msgs)
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("第 %d 筆預期成功，實際: %v", i, err)
+		}
+	}
+
+	p.Reset()
+	p.FailNext(FailNack, 1)
+	errs = PublishBatch(ctx, p, msgs)
+	if !errors.Is(errs[0], ErrNack) || !errors.Is(errs[1], ErrNotSent) || !errors.Is(errs[2], ErrNotSent) {
+		t.Fatalf("預期 [Nack, 未送出, 未送出]，實際: %v", errs)
+	}
+	if n := len(p.Messages()); n != 0 {
+		t.Fatalf("失敗後不應再送出，實際送出 %d 筆", n)
+	}
+}
+
+// fakeConfirmation 模擬 DeferredConfirmation
+type fakeConfirmation struct {
+	done chan struct{}
+	ack  bool
+}
+
+func confirmed(ack bool) *fakeConfirmation {
+	c := &fakeConfirmation{done: make(chan struct{}), ack: ack}
+	close(c.done)
+	return c
+}
+
+func (c *fakeConfirmation) Done() <-chan struct{} { return c.done }
+func (c *fakeConfirmation) Acked() bool           { return c.ack }
+
+// TestPendingPublish_Wait 驗證確認結果依訊息各自對應：Ack、Nack、斷線、逾時與被退回
+func TestPendingPublish_Wait(t *testing.T) {
+	ctx := context.Background()
+	returns := make(chan amqp.Return, 2)
+	tracker := newReturnTrackerFrom(returns)
+	open := func() bool { return false }
+	closed := func() bool { return true }
+	deadline := time.Now().Add(time.Minute)
+
+	// 第 2 筆被退回：broker 會在 Ack 之前送出 basic.return
+	returns <- amqp.Return{MessageId: "PH1-2", ReplyCode: 312, ReplyText: "NO_ROUTE", RoutingKey: "bi_dml.x.key"}
+
+	cases := []struct {
+		name string
+		p    *pendingPublish
+		want error
+	}{
+		{"Ack", &pendingPublish{messageID: "PH1-1", tag: 1, confirm: confirmed(true), returns: tracker, closed: open, deadline: deadline}, nil},
+		{"被退回", &pendingPublish{messageID: "PH1-2", tag: 2, confirm: confirmed(true), returns: tracker, closed: open, deadline: deadline}, ErrReturned},
+		{"Nack", &pendingPublish{messageID: "PH1-3", tag: 3, confirm: confirmed(false), returns: tracker, closed: open, deadline: deadline}, ErrNack},
+		{"斷線", &pendingPublish{messageID: "PH1-4", tag: 4, confirm: confirmed(false), returns: tracker, closed: closed, deadline: deadline}, ErrNotConnected},
+		{"逾時", &pendingPublish{messageID: "PH1-5", tag: 5, confirm: &fakeConfirmation{done: make(chan struct{})}, closed: open, deadline: time.Now()}, ErrConfirmTimeout},
+	}
+	for _, c := range cases {
+		err := c.p.wait(ctx)
+		if c.want == nil && err != nil || c.want != nil && !errors.Is(err, c.want) {
+			t.Errorf("%s：預期 %v，實際 %v", c.name, c.want, err)
+		}
+	}
+	if _, ok := tracker.take("PH1-2"); ok {
+		t.Fatal("退回紀錄取出後應刪除")
+	}
+}
+
+// TestPublishing_Envelope 驗證信封放進 AMQP properties 與 headers
+func TestPublishing_Envelope(t *testing.T) {
+	created := time.Date(2025, 6, 1, 8, 0, 0, 0, time.UTC)
+	env := model.Envelope{
+		MessageID:      "PH1-abc-1",
+		FactoryID:      "PH1",
+		SourceServer:   `SYSTEM2016\PH1`,
+		SourceDatabase: "Production",
+		MessageType:    model.MessageTypeDML,
+		SchemaVersion:  model.EnvelopeSchemaVersion,
+		BatchID:        42,
+		Stream:         "cutting",
+		SerialNoFrom:   100,
+		SerialNoTo:     180,
+		CreatedAt:      created,
+	}
+	msg := publishing(env, "receipt_queue", []byte(`{}`))
+
+	if msg.MessageId != "PH1-abc-1" || msg.AppId != "PH1" || msg.Type != model.MessageTypeDML ||
+		!msg.Timestamp.Equal(created) || msg.ReplyTo != "receipt_queue" || msg.DeliveryMode != amqp.Persistent {
+		t.Errorf("properties 不符: %+v", msg)
+	}
+	if msg.ContentEncoding != model.ContentEncodingIdentity {
+		t.Errorf("未設定 ContentEncoding 時應為 identity，實際 %q", msg.ContentEncoding)
+	}
+	want := amqp.Table{
+		HeaderSchemaVersion:  int32(model.EnvelopeSchemaVersion),
+		HeaderFactoryID:      "PH1",
+		HeaderSourceServer:   `SYSTEM2016\PH1`,
+		HeaderSourceDatabase: "Production",
+		HeaderBatchID:        int64(42),
+		HeaderStream:         "cutting",
+		HeaderSerialNoFrom:   int64(100),
+		HeaderSerialNoTo:     int64(180),
+	}
+	for k, v := range want {
+		if msg.Headers[k] != v {
+			t.Errorf("header %s 預期 %#v，實際 %#v", k, v, msg.Headers[k])
+		}
+	}
+	if err := msg.Headers.Validate(); err != nil {
+		t.Errorf("headers 不是合法的 AMQP table: %v", err)
+	}
+}
+
+// TestCompress 驗證各壓縮方式的 ContentEncoding，zstd 可還原
+func TestCompress(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"Action":"Insert","Data":{"TableName":"P_CuttingBCS"}}`), 50)
+
+	if out, enc, err := Compress("", body); err != nil || enc != model.ContentEncodingIdentity || !bytes.Equal(out, body) {
+		t.Errorf("未設定時應原樣回傳 identity，實際 %q：%v", enc, err)
+	}
+	out, enc, err := Compress(config.CompressionZstd, body)
+	if err != nil || enc != model.ContentEncodingZstd || len(out) >= len(body) {
+		t.Fatalf("zstd 壓縮結果不符：%q, %d bytes：%v", enc, len(out), err)
+	}
+	dec, _ := zstd.NewReader(nil)
+	defer dec.Close()
+	if got, err := dec.DecodeAll(out, nil); err != nil || !bytes.Equal(got, body) {
+		t.Errorf("zstd 無法還原：%v", err)
+	}
+	if _, _, err := Compress("br", body); err == nil {
+		t.Error("不支援的壓縮方式應回傳錯誤")
+	}
+}
+
+// TestSealer_SignAndEncrypt 驗證簽章涵蓋 headers 與 Body，且加密後可用相同金鑰解開
+func TestSealer_SignAndEncrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	encKey := bytes.Repeat([]byte{9}, 32)
+	cfg := config.MQConfig{
+		SigningKeyID:     "ph1-2025",
+		SigningSecret:    base64.StdEncoding.EncodeToString(key),
+		EncryptionSecret: base64.StdEncoding.EncodeToString(encKey),
+	}
+	s, err := newSealer(cfg)
+	if err != nil {
+		t.Fatalf("建立 sealer 失敗: %v", err)
+	}
+
+	body := []byte(`{"BatchID":42}`)
+	env := model.Envelope{MessageID: "PH1-abc-1", FactoryID: "PH1", MessageType: model.MessageTypeDDL, SchemaVersion: 1, BatchID: 42, SerialNoFrom: 1, SerialNoTo: 2}
+	msg := publishing(env, "", body)
+	signedAt := time.Unix(1748764800, 0)
+	if err := s.seal(&msg, signedAt); err != nil {
+		t.Fatalf("seal 失敗: %v", err)
+	}
+	if msg.Headers[HeaderKeyID] != "ph1-2025" || msg.Headers[HeaderSignedAt] != signedAt.Unix() || msg.Headers[HeaderEncryption] != EncryptionAESGCM {
+		t.Errorf("簽章 headers 不符: %v", msg.Headers)
+	}
+
+	// 1. 簽章可重算，任何 header 或 Body 被改動都會不同
+	want := base64.StdEncoding.EncodeToString(sign(key, msg.MessageId, msg.AppId, msg.Type, msg.ContentEncoding, msg.Headers, msg.Body))
+	if msg.Headers[HeaderSignature] != want {
+		t.Errorf("簽章無法重算")
+	}
+	tampered := amqp.Table{}
+	for k, v := range msg.Headers {
+		tampered[k] = v
+	}
+	tampered[HeaderBatchID] = int64(43)
+	if base64.StdEncoding.EncodeToString(sign(key, msg.MessageId, msg.AppId, msg.Type, msg.ContentEncoding, tampered, msg.Body)) == want {
+		t.Errorf("竄改 BatchID 後簽章不應相同")
+	}
+
+	// 2. Body 已加密，可用金鑰解開
+	block, _ := aes.NewCipher(encKey)
+	gcm, _ := cipher.NewGCM(block)
+	n := gcm.NonceSize()
+	plain, err := gcm.Open(nil, msg.Body[:n], msg.Body[n:], nil)
+	if err != nil || !bytes.Equal(plain, body) {
+		t.Errorf("解密失敗: %v", err)
+	}
+
+	// 3. 設定錯誤
+	for name, bad := range map[string]config.MQConfig{
+		"缺少 key id": {SigningSecret: cfg.SigningSecret},
+		"金鑰太短":      {SigningKeyID: "k", SigningSecret: base64.StdEncoding.EncodeToString(key[:16])},
+		"只設定加密":     {EncryptionSecret: cfg.EncryptionSecret},
+		"加密金鑰長度錯誤":  {SigningKeyID: "k", SigningSecret: cfg.SigningSecret, EncryptionSecret: base64.StdEncoding.EncodeToString(key[:16])},
+	} {
+		if _, err := newSealer(bad); err == nil {
+			t.Errorf("%s 應回傳錯誤", name)
+		}
+	}
+	if s, err := newSealer(config.MQConfig{}); s != nil || err != nil {
+		t.Errorf("未設定金鑰時應不簽章")
+	}
+}
+
+// TestSealer_VerifyReceipt 驗證以本廠金鑰簽章的回執可通過，未簽章、竄改、其他金鑰或其他工廠的回執被拒絕
+func TestSealer_VerifyReceipt(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	s, err := newSealer(config.MQConfig{SigningKeyID: "ph1-2025", SigningSecret: base64.StdEncoding.EncodeToString(key)})
+	if err != nil {
+		t.Fatalf("建立 sealer 失敗: %v", err)
+	}
+	receipt := func(signKey []byte) amqp.Delivery {
+		d := amqp.Delivery{
+			MessageId: "receipt-PH1-dml-42",
+			Type:      ReceiptMessageType,
+			Headers: amqp.Table{
+				HeaderFactoryID: "PH1",
+				HeaderBatchID:   int64(42),
+				HeaderKeyID:     "ph1-2025",
+				HeaderSignedAt:  int64(1748764800),
+			},
+			Body: []byte(`{"BatchID":42,"Outcome":"Applied"}`),
+		}
+		d.Headers[HeaderSignature] = base64.StdEncoding.EncodeToString(sign(signKey, d.MessageId, d.AppId, d.Type, d.ContentEncoding, d.Headers, d.Body))
+		return d
+	}
+
+	if err := s.verifyReceipt(receipt(key), "PH1"); err != nil {
+		t.Errorf("合法回執應通過: %v", err)
+	}
+	cases := []struct {
+		name   string
+		modify func(d *amqp.Delivery)
+		want   error
+	}{
+		{"沒有簽章", func(d *amqp.Delivery) { delete(d.Headers, HeaderSignature) }, ErrUnsignedReceipt},
+		{"竄改 Body", func(d *amqp.Delivery) { d.Body = []byte(`{"BatchID":43,"Outcome":"Applied"}`) }, ErrBadReceiptSignature},
+		{"竄改 BatchID", func(d *amqp.Delivery) { d.Headers[HeaderBatchID] = int64(43) }, ErrBadReceiptSignature},
+		{"其他金鑰代號", func(d *amqp.Delivery) { d.Headers[HeaderKeyID] = "ph1-2024" }, ErrBadReceiptSignature},
+		{"其他工廠", func(d *amqp.Delivery) { d.Headers[HeaderFactoryID] = "ESP" }, ErrBadReceiptSignature},
+		{"錯誤金鑰", func(d *amqp.Delivery) { *d = receipt(bytes.Repeat([]byte{8}, 32)) }, ErrBadReceiptSignature},
+	}
+	for _, c := range cases {
+		d := receipt(key)
+		c.modify(&d)
+		if err := s.verifyReceipt(d, "PH1"); !errors.Is(err, c.want) {
+			t.Errorf("%s：預期 %v，實際 %v", c.name, c.want, err)
+		}
+	}
+
+	var none *sealer
+	if err := none.verifyReceipt(amqp.Delivery{}, "PH1"); err != nil {
+		t.Errorf("未設定 signing_secret 時不應驗證: %v", err)
+	}
+}
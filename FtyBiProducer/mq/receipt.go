@@ -0,0 +1,117 @@
+// 接收 TpeBiConsumer 回傳的套用回執
+package mq
+
+import (
+	config "FtyBiProducer/config"
+	"context"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ReceiptHandler 處理一筆回執，回傳錯誤時回執會重新排入佇列稍後再試；
+// verifyErr 不為 nil 表示簽章驗證失敗（ErrUnsignedReceipt、ErrBadReceiptSignature），handler 應記錄後略過
+type ReceiptHandler func(ctx context.Context, body []byte, verifyErr error) error
+
+// ReceiptSource 是能接收 Consumer 回執的 Publisher（目前只有 MQClient）
+type ReceiptSource interface {
+	ConsumeReceipts(ctx context.Context, handler ReceiptHandler) error
+}
+
+// declareReceiptQueue 宣告回執 Exchange 與本廠的回執 Queue
+func declareReceiptQueue(ch *amqp.Channel, cfg config.MQConfig) error {
+	if cfg.ReceiptExchange == "" {
+		return fmt.Errorf("已設定 receipt_queue 但未設定 receipt_exchange")
+	}
+	if err := ch.ExchangeDeclare(
+		cfg.ReceiptExchange, // 回執交換機名稱，與 Consumer 端一致
+		"direct",            // 類型
+		true,                // durable
+		false,               // auto-delete
+		false,               // internal
+		false,               // no-wait
+		nil,                 // arguments
+	); err != nil {
+		return fmt.Errorf("宣告 Receipt Exchange 失敗: %w", err)
+	}
+	q, err := ch.QueueDeclare(
+		cfg.ReceiptQueue, // 每個工廠一條回執 Queue
+		true,             // durable
+		false,            // auto-delete
+		false,            // exclusive
+		false,            // no-wait
+		nil,              // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("宣告 Receipt Queue 失敗: %w", err)
+	}
+	if err := ch.QueueBind(q.Name, cfg.ReceiptQueue, cfg.ReceiptExchange, false, nil); err != nil {
+		return fmt.Errorf("綁定 Receipt Queue 失敗: %w", err)
+	}
+	return nil
+}
+
+// ConsumeReceipts 持續消費回執直到 ctx 結束，連線中斷時自動重連
+func (c *MQClient) ConsumeReceipts(ctx context.Context, handler ReceiptHandler) error {
+	if c.cfg.ReceiptQueue == "" {
+		return fmt.Errorf("未設定 receipt_queue")
+	}
+	for {
+		err := c.consumeReceiptsOnce(ctx, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			// 連線可能已斷，稍候重連
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(5 * time.Second):
+			}
+			if rerr := c.Reconnect(); rerr != nil {
+				continue
+			}
+		}
+	}
+}
+
+func (c *MQClient) consumeReceiptsOnce(ctx context.Context, handler ReceiptHandler) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	if err := ch.Qos(1, 0, false); err != nil {
+		return err
+	}
+	msgs, err := ch.Consume(c.cfg.ReceiptQueue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-msgs:
+			if !ok {
+				return fmt.Errorf("receipt channel 已關閉")
+			}
+			if err := handler(ctx, d.Body, c.sealer.verifyReceipt(d, c.cfg.FactoryID)); err != nil {
+				// 多半是 DB 暫時無法使用或批次尚未送出完成，稍候重新排入
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+				d.Nack(false, true)
+				continue
+			}
+			d.Ack(false)
+		}
+	}
+}
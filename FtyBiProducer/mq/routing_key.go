@@ -16,3 +16,11 @@ var AllRoutingKeys = []RoutingKey{
 	RoutingKeyDDL,
 	RoutingKeyDML,
 }
+
+// DmlRoutingKey 回傳 DML stream 使用的 RoutingKey，預設 stream（空字串）沿用 RoutingKeyDML
+func DmlRoutingKey(stream string) RoutingKey {
+	if stream == "" {
+		return RoutingKeyDML
+	}
+	return RoutingKey("bi_dml." + stream + ".key")
+}
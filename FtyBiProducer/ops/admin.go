@@ -0,0 +1,389 @@
+// 管理 API：暫停 / 恢復 / 立即觸發各處理迴圈、執行中調整批次大小與查詢狀態，需以 ops.admin_token 驗證
+package ops
+
+import (
+	"FtyBiProducer/config"
+	"FtyBiProducer/metrics"
+	"FtyBiProducer/model"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"go.uber.org/zap"
+)
+
+// 可由管理 API 控制的迴圈
+const (
+	LoopDDL      = "ddl"      // DdlLogProcess
+	LoopDML      = "dml"      // 所有 stream 的 DmlLogProcess
+	LoopGenerate = "generate" // DmlLogGenerate
+)
+
+// AdminLoops 為可由管理 API 控制的迴圈
+var AdminLoops = []string{LoopDDL, LoopDML, LoopGenerate}
+
+// maxAdminBody 為管理 API 請求 Body 的上限
+const maxAdminBody = 64 << 10
+
+// Controller 為執行中的工廠提供給管理 API 的操作（service.Processor）
+type Controller interface {
+	BatchLimits() config.BatchConfig
+	SetBatchLimits(limits config.BatchConfig)
+	BatchProgress() map[string]model.BatchProgress
+}
+
+// Backlog 為最近一次統計的未處理 Log
+type Backlog struct {
+	Count              int64      `json:"count"`
+	OldestGenerateDate *time.Time `json:"oldest_generate_date,omitempty"`
+}
+
+// BatchLimits 為管理 API 顯示與調整的批次上限；調整時未帶的欄位維持不變
+type BatchLimits struct {
+	DdlMaxRows *int `json:"ddl_max_rows,omitempty"`
+	DmlMaxRows *int `json:"dml_max_rows,omitempty"`
+	MaxBytes   *int `json:"max_bytes,omitempty"`
+}
+
+// LoopStatus 為一個處理迴圈的狀態
+type LoopStatus struct {
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	model.BatchProgress
+}
+
+// AdminStatus 為 /admin/status 中單一工廠的狀態
+type AdminStatus struct {
+	Running     bool                  `json:"running"`
+	Error       string                `json:"error,omitempty"`
+	Paused      map[string]bool       `json:"paused"`
+	Loops       map[string]LoopStatus `json:"loops"`
+	Backlog     map[string]Backlog    `json:"backlog"`
+	BatchLimits *BatchLimits          `json:"batch_limits,omitempty"`
+}
+
+// EnableAdmin 開放管理 API；token 為空字串時不開放，操作會記錄到 logger
+func (s *Server) EnableAdmin(token string, logger *zap.SugaredLogger) {
+	s.adminToken = token
+	s.logger = logger
+}
+
+// registerAdmin 登記管理 API 的路由，所有路由都需要 Bearer token
+func (s *Server) registerAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/status", s.authorize(s.handleAdminStatus))
+	mux.HandleFunc("POST /admin/pause", s.authorize(s.handleLoopAction("pause")))
+	mux.HandleFunc("POST /admin/resume", s.authorize(s.handleLoopAction("resume")))
+	mux.HandleFunc("POST /admin/trigger", s.authorize(s.handleLoopAction("trigger")))
+	mux.HandleFunc("PUT /admin/batch-limits", s.authorize(s.handleBatchLimits))
+}
+
+// authorize 以固定時間比對 Authorization: Bearer <token>
+func (s *Server) authorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "未授權"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// selectFactories 依 ?factory= 選出工廠，未指定時為全部
+func (s *Server) selectFactories(r *http.Request) ([]*FactoryStatus, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if id := r.URL.Query().Get("factory"); id != "" {
+		f, ok := s.factories[id]
+		if !ok {
+			return nil, fmt.Errorf("找不到工廠 %q", id)
+		}
+		return []*FactoryStatus{f}, nil
+	}
+	ids := make([]string, 0, len(s.factories))
+	for id := range s.factories {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	out := make([]*FactoryStatus, len(ids))
+	for i, id := range ids {
+		out[i] = s.factories[id]
+	}
+	return out, nil
+}
+
+// selectLoops 依 ?loop= 選出迴圈（可用逗號分隔多個），未指定時為全部
+func selectLoops(r *http.Request) ([]string, error) {
+	q := r.URL.Query().Get("loop")
+	if q == "" {
+		return AdminLoops, nil
+	}
+	var loops []string
+	for _, loop := range strings.Split(q, ",") {
+		if !slices.Contains(AdminLoops, loop) {
+			return nil, fmt.Errorf("loop 只能是 %s，實際 %q", strings.Join(AdminLoops, "、"), loop)
+		}
+		loops = append(loops, loop)
+	}
+	return loops, nil
+}
+
+func (s *Server) handleAdminStatus(w http.ResponseWriter, r *http.Request) {
+	factories, err := s.selectFactories(r)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	out := make(map[string]AdminStatus, len(factories))
+	for _, f := range factories {
+		out[f.id] = f.adminStatus()
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleLoopAction 處理 pause、resume、trigger；暫停中的迴圈不接受觸發
+func (s *Server) handleLoopAction(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		factories, err := s.selectFactories(r)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		loops, err := selectLoops(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		// 1. 觸發前先確認沒有暫停中的迴圈，避免只觸發了一部分
+		if action == "trigger" {
+			for _, f := range factories {
+				for _, loop := range loops {
+					if f.Paused(loop) {
+						writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("工廠 %s 的 %s 已暫停，請先 resume", f.id, loop)})
+						return
+					}
+				}
+			}
+		}
+
+		// 2. 執行並記錄
+		out := make(map[string]AdminStatus, len(factories))
+		for _, f := range factories {
+			for _, loop := range loops {
+				switch action {
+				case "pause":
+					f.SetPaused(loop, true)
+				case "resume":
+					f.SetPaused(loop, false)
+				case "trigger":
+					f.triggers[loop].Broadcast()
+				}
+			}
+			s.audit("管理 API %s：工廠 %s，迴圈 %v（來源 %s）", action, f.id, loops, r.RemoteAddr)
+			out[f.id] = f.adminStatus()
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+func (s *Server) handleBatchLimits(w http.ResponseWriter, r *http.Request) {
+	factories, err := s.selectFactories(r)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAdminBody))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	var patch BatchLimits
+	if err := sonic.Unmarshal(body, &patch); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "解析 JSON 失敗：" + err.Error()})
+		return
+	}
+	for _, v := range []*int{patch.DdlMaxRows, patch.DmlMaxRows, patch.MaxBytes} {
+		if v != nil && *v <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "批次上限必須大於 0"})
+			return
+		}
+	}
+
+	out := make(map[string]AdminStatus, len(factories))
+	for _, f := range factories {
+		limits := f.applyLimits(patch)
+		s.audit("管理 API batch-limits：工廠 %s，ddl_max_rows=%d dml_max_rows=%d max_bytes=%d（來源 %s）",
+			f.id, limits.DdlMaxRows, limits.DmlMaxRows, limits.MaxBytes, r.RemoteAddr)
+		out[f.id] = f.adminStatus()
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) audit(format string, args ...interface{}) {
+	if s.logger != nil {
+		s.logger.Infof(format, args...)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	body, err := sonic.ConfigStd.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// Paused 回傳迴圈（ddl、dml、generate）是否由管理 API 暫停
+func (f *FactoryStatus) Paused(loop string) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.paused[loop]
+}
+
+// SetPaused 暫停或恢復迴圈；恢復時立即喚醒，不必等到下一次檢查
+func (f *FactoryStatus) SetPaused(loop string, paused bool) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.paused[loop] = paused
+	f.mu.Unlock()
+	v := 0.0
+	if paused {
+		v = 1
+	}
+	metrics.LoopPaused.WithLabelValues(f.id, loop).Set(v)
+	if !paused {
+		f.triggers[loop].Broadcast()
+	}
+}
+
+// Triggered 回傳迴圈下一次被恢復或手動觸發時會關閉的 channel；
+// 請在檢查 Paused 與開始等待前取得，之間發生的觸發才不會遺漏
+func (f *FactoryStatus) Triggered(loop string) <-chan struct{} {
+	if f == nil {
+		return nil
+	}
+	return f.triggers[loop].C()
+}
+
+// SetController 設定執行中工廠的 Processor，之前以管理 API 調整過的批次上限會一併套用
+func (f *FactoryStatus) SetController(c Controller) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ctl = c
+	if c != nil && f.limits != nil {
+		c.SetBatchLimits(*f.limits)
+	}
+}
+
+// SetBacklog 記錄最近一次統計的未處理 Log（kind 為 ddl 或 dml）
+func (f *FactoryStatus) SetBacklog(kind string, b Backlog) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.backlog[kind] = b
+}
+
+// ClearBatchLimits 捨棄以管理 API 調整過的批次上限（例如設定檔重新載入了新的上限），回傳先前是否有調整
+func (f *FactoryStatus) ClearBatchLimits() bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	had := f.limits != nil
+	f.limits = nil
+	return had
+}
+
+// applyLimits 以 patch 覆寫批次上限並保留，工廠重新初始化後仍有效
+func (f *FactoryStatus) applyLimits(patch BatchLimits) config.BatchConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var limits config.BatchConfig
+	switch {
+	case f.ctl != nil:
+		limits = f.ctl.BatchLimits()
+	case f.limits != nil:
+		limits = *f.limits
+	}
+	if patch.DdlMaxRows != nil {
+		limits.DdlMaxRows = *patch.DdlMaxRows
+	}
+	if patch.DmlMaxRows != nil {
+		limits.DmlMaxRows = *patch.DmlMaxRows
+	}
+	if patch.MaxBytes != nil {
+		limits.MaxBytes = *patch.MaxBytes
+	}
+	f.limits = &limits
+	if f.ctl != nil {
+		f.ctl.SetBatchLimits(limits)
+	}
+	return limits
+}
+
+// adminStatus 彙整工廠目前的狀態
+func (f *FactoryStatus) adminStatus() AdminStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := AdminStatus{
+		Running: f.ctl != nil,
+		Paused:  make(map[string]bool, len(AdminLoops)),
+		Loops:   make(map[string]LoopStatus, len(f.lastSuccess)),
+		Backlog: make(map[string]Backlog, len(f.backlog)),
+	}
+	if f.lastErr != nil {
+		st.Error = f.lastErr.Error()
+	}
+	for _, loop := range AdminLoops {
+		st.Paused[loop] = f.paused[loop]
+	}
+	for loop, t := range f.lastSuccess {
+		ls := LoopStatus{}
+		if !t.IsZero() {
+			t := t
+			ls.LastSuccess = &t
+		}
+		st.Loops[loop] = ls
+	}
+	for kind, b := range f.backlog {
+		st.Backlog[kind] = b
+	}
+
+	var limits *config.BatchConfig
+	if f.ctl != nil {
+		for loop, pr := range f.ctl.BatchProgress() {
+			ls := st.Loops[loop]
+			ls.BatchProgress = pr
+			st.Loops[loop] = ls
+		}
+		l := f.ctl.BatchLimits()
+		limits = &l
+	} else if f.limits != nil {
+		limits = f.limits
+	}
+	if limits != nil {
+		st.BatchLimits = &BatchLimits{DdlMaxRows: &limits.DdlMaxRows, DmlMaxRows: &limits.DmlMaxRows, MaxBytes: &limits.MaxBytes}
+	}
+	return st
+}
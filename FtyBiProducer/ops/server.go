@@ -0,0 +1,305 @@
+// 維運 HTTP 服務：/metrics、/healthz（存活）、/readyz（DB、MQ、最近成功批次）與 /admin/*（管理 API）
+package ops
+
+import (
+	"FtyBiProducer/config"
+	"FtyBiProducer/metrics"
+	"FtyBiProducer/schedule"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// 預設值：未設定 ops.max_batch_age、ops.backlog_interval 時使用
+const (
+	DefaultMaxBatchAge     = 10 * time.Minute
+	DefaultBacklogInterval = 30 * time.Second
+)
+
+// checkTimeout 為 /readyz 中每項檢查（DB ping、MQ）的期限
+const checkTimeout = 3 * time.Second
+
+// Pinger 為可檢查連線的資料庫（*sql.DB）
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// MQChecker 回報 MQ 連線與 Channel 是否開啟，nil 表示不需檢查
+type MQChecker interface {
+	Healthy() error
+}
+
+// Server 彙整所有工廠的狀態並提供維運端點
+type Server struct {
+	maxBatchAge time.Duration
+	now         func() time.Time
+	adminToken  string             // 管理 API 的 Bearer token，空字串表示不開放
+	logger      *zap.SugaredLogger // 記錄管理 API 的操作
+
+	mu        sync.RWMutex
+	factories map[string]*FactoryStatus
+}
+
+// NewServer 建立維運服務，maxBatchAge <= 0 時使用 DefaultMaxBatchAge
+func NewServer(maxBatchAge time.Duration) *Server {
+	if maxBatchAge <= 0 {
+		maxBatchAge = DefaultMaxBatchAge
+	}
+	return &Server{maxBatchAge: maxBatchAge, now: time.Now, factories: make(map[string]*FactoryStatus)}
+}
+
+// Register 登記一個工廠，初始化完成（SetTarget）前 /readyz 會回報未就緒
+func (s *Server) Register(factoryID string) *FactoryStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := &FactoryStatus{
+		id:          factoryID,
+		now:         s.now,
+		lastSuccess: make(map[string]time.Time),
+		paused:      make(map[string]bool),
+		triggers:    make(map[string]*schedule.Wake),
+		backlog:     make(map[string]Backlog),
+	}
+	for _, loop := range AdminLoops {
+		f.triggers[loop] = schedule.NewWake()
+	}
+	s.factories[factoryID] = f
+	return f
+}
+
+// Handler 回傳包含 /metrics、/healthz、/readyz 的 http.Handler
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", s.handleReady)
+	if s.adminToken != "" {
+		s.registerAdmin(mux)
+	}
+	return mux
+}
+
+// ListenAndServe 在 port 上提供服務，ctx 結束時關閉
+func (s *Server) ListenAndServe(ctx context.Context, port int) error {
+	srv := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: s.Handler()}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// ReadyReport 為 /readyz 的回應內容
+type ReadyReport struct {
+	Ready     bool                     `json:"ready"`
+	Factories map[string]FactoryReport `json:"factories"`
+}
+
+// FactoryReport 為單一工廠的檢查結果
+type FactoryReport struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"` // 檢查項目 -> "ok" 或錯誤原因
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	// ?factory= 只檢查指定的工廠，未就緒時回 503，供只關心單一工廠的監控使用
+	var report ReadyReport
+	if id := r.URL.Query().Get("factory"); id != "" {
+		fr, ok := s.ReadyFactory(ctx, id)
+		if !ok {
+			http.Error(w, fmt.Sprintf("找不到工廠 %q", id), http.StatusNotFound)
+			return
+		}
+		report = ReadyReport{Ready: fr.Ready, Factories: map[string]FactoryReport{id: fr}}
+	} else {
+		report = s.Ready(ctx)
+	}
+	body, err := sonic.ConfigStd.MarshalIndent(report, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(body)
+}
+
+// Ready 檢查所有工廠並逐一列出結果；至少一個工廠就緒即整體就緒，
+// 單一工廠異常不會讓整個程序被移出服務，其他工廠仍照常發送
+func (s *Server) Ready(ctx context.Context) ReadyReport {
+	s.mu.RLock()
+	factories := make([]*FactoryStatus, 0, len(s.factories))
+	for _, f := range s.factories {
+		factories = append(factories, f)
+	}
+	s.mu.RUnlock()
+
+	report := ReadyReport{Factories: make(map[string]FactoryReport, len(factories))}
+	for _, f := range factories {
+		fr := f.check(ctx, s.maxBatchAge)
+		report.Factories[f.id] = fr
+		report.Ready = report.Ready || fr.Ready
+	}
+	return report
+}
+
+// ReadyFactory 只檢查指定的工廠；工廠未登記時回傳 false
+func (s *Server) ReadyFactory(ctx context.Context, factoryID string) (FactoryReport, bool) {
+	s.mu.RLock()
+	f, ok := s.factories[factoryID]
+	s.mu.RUnlock()
+	if !ok {
+		return FactoryReport{}, false
+	}
+	return f.check(ctx, s.maxBatchAge), true
+}
+
+// FactoryStatus 為單一工廠的連線對象與各迴圈最近成功時間
+type FactoryStatus struct {
+	id  string
+	now func() time.Time
+
+	mu          sync.Mutex
+	db          Pinger
+	mq          MQChecker
+	since       time.Time            // 目前連線對象設定的時間，尚未有成功批次時以此起算
+	lastErr     error                // 最近一次初始化失敗的原因
+	lastSuccess map[string]time.Time // loop -> 最近成功時間
+
+	// 以下由管理 API 使用，工廠重新初始化後仍保留
+	ctl      Controller                // 執行中工廠的 Processor，未執行時為 nil
+	limits   *config.BatchConfig       // 管理 API 調整過的批次上限，重新初始化時套用
+	paused   map[string]bool           // ddl、dml、generate -> 是否暫停
+	triggers map[string]*schedule.Wake // 恢復或手動觸發時喚醒對應迴圈
+	backlog  map[string]Backlog        // ddl、dml -> 最近一次統計的未處理 Log
+}
+
+// SetTarget 設定工廠目前使用的資料庫與 MQ，之後 /readyz 才會檢查；mq 可為 nil
+func (f *FactoryStatus) SetTarget(db Pinger, mq MQChecker) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.db, f.mq, f.lastErr = db, mq, nil
+	f.since = f.now()
+	f.lastSuccess = make(map[string]time.Time)
+}
+
+// ClearTarget 於工廠關閉或初始化失敗時清除連線對象，err 會顯示在 /readyz
+func (f *FactoryStatus) ClearTarget(err error) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.db, f.mq, f.lastErr = nil, nil, err
+	f.ctl = nil
+}
+
+// RecordSuccess 記錄某個迴圈（ddl、dml、dml.<stream>）完成一次成功的批次
+func (f *FactoryStatus) RecordSuccess(loop string) {
+	if f == nil {
+		return
+	}
+	now := f.now()
+	f.mu.Lock()
+	f.lastSuccess[loop] = now
+	f.mu.Unlock()
+	metrics.LastSuccessTimestamp.WithLabelValues(f.id, loop).Set(float64(now.Unix()))
+}
+
+// Watch 登記一個需要檢查最近成功時間的迴圈，從未成功時以 SetTarget 的時間起算
+func (f *FactoryStatus) Watch(loop string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.lastSuccess[loop]; !ok {
+		f.lastSuccess[loop] = time.Time{}
+	}
+}
+
+func (f *FactoryStatus) check(ctx context.Context, maxBatchAge time.Duration) FactoryReport {
+	f.mu.Lock()
+	db, mq, since, lastErr := f.db, f.mq, f.since, f.lastErr
+	loops := make(map[string]time.Time, len(f.lastSuccess))
+	for loop, t := range f.lastSuccess {
+		loops[loop] = t
+	}
+	f.mu.Unlock()
+
+	fr := FactoryReport{Ready: true, Checks: make(map[string]string)}
+	fail := func(name, reason string) {
+		fr.Ready = false
+		fr.Checks[name] = reason
+	}
+
+	// 1. 尚未初始化完成
+	if db == nil {
+		reason := "初始化中"
+		if lastErr != nil {
+			reason = "初始化失敗：" + lastErr.Error()
+		}
+		fail("init", reason)
+		return fr
+	}
+
+	// 2. DB ping
+	if err := db.PingContext(ctx); err != nil {
+		fail("db", err.Error())
+	} else {
+		fr.Checks["db"] = "ok"
+	}
+
+	// 3. MQ 連線與 Channel
+	if mq != nil {
+		if err := mq.Healthy(); err != nil {
+			fail("mq", err.Error())
+		} else {
+			fr.Checks["mq"] = "ok"
+		}
+	}
+
+	// 4. 各迴圈最近成功批次的時間
+	now := f.now()
+	for loop, last := range loops {
+		if group, _, _ := strings.Cut(loop, "."); f.Paused(group) {
+			fr.Checks[loop] = "已暫停"
+			continue
+		}
+		if last.IsZero() {
+			last = since
+		}
+		age := now.Sub(last).Truncate(time.Second)
+		if age > maxBatchAge {
+			fail(loop, fmt.Sprintf("已 %s 沒有成功的批次（上限 %s）", age, maxBatchAge))
+			continue
+		}
+		fr.Checks[loop] = fmt.Sprintf("ok（%s 前）", age)
+	}
+	return fr
+}
@@ -0,0 +1,227 @@
+package ops
+
+import (
+	"FtyBiProducer/config"
+	"FtyBiProducer/model"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakePinger struct{ err error }
+
+func (p fakePinger) PingContext(ctx context.Context) error { return p.err }
+
+type fakeMQ struct{ err error }
+
+func (m fakeMQ) Healthy() error { return m.err }
+
+// TestReady 驗證初始化前、DB 異常與批次過久時 /readyz 回報未就緒
+func TestReady(t *testing.T) {
+	now := time.Date(2025, 6, 1, 8, 0, 0, 0, time.UTC)
+	s := NewServer(5 * time.Minute)
+	s.now = func() time.Time { return now }
+	ph1 := s.Register("PH1")
+	ctx := context.Background()
+
+	if r := s.Ready(ctx); r.Ready || r.Factories["PH1"].Checks["init"] != "初始化中" {
+		t.Fatalf("初始化前應未就緒：%+v", r)
+	}
+
+	ph1.SetTarget(fakePinger{}, fakeMQ{})
+	ph1.Watch("ddl")
+	ph1.Watch("dml")
+	ph1.RecordSuccess("ddl")
+	if r := s.Ready(ctx); !r.Ready {
+		t.Fatalf("DB、MQ 正常且剛啟動時應就緒：%+v", r)
+	}
+
+	// dml 從未成功，超過 max_batch_age 後未就緒
+	now = now.Add(6 * time.Minute)
+	ph1.RecordSuccess("ddl")
+	r := s.Ready(ctx)
+	if r.Ready || !strings.Contains(r.Factories["PH1"].Checks["dml"], "沒有成功的批次") {
+		t.Fatalf("dml 過久未成功時應未就緒：%+v", r)
+	}
+	ph1.RecordSuccess("dml")
+
+	ph1.SetTarget(fakePinger{err: errors.New("連線逾時")}, fakeMQ{})
+	if r := s.Ready(ctx); r.Ready || r.Factories["PH1"].Checks["db"] != "連線逾時" {
+		t.Fatalf("DB 異常時應未就緒：%+v", r)
+	}
+
+	ph1.ClearTarget(errors.New("MQ 初始化失敗"))
+	if r := s.Ready(ctx); r.Ready || !strings.HasPrefix(r.Factories["PH1"].Checks["init"], "初始化失敗") {
+		t.Fatalf("初始化失敗時應未就緒：%+v", r)
+	}
+}
+
+// TestHandler 驗證 /healthz 永遠 200，/readyz 未就緒時回 503
+func TestHandler(t *testing.T) {
+	s := NewServer(0)
+	s.Register("PH1").SetTarget(fakePinger{}, fakeMQ{err: errors.New("channel 已關閉")})
+	h := s.Handler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/healthz 預期 200，實際 %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "channel 已關閉") {
+		t.Fatalf("/readyz 預期 503，實際 %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/metrics 預期 200，實際 %d", rec.Code)
+	}
+}
+
+// TestReady_MultiFactory 驗證單一工廠異常時整體仍就緒，?factory= 只檢查指定工廠
+func TestReady_MultiFactory(t *testing.T) {
+	s := NewServer(0)
+	ph1 := s.Register("PH1")
+	ph1.SetTarget(fakePinger{}, fakeMQ{})
+	s.Register("PH2").SetTarget(fakePinger{err: errors.New("連線逾時")}, fakeMQ{})
+	h := s.Handler()
+
+	r := s.Ready(context.Background())
+	if !r.Ready || !r.Factories["PH1"].Ready || r.Factories["PH2"].Ready {
+		t.Fatalf("至少一個工廠就緒時整體應就緒，且逐一列出：%+v", r)
+	}
+
+	cases := []struct {
+		url  string
+		code int
+	}{
+		{"/readyz", http.StatusOK},
+		{"/readyz?factory=PH1", http.StatusOK},
+		{"/readyz?factory=PH2", http.StatusServiceUnavailable},
+		{"/readyz?factory=PH9", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, c.url, nil))
+		if rec.Code != c.code {
+			t.Errorf("%s 預期 %d，實際 %d %s", c.url, c.code, rec.Code, rec.Body.String())
+		}
+	}
+
+	ph1.ClearTarget(errors.New("MQ 初始化失敗"))
+	if r := s.Ready(context.Background()); r.Ready {
+		t.Fatalf("沒有任何工廠就緒時應未就緒：%+v", r)
+	}
+}
+
+type fakeController struct{ limits config.BatchConfig }
+
+func (c *fakeController) BatchLimits() config.BatchConfig          { return c.limits }
+func (c *fakeController) SetBatchLimits(limits config.BatchConfig) { c.limits = limits }
+func (c *fakeController) BatchProgress() map[string]model.BatchProgress {
+	return map[string]model.BatchProgress{"ddl": {LastBatchID: 42}}
+}
+
+// TestAdmin 驗證管理 API 的驗證、暫停 / 恢復 / 觸發與批次上限調整
+func TestAdmin(t *testing.T) {
+	const token = "0123456789abcdef"
+	s := NewServer(time.Minute)
+	s.EnableAdmin(token, nil)
+	ph1 := s.Register("PH1")
+	ph1.SetTarget(fakePinger{}, fakeMQ{})
+	ph1.Watch("dml.orders")
+	ctl := &fakeController{limits: config.BatchConfig{DdlMaxRows: 100, DmlMaxRows: 200}}
+	ph1.SetController(ctl)
+	h := s.Handler()
+
+	do := func(method, target, auth, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// 1. 未帶或帶錯 token
+	if rec := do(http.MethodGet, "/admin/status", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("未帶 token 預期 401，實際 %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/admin/pause", "wrong-token", ""); rec.Code != http.StatusUnauthorized || ph1.Paused(LoopDML) {
+		t.Fatalf("token 錯誤預期 401 且不暫停，實際 %d", rec.Code)
+	}
+
+	// 2. 暫停 dml：/readyz 不因 dml 過久未成功而未就緒，暫停中不接受觸發
+	if rec := do(http.MethodPost, "/admin/pause?factory=PH1&loop=dml", token, ""); rec.Code != http.StatusOK {
+		t.Fatalf("pause 預期 200，實際 %d %s", rec.Code, rec.Body.String())
+	}
+	if !ph1.Paused(LoopDML) || ph1.Paused(LoopDDL) {
+		t.Fatal("只有 dml 應暫停")
+	}
+	s.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if r := s.Ready(context.Background()); !r.Ready || r.Factories["PH1"].Checks["dml.orders"] != "已暫停" {
+		t.Fatalf("暫停中的迴圈不應影響就緒：%+v", r)
+	}
+	if rec := do(http.MethodPost, "/admin/trigger?loop=dml", token, ""); rec.Code != http.StatusConflict {
+		t.Fatalf("暫停中觸發預期 409，實際 %d", rec.Code)
+	}
+
+	// 3. 恢復時喚醒等待中的迴圈
+	woken := ph1.Triggered(LoopDML)
+	if rec := do(http.MethodPost, "/admin/resume?loop=dml", token, ""); rec.Code != http.StatusOK || ph1.Paused(LoopDML) {
+		t.Fatalf("resume 預期 200 且恢復，實際 %d", rec.Code)
+	}
+	select {
+	case <-woken:
+	default:
+		t.Fatal("resume 應喚醒迴圈")
+	}
+	if rec := do(http.MethodPost, "/admin/trigger?loop=sync", token, ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("未知的 loop 預期 400，實際 %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/admin/pause?factory=PH9", token, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("未知的工廠預期 404，實際 %d", rec.Code)
+	}
+
+	// 4. 調整批次上限：未帶的欄位不變，重新初始化後仍套用
+	if rec := do(http.MethodPut, "/admin/batch-limits?factory=PH1", token, `{"dml_max_rows": 0}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("上限為 0 預期 400，實際 %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, "/admin/batch-limits?factory=PH1", token, `{"dml_max_rows": 50}`); rec.Code != http.StatusOK {
+		t.Fatalf("batch-limits 預期 200，實際 %d %s", rec.Code, rec.Body.String())
+	}
+	if ctl.limits.DdlMaxRows != 100 || ctl.limits.DmlMaxRows != 50 {
+		t.Fatalf("批次上限未套用：%+v", ctl.limits)
+	}
+	ph1.ClearTarget(nil)
+	restarted := &fakeController{}
+	ph1.SetController(restarted)
+	if restarted.limits.DmlMaxRows != 50 {
+		t.Fatalf("重新初始化後應套用調整過的上限：%+v", restarted.limits)
+	}
+
+	// 5. 狀態
+	rec := do(http.MethodGet, "/admin/status?factory=PH1", token, "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"last_batch_id": 42`) || !strings.Contains(rec.Body.String(), `"dml_max_rows": 50`) {
+		t.Fatalf("status 內容不符：%d %s", rec.Code, rec.Body.String())
+	}
+}
+
+// TestAdminDisabled 驗證未設定 admin_token 時不開放管理 API
+func TestAdminDisabled(t *testing.T) {
+	s := NewServer(0)
+	s.Register("PH1")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/status", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("未設定 admin_token 預期 404，實際 %d", rec.Code)
+	}
+}
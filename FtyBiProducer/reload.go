@@ -0,0 +1,137 @@
+// 設定檔熱重載：設定檔變更時重新載入，套用間隔、批次上限與 log 級別，需重新連線的設定記錄後待重新啟動
+package main
+
+import (
+	"FtyBiProducer/config"
+	"FtyBiProducer/metrics"
+	"FtyBiProducer/schedule"
+	scilog "FtyBiProducer/scilog"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// liveConfig 為單一工廠目前生效的設定：重新載入時只更新可即時套用的部分，
+// 工廠重新初始化時也使用此設定
+type liveConfig struct {
+	mu      sync.RWMutex
+	cfg     config.Config
+	loaded  config.Config  // 最後一次載入的設定，需重新啟動的差異只在與上一次不同時回報
+	changed *schedule.Wake // 更新時廣播
+}
+
+func newLiveConfig(cfg config.Config) *liveConfig {
+	return &liveConfig{cfg: cfg, loaded: cfg, changed: schedule.NewWake()}
+}
+
+// Get 回傳目前生效的設定
+func (l *liveConfig) Get() config.Config {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cfg
+}
+
+// Changed 回傳下一次更新時會關閉的 channel；nil 的 liveConfig 永遠不會觸發
+func (l *liveConfig) Changed() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+	return l.changed.C()
+}
+
+// apply 比對 next 與上一次載入的設定，套用可即時變更的部分並喚醒等待中的迴圈；
+// 已回報過的需重新啟動設定不會在之後的重新載入重複回報
+func (l *liveConfig) apply(next config.Config) config.Changes {
+	l.mu.Lock()
+	changes := config.Diff(l.loaded, next)
+	l.loaded = next
+	if len(changes.Live) > 0 {
+		l.cfg = l.cfg.WithReloadable(next)
+	}
+	l.mu.Unlock()
+	if len(changes.Live) > 0 {
+		l.changed.Broadcast()
+	}
+	return changes
+}
+
+// configReloader 在設定檔變更時重新載入並套用到各工廠
+type configReloader struct {
+	mu        sync.Mutex
+	files     []string
+	logLevel  string
+	factories map[string]*liveConfig // factory_id -> 目前生效的設定
+	sugar     *zap.SugaredLogger
+}
+
+func newConfigReloader(files []string, cfg *config.Config, sugar *zap.SugaredLogger) *configReloader {
+	return &configReloader{files: files, logLevel: cfg.LogLevel, factories: make(map[string]*liveConfig), sugar: sugar}
+}
+
+// add 登記工廠，回傳其 liveConfig
+func (r *configReloader) add(cfg config.Config) *liveConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	live := newLiveConfig(cfg)
+	r.factories[cfg.MQ.FactoryID] = live
+	return live
+}
+
+// reload 重新載入設定檔；載入或驗證失敗時維持目前的設定
+func (r *configReloader) reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// 1. 載入並驗證
+	next, err := config.LoadConfig(r.files...)
+	if err != nil {
+		metrics.ConfigReloads.WithLabelValues("failed").Inc()
+		r.sugar.Errorf("設定檔已變更但載入失敗，維持目前設定：%v", err)
+		return
+	}
+	metrics.ConfigReloads.WithLabelValues("success").Inc()
+
+	// 2. log 級別
+	if next.LogLevel != r.logLevel {
+		if err := scilog.SetLevel(next.LogLevel); err != nil {
+			r.sugar.Errorf("套用 log_level 失敗：%v", err)
+		} else {
+			r.sugar.Infof("log_level 已調整為 %q", next.LogLevel)
+			r.logLevel = next.LogLevel
+		}
+	}
+
+	// 3. 各工廠：新增或移除工廠需重新啟動
+	sources := make(map[string]config.Config)
+	for _, src := range next.FactorySources() {
+		sources[src.MQ.FactoryID] = src
+	}
+	ids := make([]string, 0, len(r.factories))
+	for id := range r.factories {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		src, ok := sources[id]
+		if !ok {
+			r.sugar.Warnf("設定檔已移除工廠 %s，需重新啟動才會生效", id)
+			continue
+		}
+		delete(sources, id)
+		changes := r.factories[id].apply(src)
+		if changes.Empty() {
+			continue
+		}
+		factorySugar := r.sugar.With("factory", id)
+		if len(changes.Live) > 0 {
+			factorySugar.Infof("設定檔已重新載入，已套用：%v", changes.Live)
+		}
+		if len(changes.Deferred) > 0 {
+			factorySugar.Warnf("下列設定需重新連線，已略過，重新啟動後才會生效：%v", changes.Deferred)
+		}
+	}
+	for id := range sources {
+		r.sugar.Warnf("設定檔新增了工廠 %s，需重新啟動才會生效", id)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"FtyBiProducer/config"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestLiveConfig_Apply 驗證可即時變更的設定會套用，需重新啟動的設定只在第一次變更時回報
+func TestLiveConfig_Apply(t *testing.T) {
+	cfg := config.Config{ProcessDmlInterval: time.Second, DB: config.DBConfig{Host: "PMSDB"}}
+	live := newLiveConfig(cfg)
+
+	next := cfg
+	next.DB.Host = "PMSDB2"
+	next.ProcessDmlInterval = 5 * time.Second
+	changed := live.Changed()
+	changes := live.apply(next)
+	if !reflect.DeepEqual(changes.Live, []string{"process_dml_interval"}) || !reflect.DeepEqual(changes.Deferred, []string{"db.host"}) {
+		t.Fatalf("第一次重新載入的差異不符：%+v", changes)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Fatal("套用可即時變更的設定後應喚醒等待中的迴圈")
+	}
+	if got := live.Get(); got.ProcessDmlInterval != 5*time.Second || got.DB.Host != "PMSDB" {
+		t.Fatalf("生效的設定不符：%+v", got)
+	}
+
+	// 設定檔未再變更時不重複回報 db.host
+	if changes := live.apply(next); !changes.Empty() {
+		t.Fatalf("相同設定不應再回報差異：%+v", changes)
+	}
+	next.LogLevel = "debug"
+	if changes := live.apply(next); !reflect.DeepEqual(changes.Live, []string{"log_level"}) || len(changes.Deferred) != 0 {
+		t.Fatalf("只應回報新的差異：%+v", changes)
+	}
+}
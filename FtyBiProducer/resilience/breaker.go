@@ -0,0 +1,125 @@
+package resilience
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 預設的熔斷參數，未設定 resilience.breaker_threshold / breaker_open_timeout 時使用
+const (
+	DefaultBreakerThreshold   = 5
+	DefaultBreakerOpenTimeout = 30 * time.Second
+)
+
+// ErrCircuitOpen 表示相依服務的熔斷器開啟中，暫不呼叫
+var ErrCircuitOpen = errors.New("熔斷器開啟中")
+
+// State 為熔斷器狀態
+type State int
+
+const (
+	StateClosed   State = iota // 正常呼叫
+	StateHalfOpen              // 開啟逾時後放行試探，下一次結果決定關閉或再開啟
+	StateOpen                  // 連續失敗達門檻，暫停呼叫
+)
+
+func (s State) String() string {
+	switch s {
+	case StateHalfOpen:
+		return "half_open"
+	case StateOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// Breaker 為單一相依服務（DB、MQ）的熔斷器：連續 Threshold 次失敗後開啟，
+// 經過 OpenTimeout 後放行試探，成功即關閉、失敗則再開啟
+type Breaker struct {
+	Name        string
+	Threshold   int
+	OpenTimeout time.Duration
+	// OnStateChange 於狀態改變時呼叫（記錄 log、更新 metrics），可為 nil；呼叫時持有鎖，不可再呼叫 Breaker 的方法
+	OnStateChange func(name string, from, to State)
+
+	now      func() time.Time
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+}
+
+// NewBreaker 建立熔斷器，threshold、openTimeout 為 0 時使用預設值
+func NewBreaker(name string, threshold int, openTimeout time.Duration) *Breaker {
+	if threshold <= 0 {
+		threshold = DefaultBreakerThreshold
+	}
+	if openTimeout <= 0 {
+		openTimeout = DefaultBreakerOpenTimeout
+	}
+	return &Breaker{Name: name, Threshold: threshold, OpenTimeout: openTimeout, now: time.Now}
+}
+
+// Allow 判斷現在能否呼叫相依服務；開啟中回傳包裝 ErrCircuitOpen 的錯誤與剩餘等待時間
+func (b *Breaker) Allow() (time.Duration, error) {
+	if b == nil {
+		return 0, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case StateOpen:
+		remain := b.OpenTimeout - b.now().Sub(b.openedAt)
+		if remain > 0 {
+			return remain, fmt.Errorf("%s %w", b.Name, ErrCircuitOpen)
+		}
+		b.setState(StateHalfOpen)
+	}
+	return 0, nil
+}
+
+// Success 記錄一次成功呼叫
+func (b *Breaker) Success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.setState(StateClosed)
+}
+
+// Failure 記錄一次相依服務造成的失敗
+func (b *Breaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == StateHalfOpen || b.failures >= b.Threshold {
+		b.openedAt = b.now()
+		b.setState(StateOpen)
+	}
+}
+
+// State 回傳目前狀態
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *Breaker) setState(to State) {
+	if b.state == to {
+		return
+	}
+	from := b.state
+	b.state = to
+	if b.OnStateChange != nil {
+		b.OnStateChange(b.Name, from, to)
+	}
+}
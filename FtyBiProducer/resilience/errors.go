@@ -0,0 +1,142 @@
+// 錯誤分類：決定失敗的批次要重試、等待熔斷，還是需要人工處理
+package resilience
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
+
+	mssql "github.com/microsoft/go-mssqldb"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Class 為錯誤的種類
+type Class int
+
+const (
+	ClassUnknown     Class = iota // 未分類，視為暫時性錯誤處理
+	ClassTransientDB              // 資料庫逾時、斷線、死結，稍後重試即可
+	ClassTransientMQ              // broker Nack、Confirm 逾時、連線中斷，稍後重試即可
+	ClassPoison                   // 資料本身有問題（無法編碼、違反條件約束），重試也不會成功
+	ClassConfig                   // 設定或結構錯誤（資料表、欄位不存在、權限不足），需修正後才會成功
+)
+
+func (c Class) String() string {
+	switch c {
+	case ClassTransientDB:
+		return "transient_db"
+	case ClassTransientMQ:
+		return "transient_mq"
+	case ClassPoison:
+		return "poison"
+	case ClassConfig:
+		return "config"
+	default:
+		return "unknown"
+	}
+}
+
+// Transient 表示重試可能成功
+func (c Class) Transient() bool {
+	return c == ClassUnknown || c == ClassTransientDB || c == ClassTransientMQ
+}
+
+// Error 為帶有分類的錯誤
+type Error struct {
+	Class Class
+	Err   error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+func (e *Error) Unwrap() error { return e.Err }
+
+// Wrap 以指定分類包裝錯誤，err 為 nil 時回傳 nil
+func Wrap(class Class, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Class: class, Err: err}
+}
+
+// DB 包裝資料庫操作的錯誤：依 SQL Server 錯誤碼區分設定錯誤、資料錯誤，其餘視為暫時性
+func DB(err error) error {
+	if err == nil {
+		return nil
+	}
+	return Wrap(classifyDB(err), err)
+}
+
+// MQ 包裝發送訊息的錯誤，一律視為暫時性
+func MQ(err error) error {
+	return Wrap(ClassTransientMQ, err)
+}
+
+// Poison 包裝資料本身造成的錯誤
+func Poison(err error) error {
+	return Wrap(ClassPoison, err)
+}
+
+// Config 包裝設定造成的錯誤
+func Config(err error) error {
+	return Wrap(ClassConfig, err)
+}
+
+// ClassOf 回傳錯誤的分類；未經包裝的錯誤依型別推斷
+func ClassOf(err error) Class {
+	if err == nil {
+		return ClassUnknown
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Class
+	}
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) {
+		return ClassTransientMQ
+	}
+	var sqlErr mssql.Error
+	if errors.As(err, &sqlErr) || errors.Is(err, driver.ErrBadConn) {
+		return classifyDB(err)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return ClassTransientDB
+	}
+	return ClassUnknown
+}
+
+// SQL Server 錯誤碼分類，未列出的視為暫時性
+var (
+	configErrorNumbers = map[int32]bool{
+		207:  true, // Invalid column name
+		208:  true, // Invalid object name
+		229:  true, // permission denied
+		230:  true, // permission denied on column
+		2812: true, // Could not find stored procedure
+		4060: true, // Cannot open database
+		9617: true, // Service Broker Queue 停用
+	}
+	poisonErrorNumbers = map[int32]bool{
+		245:  true, // Conversion failed
+		515:  true, // Cannot insert NULL
+		2601: true, // duplicate key (unique index)
+		2627: true, // duplicate key (constraint)
+		8114: true, // Error converting data type
+		8152: true, // String or binary data would be truncated
+		2628: true, // String or binary data would be truncated (2019+)
+	}
+)
+
+func classifyDB(err error) Class {
+	var sqlErr mssql.Error
+	if errors.As(err, &sqlErr) {
+		switch {
+		case configErrorNumbers[sqlErr.Number]:
+			return ClassConfig
+		case poisonErrorNumbers[sqlErr.Number]:
+			return ClassPoison
+		}
+	}
+	return ClassTransientDB
+}
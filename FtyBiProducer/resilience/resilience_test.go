@@ -0,0 +1,130 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	mssql "github.com/microsoft/go-mssqldb"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// TestClassOf 驗證包裝過與未包裝的錯誤都能分類
+func TestClassOf(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want Class
+	}{
+		{"未分類", errors.New("未知錯誤"), ClassUnknown},
+		{"包裝後保留分類", fmt.Errorf("發送失敗：%w", MQ(errors.New("nack"))), ClassTransientMQ},
+		{"資料錯誤", Poison(errors.New("無法編碼")), ClassPoison},
+		{"DB 死結", DB(mssql.Error{Number: 1205}), ClassTransientDB},
+		{"DB 資料表不存在", DB(fmt.Errorf("查詢 DdlLog 失敗：%w", mssql.Error{Number: 208})), ClassConfig},
+		{"DB 違反唯一索引", DB(mssql.Error{Number: 2627}), ClassPoison},
+		{"未包裝的 mssql 錯誤", mssql.Error{Number: 229}, ClassConfig},
+		{"未包裝的 amqp 錯誤", &amqp.Error{Code: 320, Reason: "CONNECTION_FORCED"}, ClassTransientMQ},
+		{"逾時", fmt.Errorf("查詢失敗：%w", context.DeadlineExceeded), ClassTransientDB},
+	}
+	for _, c := range cases {
+		if got := ClassOf(c.err); got != c.want {
+			t.Errorf("%s：預期 %s，實際 %s", c.name, c.want, got)
+		}
+	}
+	if DB(nil) != nil || MQ(nil) != nil {
+		t.Fatal("nil 錯誤包裝後應仍為 nil")
+	}
+}
+
+// TestRetry 驗證等待時間在 [上限/2, 上限] 之間倍增，成功後歸零
+func TestRetry(t *testing.T) {
+	r := NewRetry(time.Second, 4*time.Second)
+	ceilings := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+	for i, ceil := range ceilings {
+		if got := r.Next(); got < ceil/2 || got > ceil {
+			t.Fatalf("第 %d 次預期介於 %s ~ %s，實際 %s", i, ceil/2, ceil, got)
+		}
+	}
+	r.Reset()
+	if got := r.Next(); got > time.Second {
+		t.Fatalf("Reset 後預期不超過 1s，實際 %s", got)
+	}
+}
+
+// TestDo 驗證暫時性錯誤會重試，資料錯誤立即回傳
+func TestDo(t *testing.T) {
+	ctx := context.Background()
+	r := NewRetry(time.Millisecond, time.Millisecond)
+
+	calls := 0
+	err := Do(ctx, r, 3, func() error {
+		calls++
+		if calls < 3 {
+			return DB(errors.New("連線中斷"))
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("預期重試後成功（3 次），實際 %d 次：%v", calls, err)
+	}
+
+	calls = 0
+	err = Do(ctx, r, 3, func() error {
+		calls++
+		return Poison(errors.New("無法編碼"))
+	})
+	if ClassOf(err) != ClassPoison || calls != 1 {
+		t.Fatalf("資料錯誤不應重試，實際 %d 次：%v", calls, err)
+	}
+}
+
+// TestBreaker 驗證連續失敗後熔斷，逾時後試探成功關閉、失敗再開啟
+func TestBreaker(t *testing.T) {
+	now := time.Date(2025, 6, 1, 8, 0, 0, 0, time.UTC)
+	b := NewBreaker("db", 2, time.Minute)
+	b.now = func() time.Time { return now }
+	var changes []string
+	b.OnStateChange = func(name string, from, to State) {
+		changes = append(changes, from.String()+"->"+to.String())
+	}
+
+	b.Failure()
+	if _, err := b.Allow(); err != nil {
+		t.Fatalf("未達門檻不應熔斷：%v", err)
+	}
+	b.Failure()
+	wait, err := b.Allow()
+	if !errors.Is(err, ErrCircuitOpen) || wait != time.Minute {
+		t.Fatalf("達門檻應熔斷 1m，實際 %s：%v", wait, err)
+	}
+
+	// 逾時後放行試探，失敗立即再開啟
+	now = now.Add(time.Minute)
+	if _, err := b.Allow(); err != nil || b.State() != StateHalfOpen {
+		t.Fatalf("逾時後應放行試探，狀態 %s：%v", b.State(), err)
+	}
+	b.Failure()
+	if b.State() != StateOpen {
+		t.Fatalf("試探失敗應再開啟，實際 %s", b.State())
+	}
+
+	// 再次逾時後試探成功即關閉
+	now = now.Add(time.Minute)
+	b.Allow()
+	b.Success()
+	if b.State() != StateClosed {
+		t.Fatalf("試探成功應關閉，實際 %s", b.State())
+	}
+
+	want := []string{"closed->open", "open->half_open", "half_open->open", "open->half_open", "half_open->closed"}
+	if fmt.Sprint(changes) != fmt.Sprint(want) {
+		t.Fatalf("狀態變化預期 %v，實際 %v", want, changes)
+	}
+
+	var nilBreaker *Breaker
+	if _, err := nilBreaker.Allow(); err != nil {
+		t.Fatalf("nil 熔斷器應永遠放行：%v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package resilience
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// 預設的重試間隔，未設定 resilience.retry_base / retry_max 時使用
+const (
+	DefaultRetryBase = time.Second
+	DefaultRetryMax  = time.Minute
+)
+
+// Retry 為帶 jitter 的指數退避：第 n 次失敗後等待 [0, min(Max, Base*2^n)) 的隨機時間，
+// 避免多個工廠、多個迴圈在 DB 或 broker 恢復的瞬間同時重試
+type Retry struct {
+	Base    time.Duration
+	Max     time.Duration
+	attempt int
+}
+
+// NewRetry 建立 Retry，base、max 為 0 時使用預設值
+func NewRetry(base, max time.Duration) *Retry {
+	if base <= 0 {
+		base = DefaultRetryBase
+	}
+	if max <= 0 {
+		max = DefaultRetryMax
+	}
+	if max < base {
+		max = base
+	}
+	return &Retry{Base: base, Max: max}
+}
+
+// Next 回傳下一次重試前要等待的時間
+func (r *Retry) Next() time.Duration {
+	ceil := r.Max
+	if r.attempt < 30 {
+		if d := r.Base << r.attempt; d > 0 && d < ceil {
+			ceil = d
+		}
+	}
+	r.attempt++
+	// 保留一半固定等待，另一半隨機，避免等待時間太接近 0
+	half := ceil / 2
+	return half + time.Duration(rand.Int63n(int64(ceil-half)+1))
+}
+
+// Reset 在成功後歸零
+func (r *Retry) Reset() {
+	r.attempt = 0
+}
+
+// Do 執行 fn，暫時性錯誤最多重試 attempts 次；非暫時性錯誤或 ctx 結束時立即回傳
+func Do(ctx context.Context, r *Retry, attempts int, fn func() error) error {
+	var err error
+	for i := 0; ; i++ {
+		if err = fn(); err == nil {
+			r.Reset()
+			return nil
+		}
+		if i >= attempts || !ClassOf(err).Transient() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(r.Next()):
+		}
+	}
+}
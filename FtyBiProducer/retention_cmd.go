@@ -0,0 +1,60 @@
+// purge 子命令：依 retention 設定立即清理一次（不受離峰時段限制），或以 -dry-run 只輸出報表
+package main
+
+import (
+	"FtyBiProducer/service"
+	"context"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// purgeCommand 為 purge 子命令的參數
+type purgeCommand struct {
+	dryRun  bool
+	factory string // 多工廠時要清理的工廠
+}
+
+// parsePurgeArgs 解析 purge 子命令參數，例如：
+//
+//	fty-bi-producer purge -dry-run
+//	fty-bi-producer purge -factory PH1
+func parsePurgeArgs(args []string) (purgeCommand, error) {
+	var cmd purgeCommand
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	fs.StringVar(&cmd.factory, "factory", "", "多工廠設定時指定 factory_id")
+	fs.BoolVar(&cmd.dryRun, "dry-run", false, "只統計各資料表可清理的筆數，不刪除")
+	if err := fs.Parse(args); err != nil {
+		return cmd, err
+	}
+	return cmd, nil
+}
+
+// runPurge 執行清理並把報表印到 stdout
+func runPurge(ctx context.Context, proc *service.Processor, dryRun bool) error {
+	report, err := proc.RunRetention(ctx, dryRun, nil)
+	if report != nil {
+		printRetentionReport(report)
+	}
+	return err
+}
+
+// printRetentionReport 以一張資料表一行的格式輸出清理結果
+func printRetentionReport(report *service.RetentionReport) {
+	if len(report.Tables) == 0 {
+		fmt.Println("retention 未設定任何保留天數，沒有要清理的資料表")
+		return
+	}
+	mode := "已" + retentionVerb(report.Mode)
+	if report.DryRun {
+		mode = "dry-run"
+	}
+	fmt.Printf("%-30s %-19s %12s %-19s %12s\n", "資料表", "早於", "可清理", "最舊", mode)
+	for _, t := range report.Tables {
+		oldest := "-"
+		if t.Oldest != nil {
+			oldest = t.Oldest.Format(time.DateTime)
+		}
+		fmt.Printf("%-30s %-19s %12d %-19s %12d\n", t.Table, t.Cutoff.Format(time.DateTime), t.Eligible, oldest, t.Purged)
+	}
+}
@@ -0,0 +1,87 @@
+// 批次迴圈的排程：依上一輪結果調整等待時間，並可由外部事件提前喚醒
+package schedule
+
+import (
+	"sync"
+	"time"
+)
+
+// Backoff 依上一輪撈到的筆數決定下一輪等待多久：
+// 有資料時立即再跑（還有積壓），沒有資料或失敗時從 Min 開始倍增，最多 Max
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+	cur time.Duration
+}
+
+// NewBackoff 建立 Backoff，max 小於 min 時視為固定間隔 min
+func NewBackoff(min, max time.Duration) *Backoff {
+	if max < min {
+		max = min
+	}
+	return &Backoff{Min: min, Max: max, cur: min}
+}
+
+// Next 回傳下一輪前要等待的時間，found 為本輪處理的筆數
+func (b *Backoff) Next(found int, err error) time.Duration {
+	if err == nil && found > 0 {
+		b.cur = b.Min
+		return 0
+	}
+	wait := b.cur
+	if b.cur *= 2; b.cur > b.Max || b.cur <= 0 {
+		b.cur = b.Max
+	}
+	return wait
+}
+
+// SetBounds 調整最短與最長間隔（例如設定檔重新載入後），目前的等待時間會落在新的範圍內
+func (b *Backoff) SetBounds(min, max time.Duration) {
+	if max < min {
+		max = min
+	}
+	b.Min, b.Max = min, max
+	if b.cur < min {
+		b.cur = min
+	} else if b.cur > max {
+		b.cur = max
+	}
+}
+
+// Reset 回到最短間隔，用於被喚醒之後
+func (b *Backoff) Reset() {
+	b.cur = b.Min
+}
+
+// Wake 是可以重複廣播的喚醒訊號，多個迴圈可同時等待；nil 的 Wake 永遠不會觸發
+type Wake struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// NewWake 建立喚醒訊號
+func NewWake() *Wake {
+	return &Wake{ch: make(chan struct{})}
+}
+
+// C 回傳下一次 Broadcast 時會關閉的 channel；
+// 請在開始處理前取得，處理期間收到的喚醒才不會遺漏
+func (w *Wake) C() <-chan struct{} {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ch
+}
+
+// Broadcast 喚醒所有正在等待的迴圈
+func (w *Wake) Broadcast() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	close(w.ch)
+	w.ch = make(chan struct{})
+}
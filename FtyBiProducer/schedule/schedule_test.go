@@ -0,0 +1,99 @@
+package schedule
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestBackoff 驗證有資料時立即再跑，空批次與失敗時倍增到上限
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(time.Second, 5*time.Second)
+	steps := []struct {
+		found int
+		err   error
+		want  time.Duration
+	}{
+		{0, nil, time.Second},
+		{0, nil, 2 * time.Second},
+		{0, errors.New("逾時"), 4 * time.Second},
+		{0, nil, 5 * time.Second},
+		{0, nil, 5 * time.Second},
+		{100, nil, 0},
+		{0, nil, time.Second},
+	}
+	for i, s := range steps {
+		if got := b.Next(s.found, s.err); got != s.want {
+			t.Fatalf("第 %d 輪預期等待 %s，實際 %s", i, s.want, got)
+		}
+	}
+
+	// max 未設定（小於 min）時為固定間隔
+	fixed := NewBackoff(time.Minute, 0)
+	for i := 0; i < 3; i++ {
+		if got := fixed.Next(0, nil); got != time.Minute {
+			t.Fatalf("固定間隔預期 1m，實際 %s", got)
+		}
+	}
+
+	// 調整範圍後，目前的等待時間落在新的範圍內
+	b.Next(0, nil)
+	b.Next(0, nil)
+	b.SetBounds(time.Second, 3*time.Second)
+	if got := b.Next(0, nil); got != 3*time.Second {
+		t.Fatalf("縮小上限後預期等待 3s，實際 %s", got)
+	}
+	b.SetBounds(10*time.Second, 0)
+	if got := b.Next(0, nil); got != 10*time.Second || b.Max != 10*time.Second {
+		t.Fatalf("提高下限後預期等待 10s，實際 %s", got)
+	}
+}
+
+// TestWake 驗證處理期間的廣播不會遺漏，nil Wake 不會觸發
+func TestWake(t *testing.T) {
+	w := NewWake()
+	c := w.C()
+	w.Broadcast()
+	select {
+	case <-c:
+	default:
+		t.Fatalf("Broadcast 後 channel 應已關閉")
+	}
+	select {
+	case <-w.C():
+		t.Fatalf("新的 channel 不應已關閉")
+	default:
+	}
+
+	var none *Wake
+	none.Broadcast()
+	if none.C() != nil {
+		t.Fatalf("nil Wake 應回傳 nil channel")
+	}
+}
+
+// TestWindow 驗證一般時段、跨午夜時段與全天
+func TestWindow(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2025, 6, 1, h, m, 0, 0, time.Local) }
+
+	w, err := ParseWindow("01:00", "05:30")
+	if err != nil {
+		t.Fatalf("解析失敗：%v", err)
+	}
+	if !w.Contains(at(1, 0)) || !w.Contains(at(5, 29)) || w.Contains(at(5, 30)) || w.Contains(at(0, 59)) {
+		t.Errorf("01:00~05:30 判斷錯誤")
+	}
+
+	night, _ := ParseWindow("22:00", "02:00")
+	if !night.Contains(at(23, 0)) || !night.Contains(at(1, 0)) || night.Contains(at(12, 0)) {
+		t.Errorf("跨午夜時段判斷錯誤")
+	}
+
+	all, _ := ParseWindow("", "")
+	if !all.Contains(at(12, 0)) {
+		t.Errorf("未設定時段應為全天")
+	}
+	if _, err := ParseWindow("25:00", "02:00"); err == nil {
+		t.Errorf("不合法的時間應回傳錯誤")
+	}
+}
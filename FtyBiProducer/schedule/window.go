@@ -0,0 +1,46 @@
+// 每日時段：例如只在離峰時段執行清理
+package schedule
+
+import (
+	"fmt"
+	"time"
+)
+
+// Window 為每天的時段 [Start, End)，以距午夜的時間表示；End 小於 Start 表示跨午夜，
+// 零值的 Window 代表全天
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseWindow 解析 15:04 格式的起迄時間，兩者皆為空字串時回傳全天
+func ParseWindow(start, end string) (Window, error) {
+	if start == "" && end == "" {
+		return Window{}, nil
+	}
+	var w Window
+	for _, p := range []struct {
+		s   string
+		dst *time.Duration
+	}{{start, &w.Start}, {end, &w.End}} {
+		t, err := time.Parse("15:04", p.s)
+		if err != nil {
+			return Window{}, fmt.Errorf("時段 %q 格式應為 15:04", p.s)
+		}
+		*p.dst = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return w, nil
+}
+
+// Contains 回傳 t（當地時間）是否在時段內
+func (w Window) Contains(t time.Time) bool {
+	if w.Start == w.End {
+		return true
+	}
+	h, m, s := t.Clock()
+	d := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	if w.Start < w.End {
+		return d >= w.Start && d < w.End
+	}
+	return d >= w.Start || d < w.End
+}
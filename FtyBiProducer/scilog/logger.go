@@ -1,6 +1,8 @@
 package scilog
 
 import (
+	"SciCommon/redact"
+	"fmt"
 	"path/filepath"
 	"time"
 
@@ -9,6 +11,22 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
+// Level 為 NewFileLogger 建立的 Logger 的最低記錄級別，可在執行中以 SetLevel 調整
+var Level = zap.NewAtomicLevelAt(zapcore.InfoLevel)
+
+// SetLevel 調整最低記錄級別（debug、info、warn、error），空字串為 info
+func SetLevel(level string) error {
+	if level == "" {
+		level = "info"
+	}
+	l, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("不支援的 log_level %q", level)
+	}
+	Level.SetLevel(l)
+	return nil
+}
+
 // NewFileLogger 建立一個依「日期切檔」的 Zap Logger
 func NewFileLogger() (*zap.Logger, error) {
 	// 1. 定義 EncoderConfig（JSON 格式）
@@ -42,11 +60,10 @@ func NewFileLogger() (*zap.Logger, error) {
 		return nil, err
 	}
 
-	// 3. 建立 zapcore，將輸出導向 rotateWriter
-	ws := zapcore.AddSync(rotateWriter)
-	// 假設最低只記錄 Info 級別以上
-	level := zapcore.InfoLevel
-	core := zapcore.NewCore(encoder, ws, level)
+	// 3. 建立 zapcore，將輸出導向 rotateWriter，寫入前遮蔽密碼與金鑰
+	ws := redact.NewWriter(zapcore.AddSync(rotateWriter))
+	// 預設只記錄 Info 級別以上，載入設定後依 log_level 調整
+	core := zapcore.NewCore(encoder, ws, Level)
 
 	// 4. 最後建立 Logger，並加上呼叫者資訊與錯誤堆疊
 	logger := zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel))
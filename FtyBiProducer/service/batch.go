@@ -0,0 +1,351 @@
+// 批次狀態機：發送、確認、標記與啟動時的恢復
+package service
+
+import (
+	dbLayer "FtyBiProducer/db"
+	"FtyBiProducer/model"
+	"FtyBiProducer/mq"
+	"FtyBiProducer/resilience"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bytedance/sonic"
+
+	"gorm.io/gorm"
+)
+
+// ErrBadReceipt 表示回執無法解析或指向不存在、已 Failed 的批次，重送也不會成功
+var ErrBadReceipt = errors.New("回執無效")
+
+// batchOps 封裝 DDL / DML 批次在狀態機上的差異
+type batchOps struct {
+	kind         string // ddl 或 dml，用於錯誤訊息、metrics 與訊息的 Type
+	routingKey   mq.RoutingKey
+	stream       string // DML stream，預設 stream 與 DDL 為空字串
+	updateStatus func(ctx context.Context, db *gorm.DB, batchID int64, status model.BatchStatus, errMsg string) error
+	markLogs     func(ctx context.Context, db *gorm.DB, batchID int64) error
+	status       func(ctx context.Context, db *gorm.DB, batchID int64) (model.BatchStatus, error)
+}
+
+var (
+	ddlBatchOps = batchOps{
+		kind:         model.MessageTypeDDL,
+		routingKey:   mq.RoutingKeyDDL,
+		updateStatus: dbLayer.UpdateLogBatchDdlStatus,
+		markLogs:     dbLayer.MarkDdlProcessedByBatch,
+		status:       dbLayer.GetLogBatchDdlStatus,
+	}
+	dmlBatchOps = batchOps{
+		kind:         model.MessageTypeDML,
+		routingKey:   mq.RoutingKeyDML,
+		updateStatus: dbLayer.UpdateLogBatchDmlStatus,
+		markLogs:     dbLayer.MarkDmlProcessedByBatch,
+		status:       dbLayer.GetLogBatchDmlStatus,
+	}
+)
+
+// forStream 回傳改用指定 DML stream RoutingKey 的 batchOps
+func (o batchOps) forStream(stream string) batchOps {
+	o.routingKey = mq.DmlRoutingKey(stream)
+	o.stream = stream
+	return o
+}
+
+// delivery 為一個待發送的批次
+type delivery struct {
+	ops     batchOps
+	batchID int64
+	body    []byte
+	env     model.Envelope
+}
+
+// newDelivery 建立待發送的批次：依 mq.compression 壓縮 body，信封帶上工廠、來源資料庫、SerialNo 範圍與筆數
+func (p *Processor) newDelivery(ops batchOps, batchID, from, to int64, items int, body []byte) (delivery, error) {
+	compressed, encoding, err := mq.Compress(p.compression, body)
+	if err != nil {
+		return delivery{}, resilience.Config(fmt.Errorf("壓縮 %s 批次 %d 失敗：%w", ops.kind, batchID, err))
+	}
+	return delivery{
+		ops:     ops,
+		batchID: batchID,
+		body:    compressed,
+		env: model.Envelope{
+			FactoryID:       p.factory,
+			SourceServer:    p.sourceServer,
+			SourceDatabase:  p.sourceDatabase,
+			MessageType:     ops.kind,
+			SchemaVersion:   model.EnvelopeSchemaVersion,
+			BatchID:         batchID,
+			Stream:          ops.stream,
+			SerialNoFrom:    from,
+			SerialNoTo:      to,
+			CreatedAt:       time.Now(),
+			ContentEncoding: encoding,
+			ItemCount:       items,
+			UncompressedLen: len(body),
+		},
+	}, nil
+}
+
+// withOrder 在信封帶上批次序號與前一個批次的 SerialNoTo；replay 批次不帶，Consumer 不檢查順序
+func (d delivery) withOrder(sequence, prevSerialNoTo int64) delivery {
+	d.env.Sequence = sequence
+	d.env.PrevSerialNoTo = prevSerialNoTo
+	return d
+}
+
+// deliverCreated 在建立後續批次失敗時，先送出已建立的批次（避免範圍停在 Created 直到重啟），再回傳 cause
+func (p *Processor) deliverCreated(ctx context.Context, ds []delivery, cause error) error {
+	if len(ds) > 0 {
+		p.deliverBatches(ctx, ds)
+	}
+	return cause
+}
+
+// deliverBatch 讓一個 Created / Published 的批次走完 Published → Confirmed → Marked
+// 發送失敗時轉為 Failed，該範圍會在下一輪由新的批次重新涵蓋
+// 等待回執時停在 Confirmed，由 HandleReceipt 完成後續
+func (p *Processor) deliverBatch(ctx context.Context, d delivery) error {
+	return p.deliverBatches(ctx, []delivery{d})
+}
+
+// deliverBatches 與 deliverBatch 相同，但一次送出多個批次再各自等待確認（MQClient 會管線化發送），
+// 每個批次依自己的結果轉為 Confirmed 或 Failed；回傳第一個錯誤
+func (p *Processor) deliverBatches(ctx context.Context, ds []delivery) error {
+	p.startProgress(ds)
+	defer p.finishProgress(ds)
+
+	// 1. 全部轉為 Published
+	for _, d := range ds {
+		if err := d.ops.updateStatus(ctx, p.db, d.batchID, model.BatchStatusPublished, ""); err != nil {
+			return fmt.Errorf("更新 %s 批次 %d 為 Published 失敗：%w", d.ops.kind, d.batchID, err)
+		}
+	}
+
+	// 2. 發送消息，取得每一筆的確認結果
+	msgs := make([]mq.Message, len(ds))
+	for i, d := range ds {
+		msgs[i] = mq.Message{RoutingKey: d.ops.routingKey, Body: d.body, Envelope: d.env}
+	}
+	results := mq.PublishBatch(ctx, p.publisher, msgs)
+
+	// 3. 依各自的結果更新狀態
+	var firstErr error
+	for i, d := range ds {
+		if err := p.finishDelivery(ctx, d, results[i]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// finishDelivery 依發送結果把批次轉為 Failed，或 Confirmed 後標記（等待回執時停在 Confirmed）
+func (p *Processor) finishDelivery(ctx context.Context, d delivery, publishErr error) error {
+	ops, batchID := d.ops, d.batchID
+	if publishErr != nil {
+		// 沒有 Queue 可接收的訊息重送也不會成功，需修正 Queue 綁定
+		wrap := resilience.MQ
+		if errors.Is(publishErr, mq.ErrReturned) {
+			wrap = resilience.Config
+		}
+		// ctx 可能已逾時，狀態仍需寫回，改用不會被取消的 context
+		if uerr := ops.updateStatus(context.WithoutCancel(ctx), p.db, batchID, model.BatchStatusFailed, publishErr.Error()); uerr != nil {
+			return wrap(fmt.Errorf("發送 MQ 訊息失敗：%w（更新為 Failed 亦失敗：%v）", publishErr, uerr))
+		}
+		return wrap(fmt.Errorf("發送 MQ 訊息失敗：%w", publishErr))
+	}
+
+	// broker 已收到，之後的 DB 失敗會讓範圍一直被佔用到重啟，暫時性錯誤先就地重試幾次
+	retry := resilience.NewRetry(confirmedRetryBase, confirmedRetryMax)
+	if err := resilience.Do(ctx, retry, confirmedRetryAttempts, func() error {
+		return ops.updateStatus(ctx, p.db, batchID, model.BatchStatusConfirmed, "")
+	}); err != nil {
+		// 回執比 broker 確認先到，批次已直接結案
+		if errors.Is(err, dbLayer.ErrInvalidBatchTransition) && p.batchSettled(ctx, ops, batchID) {
+			return nil
+		}
+		return resilience.DB(fmt.Errorf("更新 %s 批次 %d 為 Confirmed 失敗：%w", ops.kind, batchID, err))
+	}
+
+	if p.awaitReceipt {
+		return nil
+	}
+	return resilience.Do(ctx, retry, confirmedRetryAttempts, func() error {
+		return p.markBatch(ctx, ops, batchID)
+	})
+}
+
+// broker 確認後更新狀態、標記 Log 的重試設定
+const (
+	confirmedRetryAttempts = 3
+	confirmedRetryBase     = 500 * time.Millisecond
+	confirmedRetryMax      = 5 * time.Second
+)
+
+// markBatch 在同一個 transaction 內標記 Log 範圍並把批次轉為 Marked
+func (p *Processor) markBatch(ctx context.Context, ops batchOps, batchID int64) error {
+	err := p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := ops.markLogs(ctx, tx, batchID); err != nil {
+			return fmt.Errorf("標記 %s Log 失敗 : %w", ops.kind, err)
+		}
+		return ops.updateStatus(ctx, tx, batchID, model.BatchStatusMarked, "")
+	})
+	if err != nil {
+		return fmt.Errorf("標記 %s 批次 %d 失敗：%w", ops.kind, batchID, err)
+	}
+	return nil
+}
+
+// RecoverBatches 在啟動時處理停在中間狀態的批次，回傳處理的批次數
+//   - Created / Published：以原 BatchID 重新發送該範圍內尚未處理的 Log（Consumer 端對重複訊息為冪等）
+//   - Confirmed：broker 已收到，只需補做標記；等待回執時則維持原狀，回執仍在 Queue 中
+func (p *Processor) RecoverBatches(ctx context.Context) (int, error) {
+	ddlRecords, err := dbLayer.GetPendingLogBatchDdlRecords(ctx, p.db)
+	if err != nil {
+		return 0, fmt.Errorf("查詢未完成的 DDL 批次失敗：%w", err)
+	}
+	dmlRecords, err := dbLayer.GetPendingLogBatchDmlRecords(ctx, p.db)
+	if err != nil {
+		return 0, fmt.Errorf("查詢未完成的 DML 批次失敗：%w", err)
+	}
+
+	recovered := 0
+	for _, rec := range ddlRecords {
+		if rec.Status == model.BatchStatusConfirmed {
+			if p.awaitReceipt {
+				continue
+			}
+			if err := p.markBatch(ctx, ddlBatchOps, rec.LogBatchDdlRecordID); err != nil {
+				return recovered, err
+			}
+			recovered++
+			continue
+		}
+		logs, err := dbLayer.GetUnprocessedDdlLogsInRange(ctx, p.db, rec.SerialNoFrom, rec.SerialNoTo)
+		if err != nil {
+			return recovered, fmt.Errorf("查詢 DDL 批次 %d 的 Log 失敗：%w", rec.LogBatchDdlRecordID, err)
+		}
+		// 建立批次後才新增的過濾規則同樣適用
+		entries, _, err := p.filterDdlLogs(ctx, parseDdlLogs(logs), true)
+		if err != nil {
+			return recovered, fmt.Errorf("過濾 DDL 批次 %d 的 Log 失敗：%w", rec.LogBatchDdlRecordID, err)
+		}
+		if len(entries) == 0 {
+			if err := p.failEmptyBatch(ctx, ddlBatchOps, rec.LogBatchDdlRecordID); err != nil {
+				return recovered, err
+			}
+			continue
+		}
+		if err := p.publishDdlBatch(ctx, rec, entries); err != nil {
+			return recovered, fmt.Errorf("恢復 DDL 批次 %d 失敗：%w", rec.LogBatchDdlRecordID, err)
+		}
+		recovered++
+	}
+
+	for _, rec := range dmlRecords {
+		if rec.Status == model.BatchStatusConfirmed {
+			if p.awaitReceipt {
+				continue
+			}
+			if err := p.markBatch(ctx, dmlBatchOps, rec.LogBatchDmlRecordID); err != nil {
+				return recovered, err
+			}
+			recovered++
+			continue
+		}
+		logs, err := dbLayer.GetUnprocessedDmlLogsInRange(ctx, p.db, rec.Stream, rec.SerialNoFrom, rec.SerialNoTo)
+		if err != nil {
+			return recovered, fmt.Errorf("查詢 DML 批次 %d 的 Log 失敗：%w", rec.LogBatchDmlRecordID, err)
+		}
+		if len(logs) == 0 {
+			if err := p.failEmptyBatch(ctx, dmlBatchOps, rec.LogBatchDmlRecordID); err != nil {
+				return recovered, err
+			}
+			continue
+		}
+		if err := p.publishDmlBatch(ctx, rec, logs); err != nil {
+			return recovered, fmt.Errorf("恢復 DML 批次 %d 失敗：%w", rec.LogBatchDmlRecordID, err)
+		}
+		recovered++
+	}
+
+	return recovered, nil
+}
+
+// failEmptyBatch 處理範圍內已無未處理 Log 的批次（已被其他批次標記），直接結案為 Failed
+func (p *Processor) failEmptyBatch(ctx context.Context, ops batchOps, batchID int64) error {
+	if err := ops.updateStatus(ctx, p.db, batchID, model.BatchStatusFailed, "恢復時範圍內已無未處理的 Log"); err != nil {
+		return fmt.Errorf("結案 %s 批次 %d 失敗：%w", ops.kind, batchID, err)
+	}
+	return nil
+}
+
+// HandleReceipt 處理 TpeBiConsumer 的套用回執
+//   - Applied：標記 Log 範圍，批次轉為 Marked
+//   - Rejected：批次轉為 Rejected，範圍保留不再自動重送，原訊息已在 DLQ
+//
+// 重複的回執（批次已是 Marked / Rejected）會被忽略；批次尚未送出完成時回傳錯誤讓回執稍後重試；
+// 格式錯誤、批次不存在或已 Failed 的回執會回傳 ErrBadReceipt
+func (p *Processor) HandleReceipt(ctx context.Context, body []byte) (*model.ApplyReceipt, error) {
+	var receipt model.ApplyReceipt
+	if err := sonic.Unmarshal(body, &receipt); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadReceipt, err)
+	}
+
+	var ops batchOps
+	switch receipt.Kind {
+	case model.ReceiptKindDDL:
+		ops = ddlBatchOps
+	case model.ReceiptKindDML:
+		ops = dmlBatchOps
+	default:
+		return &receipt, fmt.Errorf("%w: 未知的 Kind %q", ErrBadReceipt, receipt.Kind)
+	}
+
+	var err error
+	switch receipt.Outcome {
+	case model.ReceiptOutcomeApplied:
+		err = p.markBatch(ctx, ops, receipt.BatchID)
+	case model.ReceiptOutcomeRejected:
+		err = ops.updateStatus(ctx, p.db, receipt.BatchID, model.BatchStatusRejected, receipt.Error)
+	default:
+		return &receipt, fmt.Errorf("%w: 未知的 Outcome %q", ErrBadReceipt, receipt.Outcome)
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &receipt, fmt.Errorf("%w: %s 批次 %d 不存在", ErrBadReceipt, receipt.Kind, receipt.BatchID)
+	}
+	if errors.Is(err, dbLayer.ErrInvalidBatchTransition) {
+		return &receipt, p.receiptConflict(ctx, ops, receipt.BatchID)
+	}
+	return &receipt, err
+}
+
+// receiptConflict 依批次目前的狀態處理無法轉換狀態的回執
+//   - Marked / Rejected（或狀態機前的舊資料）：回執重送，忽略
+//   - Failed：範圍已由其他批次重新涵蓋，回執不再有意義
+//   - Created / Published：批次尚未送出完成，回傳錯誤讓回執稍後重試
+func (p *Processor) receiptConflict(ctx context.Context, ops batchOps, batchID int64) error {
+	status, err := ops.status(ctx, p.db, batchID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("%w: %s 批次 %d 不存在", ErrBadReceipt, ops.kind, batchID)
+	}
+	if err != nil {
+		return fmt.Errorf("查詢 %s 批次 %d 狀態失敗：%w", ops.kind, batchID, err)
+	}
+	switch status {
+	case "", model.BatchStatusMarked, model.BatchStatusRejected:
+		return nil
+	case model.BatchStatusFailed:
+		return fmt.Errorf("%w: %s 批次 %d 已為 Failed", ErrBadReceipt, ops.kind, batchID)
+	default:
+		return fmt.Errorf("%s 批次 %d 目前為 %s，稍後重試回執", ops.kind, batchID, status)
+	}
+}
+
+// batchSettled 回傳批次是否已由回執結案（Marked / Rejected）；查詢失敗視為尚未結案
+func (p *Processor) batchSettled(ctx context.Context, ops batchOps, batchID int64) bool {
+	status, err := ops.status(ctx, p.db, batchID)
+	return err == nil && (status == model.BatchStatusMarked || status == model.BatchStatusRejected)
+}
@@ -0,0 +1,227 @@
+// 以 SQL Server Change Tracking 產生 DmlLog
+package service
+
+import (
+	dbLayer "FtyBiProducer/db"
+	"FtyBiProducer/resilience"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Change Tracking 查詢結果中附加欄位的前綴，與來源資料表欄位區隔
+const (
+	ctVersionColumn   = "__CT_Version"
+	ctOperationColumn = "__CT_Operation"
+	ctPKPrefix        = "__CT_PK_"
+)
+
+// generateLogsFromChangeTracking 讀取上次同步版本之後的變更，轉成 Insert / Delete 的 DmlLog，
+// 並在同一個 transaction 內更新 DmlSyncVersion；來源資料列不做任何更新
+func (p *Processor) generateLogsFromChangeTracking(ctx context.Context, tableName, stream string) error {
+	// 1. 取得目前版本與最小有效版本
+	current, minValid, err := dbLayer.GetChangeTrackingVersions(ctx, p.db, tableName)
+	if errors.Is(err, dbLayer.ErrChangeTrackingDisabled) {
+		return resilience.Config(fmt.Errorf("查詢 %s Change Tracking 版本失敗：%w", tableName, err))
+	}
+	if err != nil {
+		return fmt.Errorf("查詢 %s Change Tracking 版本失敗：%w", tableName, err)
+	}
+
+	// 2. 第一次同步：從目前版本開始追蹤，既有資料需另行完整同步
+	last, ok, err := dbLayer.GetDmlSyncVersion(ctx, p.db, tableName)
+	if err != nil {
+		return fmt.Errorf("查詢 %s 同步版本失敗：%w", tableName, err)
+	}
+	if !ok {
+		if err := dbLayer.SaveDmlSyncVersion(ctx, p.db, tableName, current); err != nil {
+			return fmt.Errorf("初始化 %s 同步版本失敗：%w", tableName, err)
+		}
+		return nil
+	}
+	if last < minValid {
+		return resilience.Config(fmt.Errorf("%s 同步版本 %d 早於最小有效版本 %d：%w", tableName, last, minValid, dbLayer.ErrSyncVersionExpired))
+	}
+	if last >= current {
+		return nil
+	}
+
+	// 3. 取得主鍵欄位（Change Tracking 要求資料表必須有主鍵）
+	columnTypes, err := p.getColumnTypesOnce(ctx, tableName)
+	if err != nil {
+		return fmt.Errorf("取得 %s 欄位資訊失敗: %w", tableName, err)
+	}
+	var pkCols []string
+	for _, ct := range columnTypes {
+		if isPK, _ := ct.PrimaryKey(); isPK {
+			pkCols = append(pkCols, ct.Name())
+		}
+	}
+	if len(pkCols) == 0 {
+		return resilience.Config(fmt.Errorf("%s 沒有主鍵，無法使用 Change Tracking", tableName))
+	}
+
+	// 4. 撈取 (last, current] 之間的淨變更；Insert/Update 關聯目前資料列，Delete 只有主鍵
+	var rows []map[string]interface{}
+	if err := p.db.WithContext(ctx).
+		Raw(changeTrackingQuery(tableName, pkCols), last, current).
+		Scan(&rows).Error; err != nil {
+		return fmt.Errorf("查詢 %s Change Tracking 變更失敗：%w", tableName, err)
+	}
+
+	// 5. 寫入 DmlLog 與同步版本，同一個 transaction 內完成
+	tx := p.db.WithContext(ctx).Begin()
+	if err := tx.Error; err != nil {
+		return fmt.Errorf("開啟 transaction 失敗: %w", err)
+	}
+	changes := changeTrackingEntries(rows, pkCols)
+	codec := newRowCodec(columnTypes)
+	jsonList := make([]string, 0, len(changes))
+	for _, c := range changes {
+		var jsonBytes []byte
+		var err error
+		if c.action == "Update" {
+			jsonBytes, err = buildDmlUpdateEntry(tableName, c.before, c.data, codec)
+		} else {
+			jsonBytes, err = buildDmlEntry(tableName, c.action, c.data, codec)
+		}
+		if err != nil {
+			tx.Rollback()
+			return resilience.Poison(fmt.Errorf("JSON 編碼失敗: %w", err))
+		}
+		jsonList = append(jsonList, string(jsonBytes))
+	}
+	if err := dbLayer.InsertDmlLogJSON(ctx, tx, stream, jsonList); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("寫入 DmlLog 失敗: %w", err)
+	}
+	if err := dbLayer.SaveDmlSyncVersion(ctx, tx, tableName, current); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("更新 %s 同步版本失敗：%w", tableName, err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("commit 失敗：%w", err)
+	}
+	return nil
+}
+
+// changeTrackingQuery 組出 CHANGETABLE 查詢，參數依序為 last version、current version
+func changeTrackingQuery(tableName string, pkCols []string) string {
+	table := dbLayer.QuoteIdent(tableName)
+	selects := []string{
+		"CT.SYS_CHANGE_VERSION AS " + dbLayer.QuoteIdent(ctVersionColumn),
+		"CT.SYS_CHANGE_OPERATION AS " + dbLayer.QuoteIdent(ctOperationColumn),
+	}
+	joins := make([]string, 0, len(pkCols))
+	for _, pk := range pkCols {
+		col := dbLayer.QuoteIdent(pk)
+		selects = append(selects, "CT."+col+" AS "+dbLayer.QuoteIdent(ctPKPrefix+pk))
+		joins = append(joins, "T."+col+" = CT."+col)
+	}
+	selects = append(selects, "T.*")
+	return fmt.Sprintf(
+		"SELECT %s FROM CHANGETABLE(CHANGES %s, ?) AS CT LEFT JOIN %s AS T ON %s WHERE CT.SYS_CHANGE_VERSION <= ? ORDER BY CT.SYS_CHANGE_VERSION",
+		strings.Join(selects, ", "), table, table, strings.Join(joins, " AND "))
+}
+
+// ctChange 為一筆要寫入 DmlLog 的變更，before 只有 Update 才有值（舊主鍵）
+type ctChange struct {
+	action string
+	before map[string]interface{}
+	data   map[string]interface{}
+}
+
+// changeTrackingEntries 把 CHANGETABLE 結果轉成 DmlLog 變更，保持 SYS_CHANGE_VERSION 順序。
+// 同一個版本內同一個主鍵的 Delete 與 Insert 合併為一筆 Update；主鍵不同的 Delete 與 Insert
+// 無法確認是同一列的主鍵變更，分別送出 Delete 與 Insert
+func changeTrackingEntries(rows []map[string]interface{}, pkCols []string) []ctChange {
+	changes := make([]ctChange, 0, len(rows))
+	versions := make([]interface{}, 0, len(rows))
+	for _, row := range rows {
+		action, before, data := changeTrackingEntry(row, pkCols)
+		if data == nil {
+			// Insert/Update 後在 current 之後又被刪除，等下一輪的 Delete
+			continue
+		}
+		changes = append(changes, ctChange{action: action, before: before, data: data})
+		versions = append(versions, row[ctVersionColumn])
+	}
+
+	// 依版本與主鍵找出成對的 Delete / Insert
+	type pairKey struct {
+		version interface{}
+		key     string
+	}
+	type pair struct{ del, ins, dels, inss int }
+	pairs := make(map[pairKey]*pair)
+	for i, c := range changes {
+		k := pairKey{version: versions[i], key: ctKeyString(c.data, pkCols)}
+		pr, ok := pairs[k]
+		if !ok {
+			pr = &pair{}
+			pairs[k] = pr
+		}
+		switch c.action {
+		case "Delete":
+			pr.del, pr.dels = i, pr.dels+1
+		case "Insert":
+			pr.ins, pr.inss = i, pr.inss+1
+		}
+	}
+	drop := make(map[int]bool)
+	for _, pr := range pairs {
+		if pr.dels != 1 || pr.inss != 1 {
+			continue
+		}
+		changes[pr.ins].action = "Update"
+		changes[pr.ins].before = changes[pr.del].data
+		drop[pr.del] = true
+	}
+
+	result := changes[:0]
+	for i, c := range changes {
+		if !drop[i] {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// ctKeyString 以主鍵欄位的值組成比對用的字串
+func ctKeyString(data map[string]interface{}, pkCols []string) string {
+	parts := make([]string, len(pkCols))
+	for i, pk := range pkCols {
+		parts[i] = fmt.Sprintf("%T:%v", data[pk], data[pk])
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// changeTrackingEntry 把一筆 CHANGETABLE 結果轉成 DmlLog 的 Action、舊主鍵與資料；
+// 回傳 nil 資料表示該列已不存在，略過
+func changeTrackingEntry(row map[string]interface{}, pkCols []string) (string, map[string]interface{}, map[string]interface{}) {
+	key := make(map[string]interface{}, len(pkCols))
+	for _, pk := range pkCols {
+		key[pk] = row[ctPKPrefix+pk]
+	}
+	op, _ := row[ctOperationColumn].(string)
+	if op == "D" {
+		return "Delete", nil, key
+	}
+
+	if row[pkCols[0]] == nil {
+		return "", nil, nil
+	}
+	data := make(map[string]interface{}, len(row))
+	for k, v := range row {
+		if strings.HasPrefix(k, "__CT_") {
+			continue
+		}
+		data[k] = v
+	}
+	// Insert 由 TpeBiConsumer 以 MERGE upsert；Update 帶舊主鍵，在同一個 transaction 內更新
+	if op == "U" {
+		return "Update", key, data
+	}
+	return "Insert", nil, data
+}
@@ -0,0 +1,106 @@
+// 批次大小：依筆數撈取 Log，再依 byte 預算切成多個批次（每個批次一則訊息）
+package service
+
+import (
+	"FtyBiProducer/config"
+	dbLayer "FtyBiProducer/db"
+	"FtyBiProducer/model"
+
+	"github.com/bytedance/sonic"
+)
+
+// DefaultMaxMessageBytes 為未設定 batch.max_bytes 時，單一訊息 Body 壓縮前的大小上限
+const DefaultMaxMessageBytes = 4 << 20
+
+// messageOverhead 為 DdlMessage / DmlMessage 除了清單內容以外的大小上限，
+// 例如 {"BatchID":9223372036854775807,"XMLList":[],"Events":[]}
+const messageOverhead = 64
+
+// SetBatchLimits 設定每個批次的筆數與大小上限，執行中也可以呼叫，下一輪開始生效
+func (p *Processor) SetBatchLimits(limits config.BatchConfig) {
+	p.limitsMu.Lock()
+	defer p.limitsMu.Unlock()
+	p.limits = limits
+}
+
+// batchLimits 回傳目前設定的上限（0 表示使用預設值）
+func (p *Processor) batchLimits() config.BatchConfig {
+	p.limitsMu.RLock()
+	defer p.limitsMu.RUnlock()
+	return p.limits
+}
+
+// SetCompression 設定訊息 Body 的壓縮方式（mq.compression）
+func (p *Processor) SetCompression(compression string) {
+	p.compression = compression
+}
+
+func (p *Processor) ddlMaxRows() int {
+	if n := p.batchLimits().DdlMaxRows; n > 0 {
+		return n
+	}
+	return dbLayer.DdlBatchSize
+}
+
+func (p *Processor) dmlMaxRows() int {
+	if n := p.batchLimits().DmlMaxRows; n > 0 {
+		return n
+	}
+	return dbLayer.DmlBatchSize
+}
+
+func (p *Processor) maxMessageBytes() int {
+	if n := p.batchLimits().MaxBytes; n > 0 {
+		return n
+	}
+	return DefaultMaxMessageBytes
+}
+
+// ddlChunks 依 byte 預算把依 SerialNo 排序的 DdlLog 切段，大小包含 XML 與 EVENTDATA 摘要
+func (p *Processor) ddlChunks(entries []ddlEntry) [][]ddlEntry {
+	return splitBySize(entries, func(e ddlEntry) int {
+		return encodedLen(e.log.XML) + encodedEventLen(e.event)
+	}, p.maxMessageBytes())
+}
+
+// dmlChunks 依 byte 預算把依 SerialNo 排序的 DmlLog 切段
+func (p *Processor) dmlChunks(logs []model.DmlLog) [][]model.DmlLog {
+	return splitBySize(logs, func(l model.DmlLog) int { return encodedLen(l.JSON) }, p.maxMessageBytes())
+}
+
+// splitBySize 依序把 items 切成編碼後不超過 budget 的段落，順序不變；
+// 單筆就超過 budget 時自成一段，不會被丟棄
+func splitBySize[T any](items []T, size func(T) int, budget int) [][]T {
+	var chunks [][]T
+	start, total := 0, messageOverhead
+	for i, item := range items {
+		n := size(item)
+		if i > start && total+n > budget {
+			chunks = append(chunks, items[start:i])
+			start, total = i, messageOverhead
+		}
+		total += n
+	}
+	if start < len(items) {
+		chunks = append(chunks, items[start:])
+	}
+	return chunks
+}
+
+// encodedLen 回傳字串放進 JSON 陣列後佔用的位元組數（含跳脫字元與分隔逗號）
+func encodedLen(s string) int {
+	b, err := sonic.Marshal(s)
+	if err != nil {
+		return len(s) + 3
+	}
+	return len(b) + 1
+}
+
+// encodedEventLen 回傳 DdlEvent 編碼為 JSON 陣列元素時的長度（含分隔逗號）
+func encodedEventLen(event model.DdlEvent) int {
+	b, err := sonic.Marshal(event)
+	if err != nil {
+		return 256
+	}
+	return len(b) + 1
+}
@@ -0,0 +1,176 @@
+// DDL 過濾與摘要：解析 DdlLog 的 EVENTDATA，依 ddl_filter 規則決定是否送到 TPE
+package service
+
+import (
+	"FtyBiProducer/config"
+	dbLayer "FtyBiProducer/db"
+	"FtyBiProducer/metrics"
+	"FtyBiProducer/model"
+	"FtyBiProducer/resilience"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ddlEventData 對應 DDL trigger 寫入的 <DDLData><EventData><EVENT_INSTANCE>...</EVENT_INSTANCE></EventData></DDLData>
+type ddlEventData struct {
+	EventType  string `xml:"EventData>EVENT_INSTANCE>EventType"`
+	SchemaName string `xml:"EventData>EVENT_INSTANCE>SchemaName"`
+	ObjectName string `xml:"EventData>EVENT_INSTANCE>ObjectName"`
+	ObjectType string `xml:"EventData>EVENT_INSTANCE>ObjectType"`
+	LoginName  string `xml:"EventData>EVENT_INSTANCE>LoginName"`
+}
+
+// parseDdlEvent 解析 DdlLog 的 XML，回傳 EVENTDATA 摘要
+func parseDdlEvent(l model.DdlLog) (model.DdlEvent, error) {
+	event := model.DdlEvent{SerialNo: l.SerialNo}
+	var data ddlEventData
+	if err := xml.Unmarshal([]byte(l.XML), &data); err != nil {
+		return event, fmt.Errorf("解析 DdlLog %d 的 XML 失敗：%w", l.SerialNo, err)
+	}
+	event.EventType = strings.TrimSpace(data.EventType)
+	event.SchemaName = strings.TrimSpace(data.SchemaName)
+	event.ObjectName = strings.TrimSpace(data.ObjectName)
+	event.ObjectType = strings.TrimSpace(data.ObjectType)
+	event.LoginName = strings.TrimSpace(data.LoginName)
+	return event, nil
+}
+
+// ddlEntry 為 DdlLog 與其 EVENTDATA 摘要；每筆 Log 只解析一次，過濾、切段與打包訊息共用
+type ddlEntry struct {
+	log   model.DdlLog
+	event model.DdlEvent // 解析失敗時只有 SerialNo
+	err   error          // EVENTDATA 解析失敗的原因
+}
+
+// parseDdlLogs 依序解析 DdlLog 的 EVENTDATA
+func parseDdlLogs(logs []model.DdlLog) []ddlEntry {
+	entries := make([]ddlEntry, len(logs))
+	for i, l := range logs {
+		event, err := parseDdlEvent(l)
+		entries[i] = ddlEntry{log: l, event: event, err: err}
+	}
+	return entries
+}
+
+// SetDdlFilter 設定 DDL 過濾規則
+func (p *Processor) SetDdlFilter(filter config.DdlFilterConfig) {
+	p.ddlFilter = filter
+}
+
+// filterDdlLogs 依 ddl_filter 規則過濾 DdlLog，回傳要送出的 Log 與被過濾的筆數；
+// tag 為 true 時把被過濾的 Log 記錄原因（之後不會再被撈出）並計入 ddl_filtered_total，重送時則只略過不修改
+func (p *Processor) filterDdlLogs(ctx context.Context, entries []ddlEntry, tag bool) ([]ddlEntry, int, error) {
+	if !p.ddlFilter.Enabled() || len(entries) == 0 {
+		return entries, 0, nil
+	}
+
+	// 1. 有規則限定 BITaskInfo 的資料表時才讀取
+	var biTables map[string]bool
+	for _, r := range p.ddlFilter.Rules {
+		if !r.BITaskTables {
+			continue
+		}
+		tasks, err := p.loadTasks(ctx)
+		if err != nil {
+			return nil, 0, resilience.DB(err)
+		}
+		biTables = make(map[string]bool, len(tasks))
+		for _, t := range tasks {
+			biTables[strings.ToUpper(t.Name)] = true
+		}
+		break
+	}
+
+	// 2. 逐筆比對，被過濾的依原因分組
+	var kept []ddlEntry
+	filtered := make(map[string][]int64)
+	var eventTypes []string
+	for _, e := range entries {
+		reason := ""
+		if e.err != nil {
+			// 無法判斷事件內容時不送出，避免誤送被排除的 DDL
+			reason = "EVENTDATA 解析失敗"
+		} else {
+			reason = p.ddlFilterReason(e.event, biTables)
+		}
+		if reason == "" {
+			kept = append(kept, e)
+			continue
+		}
+		filtered[reason] = append(filtered[reason], e.log.SerialNo)
+		eventTypes = append(eventTypes, e.event.EventType)
+	}
+	count := len(entries) - len(kept)
+	if !tag || count == 0 {
+		return kept, count, nil
+	}
+
+	// 3. 記錄原因，之後不會再被撈出；ReceivedByTPE 維持 false，表示沒有送到 TPE
+	reasons := make([]string, 0, len(filtered))
+	for reason := range filtered {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		if err := dbLayer.MarkDdlFiltered(ctx, p.db, filtered[reason], reason); err != nil {
+			return nil, 0, resilience.DB(fmt.Errorf("標記被過濾的 DdlLog 失敗：%w", err))
+		}
+	}
+	// 4. 只在第一次標記時計數，重送與恢復批次不會重複計入
+	for _, eventType := range eventTypes {
+		metrics.DdlFiltered.WithLabelValues(p.factory, eventType).Inc()
+	}
+	return kept, count, nil
+}
+
+// ddlFilterReason 回傳事件被排除的原因，允許送出時回傳空字串
+func (p *Processor) ddlFilterReason(event model.DdlEvent, biTables map[string]bool) string {
+	for i, r := range p.ddlFilter.Rules {
+		if !ddlRuleMatches(r, event, biTables) {
+			continue
+		}
+		if r.Action == config.DdlFilterAllow {
+			return ""
+		}
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		return "ddl_filter 規則 " + name
+	}
+	if p.ddlFilter.Default == config.DdlFilterDeny {
+		return "ddl_filter 預設 deny"
+	}
+	return ""
+}
+
+// ddlRuleMatches 回傳事件是否符合規則的所有條件
+func ddlRuleMatches(r config.DdlRule, event model.DdlEvent, biTables map[string]bool) bool {
+	if r.BITaskTables && !biTables[strings.ToUpper(event.ObjectName)] {
+		return false
+	}
+	return matchAny(r.EventTypes, event.EventType) &&
+		matchAny(r.Schemas, event.SchemaName) &&
+		matchAny(r.Objects, event.ObjectName) &&
+		matchAny(r.ObjectTypes, event.ObjectType) &&
+		matchAny(r.Logins, event.LoginName)
+}
+
+// matchAny 不分大小寫比對萬用字元，未設定條件時視為符合
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	value = strings.ToUpper(value)
+	for _, pattern := range patterns {
+		// 格式已在載入設定時檢查
+		if ok, _ := path.Match(strings.ToUpper(pattern), value); ok {
+			return true
+		}
+	}
+	return false
+}
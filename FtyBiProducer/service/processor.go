@@ -2,32 +2,102 @@
 package service
 
 import (
+	"FtyBiProducer/config"
 	dbLayer "FtyBiProducer/db"
+	"FtyBiProducer/metrics"
 	"FtyBiProducer/model"
 	"FtyBiProducer/mq"
+	"FtyBiProducer/resilience"
 	"context"
+	"errors"
 	"fmt"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bytedance/sonic"
 	"gorm.io/gorm"
 )
 
+// DmlGenerateChunkSize 為 dml_source.chunk_size 未設定時，每個 chunk 認領的筆數
+const DmlGenerateChunkSize = 500
+
 type Processor struct {
-	db       *gorm.DB
-	mqClient *mq.MQClient
+	// 工廠代號，作為 metrics 的 factory label 與訊息信封的 FactoryID
+	factory string
+	// 來源 SQL Server 與資料庫，放在訊息信封
+	sourceServer   string
+	sourceDatabase string
+	db             *gorm.DB
+	publisher      mq.Publisher
+	// 為 true 時，broker 確認後不標記 Log，等 TpeBiConsumer 回執 Applied 才標記
+	awaitReceipt bool
+	// 各資料表 DmlLog 的來源（BIStatus 或 Change Tracking）
+	dmlSources config.DmlSourceConfig
+	// 資料表（小寫）對應的 DML stream，未列出的走預設 stream
+	dmlStreams map[string]string
+	// BITaskInfo 中存放 stream 名稱的欄位，有設定時優先使用
+	dmlStreamColumn string
+	// 已設定的 stream 名稱，用於檢查 BITaskInfo 的值
+	knownStreams map[string]bool
+	// 每個批次的筆數與大小上限，管理 API 可在執行中調整
+	limitsMu sync.RWMutex
+	limits   config.BatchConfig
+	// 訊息 Body 的壓縮方式（mq.compression）
+	compression string
+	// 保留天數與清理方式
+	retention config.RetentionConfig
+	// DDL 過濾規則
+	ddlFilter config.DdlFilterConfig
 	// 緩存： key = tableName, value = []gorm.ColumnType
 	colTypeCache map[string][]gorm.ColumnType
+	// 各迴圈（ddl、dml、dml.<stream>）發送中與最近完成的批次
+	progressMu sync.Mutex
+	progress   map[string]model.BatchProgress
 }
 
-// New 建構 Processor 時，把 MQ Client 傳進來
-func New(db *gorm.DB, mqClient *mq.MQClient) *Processor {
+// New 建構 Processor 時，把 Publisher 傳進來（MQClient、FilePublisher 或 MemoryPublisher）
+func New(db *gorm.DB, publisher mq.Publisher) *Processor {
 	return &Processor{
 		db:           db,
-		mqClient:     mqClient,
+		publisher:    publisher,
 		colTypeCache: make(map[string][]gorm.ColumnType),
+		progress:     make(map[string]model.BatchProgress),
+	}
+}
+
+// SetFactory 設定工廠代號，多工廠時用來區分 metrics
+func (p *Processor) SetFactory(factoryID string) {
+	p.factory = factoryID
+}
+
+// SetSource 設定來源 SQL Server（host\instance）與資料庫名稱，放在訊息信封供 Consumer 辨識
+func (p *Processor) SetSource(server, database string) {
+	p.sourceServer = server
+	p.sourceDatabase = database
+}
+
+// SetAwaitReceipt 設定是否等待 TpeBiConsumer 的套用回執才標記 ReceivedByTPE
+func (p *Processor) SetAwaitReceipt(await bool) {
+	p.awaitReceipt = await
+}
+
+// SetDmlSources 設定各資料表 DmlLog 的產生方式
+func (p *Processor) SetDmlSources(sources config.DmlSourceConfig) {
+	p.dmlSources = sources
+}
+
+// SetDmlStreams 設定資料表分流；column 為 BITaskInfo 中存放 stream 名稱的欄位，可留空
+func (p *Processor) SetDmlStreams(streams []config.DmlStream, column string) {
+	p.dmlStreams = make(map[string]string)
+	p.knownStreams = make(map[string]bool, len(streams))
+	for _, s := range streams {
+		p.knownStreams[s.Name] = true
+		for _, t := range s.Tables {
+			p.dmlStreams[strings.ToLower(t)] = s.Name
+		}
 	}
+	p.dmlStreamColumn = column
 }
 
 func (p *Processor) getColumnTypesOnce(ctx context.Context, tableName string) ([]gorm.ColumnType, error) {
@@ -42,306 +112,377 @@ func (p *Processor) getColumnTypesOnce(ctx context.Context, tableName string) ([
 	return types, nil
 }
 
-// Process 負責撈取、打包 message 組成 JSON、呼叫 Publish
+// DdlLogProcess 撈取未處理的 DdlLog，依大小切成一或多個批次後一起發送
 func (p *Processor) DdlLogProcess(ctx context.Context, logCtn *int) error {
-	// 取得待處理 DDL Log
-	ddlLogs, err := dbLayer.GetUnprocessedDdlLogs(ctx, p.db)
+	// 取得待處理 DDL Log（依 SerialNo 排序）
+	ddlLogs, err := dbLayer.GetUnprocessedDdlLogs(ctx, p.db, p.ddlMaxRows())
 
 	if err != nil {
-		return fmt.Errorf(" 查詢失敗%v", err)
+		return resilience.DB(fmt.Errorf("查詢失敗：%w", err))
 	}
 
 	*logCtn = len(ddlLogs)
-	if len(ddlLogs) > 0 {
-		// 找出這個區間最早~最晚的時間
-		minSN, maxSN := ddlLogs[0].SerialNo, ddlLogs[0].SerialNo
-		for _, log := range ddlLogs[1:] {
-			if log.SerialNo < minSN {
-				minSN = log.SerialNo
-			}
-			if log.SerialNo > maxSN {
-				maxSN = log.SerialNo
-			}
+	// 被 ddl_filter 排除的 DDL 記錄原因，不送出
+	entries, _, err := p.filterDdlLogs(ctx, parseDdlLogs(ddlLogs), true)
+	if err != nil {
+		return err
+	}
+	// 依 byte 預算切段，每段建立一個批次紀錄（Status = Created），全部建立後一起發送
+	var ds []delivery
+	for _, chunk := range p.ddlChunks(entries) {
+		from, to := chunk[0].log.SerialNo, chunk[len(chunk)-1].log.SerialNo
+		order, err := dbLayer.NextDdlBatchOrder(ctx, p.db, from)
+		if err != nil {
+			return p.deliverCreated(ctx, ds, resilience.DB(fmt.Errorf("查詢 DDL 批次序號失敗：%w", err)))
 		}
-
-		// 建立批次處理的紀錄
 		record := model.LogBatchDdlRecord{
-			SerialNoFrom: minSN,
-			SerialNoTo:   maxSN,
+			SerialNoFrom:   from,
+			SerialNoTo:     to,
+			Sequence:       order.Sequence,
+			PrevSerialNoTo: order.PrevSerialNoTo,
 		}
 
 		// 批次處理紀錄 寫入DB
 		batchID, err := dbLayer.InsertLogBatchDdlRecord(ctx, p.db, &record)
 		if err != nil {
-			return fmt.Errorf("新增 LogBatchDdlRecord 失敗：%v", err)
+			return p.deliverCreated(ctx, ds, resilience.DB(fmt.Errorf("新增 LogBatchDdlRecord 失敗：%w", err)))
 		}
-
-		// 取出所有 XML
-		var xmlList []string
-		for _, log := range ddlLogs {
-			xmlList = append(xmlList, log.XML)
-		}
-
-		// 包裝成訊息
-		message := model.DdlMessage{
-			BatchID: batchID,
-			XMLList: xmlList,
-		}
-
-		// JSON 編碼
-		jsonBytes, err := sonic.Marshal(message)
+		d, err := p.ddlDelivery(batchID, from, to, chunk)
 		if err != nil {
-			return fmt.Errorf("轉換 JSON 失敗：%v", err)
+			return p.deliverCreated(ctx, ds, err)
 		}
+		ds = append(ds, d.withOrder(order.Sequence, order.PrevSerialNoTo))
+	}
+	if len(ds) == 0 {
+		return nil
+	}
+	return p.deliverBatches(ctx, ds)
+}
 
-		// 無資料則結束
-		if jsonBytes == nil {
-			return nil
-		}
+// publishDdlBatch 把已建立批次紀錄的 DdlLog 打包並依狀態機發送、標記；沿用批次紀錄的序號
+func (p *Processor) publishDdlBatch(ctx context.Context, rec model.LogBatchDdlRecord, entries []ddlEntry) error {
+	d, err := p.ddlDelivery(rec.LogBatchDdlRecordID, rec.SerialNoFrom, rec.SerialNoTo, entries)
+	if err != nil {
+		return err
+	}
+	return p.deliverBatch(ctx, d.withOrder(rec.Sequence, rec.PrevSerialNoTo))
+}
 
-		// 發送消息
-		if err := p.mqClient.Publish(ctx, mq.RoutingKeyDDL, jsonBytes); err != nil {
-			return fmt.Errorf("發送 MQ 訊息失敗：%w", err)
-		}
+// ddlDelivery 把 DdlLog 打包成待發送的批次
+func (p *Processor) ddlDelivery(batchID, from, to int64, entries []ddlEntry) (delivery, error) {
+	jsonBytes, err := buildDdlMessage(batchID, entries)
+	if err != nil {
+		return delivery{}, err
+	}
+	return p.newDelivery(ddlBatchOps, batchID, from, to, len(entries), jsonBytes)
+}
 
-		if err := dbLayer.MarkDdlProcessedByBatch(ctx, p.db, batchID); err != nil {
-			return fmt.Errorf("標記DDL_Log失敗 : %w", err)
-		}
+// buildDdlMessage 把 DdlLog 包裝成 DdlMessage 並編碼為 JSON
+func buildDdlMessage(batchID int64, entries []ddlEntry) ([]byte, error) {
+	// 取出所有 XML 與 EVENTDATA 摘要（解析失敗時只帶 SerialNo，由 Consumer 自行解析 XML）
+	var xmlList []string
+	var events []model.DdlEvent
+	for _, e := range entries {
+		xmlList = append(xmlList, e.log.XML)
+		events = append(events, e.event)
+	}
 
+	// 包裝成訊息
+	message := model.DdlMessage{
+		BatchID: batchID,
+		XMLList: xmlList,
+		Events:  events,
 	}
-	return nil
 
+	// JSON 編碼
+	jsonBytes, err := sonic.Marshal(message)
+	if err != nil {
+		return nil, resilience.Poison(fmt.Errorf("轉換 JSON 失敗：%w", err))
+	}
+	return jsonBytes, nil
 }
 
-func (p *Processor) DmlLogProcess(ctx context.Context, logCtn *int) error {
-	// 取得待處理 DML Log
-	dmlLogs, err := dbLayer.GetUnprocessedDmlLogs(ctx, p.db)
+// DmlLogProcess 處理指定 stream 的 DmlLog；各 stream 互不阻塞，可各自在獨立的迴圈呼叫
+func (p *Processor) DmlLogProcess(ctx context.Context, stream string, logCtn *int) error {
+	// 取得待處理 DML Log（依 SerialNo 排序）
+	dmlLogs, err := dbLayer.GetUnprocessedDmlLogs(ctx, p.db, stream, p.dmlMaxRows())
 
 	if err != nil {
-		return fmt.Errorf(" 查詢失敗%v", err)
+		return resilience.DB(fmt.Errorf("查詢失敗：%w", err))
 	}
 	*logCtn = len(dmlLogs)
-	if len(dmlLogs) > 0 {
-		// 找出這個區間最小~最大的SerialNo
-		minSN, maxSN := dmlLogs[0].SerialNo, dmlLogs[0].SerialNo
-		for _, log := range dmlLogs[1:] {
-			if log.SerialNo < minSN {
-				minSN = log.SerialNo
-			}
-			if log.SerialNo > maxSN {
-				maxSN = log.SerialNo
-			}
+	// 依 byte 預算切段，每段建立一個批次紀錄（Status = Created），全部建立後一起發送
+	var ds []delivery
+	for _, chunk := range p.dmlChunks(dmlLogs) {
+		from, to := chunk[0].SerialNo, chunk[len(chunk)-1].SerialNo
+		order, err := dbLayer.NextDmlBatchOrder(ctx, p.db, stream, from)
+		if err != nil {
+			return p.deliverCreated(ctx, ds, resilience.DB(fmt.Errorf("查詢 DML 批次序號失敗：%w", err)))
 		}
-
-		// 建立批次處理的紀錄
 		record := model.LogBatchDmlRecord{
-			SerialNoFrom: minSN,
-			SerialNoTo:   maxSN,
+			SerialNoFrom:   from,
+			SerialNoTo:     to,
+			Stream:         stream,
+			Sequence:       order.Sequence,
+			PrevSerialNoTo: order.PrevSerialNoTo,
 		}
 
 		// 批次處理紀錄 寫入DB
 		batchID, err := dbLayer.InsertLogBatchDmlRecord(ctx, p.db, &record)
 		if err != nil {
-			return fmt.Errorf("新增 ProcessRecord 失敗：%v", err)
+			return p.deliverCreated(ctx, ds, resilience.DB(fmt.Errorf("新增 ProcessRecord 失敗：%w", err)))
 		}
-
-		// 取出所有 JSON
-		var jsonList []string
-		for _, log := range dmlLogs {
-			jsonList = append(jsonList, log.JSON)
-		}
-
-		// 包裝成訊息
-		message := model.DmlMessage{
-			BatchID:  batchID,
-			JSONList: jsonList,
-		}
-
-		// JSON 編碼
-		jsonBytes, err := sonic.Marshal(message)
+		d, err := p.dmlDelivery(stream, batchID, from, to, chunk)
 		if err != nil {
-			return fmt.Errorf("轉換 JSON 失敗：%v", err)
+			return p.deliverCreated(ctx, ds, err)
 		}
+		ds = append(ds, d.withOrder(order.Sequence, order.PrevSerialNoTo))
+	}
+	if len(ds) == 0 {
+		return nil
+	}
+	return p.deliverBatches(ctx, ds)
+}
 
-		// 無資料則結束
-		if jsonBytes == nil {
-			return nil
-		}
+// publishDmlBatch 把已建立批次紀錄的 DmlLog 打包，送到 stream 的 RoutingKey 並依狀態機發送、標記；沿用批次紀錄的序號
+func (p *Processor) publishDmlBatch(ctx context.Context, rec model.LogBatchDmlRecord, dmlLogs []model.DmlLog) error {
+	d, err := p.dmlDelivery(rec.Stream, rec.LogBatchDmlRecordID, rec.SerialNoFrom, rec.SerialNoTo, dmlLogs)
+	if err != nil {
+		return err
+	}
+	return p.deliverBatch(ctx, d.withOrder(rec.Sequence, rec.PrevSerialNoTo))
+}
 
-		// 發送消息
-		if err := p.mqClient.Publish(ctx, mq.RoutingKeyDML, jsonBytes); err != nil {
-			return fmt.Errorf("發送 MQ 訊息失敗：%w", err)
-		}
+// dmlDelivery 把 DmlLog 打包成送往 stream RoutingKey 的待發送批次
+func (p *Processor) dmlDelivery(stream string, batchID, from, to int64, dmlLogs []model.DmlLog) (delivery, error) {
+	jsonBytes, err := buildDmlMessage(batchID, dmlLogs)
+	if err != nil {
+		return delivery{}, err
+	}
+	return p.newDelivery(dmlBatchOps.forStream(stream), batchID, from, to, len(dmlLogs), jsonBytes)
+}
 
-		// 開啟transaction
-		tx := p.db.WithContext(ctx).Begin()
-		defer func() {
-			if r := recover(); r != nil {
-				tx.Rollback()
-				panic(r)
-			}
-		}()
-		if err := dbLayer.MarkDmlProcessedByBatch(ctx, p.db, batchID); err != nil {
-			return fmt.Errorf("標記DML_Log失敗 : %w", err)
-		}
+// buildDmlMessage 把 DmlLog 包裝成 DmlMessage 並編碼為 JSON
+func buildDmlMessage(batchID int64, dmlLogs []model.DmlLog) ([]byte, error) {
+	// 取出所有 JSON
+	var jsonList []string
+	for _, log := range dmlLogs {
+		jsonList = append(jsonList, log.JSON)
+	}
 
-		// commit
-		if err := tx.Commit().Error; err != nil {
-			return fmt.Errorf("commit 失敗：%w", err)
-		}
+	// 包裝成訊息
+	message := model.DmlMessage{
+		BatchID:  batchID,
+		JSONList: jsonList,
 	}
-	return nil
 
+	// JSON 編碼
+	jsonBytes, err := sonic.Marshal(message)
+	if err != nil {
+		return nil, resilience.Poison(fmt.Errorf("轉換 JSON 失敗：%w", err))
+	}
+	return jsonBytes, nil
 }
 
 func (p *Processor) DmlLogGenerate(ctx context.Context) error {
-	// 1. 從 BITaskInfo.Name 取得所有目標資料表
-	var tableNames []string
-	if err := p.db.WithContext(ctx).Table("BITaskInfo").Pluck("Name", &tableNames).Error; err != nil {
-		return fmt.Errorf("查詢 BITaskInfo 失敗: %w", err)
-	}
-	for _, name := range tableNames {
-		if _, err := p.getColumnTypesOnce(ctx, name); err != nil {
-			return fmt.Errorf("取得 %s 欄位資訊失敗: %w", name, err)
-		}
-		if err := p.generateLogsForTable(ctx, name, "Insert"); err != nil {
-			return err
+	// 1. 從 BITaskInfo.Name 取得所有目標資料表與所屬 stream
+	tasks, err := p.loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+	// 一張資料表失敗（結構錯誤、資料無法編碼）不影響其他資料表，全部處理完再一起回傳
+	var errs []error
+	for _, task := range tasks {
+		name, stream := task.Name, task.Stream
+		// 2. 使用 Change Tracking 的資料表不掃描 BIStatus 與 _History
+		if p.dmlSources.SourceFor(name) == config.DmlSourceChangeTracking {
+			if err := p.generateLogsFromChangeTracking(ctx, name, stream); err != nil {
+				errs = append(errs, fmt.Errorf("資料表 %s：%w", name, err))
+			}
+			continue
 		}
+		// 3. 先處理 _History 的 Delete 再處理本表的 Insert，
+		//    讓同一主鍵「先刪後插」的 SerialNo 順序與實際異動一致；Delete 失敗時本表這一輪也不產生 Insert
 		hist := fmt.Sprintf("%s_History", name)
-		if _, err := p.getColumnTypesOnce(ctx, hist); err != nil {
-			return fmt.Errorf("取得 %s 欄位資訊失敗: %w", hist, err)
+		if err := p.generateLogsForTable(ctx, hist, stream, "Delete"); err != nil {
+			errs = append(errs, fmt.Errorf("資料表 %s：%w", hist, err))
+			continue
 		}
-		if err := p.generateLogsForTable(ctx, hist, "Delete"); err != nil {
-			return err
+		if err := p.generateLogsForTable(ctx, name, stream, "Insert"); err != nil {
+			errs = append(errs, fmt.Errorf("資料表 %s：%w", name, err))
 		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
-func (p *Processor) generateLogsForTable(ctx context.Context, tableName, action string) error {
-	var rows []map[string]interface{}
-	if err := p.db.WithContext(ctx).
-		Table(tableName).
-		Where("BIStatus = ?", "New").
-		Find(&rows).Error; err != nil {
-		return fmt.Errorf("查詢 %s 失敗: %w", tableName, err)
-	}
-	for _, row := range rows {
-		tx := p.db.WithContext(ctx).Begin()
-		if err := tx.Error; err != nil {
-			return fmt.Errorf("開啟 transaction 失敗: %w", err)
-		}
+// biTask 為 BITaskInfo 中的一張目標資料表
+type biTask struct {
+	Name   string
+	Stream string
+}
 
-		data := make(map[string]interface{}, len(row)+1)
-		data["TableName"] = tableName
-		for k, v := range row {
-			data[k] = v
-		}
-		entry := map[string]interface{}{
-			"Action": action,
-			"Data":   data,
-		}
-		jsonBytes, err := sonic.Marshal(entry)
-		if err != nil {
-			_ = p.updateBIStatus(ctx, tx, tableName, row, "Pending")
-			tx.Rollback()
-			return fmt.Errorf("JSON 編碼失敗: %w", err)
+// loadTasks 讀取 BITaskInfo；設定 dml_stream_column 時一併讀取該欄位作為 stream，
+// 否則依 dml_streams.tables 決定，未列出的走預設 stream
+func (p *Processor) loadTasks(ctx context.Context) ([]biTask, error) {
+	var tasks []biTask
+	query := p.db.WithContext(ctx).Table("BITaskInfo")
+	if p.dmlStreamColumn != "" {
+		query = query.Select("Name, ISNULL(" + dbLayer.QuoteIdent(p.dmlStreamColumn) + ", '') AS Stream")
+	} else {
+		query = query.Select("Name")
+	}
+	if err := query.Scan(&tasks).Error; err != nil {
+		return nil, fmt.Errorf("查詢 BITaskInfo 失敗: %w", err)
+	}
+	for i := range tasks {
+		if p.dmlStreamColumn == "" {
+			tasks[i].Stream = p.dmlStreams[strings.ToLower(tasks[i].Name)]
+			continue
 		}
-		if err := tx.Exec("INSERT INTO [DmlLog]([JSON])VALUES(?)", string(jsonBytes)).Error; err != nil {
-			_ = p.updateBIStatus(ctx, tx, tableName, row, "Pnding")
-			tx.Rollback()
-			return fmt.Errorf("寫入 DmlLog 失敗: %w", err)
+		// 沒有對應 Queue 的 stream 訊息會被 broker 丟棄，必須先在 dml_streams 設定
+		if s := tasks[i].Stream; s != model.DefaultDmlStream && !p.knownStreams[s] {
+			return nil, resilience.Config(fmt.Errorf("BITaskInfo %s 的 stream %q 未在 mq.dml_streams 設定", tasks[i].Name, s))
 		}
+	}
+	return tasks, nil
+}
 
-		// 完成 Status = Complete
-		if err := p.updateBIStatus(ctx, tx, tableName, row, "Complete"); err != nil {
-			tx.Rollback()
-			return fmt.Errorf("更新 BIStatus 失敗: %w", err)
+// generateLogsForTable 以整批方式處理 BIStatus = 'New' 的資料列：每個 chunk 在一個 transaction 內
+// 認領資料列、多列 INSERT 寫入 DmlLog，再以一個 UPDATE 改為 Complete
+func (p *Processor) generateLogsForTable(ctx context.Context, tableName, stream, action string) error {
+	columnTypes, err := p.getColumnTypesOnce(ctx, tableName)
+	if err != nil {
+		return fmt.Errorf("取得 %s 欄位資訊失敗: %w", tableName, err)
+	}
+	chunkSize := p.dmlSources.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DmlGenerateChunkSize
+	}
+
+	start := time.Now()
+	total := 0
+	defer func() {
+		metrics.DmlGenerateRows.WithLabelValues(p.factory, tableName).Add(float64(total))
+		if elapsed := time.Since(start).Seconds(); total > 0 && elapsed > 0 {
+			metrics.DmlGenerateRowsPerSecond.WithLabelValues(p.factory, tableName).Set(float64(total) / elapsed)
 		}
+	}()
 
-		if err := tx.Commit().Error; err != nil {
-			return fmt.Errorf("commit 失敗：%w", err)
+	for {
+		n, err := p.generateChunk(ctx, tableName, stream, action, columnTypes, chunkSize)
+		total += n
+		if err != nil {
+			return err
+		}
+		if n < chunkSize {
+			return nil
 		}
 	}
-
-	return nil
 }
 
-// updateBIStatus 根據指定表格的主鍵欄位更新資料列的 BIStatus
-func (p *Processor) updateBIStatus(ctx context.Context, tx *gorm.DB, table string, row map[string]interface{}, status string) error {
-	// 取得欄位描述
-	columnTypes, err := p.getColumnTypesOnce(ctx, table)
-	if err != nil {
-		return err
+// generateChunk 處理一個 chunk，回傳寫入 DmlLog 的筆數；失敗時整個 chunk rollback，BIStatus 維持 New
+func (p *Processor) generateChunk(ctx context.Context, tableName, stream, action string, columnTypes []gorm.ColumnType, chunkSize int) (int, error) {
+	tx := p.db.WithContext(ctx).Begin()
+	if err := tx.Error; err != nil {
+		return 0, fmt.Errorf("開啟 transaction 失敗: %w", err)
 	}
 
-	// ★ 先正規化 row，避免 []byte 被誤判 ★
-	normalizeRow(columnTypes, row)
+	// 1. 認領資料列
+	rows, err := dbLayer.ClaimNewRows(ctx, tx, tableName, columnTypes, chunkSize)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("查詢 %s 失敗: %w", tableName, err)
+	}
+	if len(rows) == 0 {
+		tx.Rollback()
+		return 0, nil
+	}
 
-	// 取得table pkey
-	pkCond := make(map[string]interface{})
-	// 有些table 無 pkey，則全欄位比對
-	fullCond := make(map[string]interface{})
-	for _, ct := range columnTypes {
-		name := ct.Name()
-		val, ok := row[name]
-		if !ok {
-			continue
-		}
-		if name == "FOB" {
-			fullCond[name] = val
-		}
-		fullCond[name] = val
-		if isPK, _ := ct.PrimaryKey(); isPK {
-			pkCond[name] = val
+	// 2. 編碼後整批寫入 DmlLog
+	codec := newRowCodec(columnTypes)
+	jsonList := make([]string, 0, len(rows))
+	for _, row := range rows {
+		jsonBytes, err := buildDmlEntry(tableName, action, row, codec)
+		if err != nil {
+			tx.Rollback()
+			return 0, resilience.Poison(fmt.Errorf("JSON 編碼失敗: %w", err))
 		}
+		jsonList = append(jsonList, string(jsonBytes))
 	}
-	// 決定使用 fullCond 還是 pkCond
-	cond := fullCond
-	if len(pkCond) != 0 {
-		cond = pkCond
+	if err := dbLayer.InsertDmlLogJSON(ctx, tx, stream, jsonList); err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("寫入 DmlLog 失敗: %w", err)
 	}
 
-	// 執行更新
-	res := tx.Table(table).Where(cond).Update("BIStatus", status)
-	if res.Error != nil {
-		return res.Error
+	// 3. 一個 UPDATE 改為 Complete，筆數需與認領的一致
+	affected, err := dbLayer.CompleteClaimedRows(ctx, tx, tableName, columnTypes)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("更新 BIStatus 失敗: %w", err)
 	}
-
-	// 如果沒更新到任何列，就回傳 ErrRecordNotFound
-	if res.RowsAffected == 0 {
-		return gorm.ErrRecordNotFound
+	if affected != int64(len(rows)) {
+		tx.Rollback()
+		return 0, fmt.Errorf("更新 %s BIStatus 筆數 %d 與認領筆數 %d 不符", tableName, affected, len(rows))
 	}
 
-	return nil
+	if err := tx.Commit().Error; err != nil {
+		return 0, fmt.Errorf("commit 失敗：%w", err)
+	}
+	return len(rows), nil
 }
 
-// 將 row 內的 []byte / []uint8 轉成正確型別
-func normalizeRow(cols []gorm.ColumnType, row map[string]interface{}) {
-	for _, c := range cols {
-		name := c.Name()
+// buildDmlEntry 把一筆資料列包裝成 DmlLog.JSON 的格式：{"Action":..., "Data":{"TableName":..., 欄位...}, "Types":{...}}
+// codec 中的欄位（decimal、日期時間、binary…）以字串編碼，來源型別記錄在 Types
+func buildDmlEntry(tableName, action string, row map[string]interface{}, codec rowCodec) ([]byte, error) {
+	data, types, err := encodeDmlData(tableName, row, codec)
+	if err != nil {
+		return nil, err
+	}
+	entry := map[string]interface{}{
+		"Action": action,
+		"Data":   data,
+	}
+	if len(types) > 0 {
+		entry["Types"] = types
+	}
+	return sonic.Marshal(entry)
+}
 
-		v, ok := row[name]
-		if !ok {
-			continue
-		}
-		b, ok := v.([]byte) // gorm 回傳的是 []uint8，與 []byte 同底層
-		if !ok {
-			continue
-		}
+// buildDmlUpdateEntry 包裝 Update：Before 為舊主鍵，Data 為更新後的整列，
+// 讓主鍵變更不必拆成兩張表的 Delete + Insert
+func buildDmlUpdateEntry(tableName string, before, row map[string]interface{}, codec rowCodec) ([]byte, error) {
+	data, types, err := encodeDmlData(tableName, row, codec)
+	if err != nil {
+		return nil, err
+	}
+	key := make(map[string]interface{}, len(before))
+	for k, v := range before {
+		key[k] = v
+	}
+	if err := codec.encode(key, types); err != nil {
+		return nil, err
+	}
+	entry := map[string]interface{}{
+		"Action": "Update",
+		"Before": key,
+		"Data":   data,
+	}
+	if len(types) > 0 {
+		entry["Types"] = types
+	}
+	return sonic.Marshal(entry)
+}
 
-		dbType := strings.ToUpper(c.DatabaseTypeName())
-		switch dbType {
-		case "NUMERIC", "DECIMAL", "MONEY", "SMALLMONEY":
-			// 需比較數值 → 轉成 float64（或自行改用 decimal 套件）
-			if f, err := strconv.ParseFloat(string(b), 64); err == nil {
-				row[name] = f
-			} else {
-				row[name] = string(b) // 解析失敗就先用字串
-			}
-		default:
-			// 其他型別一律轉成字串
-			row[name] = string(b)
-		}
+// encodeDmlData 複製資料列、加上 TableName 並編碼型別化欄位
+func encodeDmlData(tableName string, row map[string]interface{}, codec rowCodec) (map[string]interface{}, map[string]string, error) {
+	data := make(map[string]interface{}, len(row)+1)
+	for k, v := range row {
+		data[k] = v
+	}
+	types := make(map[string]string)
+	if err := codec.encode(data, types); err != nil {
+		return nil, nil, err
 	}
+	data["TableName"] = tableName
+	return data, types, nil
 }
@@ -0,0 +1,1045 @@
+package service
+
+import (
+	"FtyBiProducer/config"
+	dbLayer "FtyBiProducer/db"
+	"FtyBiProducer/metrics"
+	"FtyBiProducer/model"
+	"FtyBiProducer/mq"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/bytedance/sonic"
+	dto "github.com/prometheus/client_model/go"
+	"gorm.io/driver/sqlserver"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/migrator"
+)
+
+// setupMockDB 以 sqlmock 建立 SQL Server 方言的 gorm.DB，不需要真實資料庫
+func setupMockDB(t *testing.T) (*gorm.DB, sqlmock.Sqlmock) {
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("建立 sqlmock 失敗: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	db, err := gorm.Open(sqlserver.New(sqlserver.Config{Conn: sqlDB}), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("建立 gorm.DB 失敗: %v", err)
+	}
+	return db, mock
+}
+
+func ddlLogRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"SerialNo", "XML", "ReceivedByTPE", "GenerateDate"}).
+		AddRow(int64(11), "<DDLData>a</DDLData>", false, time.Now()).
+		AddRow(int64(12), "<DDLData>b</DDLData>", false, time.Now())
+}
+
+// expectDdlLogs 預期撈取未處理的 DdlLog，再查詢範圍內下一個佔用中批次的起點 cut（0 表示沒有）
+func expectDdlLogs(mock sqlmock.Sqlmock, rows *sqlmock.Rows, cut int64) {
+	mock.ExpectQuery(`SELECT \* FROM "DdlLog" WHERE ReceivedByTPE`).WillReturnRows(rows)
+	mock.ExpectQuery(`SELECT ISNULL\(MIN\(SerialNoFrom\), 0\) FROM "LogBatchDdlRecord"`).
+		WillReturnRows(sqlmock.NewRows([]string{"SerialNoFrom"}).AddRow(cut))
+}
+
+// expectStatus 預期一次批次狀態更新（gorm 預設交易包住單一 UPDATE）
+func expectStatus(mock sqlmock.Sqlmock, table string, status model.BatchStatus) {
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE "` + table + `" SET .*"Status"=@p\d+`).
+		WithArgs(statusArgs(status)...).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+// statusArgs 組出狀態更新的參數：時間欄位、狀態、BatchID、允許的前一個狀態
+func statusArgs(status model.BatchStatus) []driver.Value {
+	args := []driver.Value{sqlmock.AnyArg(), status, sqlmock.AnyArg()}
+	for _, from := range model.BatchStatusFrom[status] {
+		args = append(args, from)
+	}
+	return args
+}
+
+// expectOrder 預期查詢新批次的序號：目前最大序號 maxSeq 與前一個批次的 SerialNoTo
+func expectOrder(mock sqlmock.Sqlmock, table string, maxSeq, prevTo int64) {
+	mock.ExpectQuery(`SELECT COALESCE\(MAX\(Sequence\), 0\) AS Sequence,.* FROM "` + table + `"`).
+		WillReturnRows(sqlmock.NewRows([]string{"Sequence", "PrevSerialNoTo"}).AddRow(maxSeq, prevTo))
+}
+
+// expectMark 預期在同一個 transaction 內標記 DdlLog 並轉為 Marked
+func expectMark(mock sqlmock.Sqlmock, batchID, from, to int64) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT \* FROM "LogBatchDdlRecord" WHERE LogBatchDdlRecordID`).
+		WillReturnRows(sqlmock.NewRows([]string{"LogBatchDdlRecordID", "SerialNoFrom", "SerialNoTo"}).AddRow(batchID, from, to))
+	mock.ExpectExec(`UPDATE "DdlLog" SET "ReceivedByTPE"`).WillReturnResult(sqlmock.NewResult(0, to-from+1))
+	mock.ExpectExec(`UPDATE "LogBatchDdlRecord" SET .*"Status"`).
+		WithArgs(statusArgs(model.BatchStatusMarked)...).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+// TestDdlLogProcess_PublishThenMark 驗證批次依 Created → Published → Confirmed → Marked 前進
+func TestDdlLogProcess_PublishThenMark(t *testing.T) {
+	db, mock := setupMockDB(t)
+	pub := mq.NewMemoryPublisher()
+
+	expectDdlLogs(mock, ddlLogRows(), 0)
+	expectOrder(mock, "LogBatchDdlRecord", 0, 0)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO "LogBatchDdlRecord"`).
+		WillReturnRows(sqlmock.NewRows([]string{"LogBatchDdlRecordID"}).AddRow(int64(7)))
+	mock.ExpectCommit()
+	expectStatus(mock, "LogBatchDdlRecord", model.BatchStatusPublished)
+	expectStatus(mock, "LogBatchDdlRecord", model.BatchStatusConfirmed)
+	expectMark(mock, 7, 11, 12)
+
+	proc := New(db, pub)
+	proc.SetFactory("PH1")
+	proc.SetSource(`SYSTEM2016\PH1`, "Production")
+	var logCtn int
+	if err := proc.DdlLogProcess(context.Background(), &logCtn); err != nil {
+		t.Fatalf("預期不會錯誤，實際: %v", err)
+	}
+	if logCtn != 2 {
+		t.Errorf("預期 2 筆，實際 %d 筆", logCtn)
+	}
+
+	msgs := pub.Messages()
+	if len(msgs) != 1 || msgs[0].RoutingKey != mq.RoutingKeyDDL {
+		t.Fatalf("預期發送 1 筆 DDL 訊息，實際: %+v", msgs)
+	}
+	var msg model.DdlMessage
+	if err := sonic.Unmarshal(msgs[0].Body, &msg); err != nil {
+		t.Fatalf("解析訊息失敗: %v", err)
+	}
+	if msg.BatchID != 7 || len(msg.XMLList) != 2 {
+		t.Errorf("訊息內容不符: %+v", msg)
+	}
+	env := msgs[0].Envelope
+	if env.FactoryID != "PH1" || env.SourceServer != `SYSTEM2016\PH1` || env.SourceDatabase != "Production" ||
+		env.MessageType != model.MessageTypeDDL || env.SchemaVersion != model.EnvelopeSchemaVersion ||
+		env.BatchID != 7 || env.SerialNoFrom != 11 || env.SerialNoTo != 12 || env.CreatedAt.IsZero() ||
+		env.Sequence != 1 || env.PrevSerialNoTo != 0 {
+		t.Errorf("信封內容不符: %+v", env)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("SQL 執行與預期不符: %v", err)
+	}
+}
+
+// ddlEventXML 組出 DDL trigger 寫入的 EVENTDATA
+func ddlEventXML(eventType, object, command string) string {
+	return "<DDLData><EventData><EVENT_INSTANCE><EventType>" + eventType + "</EventType>" +
+		"<LoginName>sa</LoginName><SchemaName>dbo</SchemaName><ObjectName>" + object + "</ObjectName>" +
+		"<ObjectType>TABLE</ObjectType><TSQLCommand><CommandText>" + command + "</CommandText></TSQLCommand>" +
+		"</EVENT_INSTANCE></EventData></DDLData>"
+}
+
+// TestDdlLogProcess_Filter 驗證被 ddl_filter 排除的 DDL 記錄原因後標記、不送出，送出的訊息帶有 EVENTDATA 摘要
+func TestDdlLogProcess_Filter(t *testing.T) {
+	db, mock := setupMockDB(t)
+	pub := mq.NewMemoryPublisher()
+
+	rows := sqlmock.NewRows([]string{"SerialNo", "XML", "ReceivedByTPE", "GenerateDate"}).
+		AddRow(int64(11), ddlEventXML("DROP_TABLE", "Orders", "DROP TABLE Orders"), false, time.Now()).
+		AddRow(int64(12), ddlEventXML("ALTER_TABLE", "orders", "ALTER TABLE orders ADD Note nvarchar(50)"), false, time.Now()).
+		AddRow(int64(13), ddlEventXML("ALTER_TABLE", "Temp", "ALTER TABLE Temp ADD X int"), false, time.Now())
+	expectDdlLogs(mock, rows, 0)
+	mock.ExpectQuery(`SELECT Name FROM "BITaskInfo"`).
+		WillReturnRows(sqlmock.NewRows([]string{"Name"}).AddRow("Orders"))
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE "DdlLog" SET "FilterReason"=@p1 WHERE SerialNo IN \(@p2\)`).
+		WithArgs("ddl_filter 規則 no-drop", int64(11)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE "DdlLog" SET "FilterReason"=@p1 WHERE SerialNo IN \(@p2\)`).
+		WithArgs("ddl_filter 預設 deny", int64(13)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectOrder(mock, "LogBatchDdlRecord", 0, 0)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO "LogBatchDdlRecord"`).
+		WillReturnRows(sqlmock.NewRows([]string{"LogBatchDdlRecordID"}).AddRow(int64(7)))
+	mock.ExpectCommit()
+	expectStatus(mock, "LogBatchDdlRecord", model.BatchStatusPublished)
+	expectStatus(mock, "LogBatchDdlRecord", model.BatchStatusConfirmed)
+	expectMark(mock, 7, 12, 12)
+
+	proc := New(db, pub)
+	proc.SetDdlFilter(config.DdlFilterConfig{
+		Default: config.DdlFilterDeny,
+		Rules: []config.DdlRule{
+			{Name: "no-drop", Action: config.DdlFilterDeny, EventTypes: []string{"drop_*"}},
+			{Name: "bi-tables", Action: config.DdlFilterAllow, EventTypes: []string{"ALTER_TABLE", "CREATE_TABLE"}, BITaskTables: true},
+		},
+	})
+	proc.SetFactory("FILTER")
+	var logCtn int
+	if err := proc.DdlLogProcess(context.Background(), &logCtn); err != nil {
+		t.Fatalf("預期不會錯誤，實際: %v", err)
+	}
+	if logCtn != 3 {
+		t.Errorf("預期撈出 3 筆，實際 %d 筆", logCtn)
+	}
+	if n := counterValue(t, "FILTER", "DROP_TABLE"); n != 1 {
+		t.Errorf("ddl_filtered_total 預期 1，實際 %v", n)
+	}
+
+	msgs := pub.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("預期發送 1 筆 DDL 訊息，實際: %+v", msgs)
+	}
+	var msg model.DdlMessage
+	if err := sonic.Unmarshal(msgs[0].Body, &msg); err != nil {
+		t.Fatalf("解析訊息失敗: %v", err)
+	}
+	want := model.DdlEvent{SerialNo: 12, EventType: "ALTER_TABLE", SchemaName: "dbo", ObjectName: "orders",
+		ObjectType: "TABLE", LoginName: "sa"}
+	if len(msg.XMLList) != 1 || len(msg.Events) != 1 || msg.Events[0] != want {
+		t.Errorf("訊息內容不符: %+v", msg)
+	}
+	if n := strings.Count(string(msgs[0].Body), "ADD Note"); n != 1 {
+		t.Errorf("DDL 語法只應出現在 XML 中，實際出現 %d 次", n)
+	}
+	if env := msgs[0].Envelope; env.SerialNoFrom != 12 || env.SerialNoTo != 12 {
+		t.Errorf("批次範圍應只涵蓋送出的 DDL，實際 %d ~ %d", env.SerialNoFrom, env.SerialNoTo)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("SQL 執行與預期不符: %v", err)
+	}
+}
+
+// counterValue 回傳 ddl_filtered_total{factory,event_type} 目前的值
+func counterValue(t *testing.T, factory, eventType string) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := metrics.DdlFiltered.WithLabelValues(factory, eventType).Write(&m); err != nil {
+		t.Fatalf("讀取 ddl_filtered_total 失敗: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// TestFilterDdlLogs_NoTag 驗證重送（tag = false）時只略過被排除的 DDL，不寫入 FilterReason 也不計入 ddl_filtered_total
+func TestFilterDdlLogs_NoTag(t *testing.T) {
+	db, mock := setupMockDB(t)
+	proc := New(db, mq.NewMemoryPublisher())
+	proc.SetFactory("REPLAY")
+	proc.SetDdlFilter(config.DdlFilterConfig{Rules: []config.DdlRule{
+		{Name: "no-drop", Action: config.DdlFilterDeny, EventTypes: []string{"DROP_*"}},
+	}})
+
+	entries := parseDdlLogs([]model.DdlLog{
+		{SerialNo: 21, XML: ddlEventXML("DROP_TABLE", "Orders", "DROP TABLE Orders")},
+		{SerialNo: 22, XML: ddlEventXML("ALTER_TABLE", "Orders", "ALTER TABLE Orders ADD Note nvarchar(50)")},
+	})
+	kept, filtered, err := proc.filterDdlLogs(context.Background(), entries, false)
+	if err != nil {
+		t.Fatalf("預期不會錯誤，實際: %v", err)
+	}
+	if filtered != 1 || len(kept) != 1 || kept[0].log.SerialNo != 22 || kept[0].event.EventType != "ALTER_TABLE" {
+		t.Errorf("過濾結果不符：%d %+v", filtered, kept)
+	}
+	if n := counterValue(t, "REPLAY", "DROP_TABLE"); n != 0 {
+		t.Errorf("重送不應計入 ddl_filtered_total，實際 %v", n)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("重送不應修改 DdlLog: %v", err)
+	}
+}
+
+// TestDdlLogProcess_SplitsByBytes 驗證超過 batch.max_bytes 時拆成多個批次一起發送，並依 mq.compression 壓縮
+func TestDdlLogProcess_SplitsByBytes(t *testing.T) {
+	db, mock := setupMockDB(t)
+	pub := mq.NewMemoryPublisher()
+
+	expectDdlLogs(mock, ddlLogRows(), 0)
+	for _, id := range []int64{7, 8} {
+		expectOrder(mock, "LogBatchDdlRecord", id-3, id+3) // 序號 5、6，前一個批次到 10、11
+		mock.ExpectBegin()
+		mock.ExpectQuery(`INSERT INTO "LogBatchDdlRecord"`).
+			WillReturnRows(sqlmock.NewRows([]string{"LogBatchDdlRecordID"}).AddRow(id))
+		mock.ExpectCommit()
+	}
+	expectStatus(mock, "LogBatchDdlRecord", model.BatchStatusPublished)
+	expectStatus(mock, "LogBatchDdlRecord", model.BatchStatusPublished)
+	expectStatus(mock, "LogBatchDdlRecord", model.BatchStatusConfirmed)
+	expectMark(mock, 7, 11, 11)
+	expectStatus(mock, "LogBatchDdlRecord", model.BatchStatusConfirmed)
+	expectMark(mock, 8, 12, 12)
+
+	proc := New(db, pub)
+	proc.SetBatchLimits(config.BatchConfig{MaxBytes: 100}) // 只放得下一筆
+	proc.SetCompression(config.CompressionGzip)
+	var logCtn int
+	if err := proc.DdlLogProcess(context.Background(), &logCtn); err != nil {
+		t.Fatalf("預期不會錯誤，實際: %v", err)
+	}
+
+	msgs := pub.Messages()
+	if len(msgs) != 2 {
+		t.Fatalf("預期拆成 2 則訊息，實際 %d 則", len(msgs))
+	}
+	for i, m := range msgs {
+		env := m.Envelope
+		if env.ContentEncoding != model.ContentEncodingGzip || env.ItemCount != 1 ||
+			env.SerialNoFrom != int64(11+i) || env.SerialNoTo != int64(11+i) ||
+			env.Sequence != int64(5+i) || env.PrevSerialNoTo != int64(10+i) {
+			t.Errorf("第 %d 則信封不符: %+v", i, env)
+		}
+		r, err := gzip.NewReader(bytes.NewReader(m.Body))
+		if err != nil {
+			t.Fatalf("第 %d 則不是 gzip: %v", i, err)
+		}
+		body, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("第 %d 則解壓失敗: %v", i, err)
+		}
+		var msg model.DdlMessage
+		if err := sonic.Unmarshal(body, &msg); err != nil || len(msg.XMLList) != 1 || len(body) != env.UncompressedLen {
+			t.Errorf("第 %d 則內容不符: %s（%v）", i, body, err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("SQL 執行與預期不符: %v", err)
+	}
+}
+
+// TestDdlLogProcess_NackMarksFailed 驗證 broker Nack 時批次轉為 Failed，且不會標記 DdlLog
+func TestDdlLogProcess_NackMarksFailed(t *testing.T) {
+	db, mock := setupMockDB(t)
+	pub := mq.NewMemoryPublisher()
+	pub.FailNext(mq.FailNack, 1)
+
+	expectDdlLogs(mock, ddlLogRows(), 0)
+	expectOrder(mock, "LogBatchDdlRecord", 0, 0)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO "LogBatchDdlRecord"`).
+		WillReturnRows(sqlmock.NewRows([]string{"LogBatchDdlRecordID"}).AddRow(int64(8)))
+	mock.ExpectCommit()
+	expectStatus(mock, "LogBatchDdlRecord", model.BatchStatusPublished)
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE "LogBatchDdlRecord" SET "ErrorMsg"=@p1,"FailedTime"=@p2,"Status"=@p3`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	var logCtn int
+	if err := New(db, pub).DdlLogProcess(context.Background(), &logCtn); !errors.Is(err, mq.ErrNack) {
+		t.Fatalf("預期 ErrNack，實際: %v", err)
+	}
+	if len(pub.Messages()) != 0 {
+		t.Errorf("Nack 的訊息不應被記錄")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("SQL 執行與預期不符: %v", err)
+	}
+}
+
+// TestDdlLogProcess_FailedBelowRejected 驗證被拒絕批次（20~25）之下、發送失敗的範圍（11~12）仍會被撈出重新涵蓋，
+// 且新批次不會跨過被拒絕批次的範圍
+func TestDdlLogProcess_FailedBelowRejected(t *testing.T) {
+	db, mock := setupMockDB(t)
+	pub := mq.NewMemoryPublisher()
+
+	rows := sqlmock.NewRows([]string{"SerialNo", "XML", "ReceivedByTPE", "GenerateDate"}).
+		AddRow(int64(11), "<DDLData>a</DDLData>", false, time.Now()).
+		AddRow(int64(12), "<DDLData>b</DDLData>", false, time.Now()).
+		AddRow(int64(30), "<DDLData>c</DDLData>", false, time.Now())
+	mock.ExpectQuery(`SELECT \* FROM "DdlLog" WHERE ReceivedByTPE = @p1 AND FilterReason IS NULL AND NOT EXISTS \(SELECT 1 FROM "LogBatchDdlRecord" WHERE Status IN \(.*\) AND \(DdlLog.SerialNo BETWEEN SerialNoFrom AND SerialNoTo\)\)`).
+		WillReturnRows(rows)
+	mock.ExpectQuery(`SELECT ISNULL\(MIN\(SerialNoFrom\), 0\) FROM "LogBatchDdlRecord"`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), int64(11), int64(30)).
+		WillReturnRows(sqlmock.NewRows([]string{"SerialNoFrom"}).AddRow(int64(20)))
+	expectOrder(mock, "LogBatchDdlRecord", 3, 0)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO "LogBatchDdlRecord"`).
+		WillReturnRows(sqlmock.NewRows([]string{"LogBatchDdlRecordID"}).AddRow(int64(7)))
+	mock.ExpectCommit()
+	expectStatus(mock, "LogBatchDdlRecord", model.BatchStatusPublished)
+	expectStatus(mock, "LogBatchDdlRecord", model.BatchStatusConfirmed)
+
+	proc := New(db, pub)
+	proc.SetAwaitReceipt(true)
+	var logCtn int
+	if err := proc.DdlLogProcess(context.Background(), &logCtn); err != nil {
+		t.Fatalf("預期不會錯誤，實際: %v", err)
+	}
+	msgs := pub.Messages()
+	if len(msgs) != 1 || msgs[0].Envelope.SerialNoFrom != 11 || msgs[0].Envelope.SerialNoTo != 12 {
+		t.Errorf("預期只送出 11~12 的批次，實際: %+v", msgs)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("SQL 執行與預期不符: %v", err)
+	}
+}
+
+// TestRecoverBatches_ConfirmedOnlyMarks 驗證 Confirmed 的批次在恢復時只補標記，不重新發送
+func TestRecoverBatches_ConfirmedOnlyMarks(t *testing.T) {
+	db, mock := setupMockDB(t)
+	pub := mq.NewMemoryPublisher()
+
+	mock.ExpectQuery(`SELECT \* FROM "LogBatchDdlRecord" WHERE Status IN`).
+		WillReturnRows(sqlmock.NewRows([]string{"LogBatchDdlRecordID", "SerialNoFrom", "SerialNoTo", "Status"}).
+			AddRow(int64(9), int64(20), int64(25), model.BatchStatusConfirmed))
+	mock.ExpectQuery(`SELECT \* FROM "LogBatchDmlRecord" WHERE Status IN`).
+		WillReturnRows(sqlmock.NewRows([]string{"LogBatchDmlRecordID"}))
+	expectMark(mock, 9, 20, 25)
+
+	recovered, err := New(db, pub).RecoverBatches(context.Background())
+	if err != nil {
+		t.Fatalf("預期不會錯誤，實際: %v", err)
+	}
+	if recovered != 1 {
+		t.Errorf("預期恢復 1 筆，實際 %d 筆", recovered)
+	}
+	if len(pub.Messages()) != 0 {
+		t.Errorf("Confirmed 的批次不應重新發送")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("SQL 執行與預期不符: %v", err)
+	}
+}
+
+// TestDdlLogProcess_AwaitReceiptStopsAtConfirmed 驗證等待回執時，broker 確認後不標記 DdlLog
+func TestDdlLogProcess_AwaitReceiptStopsAtConfirmed(t *testing.T) {
+	db, mock := setupMockDB(t)
+	pub := mq.NewMemoryPublisher()
+
+	expectDdlLogs(mock, ddlLogRows(), 0)
+	expectOrder(mock, "LogBatchDdlRecord", 0, 0)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO "LogBatchDdlRecord"`).
+		WillReturnRows(sqlmock.NewRows([]string{"LogBatchDdlRecordID"}).AddRow(int64(7)))
+	mock.ExpectCommit()
+	expectStatus(mock, "LogBatchDdlRecord", model.BatchStatusPublished)
+	expectStatus(mock, "LogBatchDdlRecord", model.BatchStatusConfirmed)
+
+	proc := New(db, pub)
+	proc.SetAwaitReceipt(true)
+	var logCtn int
+	if err := proc.DdlLogProcess(context.Background(), &logCtn); err != nil {
+		t.Fatalf("預期不會錯誤，實際: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("SQL 執行與預期不符: %v", err)
+	}
+
+	// 收到 Applied 回執後才標記
+	expectMark(mock, 7, 11, 12)
+	receipt, err := proc.HandleReceipt(context.Background(), []byte(`{"BatchID":7,"Kind":"ddl","Outcome":"Applied"}`))
+	if err != nil {
+		t.Fatalf("處理回執失敗: %v", err)
+	}
+	if receipt.BatchID != 7 {
+		t.Errorf("回執 BatchID 不符: %+v", receipt)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("SQL 執行與預期不符: %v", err)
+	}
+}
+
+// TestHandleReceipt_Rejected 驗證 Rejected 回執只更新批次狀態，不標記 Log
+func TestHandleReceipt_Rejected(t *testing.T) {
+	db, mock := setupMockDB(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE "LogBatchDmlRecord" SET "ErrorMsg"=@p1,"RejectedTime"=@p2,"Status"=@p3`).
+		WithArgs("欄位轉換失敗", sqlmock.AnyArg(), model.BatchStatusRejected, int64(5), model.BatchStatusPublished, model.BatchStatusConfirmed).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	body := []byte(`{"BatchID":5,"Kind":"dml","Outcome":"Rejected","Error":"欄位轉換失敗"}`)
+	if _, err := New(db, mq.NewMemoryPublisher()).HandleReceipt(context.Background(), body); err != nil {
+		t.Fatalf("預期不會錯誤，實際: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("SQL 執行與預期不符: %v", err)
+	}
+
+	if _, err := New(db, mq.NewMemoryPublisher()).HandleReceipt(context.Background(), []byte(`not json`)); !errors.Is(err, ErrBadReceipt) {
+		t.Errorf("預期 ErrBadReceipt，實際: %v", err)
+	}
+}
+
+// TestFinishDelivery_ReceiptBeforeConfirm 驗證回執比 broker 確認先寫回時，批次由 Published 直接 Marked，
+// 之後轉 Confirmed 失敗不視為錯誤
+func TestFinishDelivery_ReceiptBeforeConfirm(t *testing.T) {
+	db, mock := setupMockDB(t)
+	proc := New(db, mq.NewMemoryPublisher())
+	proc.SetAwaitReceipt(true)
+
+	// 1. 批次仍為 Published 時收到 Applied 回執
+	expectMark(mock, 7, 11, 12)
+	if _, err := proc.HandleReceipt(context.Background(), []byte(`{"BatchID":7,"Kind":"ddl","Outcome":"Applied"}`)); err != nil {
+		t.Fatalf("處理回執失敗: %v", err)
+	}
+
+	// 2. broker 確認後轉 Confirmed 已不合法，查得批次已 Marked
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE "LogBatchDdlRecord" SET .*"Status"=@p\d+`).
+		WithArgs(statusArgs(model.BatchStatusConfirmed)...).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	mock.ExpectQuery(`SELECT \* FROM "LogBatchDdlRecord" WHERE LogBatchDdlRecordID`).
+		WillReturnRows(sqlmock.NewRows([]string{"LogBatchDdlRecordID", "Status"}).AddRow(int64(7), model.BatchStatusMarked))
+
+	d, err := proc.newDelivery(ddlBatchOps, 7, 11, 12, 2, []byte(`[]`))
+	if err != nil {
+		t.Fatalf("建立批次失敗: %v", err)
+	}
+	if err := proc.finishDelivery(context.Background(), d, nil); err != nil {
+		t.Errorf("批次已由回執結案，不應回傳錯誤: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("SQL 執行與預期不符: %v", err)
+	}
+}
+
+// TestHandleReceipt_Conflict 驗證無法轉換狀態的回執依批次目前的狀態忽略、重試或略過
+func TestHandleReceipt_Conflict(t *testing.T) {
+	body := []byte(`{"BatchID":5,"Kind":"dml","Outcome":"Rejected","Error":"欄位轉換失敗"}`)
+	cases := []struct {
+		name   string
+		status model.BatchStatus
+		ok     bool // 回執視為重送而忽略
+		bad    bool // 回傳 ErrBadReceipt，記錄後略過
+	}{
+		{"已 Rejected", model.BatchStatusRejected, true, false},
+		{"已 Marked", model.BatchStatusMarked, true, false},
+		{"仍為 Created", model.BatchStatusCreated, false, false},
+		{"已 Failed", model.BatchStatusFailed, false, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, mock := setupMockDB(t)
+			mock.ExpectBegin()
+			mock.ExpectExec(`UPDATE "LogBatchDmlRecord" SET`).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectCommit()
+			mock.ExpectQuery(`SELECT \* FROM "LogBatchDmlRecord" WHERE LogBatchDmlRecordID`).
+				WillReturnRows(sqlmock.NewRows([]string{"LogBatchDmlRecordID", "Status"}).AddRow(int64(5), c.status))
+
+			_, err := New(db, mq.NewMemoryPublisher()).HandleReceipt(context.Background(), body)
+			if c.ok != (err == nil) {
+				t.Errorf("預期忽略=%v，實際錯誤: %v", c.ok, err)
+			}
+			if c.bad != errors.Is(err, ErrBadReceipt) {
+				t.Errorf("預期 ErrBadReceipt=%v，實際: %v", c.bad, err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("SQL 執行與預期不符: %v", err)
+			}
+		})
+	}
+}
+
+// TestHandleReceipt_UnknownBatch 驗證指向不存在批次的回執回傳 ErrBadReceipt，不會一直重新排入
+func TestHandleReceipt_UnknownBatch(t *testing.T) {
+	db, mock := setupMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT \* FROM "LogBatchDdlRecord" WHERE LogBatchDdlRecordID`).
+		WillReturnRows(sqlmock.NewRows([]string{"LogBatchDdlRecordID"}))
+	mock.ExpectRollback()
+
+	_, err := New(db, mq.NewMemoryPublisher()).HandleReceipt(context.Background(), []byte(`{"BatchID":99,"Kind":"ddl","Outcome":"Applied"}`))
+	if !errors.Is(err, ErrBadReceipt) {
+		t.Errorf("預期 ErrBadReceipt，實際: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("SQL 執行與預期不符: %v", err)
+	}
+}
+
+// TestReplay_DryRunDoesNotPublish 驗證 dry-run 只統計筆數與大小，不建立批次也不發送
+func TestReplay_DryRunDoesNotPublish(t *testing.T) {
+	db, mock := setupMockDB(t)
+	pub := mq.NewMemoryPublisher()
+
+	mock.ExpectQuery(`SELECT \* FROM "DmlLog" WHERE SerialNo >= @p1 AND SerialNo <= @p2 AND SerialNo > @p3`).
+		WithArgs(int64(100), int64(200), int64(0)).
+		WillReturnRows(sqlmock.NewRows([]string{"SerialNo", "JSON", "ReceivedByTPE", "GenerateDate"}).
+			AddRow(int64(100), `{"Action":"Insert","Data":{}}`, true, time.Now()).
+			AddRow(int64(150), `{"Action":"Delete","Data":{}}`, true, time.Now()))
+	mock.ExpectQuery(`SELECT \* FROM "DmlLog" WHERE SerialNo >= @p1 AND SerialNo <= @p2 AND SerialNo > @p3`).
+		WithArgs(int64(100), int64(200), int64(150)).
+		WillReturnRows(sqlmock.NewRows([]string{"SerialNo", "JSON", "ReceivedByTPE", "GenerateDate"}))
+
+	report, err := New(db, pub).Replay(context.Background(), ReplayRequest{
+		Kind:   model.ReceiptKindDML,
+		Range:  dbLayer.LogRange{SerialNoFrom: 100, SerialNoTo: 200},
+		DryRun: true,
+	})
+	if err != nil {
+		t.Fatalf("預期不會錯誤，實際: %v", err)
+	}
+	if report.Rows != 2 || report.SerialNoFrom != 100 || report.SerialNoTo != 150 || report.Bytes == 0 {
+		t.Errorf("報告內容不符: %+v", report)
+	}
+	if len(report.BatchIDs) != 0 || len(pub.Messages()) != 0 {
+		t.Errorf("dry-run 不應建立批次或發送訊息")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("SQL 執行與預期不符: %v", err)
+	}
+}
+
+func TestChangeTrackingEntry(t *testing.T) {
+	pk := []string{"ID"}
+
+	// Delete 只帶主鍵
+	action, _, data := changeTrackingEntry(map[string]interface{}{
+		ctVersionColumn:   int64(10),
+		ctOperationColumn: "D",
+		ctPKPrefix + "ID": "A01",
+		"ID":              nil,
+		"Qty":             nil,
+	}, pk)
+	if action != "Delete" || len(data) != 1 || data["ID"] != "A01" {
+		t.Fatalf("Delete 結果不符：%s %v", action, data)
+	}
+
+	// Update 帶舊主鍵，資料不含 Change Tracking 附加欄位
+	action, before, data := changeTrackingEntry(map[string]interface{}{
+		ctVersionColumn:   int64(11),
+		ctOperationColumn: "U",
+		ctPKPrefix + "ID": "A02",
+		"ID":              "A02",
+		"Qty":             int64(3),
+	}, pk)
+	if action != "Update" || before["ID"] != "A02" || len(data) != 2 || data["Qty"] != int64(3) {
+		t.Fatalf("Update 結果不符：%s %v %v", action, before, data)
+	}
+
+	// 資料列已被刪除時略過
+	if _, _, data = changeTrackingEntry(map[string]interface{}{
+		ctOperationColumn: "I",
+		ctPKPrefix + "ID": "A03",
+		"ID":              nil,
+	}, pk); data != nil {
+		t.Fatalf("已刪除的資料列應略過：%v", data)
+	}
+}
+
+// TestChangeTrackingEntries_KeyChange 驗證只有同一版本、同一主鍵的 Delete + Insert 合併為 Update，
+// 主鍵不同的 Delete 與 Insert 分別保留
+func TestChangeTrackingEntries_KeyChange(t *testing.T) {
+	rows := []map[string]interface{}{
+		{ctVersionColumn: int64(5), ctOperationColumn: "D", ctPKPrefix + "ID": "OLD", "ID": nil},
+		{ctVersionColumn: int64(5), ctOperationColumn: "I", ctPKPrefix + "ID": "NEW", "ID": "NEW", "Qty": int64(1)},
+		{ctVersionColumn: int64(6), ctOperationColumn: "D", ctPKPrefix + "ID": "X", "ID": nil},
+		{ctVersionColumn: int64(7), ctOperationColumn: "D", ctPKPrefix + "ID": "Y", "ID": nil},
+		{ctVersionColumn: int64(7), ctOperationColumn: "I", ctPKPrefix + "ID": "Y", "ID": "Y", "Qty": int64(2)},
+	}
+	changes := changeTrackingEntries(rows, []string{"ID"})
+	want := []struct{ action, id string }{
+		{"Delete", "OLD"},
+		{"Insert", "NEW"},
+		{"Delete", "X"},
+		{"Update", "Y"},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("預期 %d 筆變更，實際 %d：%+v", len(want), len(changes), changes)
+	}
+	for i, w := range want {
+		if c := changes[i]; c.action != w.action || c.data["ID"] != w.id {
+			t.Fatalf("第 %d 筆變更不符：%+v", i, c)
+		}
+	}
+	if c := changes[1]; c.before != nil {
+		t.Fatalf("主鍵不同的 Insert 不應帶 Before：%+v", c)
+	}
+	if c := changes[3]; c.before["ID"] != "Y" {
+		t.Fatalf("同一主鍵應合併為 Update 並帶舊主鍵：%+v", c)
+	}
+}
+
+func TestChangeTrackingQuery(t *testing.T) {
+	got := changeTrackingQuery("P_Test", []string{"ID", "Seq"})
+	want := "SELECT CT.SYS_CHANGE_VERSION AS [__CT_Version], CT.SYS_CHANGE_OPERATION AS [__CT_Operation], " +
+		"CT.[ID] AS [__CT_PK_ID], CT.[Seq] AS [__CT_PK_Seq], T.* " +
+		"FROM CHANGETABLE(CHANGES [P_Test], ?) AS CT LEFT JOIN [P_Test] AS T ON T.[ID] = CT.[ID] AND T.[Seq] = CT.[Seq] " +
+		"WHERE CT.SYS_CHANGE_VERSION <= ? ORDER BY CT.SYS_CHANGE_VERSION"
+	if got != want {
+		t.Fatalf("查詢不符：\n%s", got)
+	}
+}
+
+// TestGenerateChunk_SetBased 驗證一個 chunk 只用一個多列 INSERT 與一個 UPDATE 完成
+func TestGenerateChunk_SetBased(t *testing.T) {
+	db, mock := setupMockDB(t)
+	cols := []gorm.ColumnType{
+		migrator.ColumnType{NameValue: sql.NullString{String: "ID", Valid: true}, ColumnTypeValue: sql.NullString{String: "nvarchar", Valid: true}, PrimaryKeyValue: sql.NullBool{Bool: true, Valid: true}},
+		migrator.ColumnType{NameValue: sql.NullString{String: "Qty", Valid: true}, ColumnTypeValue: sql.NullString{String: "int", Valid: true}},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`IF OBJECT_ID\('tempdb..#BIChunk'\) IS NOT NULL DROP TABLE #BIChunk`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`SELECT TOP \(2\) \* INTO #BIChunk FROM \[P_Test\] WITH \(UPDLOCK, READPAST\) WHERE BIStatus = 'New'`).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery(`SELECT \* FROM #BIChunk`).
+		WillReturnRows(sqlmock.NewRows([]string{"ID", "Qty"}).AddRow("A01", 1).AddRow("A02", 2))
+	mock.ExpectExec(`INSERT INTO \[DmlLog\]\(\[JSON\],\[Stream\]\)VALUES\(@p1,@p2\),\(@p3,@p4\)`).
+		WithArgs(sqlmock.AnyArg(), "", sqlmock.AnyArg(), "").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`UPDATE T SET BIStatus = 'Complete' FROM \[P_Test\] AS T INNER JOIN #BIChunk AS C ON T.\[ID\] = C.\[ID\] WHERE T.BIStatus = 'New'`).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DROP TABLE #BIChunk`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	proc := New(db, mq.NewMemoryPublisher())
+	n, err := proc.generateChunk(context.Background(), "P_Test", "", "Insert", cols, 2)
+	if err != nil {
+		t.Fatalf("generateChunk 失敗: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("預期 2 筆，實際 %d", n)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestGenerateChunk_CountMismatchRollsBack 驗證 UPDATE 筆數不符時整個 chunk rollback
+func TestGenerateChunk_CountMismatchRollsBack(t *testing.T) {
+	db, mock := setupMockDB(t)
+	cols := []gorm.ColumnType{
+		migrator.ColumnType{NameValue: sql.NullString{String: "ID", Valid: true}, ColumnTypeValue: sql.NullString{String: "nvarchar", Valid: true}, PrimaryKeyValue: sql.NullBool{Bool: true, Valid: true}},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`DROP TABLE #BIChunk`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INTO #BIChunk`).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery(`SELECT \* FROM #BIChunk`).
+		WillReturnRows(sqlmock.NewRows([]string{"ID"}).AddRow("A01").AddRow("A02"))
+	mock.ExpectExec(`INSERT INTO \[DmlLog\]`).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`UPDATE T SET BIStatus = 'Complete'`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DROP TABLE #BIChunk`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	proc := New(db, mq.NewMemoryPublisher())
+	if _, err := proc.generateChunk(context.Background(), "P_Test", "", "Insert", cols, 2); err == nil {
+		t.Fatal("筆數不符應回傳錯誤")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestGenerateChunk_NoPrimaryKeyUsesPhysLoc 驗證沒有主鍵的資料表以 %%physloc%% 認領並更新，不會多更新相同內容的資料列
+func TestGenerateChunk_NoPrimaryKeyUsesPhysLoc(t *testing.T) {
+	db, mock := setupMockDB(t)
+	cols := []gorm.ColumnType{
+		migrator.ColumnType{NameValue: sql.NullString{String: "Line", Valid: true}, ColumnTypeValue: sql.NullString{String: "nvarchar", Valid: true}},
+		migrator.ColumnType{NameValue: sql.NullString{String: "Qty", Valid: true}, ColumnTypeValue: sql.NullString{String: "int", Valid: true}},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`DROP TABLE #BIChunk`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`SELECT TOP \(2\) %%physloc%% AS \[__BIPhysLoc\], \* INTO #BIChunk FROM \[P_Test\] WITH \(UPDLOCK, READPAST\) WHERE BIStatus = 'New'`).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery(`SELECT \* FROM #BIChunk`).
+		WillReturnRows(sqlmock.NewRows([]string{"__BIPhysLoc", "Line", "Qty"}).AddRow([]byte{1}, "L1", 1).AddRow([]byte{2}, "L1", 1))
+	mock.ExpectExec(`INSERT INTO \[DmlLog\]`).
+		WithArgs(jsonWithout("__BIPhysLoc"), "", jsonWithout("__BIPhysLoc"), "").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`UPDATE T SET BIStatus = 'Complete' FROM \[P_Test\] AS T INNER JOIN #BIChunk AS C ON T.%%physloc%% = C.\[__BIPhysLoc\] WHERE T.BIStatus = 'New'`).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DROP TABLE #BIChunk`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	proc := New(db, mq.NewMemoryPublisher())
+	n, err := proc.generateChunk(context.Background(), "P_Test", "", "Insert", cols, 2)
+	if err != nil {
+		t.Fatalf("generateChunk 失敗: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("預期 2 筆，實際 %d", n)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// jsonWithout 比對不含指定字串的 DmlLog.JSON
+type jsonWithout string
+
+func (j jsonWithout) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	return ok && !strings.Contains(s, string(j))
+}
+
+// TestDmlLogGenerate_ContinuesAfterTableError 驗證一張資料表失敗時仍處理其他資料表，最後回傳失敗的資料表
+func TestDmlLogGenerate_ContinuesAfterTableError(t *testing.T) {
+	db, mock := setupMockDB(t)
+	proc := New(db, mq.NewMemoryPublisher())
+	cols := []gorm.ColumnType{
+		migrator.ColumnType{NameValue: sql.NullString{String: "ID", Valid: true}, ColumnTypeValue: sql.NullString{String: "nvarchar", Valid: true}, PrimaryKeyValue: sql.NullBool{Bool: true, Valid: true}},
+	}
+	for _, name := range []string{"Broken", "Broken_History", "P_Test", "P_Test_History"} {
+		proc.colTypeCache[name] = cols
+	}
+
+	mock.ExpectQuery(`SELECT Name FROM "BITaskInfo"`).
+		WillReturnRows(sqlmock.NewRows([]string{"Name"}).AddRow("Broken").AddRow("P_Test"))
+	// Broken_History 認領失敗：本表的 Insert 這一輪不處理
+	mock.ExpectBegin()
+	mock.ExpectExec(`DROP TABLE #BIChunk`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INTO #BIChunk FROM \[Broken_History\]`).WillReturnError(fmt.Errorf("Invalid object name"))
+	mock.ExpectRollback()
+	// P_Test_History 與 P_Test 照常處理
+	for _, name := range []string{"P_Test_History", "P_Test"} {
+		mock.ExpectBegin()
+		mock.ExpectExec(`DROP TABLE #BIChunk`).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(`INTO #BIChunk FROM \[` + name + `\]`).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(`SELECT \* FROM #BIChunk`).WillReturnRows(sqlmock.NewRows([]string{"ID"}))
+		mock.ExpectRollback()
+	}
+
+	err := proc.DmlLogGenerate(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "Broken_History") {
+		t.Fatalf("應回傳失敗的資料表，實際 %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestGroupDmlLogsByStream 驗證重送時依 stream 分組且保持 SerialNo 順序
+func TestGroupDmlLogsByStream(t *testing.T) {
+	logs := []model.DmlLog{
+		{SerialNo: 1, Stream: ""},
+		{SerialNo: 2, Stream: "cutting"},
+		{SerialNo: 3, Stream: ""},
+		{SerialNo: 4, Stream: "cutting"},
+	}
+	groups := groupDmlLogsByStream(logs)
+	if len(groups) != 2 || groups[0].stream != "" || groups[1].stream != "cutting" {
+		t.Fatalf("分組不符：%+v", groups)
+	}
+	if groups[1].logs[0].SerialNo != 2 || groups[1].logs[1].SerialNo != 4 {
+		t.Fatalf("stream 內順序不符：%+v", groups[1].logs)
+	}
+	if got := dmlBatchOps.forStream("cutting").routingKey; got != "bi_dml.cutting.key" {
+		t.Fatalf("RoutingKey 不符：%s", got)
+	}
+}
+
+// TestBuildDmlEntry_TypedValues 驗證 decimal、日期時間、binary、uniqueidentifier 以字串無損編碼並記錄 Types
+func TestBuildDmlEntry_TypedValues(t *testing.T) {
+	col := func(name, dataType string, prec, scale int64) gorm.ColumnType {
+		return migrator.ColumnType{
+			NameValue:        sql.NullString{String: name, Valid: true},
+			ColumnTypeValue:  sql.NullString{String: dataType, Valid: true},
+			DecimalSizeValue: sql.NullInt64{Int64: prec, Valid: prec > 0},
+			ScaleValue:       sql.NullInt64{Int64: scale, Valid: prec > 0},
+		}
+	}
+	codec := newRowCodec([]gorm.ColumnType{
+		col("ID", "nvarchar", 0, 0),
+		col("Qty", "decimal", 18, 4),
+		col("Price", "money", 0, 0),
+		col("UpdTime", "datetime2", 0, 0),
+		col("SyncTime", "datetimeoffset", 0, 0),
+		col("ShiftStart", "time", 0, 0),
+		col("Photo", "varbinary", 0, 0),
+		col("RowGuid", "uniqueidentifier", 0, 0),
+		col("Note", "nvarchar", 0, 0),
+	})
+
+	tpe := time.FixedZone("", 8*3600)
+	row := map[string]interface{}{
+		"ID":         "A01",
+		"Qty":        []byte("12345678901234.5600"),
+		"Price":      []byte("19.9900"),
+		"UpdTime":    time.Date(2025, 6, 1, 8, 30, 0, 123456700, time.UTC),
+		"SyncTime":   time.Date(2025, 6, 1, 8, 30, 0, 0, tpe),
+		"ShiftStart": time.Date(1, 1, 1, 7, 45, 0, 0, time.UTC),
+		"Photo":      []byte{0x00, 0xff, 0x10},
+		// SQL Server 位元組順序的 6F9619FF-8B86-D011-B42D-00C04FC964FF
+		"RowGuid": []byte{0xff, 0x19, 0x96, 0x6f, 0x86, 0x8b, 0x11, 0xd0, 0xb4, 0x2d, 0x00, 0xc0, 0x4f, 0xc9, 0x64, 0xff},
+		"Note":    nil,
+	}
+	body, err := buildDmlEntry("P_Test", "Insert", row, codec)
+	if err != nil {
+		t.Fatalf("buildDmlEntry 失敗: %v", err)
+	}
+	var entry struct {
+		Data  map[string]interface{}
+		Types map[string]string
+	}
+	if err := sonic.Unmarshal(body, &entry); err != nil {
+		t.Fatalf("解析失敗: %v", err)
+	}
+
+	wantData := map[string]interface{}{
+		"TableName":  "P_Test",
+		"ID":         "A01",
+		"Qty":        "12345678901234.5600",
+		"Price":      "19.9900",
+		"UpdTime":    "2025-06-01T08:30:00.1234567",
+		"SyncTime":   "2025-06-01T08:30:00+08:00",
+		"ShiftStart": "07:45:00",
+		"Photo":      "AP8Q",
+		"RowGuid":    "6F9619FF-8B86-D011-B42D-00C04FC964FF",
+		"Note":       nil,
+	}
+	for k, want := range wantData {
+		if got := entry.Data[k]; got != want {
+			t.Errorf("Data[%s] 預期 %v，實際 %v", k, want, got)
+		}
+	}
+	wantTypes := map[string]string{
+		"Qty": "decimal(18,4)", "Price": "money", "UpdTime": "datetime2", "SyncTime": "datetimeoffset",
+		"ShiftStart": "time", "Photo": "varbinary", "RowGuid": "uniqueidentifier",
+	}
+	if len(entry.Types) != len(wantTypes) {
+		t.Fatalf("Types 預期 %v，實際 %v", wantTypes, entry.Types)
+	}
+	for k, want := range wantTypes {
+		if got := entry.Types[k]; got != want {
+			t.Errorf("Types[%s] 預期 %s，實際 %s", k, want, got)
+		}
+	}
+}
+
+// TestSplitBySize 驗證依 byte 預算切段、順序不變，單筆超過預算時自成一段
+func TestSplitBySize(t *testing.T) {
+	size := func(n int) int { return n }
+	got := splitBySize([]int{10, 20, 30, 500, 5}, size, messageOverhead+40)
+	want := [][]int{{10, 20}, {30}, {500}, {5}}
+	if len(got) != len(want) {
+		t.Fatalf("預期 %v，實際 %v", want, got)
+	}
+	for i := range want {
+		if len(got[i]) != len(want[i]) || got[i][0] != want[i][0] {
+			t.Fatalf("預期 %v，實際 %v", want, got)
+		}
+	}
+	if chunks := splitBySize([]int{}, size, 100); len(chunks) != 0 {
+		t.Fatalf("沒有資料時不應產生批次，實際 %v", chunks)
+	}
+}
+
+// TestRunRetention 驗證 dry-run 只統計，一般執行以 DELETE TOP 分段刪除到不足一個 chunk 為止
+func TestRunRetention(t *testing.T) {
+	db, mock := setupMockDB(t)
+	p := New(db, mq.NewMemoryPublisher())
+	p.SetRetention(config.RetentionConfig{LogDays: 30, ChunkSize: 2})
+
+	countRows := func(n int64) *sqlmock.Rows {
+		oldest := sql.NullTime{}
+		if n > 0 {
+			oldest = sql.NullTime{Time: time.Now().AddDate(0, 0, -40), Valid: true}
+		}
+		return sqlmock.NewRows([]string{"count", "oldest"}).AddRow(n, oldest)
+	}
+
+	// 1. dry-run：只查詢筆數
+	mock.ExpectQuery(`SELECT COUNT_BIG\(\*\), MIN\(\[GenerateDate\]\) FROM \[DdlLog\] WHERE \[GenerateDate\] < @p1 AND \(ReceivedByTPE = @p2 OR FilterReason IS NOT NULL\)`).
+		WithArgs(sqlmock.AnyArg(), true).WillReturnRows(countRows(3))
+	mock.ExpectQuery(`FROM \[DmlLog\]`).WillReturnRows(countRows(0))
+	report, err := p.RunRetention(context.Background(), true, nil)
+	if err != nil {
+		t.Fatalf("dry-run 失敗: %v", err)
+	}
+	if !report.DryRun || len(report.Tables) != 2 || report.Tables[0].Eligible != 3 || report.Tables[0].Purged != 0 || report.Tables[0].Oldest == nil {
+		t.Errorf("dry-run 報表不符: %+v", report)
+	}
+
+	// 2. 一般執行：3 筆分成 2 + 1 兩段，DmlLog 沒有可清理的資料就不刪除
+	mock.ExpectQuery(`FROM \[DdlLog\]`).WillReturnRows(countRows(3))
+	mock.ExpectExec(`DELETE TOP \(2\) FROM \[DdlLog\] WHERE \[GenerateDate\] < @p1 AND \(ReceivedByTPE = @p2 OR FilterReason IS NOT NULL\)`).
+		WithArgs(sqlmock.AnyArg(), true).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE TOP \(2\) FROM \[DdlLog\]`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`FROM \[DmlLog\]`).WillReturnRows(countRows(0))
+	report, err = p.RunRetention(context.Background(), false, nil)
+	if err != nil {
+		t.Fatalf("清理失敗: %v", err)
+	}
+	if report.Tables[0].Purged != 3 || report.Interrupted {
+		t.Errorf("清理報表不符: %+v", report)
+	}
+
+	// 3. 離開離峰時段：統計後不刪除，標記為中斷
+	mock.ExpectQuery(`FROM \[DdlLog\]`).WillReturnRows(countRows(3))
+	report, err = p.RunRetention(context.Background(), false, func() bool { return false })
+	if err != nil || !report.Interrupted || report.Tables[0].Purged != 0 {
+		t.Errorf("離開時段應停止清理: %+v, %v", report, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("SQL 預期未滿足: %v", err)
+	}
+}
+
+// TestSnapshot_StartChunksEnd 驗證完整同步依主鍵讀取、依筆數切段，並依序發送 Start、Chunk 與 End
+func TestSnapshot_StartChunksEnd(t *testing.T) {
+	db, mock := setupMockDB(t)
+	pub := mq.NewMemoryPublisher()
+	proc := New(db, pub)
+	proc.colTypeCache["P_Test"] = []gorm.ColumnType{
+		migrator.ColumnType{NameValue: sql.NullString{String: "ID", Valid: true}, ColumnTypeValue: sql.NullString{String: "nvarchar", Valid: true}, PrimaryKeyValue: sql.NullBool{Bool: true, Valid: true}},
+		migrator.ColumnType{NameValue: sql.NullString{String: "Qty", Valid: true}, ColumnTypeValue: sql.NullString{String: "int", Valid: true}},
+	}
+
+	mock.ExpectQuery(`SELECT Name FROM "BITaskInfo"`).
+		WillReturnRows(sqlmock.NewRows([]string{"Name"}).AddRow("Other").AddRow("P_Test"))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT COALESCE\(MAX\(SerialNo\), 0\) FROM "DmlLog"`).
+		WillReturnRows(sqlmock.NewRows([]string{"MaxSerialNo"}).AddRow(int64(42)))
+	mock.ExpectQuery(`SELECT \* FROM \[P_Test\] ORDER BY \[ID\]`).
+		WillReturnRows(sqlmock.NewRows([]string{"ID", "Qty"}).AddRow("A01", 1).AddRow("A02", 2).AddRow("A03", 3))
+	mock.ExpectCommit()
+
+	report, err := proc.Snapshot(context.Background(), SnapshotRequest{Table: "p_test", ChunkRows: 2})
+	if err != nil {
+		t.Fatalf("Snapshot 失敗: %v", err)
+	}
+	if report.Rows != 3 || report.Chunks != 2 || report.Mode != model.SnapshotModeReconcile || report.SnapshotID == "" || report.Watermark != 42 {
+		t.Errorf("報告內容不符: %+v", report)
+	}
+
+	msgs := pub.Messages()
+	wantPhases := []string{model.SnapshotPhaseStart, model.SnapshotPhaseChunk, model.SnapshotPhaseChunk, model.SnapshotPhaseEnd}
+	if len(msgs) != len(wantPhases) {
+		t.Fatalf("預期 %d 則訊息，實際 %d", len(wantPhases), len(msgs))
+	}
+	for i, m := range msgs {
+		var msg model.DmlMessage
+		if err := sonic.Unmarshal(m.Body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Snapshot == nil || msg.Snapshot.Phase != wantPhases[i] || msg.Snapshot.TableName != "P_Test" || msg.Snapshot.Watermark != 42 {
+			t.Fatalf("第 %d 則訊息不符: %+v", i, msg.Snapshot)
+		}
+		if m.RoutingKey != mq.RoutingKeyDML || m.Envelope.SnapshotID != report.SnapshotID || m.Envelope.Sequence != 0 || m.Envelope.ItemCount != len(msg.JSONList) {
+			t.Errorf("第 %d 則信封不符: %s %+v", i, m.RoutingKey, m.Envelope)
+		}
+		switch msg.Snapshot.Phase {
+		case model.SnapshotPhaseChunk:
+			if msg.Snapshot.Chunk != i || msg.Snapshot.Rows != int64(len(msg.JSONList)) {
+				t.Errorf("第 %d 段內容不符: %+v（%d 筆）", i, msg.Snapshot, len(msg.JSONList))
+			}
+		case model.SnapshotPhaseEnd:
+			if msg.Snapshot.Chunks != 2 || msg.Snapshot.Rows != 3 {
+				t.Errorf("End 內容不符: %+v", msg.Snapshot)
+			}
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("SQL 執行與預期不符: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+// 批次進度：記錄各迴圈發送中與最近完成的批次，並提供執行期間調整批次大小
+package service
+
+import (
+	"FtyBiProducer/config"
+	"FtyBiProducer/model"
+	"slices"
+	"time"
+)
+
+// loop 回傳批次所屬的處理迴圈：ddl、dml 或 dml.<stream>
+func (o batchOps) loop() string {
+	if o.stream == "" {
+		return o.kind
+	}
+	return o.kind + "." + o.stream
+}
+
+// startProgress 記錄開始發送的批次
+func (p *Processor) startProgress(ds []delivery) {
+	now := time.Now()
+	p.progressMu.Lock()
+	defer p.progressMu.Unlock()
+	for _, d := range ds {
+		pr := p.progress[d.ops.loop()]
+		if len(pr.InFlight) == 0 {
+			pr.InFlightSince = &now
+		}
+		pr.InFlight = append(pr.InFlight, d.batchID)
+		p.progress[d.ops.loop()] = pr
+	}
+}
+
+// finishProgress 移除發送結束的批次，並更新最近的 BatchID
+func (p *Processor) finishProgress(ds []delivery) {
+	p.progressMu.Lock()
+	defer p.progressMu.Unlock()
+	for _, d := range ds {
+		pr := p.progress[d.ops.loop()]
+		pr.InFlight = slices.DeleteFunc(pr.InFlight, func(id int64) bool { return id == d.batchID })
+		if len(pr.InFlight) == 0 {
+			pr.InFlight, pr.InFlightSince = nil, nil
+		}
+		pr.LastBatchID = max(pr.LastBatchID, d.batchID)
+		p.progress[d.ops.loop()] = pr
+	}
+}
+
+// BatchProgress 回傳各迴圈的批次進度（複本）
+func (p *Processor) BatchProgress() map[string]model.BatchProgress {
+	p.progressMu.Lock()
+	defer p.progressMu.Unlock()
+	out := make(map[string]model.BatchProgress, len(p.progress))
+	for loop, pr := range p.progress {
+		pr.InFlight = slices.Clone(pr.InFlight)
+		out[loop] = pr
+	}
+	return out
+}
+
+// BatchLimits 回傳目前生效的批次上限（未設定的欄位為預設值）
+func (p *Processor) BatchLimits() config.BatchConfig {
+	return config.BatchConfig{DdlMaxRows: p.ddlMaxRows(), DmlMaxRows: p.dmlMaxRows(), MaxBytes: p.maxMessageBytes()}
+}
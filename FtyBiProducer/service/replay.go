@@ -0,0 +1,243 @@
+// 重送指定範圍的 DdlLog / DmlLog
+package service
+
+import (
+	dbLayer "FtyBiProducer/db"
+	"FtyBiProducer/model"
+	"context"
+	"fmt"
+)
+
+// ReplayRequest 描述一次重送，BatchID 與 Range 擇一
+type ReplayRequest struct {
+	Kind    string           // model.ReceiptKindDDL 或 model.ReceiptKindDML
+	BatchID int64            // 重送既有批次紀錄的 SerialNo 範圍
+	Range   dbLayer.LogRange // SerialNo 範圍及/或 GenerateDate 區間
+	DryRun  bool             // 只統計筆數與大小，不建立批次也不發送
+}
+
+// ReplayReport 是重送（或 dry-run）的結果
+type ReplayReport struct {
+	Kind         string
+	DryRun       bool
+	Rows         int
+	Filtered     int // 被 ddl_filter 排除而略過的 DDL 筆數
+	Bytes        int
+	SerialNoFrom int64   // 實際涵蓋的第一筆 SerialNo
+	SerialNoTo   int64   // 實際涵蓋的最後一筆 SerialNo
+	BatchIDs     []int64 // 建立的重送批次，dry-run 時為空
+}
+
+func (r *ReplayReport) add(from, to int64, rows, bytes int) {
+	if r.Rows == 0 {
+		r.SerialNoFrom = from
+	}
+	r.SerialNoTo = to
+	r.Rows += rows
+	r.Bytes += bytes
+}
+
+// Replay 重新發送指定範圍的 Log，不論 ReceivedByTPE 是否已標記
+// 每個分段都會建立 Origin = Replay 的批次紀錄並走完整的狀態機，方便稽核
+func (p *Processor) Replay(ctx context.Context, req ReplayRequest) (*ReplayReport, error) {
+	r := req.Range
+	if req.BatchID > 0 {
+		var err error
+		if r, err = p.replayRangeOfBatch(ctx, req.Kind, req.BatchID); err != nil {
+			return nil, err
+		}
+	}
+	if r.IsEmpty() {
+		return nil, fmt.Errorf("未指定重送範圍")
+	}
+
+	report := &ReplayReport{Kind: req.Kind, DryRun: req.DryRun}
+	var err error
+	switch req.Kind {
+	case model.ReceiptKindDDL:
+		err = p.replayDdl(ctx, r, req.DryRun, report)
+	case model.ReceiptKindDML:
+		err = p.replayDml(ctx, r, req.DryRun, report)
+	default:
+		return nil, fmt.Errorf("不支援的重送種類: %q", req.Kind)
+	}
+	return report, err
+}
+
+func (p *Processor) replayRangeOfBatch(ctx context.Context, kind string, batchID int64) (dbLayer.LogRange, error) {
+	switch kind {
+	case model.ReceiptKindDDL:
+		rec, err := dbLayer.GetLogBatchDdlRecord(ctx, p.db, batchID)
+		if err != nil {
+			return dbLayer.LogRange{}, fmt.Errorf("查詢 DDL 批次 %d 失敗：%w", batchID, err)
+		}
+		return dbLayer.LogRange{SerialNoFrom: rec.SerialNoFrom, SerialNoTo: rec.SerialNoTo}, nil
+	case model.ReceiptKindDML:
+		rec, err := dbLayer.GetLogBatchDmlRecord(ctx, p.db, batchID)
+		if err != nil {
+			return dbLayer.LogRange{}, fmt.Errorf("查詢 DML 批次 %d 失敗：%w", batchID, err)
+		}
+		return dbLayer.LogRange{SerialNoFrom: rec.SerialNoFrom, SerialNoTo: rec.SerialNoTo}, nil
+	}
+	return dbLayer.LogRange{}, fmt.Errorf("不支援的重送種類: %q", kind)
+}
+
+// checkContiguous 以 GenerateDate 區間重送時，確認分段的 SerialNo 範圍內沒有夾雜區間外的 Log
+// 否則標記範圍時會把沒有送出的 Log 一併標記
+func checkContiguous(r dbLayer.LogRange, rows int, total int64) error {
+	if r.GenerateFrom.IsZero() && r.GenerateTo.IsZero() {
+		return nil
+	}
+	if int64(rows) != total {
+		return fmt.Errorf("GenerateDate 區間與 SerialNo 不連續（範圍內 %d 筆，符合條件 %d 筆），請改用 SerialNo 範圍重送", total, rows)
+	}
+	return nil
+}
+
+func (p *Processor) replayDdl(ctx context.Context, r dbLayer.LogRange, dryRun bool, report *ReplayReport) error {
+	var after int64
+	for {
+		logs, err := dbLayer.GetDdlLogsForReplay(ctx, p.db, r, after, p.ddlMaxRows())
+		if err != nil {
+			return fmt.Errorf("查詢重送 DdlLog 失敗：%w", err)
+		}
+		if len(logs) == 0 {
+			return nil
+		}
+		from, to := logs[0].SerialNo, logs[len(logs)-1].SerialNo
+		after = to
+
+		if !dryRun {
+			total, err := dbLayer.CountDdlLogsInRange(ctx, p.db, from, to)
+			if err != nil {
+				return fmt.Errorf("計算 DdlLog 筆數失敗：%w", err)
+			}
+			if err := checkContiguous(r, len(logs), total); err != nil {
+				return err
+			}
+		}
+
+		// 被 ddl_filter 排除的 DDL 不重送，也不修改其 FilterReason
+		entries, filtered, err := p.filterDdlLogs(ctx, parseDdlLogs(logs), false)
+		if err != nil {
+			return err
+		}
+		report.Filtered += filtered
+
+		// 依 byte 預算切成多個批次，同一輪的批次一起發送
+		var ds []delivery
+		for _, chunk := range p.ddlChunks(entries) {
+			cFrom, cTo := chunk[0].log.SerialNo, chunk[len(chunk)-1].log.SerialNo
+			if dryRun {
+				body, err := buildDdlMessage(0, chunk)
+				if err != nil {
+					return err
+				}
+				report.add(cFrom, cTo, len(chunk), len(body))
+				continue
+			}
+
+			record := model.LogBatchDdlRecord{SerialNoFrom: cFrom, SerialNoTo: cTo, Origin: model.BatchOriginReplay}
+			batchID, err := dbLayer.InsertLogBatchDdlRecord(ctx, p.db, &record)
+			if err != nil {
+				return p.deliverCreated(ctx, ds, fmt.Errorf("新增 LogBatchDdlRecord 失敗：%v", err))
+			}
+			report.BatchIDs = append(report.BatchIDs, batchID)
+
+			d, err := p.ddlDelivery(batchID, cFrom, cTo, chunk)
+			if err != nil {
+				return p.deliverCreated(ctx, ds, err)
+			}
+			ds = append(ds, d)
+			report.add(cFrom, cTo, len(chunk), d.env.UncompressedLen)
+		}
+		if len(ds) > 0 {
+			if err := p.deliverBatches(ctx, ds); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *Processor) replayDml(ctx context.Context, r dbLayer.LogRange, dryRun bool, report *ReplayReport) error {
+	var after int64
+	for {
+		logs, err := dbLayer.GetDmlLogsForReplay(ctx, p.db, r, after, p.dmlMaxRows())
+		if err != nil {
+			return fmt.Errorf("查詢重送 DmlLog 失敗：%w", err)
+		}
+		if len(logs) == 0 {
+			return nil
+		}
+		from, to := logs[0].SerialNo, logs[len(logs)-1].SerialNo
+		after = to
+
+		if !dryRun {
+			total, err := dbLayer.CountDmlLogsInRange(ctx, p.db, from, to)
+			if err != nil {
+				return fmt.Errorf("計算 DmlLog 筆數失敗：%w", err)
+			}
+			if err := checkContiguous(r, len(logs), total); err != nil {
+				return err
+			}
+		}
+
+		// 不同 stream 的 Log 分開成批，各自送到自己的 RoutingKey，stream 內順序不變；
+		// 每個 stream 再依 byte 預算切段，同一輪的批次一起發送，不必逐批等待確認
+		var ds []delivery
+		for _, group := range groupDmlLogsByStream(logs) {
+			for _, chunk := range p.dmlChunks(group.logs) {
+				cFrom, cTo := chunk[0].SerialNo, chunk[len(chunk)-1].SerialNo
+				if dryRun {
+					body, err := buildDmlMessage(0, chunk)
+					if err != nil {
+						return err
+					}
+					report.add(cFrom, cTo, len(chunk), len(body))
+					continue
+				}
+
+				record := model.LogBatchDmlRecord{SerialNoFrom: cFrom, SerialNoTo: cTo, Origin: model.BatchOriginReplay, Stream: group.stream}
+				batchID, err := dbLayer.InsertLogBatchDmlRecord(ctx, p.db, &record)
+				if err != nil {
+					return p.deliverCreated(ctx, ds, fmt.Errorf("新增 LogBatchDmlRecord 失敗：%v", err))
+				}
+				report.BatchIDs = append(report.BatchIDs, batchID)
+
+				d, err := p.dmlDelivery(group.stream, batchID, cFrom, cTo, chunk)
+				if err != nil {
+					return p.deliverCreated(ctx, ds, err)
+				}
+				ds = append(ds, d)
+				report.add(cFrom, cTo, len(chunk), d.env.UncompressedLen)
+			}
+		}
+		if len(ds) > 0 {
+			if err := p.deliverBatches(ctx, ds); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// dmlStreamGroup 為同一個 stream 的 DmlLog，依 SerialNo 排序
+type dmlStreamGroup struct {
+	stream string
+	logs   []model.DmlLog
+}
+
+// groupDmlLogsByStream 依 stream 分組，組的順序為各 stream 第一次出現的順序
+func groupDmlLogsByStream(logs []model.DmlLog) []dmlStreamGroup {
+	var groups []dmlStreamGroup
+	index := make(map[string]int)
+	for _, log := range logs {
+		i, ok := index[log.Stream]
+		if !ok {
+			i = len(groups)
+			index[log.Stream] = i
+			groups = append(groups, dmlStreamGroup{stream: log.Stream})
+		}
+		groups[i].logs = append(groups[i].logs, log)
+	}
+	return groups
+}
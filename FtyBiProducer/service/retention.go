@@ -0,0 +1,146 @@
+// 保留期限：分段清理已完成且超過保留天數的 Log、批次紀錄與 _History 資料
+package service
+
+import (
+	"FtyBiProducer/config"
+	dbLayer "FtyBiProducer/db"
+	"FtyBiProducer/metrics"
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultRetentionChunkSize 為未設定 retention.chunk_size 時，每次 DELETE 的筆數
+const DefaultRetentionChunkSize = 5000
+
+// RetentionTableReport 為一張資料表的清理結果
+type RetentionTableReport struct {
+	Table    string
+	Cutoff   time.Time  // 早於此時間的資料才會清理
+	Eligible int64      // 開始時符合條件的筆數
+	Oldest   *time.Time // 符合條件中最舊的時間
+	Purged   int64      // 實際刪除（或搬移）的筆數，dry-run 時為 0
+}
+
+// RetentionReport 為一次清理（或 dry-run）的結果
+type RetentionReport struct {
+	DryRun      bool
+	Mode        string
+	Tables      []RetentionTableReport
+	Interrupted bool // 離開離峰時段或被取消，尚有資料未清理
+}
+
+// SetRetention 設定保留天數與清理方式
+func (p *Processor) SetRetention(cfg config.RetentionConfig) {
+	p.retention = cfg
+}
+
+// retentionTarget 為一張資料表與其保留天數
+type retentionTarget struct {
+	dbLayer.PurgeTarget
+	days int
+}
+
+// retentionTargets 依設定列出要清理的資料表，天數為 0 的類別不列入
+func (p *Processor) retentionTargets(ctx context.Context) ([]retentionTarget, error) {
+	cfg := p.retention
+	var targets []retentionTarget
+	if cfg.LogDays > 0 {
+		for _, t := range dbLayer.LogPurgeTargets() {
+			targets = append(targets, retentionTarget{t, cfg.LogDays})
+		}
+	}
+	if cfg.BatchDays > 0 {
+		for _, t := range dbLayer.BatchPurgeTargets() {
+			targets = append(targets, retentionTarget{t, cfg.BatchDays})
+		}
+	}
+	if cfg.HistoryDays > 0 {
+		tasks, err := p.loadTasks(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, task := range tasks {
+			t := dbLayer.HistoryPurgeTarget(task.Name+"_History", cfg.HistoryDateColumn)
+			targets = append(targets, retentionTarget{t, cfg.HistoryDays})
+		}
+	}
+	return targets, nil
+}
+
+// RunRetention 依序清理各資料表：先統計可清理的筆數，再以 chunk_size 分段刪除，每段是獨立的 statement。
+// dryRun 時只統計；keepGoing 回傳 false（例如離開離峰時段）時停止，下一次再繼續，nil 表示不限制
+func (p *Processor) RunRetention(ctx context.Context, dryRun bool, keepGoing func() bool) (*RetentionReport, error) {
+	cfg := p.retention
+	mode := cfg.Mode
+	if mode == "" {
+		mode = config.RetentionModeDelete
+	}
+	chunk := cfg.ChunkSize
+	if chunk <= 0 {
+		chunk = DefaultRetentionChunkSize
+	}
+	report := &RetentionReport{DryRun: dryRun, Mode: mode}
+
+	// 1. 列出要清理的資料表
+	targets, err := p.retentionTargets(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	now := time.Now()
+	for _, t := range targets {
+		// 2. 統計可清理的筆數
+		tr := RetentionTableReport{Table: t.Table, Cutoff: now.AddDate(0, 0, -t.days)}
+		stats, err := dbLayer.CountPurgeable(ctx, p.db, t.PurgeTarget, tr.Cutoff)
+		if err != nil {
+			return report, fmt.Errorf("統計 %s 可清理筆數失敗：%w", t.Table, err)
+		}
+		tr.Eligible = stats.Count
+		if stats.Oldest.Valid {
+			oldest := stats.Oldest.Time
+			tr.Oldest = &oldest
+		}
+		metrics.RetentionEligibleRows.WithLabelValues(p.factory, t.Table).Set(float64(stats.Count))
+		report.Tables = append(report.Tables, tr)
+		cur := &report.Tables[len(report.Tables)-1]
+		if dryRun || stats.Count == 0 {
+			continue
+		}
+
+		// 3. archive 時先確認目的資料表存在
+		if mode == config.RetentionModeArchive {
+			if err := dbLayer.EnsureArchiveTable(ctx, p.db, t.Table); err != nil {
+				return report, fmt.Errorf("建立 %s%s 失敗：%w", t.Table, dbLayer.ArchiveSuffix, err)
+			}
+		}
+
+		// 4. 分段刪除，直到不足一個 chunk
+		purged := metrics.RetentionPurgedRows.WithLabelValues(p.factory, t.Table, mode)
+		for {
+			if ctx.Err() != nil || (keepGoing != nil && !keepGoing()) {
+				report.Interrupted = true
+				return report, ctx.Err()
+			}
+			n, err := dbLayer.PurgeChunk(ctx, p.db, t.PurgeTarget, tr.Cutoff, chunk, mode == config.RetentionModeArchive)
+			if err != nil {
+				return report, fmt.Errorf("清理 %s 失敗（已清理 %d 筆）：%w", t.Table, cur.Purged, err)
+			}
+			cur.Purged += n
+			purged.Add(float64(n))
+			if n < int64(chunk) {
+				break
+			}
+			if cfg.ChunkPause > 0 {
+				select {
+				case <-ctx.Done():
+				case <-time.After(cfg.ChunkPause):
+				}
+			}
+		}
+	}
+	if !dryRun {
+		metrics.RetentionLastRunTimestamp.WithLabelValues(p.factory).SetToCurrentTime()
+	}
+	return report, nil
+}
@@ -0,0 +1,239 @@
+// 完整同步：以 snapshot isolation 讀取 BITaskInfo 資料表在同一時間點的完整資料，分段發送給 TpeBiConsumer
+package service
+
+import (
+	"FtyBiProducer/config"
+	dbLayer "FtyBiProducer/db"
+	"FtyBiProducer/model"
+	"FtyBiProducer/mq"
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"gorm.io/gorm"
+)
+
+// snapshotOverhead 為 SnapshotInfo 編碼後的大小上限，切段時與 messageOverhead 一起預留
+const snapshotOverhead = 256
+
+// SnapshotRequest 描述一次完整同步
+type SnapshotRequest struct {
+	Table     string // BITaskInfo 中的資料表
+	Mode      string // model.SnapshotModeReconcile（預設）或 model.SnapshotModeSwap
+	ChunkRows int    // 每段的筆數上限，0 表示使用 batch.dml_max_rows
+	DryRun    bool   // 只統計筆數與大小，不發送
+}
+
+// SnapshotReport 是完整同步（或 dry-run）的結果
+type SnapshotReport struct {
+	SnapshotID string
+	Table      string
+	Stream     string
+	Mode       string
+	DryRun     bool
+	Rows       int64
+	Bytes      int
+	Chunks     int
+	TakenAt    time.Time
+	// Change Tracking 資料表在 snapshot 時的版本，其他資料表為 0
+	Version int64
+	// 為 true 表示同步版本原本未初始化，已設為 Version
+	VersionSaved bool
+	// snapshot 時 DmlLog 最大的 SerialNo，隨每則訊息送出
+	Watermark int64
+}
+
+// Snapshot 把資料表的完整資料依序發送為 Start、Chunk…、End 訊息，送往該資料表所屬 stream 的 RoutingKey：
+//  1. 資料表必須在 BITaskInfo 中且有主鍵，TpeBiConsumer 以主鍵把 staging 套用到正式資料表
+//  2. 在 snapshot isolation 的 transaction 內依主鍵順序讀取，不會鎖住來源資料表，也不會讀到讀取期間的異動
+//  3. 每則訊息都等 broker 確認後才送下一則；中途失敗時重新執行即可，Consumer 會以新的 SnapshotID 重建 staging
+//  4. Change Tracking 資料表的同步版本尚未初始化時，設為 snapshot 的版本，之後的變更由 DmlLog 接續
+//
+// 完整同步不建立批次紀錄也不更新 BIStatus；每則訊息帶 snapshot 時 DmlLog 最大的 SerialNo（Watermark），
+// Consumer 在 End 套用前暫存該資料表的 DML 異動，套用後略過 Watermark 以前的異動，不必暫停 DML 發送
+func (p *Processor) Snapshot(ctx context.Context, req SnapshotRequest) (*SnapshotReport, error) {
+	// 1. 確認資料表與所屬 stream
+	task, err := p.findTask(ctx, req.Table)
+	if err != nil {
+		return nil, err
+	}
+	mode := req.Mode
+	if mode == "" {
+		mode = model.SnapshotModeReconcile
+	}
+	if mode != model.SnapshotModeReconcile && mode != model.SnapshotModeSwap {
+		return nil, fmt.Errorf("不支援的完整同步方式: %q", mode)
+	}
+	chunkRows := req.ChunkRows
+	if chunkRows <= 0 {
+		chunkRows = p.dmlMaxRows()
+	}
+
+	// 2. 取得欄位與主鍵
+	columnTypes, err := p.getColumnTypesOnce(ctx, task.Name)
+	if err != nil {
+		return nil, fmt.Errorf("取得 %s 欄位資訊失敗: %w", task.Name, err)
+	}
+	var pkCols []string
+	for _, ct := range columnTypes {
+		if isPK, _ := ct.PrimaryKey(); isPK {
+			pkCols = append(pkCols, dbLayer.QuoteIdent(ct.Name()))
+		}
+	}
+	if len(pkCols) == 0 {
+		return nil, fmt.Errorf("%s 沒有主鍵，無法完整同步", task.Name)
+	}
+
+	report := &SnapshotReport{
+		Table:  task.Name,
+		Stream: task.Stream,
+		Mode:   mode,
+		DryRun: req.DryRun,
+	}
+	ct := p.dmlSources.SourceFor(task.Name) == config.DmlSourceChangeTracking
+
+	// 3. 在 snapshot isolation 的 transaction 內讀取並發送（資料庫需開啟 ALLOW_SNAPSHOT_ISOLATION）
+	err = p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		report.TakenAt = time.Now()
+		report.SnapshotID = p.factory + "-" + task.Name + "-" + strconv.FormatInt(report.TakenAt.UnixNano(), 10)
+		if ct {
+			current, _, err := dbLayer.GetChangeTrackingVersions(ctx, tx, task.Name)
+			if err != nil {
+				return fmt.Errorf("查詢 %s Change Tracking 版本失敗：%w", task.Name, err)
+			}
+			report.Version = current
+		}
+		watermark, err := dbLayer.GetMaxDmlSerialNo(ctx, tx)
+		if err != nil {
+			return fmt.Errorf("查詢 DmlLog 最大 SerialNo 失敗：%w", err)
+		}
+		report.Watermark = watermark
+		return p.streamSnapshot(ctx, tx, report, columnTypes, pkCols, chunkRows)
+	}, &sql.TxOptions{Isolation: sql.LevelSnapshot})
+	if err != nil {
+		return report, err
+	}
+
+	// 4. Change Tracking 資料表：第一次同步從 snapshot 的版本開始追蹤
+	if ct && !req.DryRun {
+		if _, ok, err := dbLayer.GetDmlSyncVersion(ctx, p.db, task.Name); err != nil {
+			return report, fmt.Errorf("查詢 %s 同步版本失敗：%w", task.Name, err)
+		} else if !ok {
+			if err := dbLayer.SaveDmlSyncVersion(ctx, p.db, task.Name, report.Version); err != nil {
+				return report, fmt.Errorf("初始化 %s 同步版本失敗：%w", task.Name, err)
+			}
+			report.VersionSaved = true
+		}
+	}
+	return report, nil
+}
+
+// findTask 在 BITaskInfo 中找出資料表（不分大小寫）
+func (p *Processor) findTask(ctx context.Context, tableName string) (biTask, error) {
+	tasks, err := p.loadTasks(ctx)
+	if err != nil {
+		return biTask{}, err
+	}
+	for _, task := range tasks {
+		if strings.EqualFold(task.Name, tableName) {
+			return task, nil
+		}
+	}
+	return biTask{}, fmt.Errorf("%s 不在 BITaskInfo 中", tableName)
+}
+
+// streamSnapshot 依主鍵順序逐列讀取，依筆數與 byte 預算切段；發送 Start、各段 Chunk 與 End
+func (p *Processor) streamSnapshot(ctx context.Context, tx *gorm.DB, report *SnapshotReport, columnTypes []gorm.ColumnType, pkCols []string, chunkRows int) error {
+	info := model.SnapshotInfo{
+		SnapshotID: report.SnapshotID,
+		TableName:  report.Table,
+		Mode:       report.Mode,
+		TakenAt:    report.TakenAt,
+		Watermark:  report.Watermark,
+	}
+	send := func(phase string, jsonList []string, rows int64) error {
+		info.Phase, info.Rows = phase, rows
+		if report.DryRun {
+			return nil
+		}
+		return p.publishSnapshot(ctx, report.Stream, info, jsonList)
+	}
+	if err := send(model.SnapshotPhaseStart, nil, 0); err != nil {
+		return err
+	}
+
+	rows, err := tx.Raw(fmt.Sprintf("SELECT * FROM %s ORDER BY %s",
+		dbLayer.QuoteIdent(report.Table), strings.Join(pkCols, ", "))).Rows()
+	if err != nil {
+		return fmt.Errorf("查詢 %s 失敗: %w", report.Table, err)
+	}
+	defer rows.Close()
+
+	budget := p.maxMessageBytes() - snapshotOverhead
+	codec := newRowCodec(columnTypes)
+	var chunk []string
+	size := messageOverhead
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		report.Chunks++
+		report.Rows += int64(len(chunk))
+		report.Bytes += size
+		info.Chunk = report.Chunks
+		if err := send(model.SnapshotPhaseChunk, chunk, int64(len(chunk))); err != nil {
+			return err
+		}
+		chunk, size = nil, messageOverhead
+		return nil
+	}
+	for rows.Next() {
+		row := make(map[string]interface{})
+		if err := tx.ScanRows(rows, &row); err != nil {
+			return fmt.Errorf("讀取 %s 失敗: %w", report.Table, err)
+		}
+		jsonBytes, err := buildDmlEntry(report.Table, "Insert", row, codec)
+		if err != nil {
+			return fmt.Errorf("JSON 編碼失敗: %w", err)
+		}
+		n := encodedLen(string(jsonBytes))
+		if len(chunk) > 0 && (len(chunk) >= chunkRows || size+n > budget) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		chunk = append(chunk, string(jsonBytes))
+		size += n
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("讀取 %s 失敗: %w", report.Table, err)
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	info.Chunk, info.Chunks = 0, report.Chunks
+	return send(model.SnapshotPhaseEnd, nil, report.Rows)
+}
+
+// publishSnapshot 發送一則完整同步訊息並等待 broker 確認；不需要回執，也不帶批次序號
+func (p *Processor) publishSnapshot(ctx context.Context, stream string, info model.SnapshotInfo, jsonList []string) error {
+	body, err := sonic.Marshal(model.DmlMessage{JSONList: jsonList, Snapshot: &info})
+	if err != nil {
+		return fmt.Errorf("轉換 JSON 失敗：%w", err)
+	}
+	d, err := p.newDelivery(dmlBatchOps.forStream(stream), 0, 0, 0, len(jsonList), body)
+	if err != nil {
+		return err
+	}
+	d.env.SnapshotID = info.SnapshotID
+	msg := mq.Message{RoutingKey: d.ops.routingKey, Body: d.body, Envelope: d.env}
+	if err := mq.PublishBatch(ctx, p.publisher, []mq.Message{msg})[0]; err != nil {
+		return fmt.Errorf("發送 %s 完整同步 %s（%s %d）失敗：%w", info.TableName, info.SnapshotID, info.Phase, info.Chunk, err)
+	}
+	return nil
+}
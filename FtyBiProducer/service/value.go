@@ -0,0 +1,166 @@
+// 欄位值編碼：JSON 無法無損表示的型別（decimal、日期時間、binary…）改以字串編碼，
+// 並在 DmlLog 的 Types 記錄來源型別，TpeBiConsumer 依 Types 與目的欄位型別還原
+package service
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	mssql "github.com/microsoft/go-mssqldb"
+	"gorm.io/gorm"
+)
+
+// 型別化欄位的種類，由 Types 中的來源型別決定
+const (
+	valueKindDecimal        = "decimal"          // 完整精度的十進位字串，例如 "12.3400"
+	valueKindDate           = "date"             // 2006-01-02
+	valueKindTime           = "time"             // 15:04:05.9999999
+	valueKindDateTime       = "datetime"         // 2006-01-02T15:04:05.9999999，不帶時區（牆上時間）
+	valueKindDateTimeOffset = "datetimeoffset"   // 2006-01-02T15:04:05.9999999+08:00
+	valueKindBinary         = "binary"           // base64
+	valueKindGUID           = "uniqueidentifier" // 8-4-4-4-12 大寫十六進位
+	valueKindXML            = "xml"              // 原始 XML 字串
+)
+
+// 型別化欄位的時間格式
+const (
+	layoutDate           = "2006-01-02"
+	layoutTime           = "15:04:05.9999999"
+	layoutDateTime       = "2006-01-02T15:04:05.9999999"
+	layoutDateTimeOffset = "2006-01-02T15:04:05.9999999Z07:00"
+)
+
+// valueKind 回傳來源型別（不分大小寫，可帶精度）對應的編碼種類，JSON 原生型別回傳空字串
+func valueKind(srcType string) string {
+	name := strings.ToUpper(srcType)
+	if i := strings.IndexByte(name, '('); i >= 0 {
+		name = name[:i]
+	}
+	switch strings.TrimSpace(name) {
+	case "DECIMAL", "NUMERIC", "MONEY", "SMALLMONEY":
+		return valueKindDecimal
+	case "DATE":
+		return valueKindDate
+	case "TIME":
+		return valueKindTime
+	case "DATETIME", "DATETIME2", "SMALLDATETIME":
+		return valueKindDateTime
+	case "DATETIMEOFFSET":
+		return valueKindDateTimeOffset
+	case "BINARY", "VARBINARY", "IMAGE", "TIMESTAMP", "ROWVERSION":
+		return valueKindBinary
+	case "UNIQUEIDENTIFIER":
+		return valueKindGUID
+	case "XML":
+		return valueKindXML
+	}
+	return ""
+}
+
+// rowCodec 記錄一張資料表中需要型別化編碼的欄位：欄位名稱 -> 來源型別（寫入 Types）
+type rowCodec map[string]string
+
+// newRowCodec 依資料表欄位資訊建立 rowCodec，decimal / numeric 帶上精度與小數位數
+func newRowCodec(columnTypes []gorm.ColumnType) rowCodec {
+	codec := make(rowCodec)
+	for _, ct := range columnTypes {
+		dbType := strings.ToLower(columnTypeName(ct))
+		if valueKind(dbType) == "" {
+			continue
+		}
+		if dbType == "decimal" || dbType == "numeric" {
+			if prec, scale, ok := ct.DecimalSize(); ok {
+				dbType = fmt.Sprintf("%s(%d,%d)", dbType, prec, scale)
+			}
+		}
+		codec[ct.Name()] = dbType
+	}
+	return codec
+}
+
+// columnTypeName 回傳欄位的資料庫型別名稱，優先使用 INFORMATION_SCHEMA 的 DATA_TYPE
+func columnTypeName(ct gorm.ColumnType) string {
+	if name, ok := ct.ColumnType(); ok && name != "" {
+		return name
+	}
+	return ct.DatabaseTypeName()
+}
+
+// encode 編碼 row 中需要型別化的欄位（原地修改），並把來源型別記錄到 types；NULL 不列入
+func (c rowCodec) encode(row map[string]interface{}, types map[string]string) error {
+	for col, srcType := range c {
+		v, ok := row[col]
+		if !ok || v == nil {
+			continue
+		}
+		encoded, err := encodeValue(valueKind(srcType), v)
+		if err != nil {
+			return fmt.Errorf("欄位 %s (%s) 編碼失敗：%w", col, srcType, err)
+		}
+		row[col] = encoded
+		types[col] = srcType
+	}
+	return nil
+}
+
+// encodeValue 把 driver 回傳的值依種類轉成字串
+func encodeValue(kind string, v interface{}) (string, error) {
+	switch kind {
+	case valueKindDecimal:
+		// go-mssqldb 以 []byte 回傳 decimal / money，內容即完整精度的十進位字串
+		switch x := v.(type) {
+		case []byte:
+			return string(x), nil
+		case string:
+			return x, nil
+		case int64:
+			return strconv.FormatInt(x, 10), nil
+		case float64:
+			return strconv.FormatFloat(x, 'f', -1, 64), nil
+		}
+	case valueKindDate, valueKindTime, valueKindDateTime, valueKindDateTimeOffset:
+		switch x := v.(type) {
+		case time.Time:
+			return x.Format(timeLayout(kind)), nil
+		case string:
+			return x, nil
+		}
+	case valueKindBinary:
+		switch x := v.(type) {
+		case []byte:
+			return base64.StdEncoding.EncodeToString(x), nil
+		case string:
+			return base64.StdEncoding.EncodeToString([]byte(x)), nil
+		}
+	case valueKindGUID:
+		// driver 回傳的是 SQL Server 的位元組順序，以 mssql.UniqueIdentifier 轉換
+		var u mssql.UniqueIdentifier
+		if err := u.Scan(v); err != nil {
+			return "", err
+		}
+		return u.String(), nil
+	case valueKindXML:
+		switch x := v.(type) {
+		case string:
+			return x, nil
+		case []byte:
+			return string(x), nil
+		}
+	}
+	return "", fmt.Errorf("不支援的值型別 %T", v)
+}
+
+func timeLayout(kind string) string {
+	switch kind {
+	case valueKindDate:
+		return layoutDate
+	case valueKindTime:
+		return layoutTime
+	case valueKindDateTimeOffset:
+		return layoutDateTimeOffset
+	}
+	return layoutDateTime
+}
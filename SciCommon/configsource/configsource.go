@@ -0,0 +1,189 @@
+// 設定來源：決定服務要載入的設定檔（--config / --profile / ENV），並輸出遮蔽敏感欄位後的有效設定；
+// JSON 設定檔的服務以 Load 載入，YAML 設定檔的服務只用 Resolve 決定檔案，再交給 viper 合併
+package configsource
+
+import (
+	"SciCommon/redact"
+	"SciCommon/secret"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Locator 描述服務的設定檔目錄、副檔名與 ENV 前綴
+type Locator struct {
+	Dir       string // 例如 "config"
+	Ext       string // 例如 "json"、"yaml"
+	EnvPrefix string // 例如 "ScriptPilot"，對應 SCRIPTPILOT_CONFIG、SCRIPTPILOT_PROFILE
+}
+
+// Selection 為命令列或 ENV 指定的設定來源，兩者擇一
+type Selection struct {
+	Files   []string // --config：依序合併，後面的覆寫前面的
+	Profile string   // --profile：載入 config.base.<ext>（若存在）再疊上 config.<profile>.<ext>
+}
+
+// RegisterFlags 在 fs 上註冊 --config 與 --profile
+func (s *Selection) RegisterFlags(fs *flag.FlagSet) {
+	fs.Func("config", "設定檔路徑，可重複指定或以逗號分隔，後面的覆寫前面的", func(v string) error {
+		s.Files = append(s.Files, splitList(v)...)
+		return nil
+	})
+	fs.StringVar(&s.Profile, "profile", "", "設定檔 profile，例如 prod 對應 config/config.prod.<副檔名>，疊在 config.base 之上")
+}
+
+// Resolve 依 Selection、ENV 決定要依序載入的設定檔；
+// 都未指定時，目錄下只能有一個 config.*.<ext>，避免依目錄排序誤用其他環境的設定
+func (l Locator) Resolve(sel Selection) ([]string, error) {
+	if len(sel.Files) == 0 && sel.Profile == "" {
+		sel.Files = splitList(os.Getenv(l.envName("CONFIG")))
+		sel.Profile = os.Getenv(l.envName("PROFILE"))
+	}
+	if len(sel.Files) > 0 && sel.Profile != "" {
+		return nil, errors.New("--config 與 --profile 不可同時指定")
+	}
+
+	// 1. 明確指定的檔案
+	if len(sel.Files) > 0 {
+		for _, f := range sel.Files {
+			if _, err := os.Stat(f); err != nil {
+				return nil, fmt.Errorf("找不到設定檔 %s：%w", f, err)
+			}
+		}
+		return sel.Files, nil
+	}
+
+	// 2. 指定 profile
+	if sel.Profile != "" {
+		file := l.file(sel.Profile)
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("找不到 profile %q 的設定檔 %s：%w", sel.Profile, file, err)
+		}
+		return l.withBase(file), nil
+	}
+
+	// 3. 未指定：目錄下只有一個設定檔時才自動使用
+	matches, err := filepath.Glob(filepath.Join(l.Dir, "config.*."+l.Ext))
+	if err != nil {
+		return nil, fmt.Errorf("尋找設定檔時發生錯誤：%w", err)
+	}
+	base := l.file("base")
+	candidates := matches[:0]
+	for _, m := range matches {
+		if m != base {
+			candidates = append(candidates, m)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("在 %s/ 目錄下找不到任何 config.*.%s 檔案", l.Dir, l.Ext)
+	case 1:
+		return l.withBase(candidates[0]), nil
+	default:
+		return nil, fmt.Errorf("%s/ 目錄下有多個設定檔 %v，請以 --profile、--config 或 %s 指定",
+			l.Dir, candidates, l.envName("PROFILE"))
+	}
+}
+
+func (l Locator) file(profile string) string {
+	return filepath.Join(l.Dir, "config."+profile+"."+l.Ext)
+}
+
+// withBase 在 file 前加上存在的基底設定檔
+func (l Locator) withBase(file string) []string {
+	base := l.file("base")
+	if _, err := os.Stat(base); err == nil {
+		return []string{base, file}
+	}
+	return []string{file}
+}
+
+func (l Locator) envName(key string) string {
+	return strings.ToUpper(l.EnvPrefix + "_" + key)
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Secrets 回傳本服務的加密秘密檔：預設為 <Dir>/secrets.enc.json，master key 由 <EnvPrefix>_MASTER_KEY 指定
+func (l Locator) Secrets() secret.Source {
+	return secret.Source{Dir: l.Dir, EnvPrefix: l.EnvPrefix}
+}
+
+// Load 依序載入 JSON 設定檔（同 LoadJSON），再展開秘密參照
+func (l Locator) Load(files []string, out interface{}) error {
+	if err := LoadJSON(files, out); err != nil {
+		return err
+	}
+	return secret.Resolve(out, "json", l.Secrets().Providers())
+}
+
+// LoadJSON 依序把 JSON 設定檔解析到 out，後面的檔案只覆寫自己有寫的欄位
+func LoadJSON(files []string, out interface{}) error {
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("讀取設定檔 %s 失敗：%w", f, err)
+		}
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("解析設定檔 %s 失敗：%w", f, err)
+		}
+	}
+	return nil
+}
+
+// RedactedJSON 回傳遮蔽密碼、金鑰與連線字串帳密後的縮排 JSON，供 validate-config 輸出
+func RedactedJSON(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(redactValue("", m), "", "  ")
+}
+
+// RedactSettings 回傳遮蔽密碼、金鑰與連線字串帳密後的設定複本，供以 viper 載入的服務輸出 AllSettings
+func RedactSettings(m map[string]interface{}) map[string]interface{} {
+	return redactValue("", m).(map[string]interface{})
+}
+
+func redactValue(key string, v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			out[k] = redactValue(k, item)
+		}
+		return out
+	case []interface{}:
+		items := make([]interface{}, len(val))
+		for i, item := range val {
+			items[i] = redactValue(key, item)
+		}
+		return items
+	case string:
+		if redact.IsSensitiveKey(key) && val != "" {
+			return redact.Mask
+		}
+		// 連線字串中的密碼與已登記的秘密值，與 log 的遮蔽規則相同
+		return redact.String(val)
+	}
+	if redact.IsSensitiveKey(key) {
+		return redact.Mask
+	}
+	return v
+}
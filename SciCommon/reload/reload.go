@@ -0,0 +1,96 @@
+// 設定檔熱重載的共用部分：監看設定檔、比對新舊設定並依是否可即時套用分類，
+// 由 FtyBiProducer 與 TpeBiConsumer 的 config 套件各自決定哪些設定可即時套用
+package reload
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// debounce 為設定檔變更後等待的時間，編輯器存檔常連續觸發多次事件，只重載一次
+const debounce = 500 * time.Millisecond
+
+// Changes 為新舊設定的差異
+type Changes struct {
+	Live     []string // 可即時套用的設定鍵
+	Deferred []string // 需重新啟動才會生效的設定鍵
+}
+
+// Empty 回傳是否沒有任何差異
+func (c Changes) Empty() bool {
+	return len(c.Live) == 0 && len(c.Deferred) == 0
+}
+
+// Diff 比較兩份同型別的設定 struct（以 mapstructure 鍵名表示，例如 batch.dml_max_rows），
+// 依 reloadable 分類為可即時套用或需重新啟動
+func Diff(old, next interface{}, reloadable func(key string) bool) Changes {
+	var changes Changes
+	diffValue("", reflect.ValueOf(old), reflect.ValueOf(next), func(key string) {
+		if reloadable(key) {
+			changes.Live = append(changes.Live, key)
+		} else {
+			changes.Deferred = append(changes.Deferred, key)
+		}
+	})
+	sort.Strings(changes.Live)
+	sort.Strings(changes.Deferred)
+	return changes
+}
+
+// diffValue 逐欄位比較 struct，巢狀 struct 以 . 串接鍵名，其餘型別（含 slice）整體比較
+func diffValue(prefix string, old, next reflect.Value, changed func(key string)) {
+	t := old.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("mapstructure"), ",")
+		if tag == "-" || !f.IsExported() {
+			continue
+		}
+		if tag == "" {
+			tag = strings.ToLower(f.Name)
+		}
+		key := prefix + tag
+		ov, nv := old.Field(i), next.Field(i)
+		if f.Type.Kind() == reflect.Struct && f.Type != reflect.TypeOf(time.Time{}) {
+			diffValue(key+".", ov, nv, changed)
+			continue
+		}
+		if !reflect.DeepEqual(ov.Interface(), nv.Interface()) {
+			changed(key)
+		}
+	}
+}
+
+// Watch 以 viper 監看每個設定檔，任一檔案變更時（合併連續事件後）呼叫 onChange；
+// onChange 需自行重新載入全部設定檔，並以 Diff 判斷是否真的有變更
+func Watch(files []string, onChange func()) error {
+	var (
+		mu    sync.Mutex
+		timer *time.Timer
+	)
+	fire := func(fsnotify.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = time.AfterFunc(debounce, onChange)
+	}
+	for _, f := range files {
+		v := viper.New()
+		v.SetConfigFile(f)
+		if err := v.ReadInConfig(); err != nil {
+			return fmt.Errorf("監看設定檔 %s 失敗: %w", f, err)
+		}
+		v.OnConfigChange(fire)
+		v.WatchConfig()
+	}
+	return nil
+}
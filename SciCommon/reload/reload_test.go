@@ -0,0 +1,78 @@
+package reload
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testBatch struct {
+	MaxRows int `mapstructure:"max_rows"`
+}
+
+type testConfig struct {
+	LogLevel string        `mapstructure:"log_level"`
+	Interval time.Duration `mapstructure:"interval"`
+	Host     string        `mapstructure:"host"`
+	Streams  []string      `mapstructure:"streams"`
+	Batch    testBatch     `mapstructure:"batch"`
+	Since    time.Time     `mapstructure:"since"`
+	internal int
+}
+
+// TestDiff 驗證巢狀 struct 以 . 串接鍵名、slice 與 time.Time 整體比較，並依 reloadable 分類
+func TestDiff(t *testing.T) {
+	reloadable := func(key string) bool { return key == "log_level" || key == "batch.max_rows" }
+	old := testConfig{Interval: time.Second, Host: "PMSDB", Streams: []string{"orders"}, Batch: testBatch{MaxRows: 1000}}
+	next := old
+	next.LogLevel = "debug"
+	next.Batch.MaxRows = 500
+	next.Host = "PMSDB2"
+	next.Streams = []string{"orders", "stock"}
+	next.Since = time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	next.internal = 1
+
+	changes := Diff(old, next, reloadable)
+	if want := []string{"batch.max_rows", "log_level"}; !reflect.DeepEqual(changes.Live, want) {
+		t.Fatalf("可即時套用的設定預期 %v，實際 %v", want, changes.Live)
+	}
+	if want := []string{"host", "since", "streams"}; !reflect.DeepEqual(changes.Deferred, want) {
+		t.Fatalf("需重新啟動的設定預期 %v，實際 %v", want, changes.Deferred)
+	}
+	if !Diff(next, next, reloadable).Empty() {
+		t.Fatal("相同設定不應有差異")
+	}
+}
+
+// TestWatch 驗證設定檔連續變更只觸發一次 onChange
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("log_level: info\n"), 0o600); err != nil {
+		t.Fatalf("寫入設定檔失敗: %v", err)
+	}
+	fired := make(chan struct{}, 10)
+	if err := Watch([]string{path}, func() { fired <- struct{}{} }); err != nil {
+		t.Fatalf("Watch 失敗: %v", err)
+	}
+	for _, level := range []string{"debug", "warn", "error"} {
+		if err := os.WriteFile(path, []byte("log_level: "+level+"\n"), 0o600); err != nil {
+			t.Fatalf("寫入設定檔失敗: %v", err)
+		}
+	}
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("設定檔變更後應呼叫 onChange")
+	}
+	select {
+	case <-fired:
+		t.Fatal("連續變更應只觸發一次")
+	case <-time.After(2 * debounce):
+	}
+
+	if err := Watch([]string{filepath.Join(t.TempDir(), "missing.yaml")}, func() {}); err == nil {
+		t.Fatal("設定檔不存在時應回傳錯誤")
+	}
+}
@@ -0,0 +1,90 @@
+package secret
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Run 執行各服務的 secrets 子命令，例如：
+//
+//	fty-bi-producer secrets keygen
+//	echo -n 'P@ssw0rd' | fty-bi-producer secrets set db.password
+//	fty-bi-producer secrets list
+//	fty-bi-producer secrets delete db.password
+//
+// set 從 stdin 讀取一行作為值，避免密碼出現在命令列歷史；-file 可指定秘密檔，預設依 <EnvPrefix>_SECRETS_FILE
+func Run(src Source, args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("請指定 keygen、set、delete 或 list")
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("secrets "+action, flag.ContinueOnError)
+	file := fs.String("file", src.File(), "加密秘密檔路徑")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	// 1. keygen 不需要開啟秘密檔
+	if action == "keygen" {
+		key, err := GenerateMasterKey()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, key)
+		return nil
+	}
+
+	// 2. 其餘動作需要 master key
+	key, err := src.MasterKey()
+	if err != nil {
+		return err
+	}
+	store, err := OpenStore(*file, key)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "list":
+		for _, name := range store.Names() {
+			fmt.Fprintln(stdout, name)
+		}
+		return nil
+	case "set":
+		if fs.NArg() != 1 {
+			return errors.New("用法：secrets set <名稱>，值從 stdin 讀取")
+		}
+		value, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("讀取 stdin 失敗：%w", err)
+		}
+		if value = strings.TrimRight(value, "\r\n"); value == "" {
+			return errors.New("值不可為空")
+		}
+		if err := store.Set(fs.Arg(0), value); err != nil {
+			return err
+		}
+		if err := store.Save(); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "已設定 %s（%s）\n", fs.Arg(0), *file)
+		return nil
+	case "delete":
+		if fs.NArg() != 1 {
+			return errors.New("用法：secrets delete <名稱>")
+		}
+		if !store.Delete(fs.Arg(0)) {
+			return fmt.Errorf("%s 中沒有 %q", *file, fs.Arg(0))
+		}
+		if err := store.Save(); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "已移除 %s（%s）\n", fs.Arg(0), *file)
+		return nil
+	default:
+		return fmt.Errorf("未知的 secrets 動作：%s", action)
+	}
+}
@@ -0,0 +1,120 @@
+package secret
+
+import (
+	"SciCommon/redact"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// refPattern 比對設定值中的秘密參照，可以是整個值或其中一段，例如 amqps://bi:${secret:mq.password}@host/
+var refPattern = regexp.MustCompile(`\$\{(env|file|secret):([^}]+)\}`)
+
+// Resolve 展開 out（struct 指標）中所有字串欄位的秘密參照；
+// 參照取得的值與密碼、金鑰欄位的值都登記到 redact，寫 log 時遮蔽。
+// tag 為設定檔解碼使用的 struct tag（viper 為 mapstructure、encoding/json 為 json），錯誤訊息以此組出設定鍵
+func Resolve(out interface{}, tag string, providers Providers) error {
+	return resolveValue(reflect.ValueOf(out), "", tag, providers)
+}
+
+func resolveValue(v reflect.Value, key, tag string, providers Providers) error {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return resolveValue(v.Elem(), key, tag, providers)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			if err := resolveValue(v.Field(i), joinKey(key, fieldKey(f, tag)), tag, providers); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := resolveValue(v.Index(i), fmt.Sprintf("%s[%d]", key, i), tag, providers); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			name := iter.Key().String()
+			s, err := expand(iter.Value().String(), providers)
+			if err != nil {
+				return fmt.Errorf("設定 %s 的秘密參照無法取得：%w", joinKey(key, name), err)
+			}
+			registerIfSensitive(name, s)
+			v.SetMapIndex(iter.Key(), reflect.ValueOf(s).Convert(v.Type().Elem()))
+		}
+	case reflect.String:
+		s, err := expand(v.String(), providers)
+		if err != nil {
+			return fmt.Errorf("設定 %s 的秘密參照無法取得：%w", key, err)
+		}
+		registerIfSensitive(key[strings.LastIndex(key, ".")+1:], s)
+		if v.CanSet() {
+			v.SetString(s)
+		}
+	}
+	return nil
+}
+
+// expand 以 Provider 取代字串中的秘密參照
+func expand(s string, providers Providers) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var firstErr error
+	out := refPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		m := refPattern.FindStringSubmatch(ref)
+		provider, ok := providers[m[1]]
+		if !ok {
+			return ref
+		}
+		value, err := provider.Secret(strings.TrimSpace(m[2]))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return ref
+		}
+		redact.RegisterSecret(value)
+		return value
+	})
+	return out, firstErr
+}
+
+// registerIfSensitive 登記密碼、金鑰欄位的值，未使用秘密參照的明文密碼也會在 log 中遮蔽
+func registerIfSensitive(key, value string) {
+	if redact.IsSensitiveKey(key) && value != "" {
+		redact.RegisterSecret(value)
+	}
+}
+
+// fieldKey 回傳欄位在設定檔中的鍵名；未設定 tag 時 viper 以小寫欄位名稱對應，encoding/json 則為欄位名稱
+func fieldKey(f reflect.StructField, tag string) string {
+	name, _, _ := strings.Cut(f.Tag.Get(tag), ",")
+	if name != "" && name != "-" {
+		return name
+	}
+	if tag == "mapstructure" {
+		return strings.ToLower(f.Name)
+	}
+	return f.Name
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
@@ -0,0 +1,234 @@
+// 秘密值：設定值可用 ${env:NAME}、${file:PATH}、${secret:NAME} 參照環境變數、檔案或本機加密秘密檔，
+// 載入設定時以 Resolve 展開，並登記到 redact 以便在 log 中遮蔽
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MasterKeyLen 為加密秘密檔的 master key 長度（AES-256）
+const MasterKeyLen = 32
+
+// Source 描述服務的加密秘密檔位置與 ENV 前綴
+type Source struct {
+	Dir       string // 設定檔目錄，未以 ENV 指定時秘密檔為 <Dir>/secrets.enc.json
+	EnvPrefix string // 例如 "FtyBiProducer"，對應 FTYBIPRODUCER_SECRETS_FILE、FTYBIPRODUCER_MASTER_KEY
+}
+
+// File 回傳加密秘密檔路徑：<EnvPrefix>_SECRETS_FILE，未設定時為 <Dir>/secrets.enc.json
+func (s Source) File() string {
+	if f := os.Getenv(s.envName("SECRETS_FILE")); f != "" {
+		return f
+	}
+	return filepath.Join(s.Dir, "secrets.enc.json")
+}
+
+// MasterKey 讀取加密秘密檔的 master key：<EnvPrefix>_MASTER_KEY（base64），或 <EnvPrefix>_MASTER_KEY_FILE 指定的檔案
+func (s Source) MasterKey() ([]byte, error) {
+	encoded := os.Getenv(s.envName("MASTER_KEY"))
+	if encoded == "" {
+		if f := os.Getenv(s.envName("MASTER_KEY_FILE")); f != "" {
+			data, err := os.ReadFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("讀取 master key 檔 %s 失敗：%w", f, err)
+			}
+			encoded = strings.TrimSpace(string(data))
+		}
+	}
+	if encoded == "" {
+		return nil, fmt.Errorf("未設定 %s 或 %s", s.envName("MASTER_KEY"), s.envName("MASTER_KEY_FILE"))
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("master key 必須是 base64：%w", err)
+	}
+	if len(key) != MasterKeyLen {
+		return nil, fmt.Errorf("master key 必須是 %d bytes，實際 %d bytes", MasterKeyLen, len(key))
+	}
+	return key, nil
+}
+
+// OpenStore 以 ENV 指定的檔案與 master key 開啟加密秘密檔
+func (s Source) OpenStore() (*Store, error) {
+	key, err := s.MasterKey()
+	if err != nil {
+		return nil, err
+	}
+	return OpenStore(s.File(), key)
+}
+
+// Providers 回傳載入設定時使用的 Provider；加密秘密檔在第一次參照時才開啟
+func (s Source) Providers() Providers {
+	return Providers{
+		"env":    EnvProvider{},
+		"file":   FileProvider{},
+		"secret": &lazyStore{open: s.OpenStore},
+	}
+}
+
+// envName 回傳帶前綴的 ENV 名稱，與 viper 相同轉為大寫
+func (s Source) envName(key string) string {
+	return strings.ToUpper(s.EnvPrefix + "_" + key)
+}
+
+// Provider 依名稱取得秘密值
+type Provider interface {
+	Secret(name string) (string, error)
+}
+
+// Providers 為參照前綴（env、file、secret）對應的 Provider
+type Providers map[string]Provider
+
+// EnvProvider 從環境變數取得秘密值
+type EnvProvider struct{}
+
+func (EnvProvider) Secret(name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("環境變數 %s 未設定", name)
+	}
+	return v, nil
+}
+
+// FileProvider 從檔案取得秘密值（例如 Docker、Kubernetes 掛載的 secret），去除結尾的換行
+type FileProvider struct{}
+
+func (FileProvider) Secret(name string) (string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", fmt.Errorf("讀取秘密檔 %s 失敗：%w", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// lazyStore 在第一次參照時開啟加密秘密檔，沒有參照時不需要 master key
+type lazyStore struct {
+	open  func() (*Store, error)
+	once  sync.Once
+	store *Store
+	err   error
+}
+
+func (l *lazyStore) Secret(name string) (string, error) {
+	l.once.Do(func() {
+		l.store, l.err = l.open()
+	})
+	if l.err != nil {
+		return "", l.err
+	}
+	return l.store.Secret(name)
+}
+
+// GenerateMasterKey 產生新的 master key（base64）
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, MasterKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("產生 master key 失敗：%w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Store 為本機加密秘密檔：JSON 物件，每個值以 master key 經 AES-256-GCM 加密（名稱為附加資料）後以 base64 儲存
+type Store struct {
+	path   string
+	aead   cipher.AEAD
+	values map[string]string // 名稱 -> base64(nonce + 密文)
+}
+
+// OpenStore 開啟加密秘密檔，檔案不存在時視為空的秘密檔
+func OpenStore(path string, key []byte) (*Store, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("master key 無效：%w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("建立 AES-GCM 失敗：%w", err)
+	}
+	s := &Store{path: path, aead: aead, values: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("讀取加密秘密檔 %s 失敗：%w", path, err)
+	}
+	if err := json.Unmarshal(data, &s.values); err != nil {
+		return nil, fmt.Errorf("解析加密秘密檔 %s 失敗：%w", path, err)
+	}
+	return s, nil
+}
+
+// Secret 解密並回傳指定名稱的秘密值
+func (s *Store) Secret(name string) (string, error) {
+	encoded, ok := s.values[name]
+	if !ok {
+		return "", fmt.Errorf("加密秘密檔 %s 沒有 %q", s.path, name)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) < s.aead.NonceSize() {
+		return "", fmt.Errorf("加密秘密檔中的 %q 格式錯誤", name)
+	}
+	nonce, sealed := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, sealed, []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("解密 %q 失敗，請確認 master key 是否正確", name)
+	}
+	return string(plain), nil
+}
+
+// Set 加密並設定秘密值，需呼叫 Save 才會寫入檔案
+func (s *Store) Set(name, value string) error {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("產生 nonce 失敗：%w", err)
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	s.values[name] = base64.StdEncoding.EncodeToString(sealed)
+	return nil
+}
+
+// Delete 移除秘密值，回傳是否存在
+func (s *Store) Delete(name string) bool {
+	_, ok := s.values[name]
+	delete(s.values, name)
+	return ok
+}
+
+// Names 回傳依名稱排序的秘密值名稱
+func (s *Store) Names() []string {
+	names := make([]string, 0, len(s.values))
+	for name := range s.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Save 寫入加密秘密檔（權限 0600），先寫暫存檔再改名，避免寫到一半的檔案
+func (s *Store) Save() error {
+	data, err := json.MarshalIndent(s.values, "", "  ")
+	if err != nil {
+		return fmt.Errorf("編碼加密秘密檔失敗：%w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("寫入加密秘密檔 %s 失敗：%w", tmp, err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("更新加密秘密檔 %s 失敗：%w", s.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package secret
+
+import (
+	"SciCommon/redact"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testConfig struct {
+	DB struct {
+		Password string `mapstructure:"password"`
+	} `mapstructure:"db"`
+	AMQPURL string            `mapstructure:"amqp_url"`
+	Token   string            // 未設定 tag，鍵名為 token
+	Paths   map[string]string `mapstructure:"paths"`
+}
+
+// TestRun_SetThenResolve 驗證 secrets set 寫入的值不以明文儲存，且能以 ${secret:...}、${env:...}、${file:...} 展開並在 log 中遮蔽
+func TestRun_SetThenResolve(t *testing.T) {
+	dir := t.TempDir()
+	src := Source{Dir: dir, EnvPrefix: "SciCommonTest"}
+
+	// 1. keygen 後以 set 寫入加密秘密檔
+	var out bytes.Buffer
+	if err := Run(src, []string{"keygen"}, nil, &out); err != nil {
+		t.Fatalf("keygen 失敗: %v", err)
+	}
+	t.Setenv("SCICOMMONTEST_MASTER_KEY", strings.TrimSpace(out.String()))
+	if err := Run(src, []string{"set", "db.password"}, strings.NewReader("db-secret-27128299\n"), &out); err != nil {
+		t.Fatalf("set 失敗: %v", err)
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, "secrets.enc.json"))
+	if err != nil || strings.Contains(string(raw), "db-secret-27128299") {
+		t.Fatalf("加密秘密檔不應包含明文：%s, %v", raw, err)
+	}
+	out.Reset()
+	if err := Run(src, []string{"list"}, nil, &out); err != nil || out.String() != "db.password\n" {
+		t.Fatalf("list 結果不符：%q, %v", out.String(), err)
+	}
+
+	// 2. 展開參照
+	t.Setenv("SCICOMMONTEST_MQ_PASSWORD", "mq-p@ss")
+	tokenFile := filepath.Join(dir, "admin_token")
+	if err := os.WriteFile(tokenFile, []byte("admin-token-0123456789\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var cfg testConfig
+	cfg.DB.Password = "${secret:db.password}"
+	cfg.AMQPURL = "amqps://bi:${env:SCICOMMONTEST_MQ_PASSWORD}@pmsap:5671/"
+	cfg.Token = "${file:" + tokenFile + "}"
+	cfg.Paths = map[string]string{"password": "plain-p@ss-0001"}
+	if err := Resolve(&cfg, "mapstructure", src.Providers()); err != nil {
+		t.Fatalf("Resolve 失敗: %v", err)
+	}
+	if cfg.DB.Password != "db-secret-27128299" || cfg.AMQPURL != "amqps://bi:mq-p@ss@pmsap:5671/" || cfg.Token != "admin-token-0123456789" {
+		t.Fatalf("秘密參照未展開：%+v", cfg)
+	}
+
+	// 3. 展開後的值與明文密碼欄位都在 log 中遮蔽
+	line := redact.String(cfg.AMQPURL + " " + cfg.DB.Password + " " + cfg.Token + " " + cfg.Paths["password"])
+	for _, s := range []string{"mq-p@ss", "db-secret-27128299", "admin-token-0123456789", "plain-p@ss-0001"} {
+		if strings.Contains(line, s) {
+			t.Fatalf("log 未遮蔽 %q：%s", s, line)
+		}
+	}
+
+	// 4. 參照不存在時錯誤指出設定鍵
+	cfg.Token = "${secret:none}"
+	if err := Resolve(&cfg, "mapstructure", src.Providers()); err == nil || !strings.Contains(err.Error(), "token") {
+		t.Fatalf("預期指出 token 的錯誤，實際: %v", err)
+	}
+}
@@ -3,18 +3,20 @@ package main
 // HTTP 後端服務入口
 
 import (
+	"SciCommon/configsource"
+	"SciCommon/redact"
+	"SciCommon/secret"
 	"SciTaipeiTool/internal/auth"
 	"SciTaipeiTool/internal/ftygrpc"
 	"SciTaipeiTool/internal/handler"
 	"SciTaipeiTool/middleware"
 	"SciTaipeiTool/scilog"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"syscall"
 	"time"
 
@@ -41,30 +43,20 @@ type Config struct {
 	Jwt_secret_key string `json:"jwt_secret_key"`
 }
 
-// 載入Config配置
-func loadConfig() (*Config, error) {
-	// 自動尋找 config 目錄下第一個 config.*.json
-	matches, err := filepath.Glob("config/config.*.json")
+// configLocator 為本服務的設定檔位置與 ENV 前綴（SCITAIPEITOOL_CONFIG、SCITAIPEITOOL_PROFILE）
+var configLocator = configsource.Locator{Dir: "config", Ext: "json", EnvPrefix: "SciTaipeiTool"}
 
-	if err != nil {
+// 載入Config配置，依序合併設定檔，後面的覆寫前面的（例如 config.base.json + config.prod.json），並展開秘密參照
+func loadConfig(files []string) (*Config, error) {
+	var config Config
+	if err := configLocator.Load(files, &config); err != nil {
 		return nil, err
 	}
-
-	if len(matches) == 0 {
-		return nil, errors.New("在 config/ 目錄下找不到任何 config.*.json 檔案")
-
+	if config.Port == "" {
+		return nil, errors.New("設定驗證失敗: 缺少 port")
 	}
-	cfgPath := matches[0]
-	file, err := os.Open(cfgPath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	var config Config
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&config); err != nil {
-		return nil, err
+	if config.Jwt_secret_key == "" {
+		return nil, errors.New("設定驗證失敗: 缺少 jwt_secret_key")
 	}
 	return &config, nil
 }
@@ -101,10 +93,59 @@ func main() {
 	// 建立 Sugared Logger，方便後續呼叫
 	sugar := logger.Sugar()
 	sugar.Info("Logger 初始化成功")
+	// 標準 log 與 gin 的輸出同樣遮蔽密碼與 JWT 金鑰
+	log.SetOutput(redact.NewWriter(os.Stderr))
+	gin.DefaultWriter = redact.NewWriter(os.Stdout)
+	gin.DefaultErrorWriter = redact.NewWriter(os.Stderr)
+
+	// 解析命令列：--config / --profile 指定設定檔，子命令 validate-config 只檢查設定，secrets 管理加密秘密檔
+	var sel configsource.Selection
+	fs := flag.NewFlagSet("SciTaipeiTool", flag.ContinueOnError)
+	sel.RegisterFlags(fs)
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		sugar.Fatalf("參數錯誤：%v", err)
+	}
+	validateOnly := false
+	if args := fs.Args(); len(args) > 0 {
+		switch args[0] {
+		case "validate-config":
+			validateOnly = true
+		case "secrets":
+			if err := secret.Run(configLocator.Secrets(), args[1:], os.Stdin, os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				logger.Sync()
+				os.Exit(1)
+			}
+			return
+		default:
+			sugar.Fatalf("未知的子命令：%s", args[0])
+		}
+	}
 
 	// 組態設定載入
-	config, err := loadConfig()
-
+	cfgFiles, err := configLocator.Resolve(sel)
+	if err != nil {
+		sugar.Fatalf("無法決定組態檔: %v", err)
+	}
+	sugar.Infof("載入組態檔：%v", cfgFiles)
+
+	config, err := loadConfig(cfgFiles)
+	if validateOnly {
+		// 印出遮蔽敏感欄位後的有效設定，驗證失敗時以非 0 結束
+		if err == nil {
+			var out []byte
+			if out, err = configsource.RedactedJSON(config); err == nil {
+				fmt.Printf("// 組態檔：%v\n%s\n", cfgFiles, out)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			sugar.Errorf("組態驗證失敗: %v", err)
+			logger.Sync()
+			os.Exit(1)
+		}
+		return
+	}
 	if err != nil {
 		sugar.Fatalf("無法載入組態: %v", err)
 	}
@@ -1,6 +1,7 @@
 package scilog
 
 import (
+	"SciCommon/redact"
 	"path/filepath"
 	"time"
 
@@ -43,7 +44,8 @@ func NewFileLogger() (*zap.Logger, error) {
 	}
 
 	// 3. 建立 zapcore，將輸出導向 rotateWriter
-	ws := zapcore.AddSync(rotateWriter)
+	// 寫入前遮蔽密碼與金鑰
+	ws := redact.NewWriter(zapcore.AddSync(rotateWriter))
 	// 假設最低只記錄 Info 級別以上
 	level := zapcore.InfoLevel
 	core := zapcore.NewCore(encoder, ws, level)
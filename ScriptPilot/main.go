@@ -1,11 +1,14 @@
 package main
 
 import (
+	"SciCommon/configsource"
+	"SciCommon/secret"
 	pb "ScriptPilot/proto/taskexecutor" // 替換為實際的 Protobuf 生成包路徑
 	"ScriptPilot/scilog"
 	"bytes"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"net"
 	"os"
@@ -37,26 +40,21 @@ var (
 	// configErr  error
 )
 
-func loadConfig() (*Config, error) {
-	matches, err := filepath.Glob("config/config.*.json")
-	if err != nil {
-		return nil, err
-	}
-	if len(matches) == 0 {
-		return nil, errors.New("在 config/ 目錄下找不到任何 config.*.json 檔案")
-	}
-	cfgPath := matches[0]
-	file, err := os.Open(cfgPath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
+// configLocator 為本服務的設定檔位置與 ENV 前綴（SCRIPTPILOT_CONFIG、SCRIPTPILOT_PROFILE）
+var configLocator = configsource.Locator{Dir: "config", Ext: "json", EnvPrefix: "ScriptPilot"}
 
+// loadConfig 依序載入設定檔，後面的覆寫前面的（例如 config.base.json + config.prod.json），並展開秘密參照
+func loadConfig(files []string) (*Config, error) {
 	var cfg Config
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&cfg); err != nil {
+	if err := configLocator.Load(files, &cfg); err != nil {
 		return nil, err
 	}
+	if cfg.FactoryID == "" {
+		return nil, errors.New("設定驗證失敗: 缺少 FactoryId")
+	}
+	if cfg.TcpPort <= 0 {
+		return nil, errors.New("設定驗證失敗: TcpPort 必須大於 0")
+	}
 	return &cfg, nil
 }
 
@@ -194,7 +192,53 @@ func main() {
 	sugar := logger.Sugar()
 	sugar.Info("Logger 初始化成功")
 
-	cfg, err := loadConfig()
+	// 解析命令列：--config / --profile 指定設定檔，子命令 validate-config 只檢查設定，secrets 管理加密秘密檔
+	var sel configsource.Selection
+	fs := flag.NewFlagSet("ScriptPilot", flag.ContinueOnError)
+	sel.RegisterFlags(fs)
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		sugar.Fatalf("參數錯誤：%v", err)
+	}
+	validateOnly := false
+	if args := fs.Args(); len(args) > 0 {
+		switch args[0] {
+		case "validate-config":
+			validateOnly = true
+		case "secrets":
+			if err := secret.Run(configLocator.Secrets(), args[1:], os.Stdin, os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				logger.Sync()
+				os.Exit(1)
+			}
+			return
+		default:
+			sugar.Fatalf("未知的子命令：%s", args[0])
+		}
+	}
+
+	cfgFiles, err := configLocator.Resolve(sel)
+	if err != nil {
+		sugar.Fatalf("無法決定組態檔: %v", err)
+	}
+	sugar.Infof("載入組態檔：%v", cfgFiles)
+
+	cfg, err := loadConfig(cfgFiles)
+	if validateOnly {
+		// 印出遮蔽敏感欄位後的有效設定，驗證失敗時以非 0 結束
+		if err == nil {
+			var out []byte
+			if out, err = configsource.RedactedJSON(cfg); err == nil {
+				fmt.Printf("// 組態檔：%v\n%s\n", cfgFiles, out)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			sugar.Errorf("組態驗證失敗: %v", err)
+			logger.Sync()
+			os.Exit(1)
+		}
+		return
+	}
 	if err != nil {
 		sugar.Fatalf("無法載入組態: %v", err)
 	}
@@ -1,6 +1,7 @@
 package scilog
 
 import (
+	"SciCommon/redact"
 	"path/filepath"
 	"time"
 
@@ -36,7 +37,7 @@ func NewFileLogger() (*zap.Logger, error) {
 		return nil, err
 	}
 
-	ws := zapcore.AddSync(rotateWriter)
+	ws := redact.NewWriter(zapcore.AddSync(rotateWriter))
 	level := zapcore.InfoLevel
 	core := zapcore.NewCore(encoder, ws, level)
 
@@ -2,7 +2,10 @@
 package config
 
 import (
+	"SciCommon/configsource"
+	"SciCommon/secret"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator"
@@ -10,17 +13,62 @@ import (
 )
 
 type MQConfig struct {
-	AMQPURL              string        `mapstructure:"amqp_url"     yaml:"amqp_url"`
-	Exchange             string        `mapstructure:"exchange"     yaml:"exchange"`
-	CertFile             string        `mapstructure:"cert_file"    yaml:"cert_file"`
-	KeyFile              string        `mapstructure:"key_file"     yaml:"key_file"`
-	CACertFile           string        `mapstructure:"ca_cert_file" yaml:"ca_cert_file"`
-	Timeout              time.Duration `mapstructure:"timeout"      yaml:"timeout"`
-	DeadLetterExchange   string        `mapstructure:"dead_letter_exchange" yaml:"dead_letter_exchange"`
-	DeadLetterQueue      string        `mapstructure:"dead_letter_queue" yaml:"dead_letter_queue"`
-	DeadLetterRoutingKey string        `mapstructure:"dead_letter_routing_key" yaml:"dead_letter_routing_key"`
-	PrimaryExchange      string        `mapstructure:"primary_exchange" yaml:"primary_exchange"`
-	PrimaryQueue         string        `mapstructure:"primary_queue" yaml:"primary_queue"`
+	AMQPURL              string         `mapstructure:"amqp_url"     yaml:"amqp_url"`
+	Exchange             string         `mapstructure:"exchange"     yaml:"exchange"`
+	CertFile             string         `mapstructure:"cert_file"    yaml:"cert_file"`
+	KeyFile              string         `mapstructure:"key_file"     yaml:"key_file"`
+	CACertFile           string         `mapstructure:"ca_cert_file" yaml:"ca_cert_file"`
+	Timeout              time.Duration  `mapstructure:"timeout"      yaml:"timeout"`
+	DeadLetterExchange   string         `mapstructure:"dead_letter_exchange" yaml:"dead_letter_exchange"`
+	DeadLetterQueue      string         `mapstructure:"dead_letter_queue" yaml:"dead_letter_queue"`
+	DeadLetterRoutingKey string         `mapstructure:"dead_letter_routing_key" yaml:"dead_letter_routing_key"`
+	PrimaryExchange      string         `mapstructure:"primary_exchange" yaml:"primary_exchange"`
+	PrimaryQueue         string         `mapstructure:"primary_queue" yaml:"primary_queue"`
+	ReceiptExchange      string         `mapstructure:"receipt_exchange" yaml:"receipt_exchange"`   // 回傳套用回執的 Exchange，留空則不回傳
+	RequireEnvelope      bool           `mapstructure:"require_envelope" yaml:"require_envelope"`   // 為 true 時拒絕沒有信封的舊版訊息
+	MaxMessageBytes      int            `mapstructure:"max_message_bytes" yaml:"max_message_bytes"` // 解壓縮後 Body 的大小上限，0 為預設 64 MiB
+	DmlStreams           []DmlStream    `mapstructure:"dml_streams" yaml:"dml_streams"`
+	SigningKeys          []SigningKey   `mapstructure:"signing_keys" yaml:"signing_keys" validate:"dive"` // 各廠的簽章金鑰，留空表示不驗證簽章
+	AllowUnsigned        bool           `mapstructure:"allow_unsigned" yaml:"allow_unsigned"`             // 遷移期間允許沒有簽章的訊息；有簽章的仍會驗證
+	SignatureMaxAge      time.Duration  `mapstructure:"signature_max_age" yaml:"signature_max_age"`       // 簽章有效期間，0 為預設 24h
+	Ordering             OrderingConfig `mapstructure:"ordering" yaml:"ordering"`
+}
+
+// 批次順序的處理方式：前一個批次尚未套用（缺漏或亂序）時
+const (
+	OrderPolicyHold  = "hold"  // 等待前一個批次最多 hold_timeout，逾時後套用並告警
+	OrderPolicyApply = "apply" // 直接套用，記錄 Warn
+	OrderPolicyAlert = "alert" // 直接套用，記錄 Error 供告警
+)
+
+// OrderingConfig 設定依 FtyBiProducer 的批次序號偵測缺漏、重複與亂序；重複的批次一律略過
+type OrderingConfig struct {
+	Policy      string        `mapstructure:"policy" yaml:"policy" validate:"omitempty,oneof=hold apply alert"` // 預設 hold
+	HoldTimeout time.Duration `mapstructure:"hold_timeout" yaml:"hold_timeout"`                                 // hold 的最長等待時間，0 為預設 30s
+}
+
+// SigningKey 為一把 FtyBiProducer 的簽章金鑰，需與該廠的 mq.signing_key_id / signing_secret / encryption_secret 一致；
+// 換金鑰時新舊兩把可同時存在，以 key_id 區分
+type SigningKey struct {
+	KeyID            string `mapstructure:"key_id" yaml:"key_id" validate:"required"`
+	FactoryID        string `mapstructure:"factory_id" yaml:"factory_id" validate:"required"` // 只接受此工廠的訊息
+	Secret           string `mapstructure:"secret" yaml:"secret" validate:"required"`         // HMAC-SHA256 金鑰（base64）
+	EncryptionSecret string `mapstructure:"encryption_secret" yaml:"encryption_secret"`       // AES-256-GCM 金鑰（base64），該廠有加密時必填
+}
+
+// DmlStream 對應 FtyBiProducer 的 DML 分流，每個 stream 有自己的 Queue，
+// 由單一 consumer 依序處理以維持表內順序
+type DmlStream struct {
+	Name  string `mapstructure:"name"  yaml:"name"`
+	Queue string `mapstructure:"queue" yaml:"queue"` // 留空則為 <primary_queue>.<name>，需與 Producer 一致
+}
+
+// QueueName 回傳 stream 使用的 Queue 名稱
+func (s DmlStream) QueueName(primaryQueue string) string {
+	if s.Queue != "" {
+		return s.Queue
+	}
+	return primaryQueue + "." + s.Name
 }
 
 type DBConfig struct {
@@ -47,15 +95,56 @@ type Config struct {
 	ProcessDdlInterval time.Duration    `mapstructure:"process_ddl_interval" validate:"required"`
 	ProcessDmlInterval time.Duration    `mapstructure:"process_dml_interval" validate:"required"`
 	ProcessTimeout     time.Duration    `mapstructure:"process_timeout" validate:"required"`
+	// 最低記錄級別：debug、info（預設）、warn、error
+	LogLevel string `mapstructure:"log_level" validate:"omitempty,oneof=debug info warn error"`
 }
 
-// LoadConfig 從指定檔案路徑讀取設定，並支援 ENV 覆寫，最後進行欄位驗證
-func LoadConfig(path string) (*Config, error) {
+// LoadConfig 依序讀取設定檔（後面的覆寫前面的，例如 base + prod），並支援 ENV 覆寫，
+// 展開 ${env:...}、${file:...}、${secret:...} 秘密參照，最後進行欄位驗證
+func LoadConfig(files ...string) (*Config, error) {
+	// 1. 讀檔
+	v, err := readFiles(files)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. 解析到 struct
+	var cfg Config
+	if err := v.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("解析設定失敗: %w", err)
+	}
+	if err := secret.Resolve(&cfg, "mapstructure", Secrets.Providers()); err != nil {
+		return nil, err
+	}
+
+	// 3. 驗證必填欄位
+	validate := validator.New()
+	if err := validate.Struct(&cfg); err != nil {
+		return nil, fmt.Errorf("設定驗證失敗: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// EffectiveSettings 回傳合併設定檔與 ENV 後、遮蔽敏感欄位的有效設定
+func EffectiveSettings(files ...string) (map[string]interface{}, error) {
+	v, err := readFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	return configsource.RedactSettings(v.AllSettings()), nil
+}
+
+// readFiles 建立 viper、綁定 ENV，依序讀入並深度合併設定檔
+func readFiles(files []string) (*viper.Viper, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("讀取設定檔失敗: 未指定設定檔")
+	}
 	v := viper.New()
-	v.SetConfigFile(path) // 例如 "config/config.yaml"
 	v.SetConfigType("yaml")
 	v.AutomaticEnv() // 支援以 ENV 覆寫
-	v.SetEnvPrefix("FtyBiProducer")
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_")) // db.host 對應 TPEBICONSUMER_DB_HOST
 
 	// 綁定 ENV 變數（可按需增減）
 	v.BindEnv("mq.amqp_url")
@@ -69,6 +158,13 @@ func LoadConfig(path string) (*Config, error) {
 	v.BindEnv("mq.dead_letter_routing_key")
 	v.BindEnv("mq.primary_exchange")
 	v.BindEnv("mq.primary_queue")
+	v.BindEnv("mq.receipt_exchange")
+	v.BindEnv("mq.require_envelope")
+	v.BindEnv("mq.max_message_bytes")
+	v.BindEnv("mq.allow_unsigned")
+	v.BindEnv("mq.signature_max_age")
+	v.BindEnv("mq.ordering.policy")
+	v.BindEnv("mq.ordering.hold_timeout")
 
 	v.BindEnv("db.host")
 	v.BindEnv("db.instance")
@@ -80,26 +176,20 @@ func LoadConfig(path string) (*Config, error) {
 	v.BindEnv("db.timeout")
 	v.BindEnv("prometheus.metrics_port")
 	v.BindEnv("consumer_count")
+	v.BindEnv("log_level")
 	v.BindEnv("process_ddl_interval")
 	v.BindEnv("process_dml_interval")
 	v.BindEnv("process_timeout")
 
-	// 1. 讀檔
-	if err := v.ReadInConfig(); err != nil {
-		return nil, fmt.Errorf("讀取設定檔失敗: %w", err)
-	}
-
-	// 2. 解析到 struct
-	var cfg Config
-	if err := v.Unmarshal(&cfg); err != nil {
-		return nil, fmt.Errorf("解析設定失敗: %w", err)
-	}
-
-	// 3. 驗證必填欄位
-	validate := validator.New()
-	if err := validate.Struct(&cfg); err != nil {
-		return nil, fmt.Errorf("設定驗證失敗: %w", err)
+	for i, f := range files {
+		v.SetConfigFile(f) // 例如 "config/config.base.yaml"、"config/config.prod.yaml"
+		read := v.MergeInConfig
+		if i == 0 {
+			read = v.ReadInConfig
+		}
+		if err := read(); err != nil {
+			return nil, fmt.Errorf("讀取設定檔 %s 失敗: %w", f, err)
+		}
 	}
-
-	return &cfg, nil
+	return v, nil
 }
@@ -0,0 +1,13 @@
+// 設定來源：設定檔的決定與遮蔽由 SciCommon/configsource 處理，這裡只描述本服務的目錄、副檔名與 ENV 前綴
+package config
+
+import "SciCommon/configsource"
+
+// EnvPrefix 為本服務的 ENV 前綴，例如 TpeBiConsumer_DB_HOST、TpeBiConsumer_PROFILE
+const EnvPrefix = "TpeBiConsumer"
+
+// Locator 為本服務的設定檔位置：config/config.<profile>.yaml，可疊在 config/config.base.yaml 之上
+var Locator = configsource.Locator{Dir: "config", Ext: "yaml", EnvPrefix: EnvPrefix}
+
+// Secrets 為本服務的加密秘密檔：預設為 config/secrets.enc.json，master key 由 <EnvPrefix>_MASTER_KEY 指定
+var Secrets = Locator.Secrets()
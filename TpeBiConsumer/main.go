@@ -2,16 +2,23 @@
 package main
 
 import (
+	"SciCommon/configsource"
+	"SciCommon/reload"
+	"SciCommon/secret"
 	"TpeBiConsumer/config"
+	"TpeBiConsumer/model"
 	mq "TpeBiConsumer/mq"
 	scilog "TpeBiConsumer/scilog"
 	"TpeBiConsumer/service"
 	"context"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"syscall"
+
+	"gopkg.in/yaml.v3"
 	// "github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -30,21 +37,56 @@ func main() {
 	sugar := logger.Sugar()
 	sugar.Info("Logger 初始化成功")
 
-	// 3. 設定管理：自動尋找 config 目錄下第一個 config.*.yaml
-	matches, err := filepath.Glob("config/config.*.yaml")
+	// 2.1 解析命令列：--config / --profile 指定設定檔，子命令 validate-config 只檢查設定，secrets 管理加密秘密檔
+	//     例如 tpe-bi-consumer --profile prod validate-config
+	var sel configsource.Selection
+	fs := flag.NewFlagSet("tpe-bi-consumer", flag.ContinueOnError)
+	sel.RegisterFlags(fs)
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		sugar.Fatalf("參數錯誤：%v", err)
+	}
+	validateOnly := false
+	if args := fs.Args(); len(args) > 0 {
+		switch args[0] {
+		case "validate-config":
+			validateOnly = true
+		case "secrets":
+			if err := secret.Run(config.Secrets, args[1:], os.Stdin, os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				logger.Sync()
+				os.Exit(1)
+			}
+			return
+		default:
+			sugar.Fatalf("未知的子命令：%s", args[0])
+		}
+	}
+
+	// 3. 設定管理：依 --config / --profile / ENV 決定設定檔，base 與環境設定依序合併
+	cfgFiles, err := config.Locator.Resolve(sel)
 	if err != nil {
-		sugar.Fatalf("尋找設定檔時發生錯誤：%v", err)
+		sugar.Fatalf("決定設定檔失敗：%v", err)
 	}
-	if len(matches) == 0 {
-		sugar.Fatalf("在 config/ 目錄下找不到任何 config.*.yaml 檔案")
+	sugar.Infof("載入設定檔：%v", cfgFiles)
+
+	// 3.1 validate-config：印出遮蔽敏感欄位後的有效設定，驗證失敗時以非 0 結束
+	if validateOnly {
+		if err := validateConfig(os.Stdout, cfgFiles); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			sugar.Errorf("設定驗證失敗：%v", err)
+			logger.Sync()
+			os.Exit(1)
+		}
+		return
 	}
-	cfgPath := matches[0]
-	sugar.Infof("載入設定檔：%s", cfgPath)
 
-	cfg, err := config.LoadConfig(cfgPath)
+	cfg, err := config.LoadConfig(cfgFiles...)
 	if err != nil {
 		sugar.Fatalf("載入設定失敗：%v", err)
 	}
+	if err := scilog.SetLevel(cfg.LogLevel); err != nil {
+		sugar.Fatalf("載入設定失敗：%v", err)
+	}
 
 	// 4. 啟動 Metrics Server. 先啟動一個專門用來暴露 /metrics 的 HTTP 伺服器
 	// go func() {
@@ -65,13 +107,18 @@ func main() {
 		sugar.Fatalf("MQ 初始化失敗：%v", err)
 	}
 	defer mqClient.Close()
+	if !mqClient.SigningEnabled() {
+		sugar.Warn("未設定 mq.signing_keys，不驗證訊息簽章")
+	} else if cfg.MQ.AllowUnsigned {
+		sugar.Warn("mq.allow_unsigned 已開啟，沒有簽章的訊息仍會套用")
+	}
 
 	// 7. 初始化資料庫
 	db, err := config.InitGormDB(cfg.DB)
 	if err != nil {
 		sugar.Fatalf("初始化資料庫失敗：%v", err)
 	}
-	sugar.Infof("初始化資料庫成功：%v", cfg.DB)
+	sugar.Infof("初始化資料庫成功：%s\\%s，資料庫 %s", cfg.DB.Host, cfg.DB.Instance, cfg.DB.Name)
 	defer func() {
 		if sqlDB, err := db.DB(); err == nil {
 			sqlDB.Close()
@@ -81,49 +128,96 @@ func main() {
 	// 8. 建立 Processor
 	proc := service.NewProcessor(db)
 
-	// 9. 建立 consumer 列表
-	consumerCount := cfg.ConsumerCount
-	consumers := make([]*mq.Consumer, 0, consumerCount)
-
-	for i := 0; i < consumerCount; i++ {
-		idx := i // 建立一個新的區域複本
-		c := mq.NewConsumer(mqClient, sugar)
-
-		// // （可選）設定 prefetch count，避免一次拉太多未 Ack 的訊息
-		// prefetchCount := 1
-		// if err := c.Ch().Qos(prefetchCount, 0, false); err != nil {
-		// 	log.Fatalf("設定 Qos 失敗：%v", err)
-		// }
-
-		// 啟動並行處理
-		err := c.Start(ctx, func(ctx context.Context, routingKey string, body []byte) error {
-			sugar.Infof("[Consumer %d] 收到訊息，RoutingKey=%s", idx, routingKey)
-			switch routingKey {
-			case string(mq.RoutingKeyDDL):
-				return proc.DdlLogProcess(ctx, body)
-			case string(mq.RoutingKeyDML):
-				return proc.DmlLogProcess(ctx, body)
+	// 8.1 批次順序：讀取各 stream 已套用到的批次，偵測缺漏、重複與亂序
+	orderStore, err := service.NewOrderStore(db)
+	if err != nil {
+		sugar.Fatalf("%v", err)
+	}
+	if err := mqClient.EnableOrdering(ctx, orderStore); err != nil {
+		sugar.Fatalf("讀取批次順序失敗：%v", err)
+	}
+
+	// 9. 建立 consumer 列表：主 Queue 的 consumer 由 pool 管理，可依 consumer_count 增減
+	consumers := make([]*mq.Consumer, 0, len(cfg.MQ.DmlStreams))
+
+	// 依 RoutingKey 分派：DDL、DML（含各 stream）
+	newHandler := func(name string) mq.HandlerFunc {
+		return func(ctx context.Context, env model.Envelope, routingKey string, body []byte) (model.ApplyResult, error) {
+			sugar.Infof("[Consumer %s] 收到訊息，RoutingKey=%s", name, routingKey)
+			var (
+				result model.ApplyResult
+				err    error
+			)
+			switch {
+			case routingKey == string(mq.RoutingKeyDDL):
+				result, err = proc.DdlLogProcess(ctx, body)
+			case mq.IsDmlRoutingKey(routingKey):
+				result, err = proc.DmlLogProcess(ctx, env, body)
 			default:
-				return fmt.Errorf("無效 routing key: %s", routingKey)
+				return model.ApplyResult{}, fmt.Errorf("無效 routing key: %s", routingKey)
+			}
+			if err == nil && result.Skipped != "" {
+				sugar.Infof("[Consumer %s] %s", name, result.Skipped)
 			}
-		})
-		if err != nil {
-			sugar.Fatalf("啟動 Consumer[%d] 失敗：%v", i, err)
+			return result, err
 		}
-		sugar.Infof("Consumer[%d] 已啟動", i)
+	}
+
+	// 啟動並行處理（每個 consumer 的 prefetch 為 1，避免一次拉太多未 Ack 的訊息）
+	pool := &consumerPool{ctx: ctx, client: mqClient, newHandler: newHandler, sugar: sugar}
+	if err := pool.Resize(cfg.ConsumerCount); err != nil {
+		sugar.Fatalf("%v", err)
+	}
+
+	// 9.1 每個 DML stream 只有一個 consumer（prefetch 1），同一張表的批次依序套用
+	for _, stream := range cfg.MQ.DmlStreams {
+		queue := stream.QueueName(cfg.MQ.PrimaryQueue)
+		c := mq.NewStreamConsumer(mqClient, queue, sugar)
+		if c == nil {
+			sugar.Fatalf("建立 Stream Consumer[%s] 失敗", stream.Name)
+		}
+		if err := c.Start(ctx, newHandler(stream.Name)); err != nil {
+			sugar.Fatalf("啟動 Stream Consumer[%s] 失敗：%v", stream.Name, err)
+		}
+		sugar.Infof("Stream Consumer[%s] 已啟動，Queue=%s", stream.Name, queue)
 		consumers = append(consumers, c)
 	}
 
-	sugar.Infof("所有 %d 個 Consumer 已啟動，等待訊息...", consumerCount)
+	sugar.Infof("所有 %d 個 Consumer 已啟動，等待訊息...", pool.Len()+len(consumers))
+
+	// 9.2 監看設定檔：consumer_count、log_level 變更時立即套用，DB、MQ 等需重新連線的設定待重新啟動
+	reloader := &configReloader{files: cfgFiles, cfg: *cfg, loaded: *cfg, pool: pool, sugar: sugar}
+	if err := reload.Watch(cfgFiles, reloader.reload); err != nil {
+		sugar.Warnf("無法監看設定檔，變更需重新啟動才會生效：%v", err)
+	}
 
 	// 8. 等待關機訊號
 	<-ctx.Done()
 	sugar.Info("收到關機信號，開始等待 consumer 處理結束…")
 
 	// 9. 依序等待所有 consumer 結束
+	pool.Wait()
 	for i, c := range consumers {
-		sugar.Infof("等待 Consumer[%d] 完成…", i)
+		sugar.Infof("等待 Stream Consumer[%d] 完成…", i)
 		c.Wait()
 	}
 	sugar.Info("所有 Consumer 處理完畢，優雅關閉")
 }
+
+// validateConfig 載入並驗證設定，將合併後的有效設定以 YAML 寫到 w（密碼、連線字串帳密已遮蔽）
+func validateConfig(w io.Writer, files []string) error {
+	if _, err := config.LoadConfig(files...); err != nil {
+		return err
+	}
+	settings, err := config.EffectiveSettings(files...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "# 設定檔：%v\n", files)
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(settings); err != nil {
+		return fmt.Errorf("輸出設定失敗：%w", err)
+	}
+	return enc.Close()
+}
@@ -25,8 +25,29 @@ var (
 		},
 		[]string{"type"},
 	)
+	InvalidMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "invalid_messages_total",
+			Help: "信封驗證失敗、沒有信封、簽章不符或內容不完整的訊息數",
+		},
+		[]string{"reason"}, // reason: no_envelope, unsupported_version, invalid_envelope, corrupt_payload, unsigned, bad_signature, expired
+	)
+	OrderEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "order_events_total",
+			Help: "批次順序異常次數",
+		},
+		[]string{"factory", "kind", "stream", "event"}, // event: duplicate, gap, out_of_order, hold_timeout
+	)
+	HandlerRequeues = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "handler_requeues_total",
+			Help: "套用時發生暫時性錯誤（死結、逾時、斷線）而重新排入 Queue 的訊息數",
+		},
+		[]string{"type"}, // type: ddl or dml
+	)
 )
 
 func init() {
-	prometheus.MustRegister(ProcessRuns, ProcessErrors, ProcessDuration)
+	prometheus.MustRegister(ProcessRuns, ProcessErrors, ProcessDuration, InvalidMessages, OrderEvents, HandlerRequeues)
 }
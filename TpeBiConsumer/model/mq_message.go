@@ -1,16 +1,60 @@
 package model
 
-import "encoding/xml"
+import (
+	"encoding/xml"
+	"time"
+)
 
 type DmlMessage struct {
 	BatchID  int      `json:"BatchID"`
 	JSONList []string `json:"JSONList"`
+	// FtyBiProducer snapshot 子命令的完整同步訊息才有，一般批次為 nil
+	Snapshot *SnapshotInfo `json:"Snapshot,omitempty"`
+}
+
+// 完整同步訊息的階段，與 FtyBiProducer 一致
+const (
+	SnapshotPhaseStart = "Start"
+	SnapshotPhaseChunk = "Chunk"
+	SnapshotPhaseEnd   = "End"
+)
+
+// 完整同步套用到正式資料表的方式
+const (
+	SnapshotModeReconcile = "reconcile" // 刪除 staging 中沒有的資料列，再以主鍵 MERGE
+	SnapshotModeSwap      = "swap"      // 以 sp_rename 把 staging 換成正式資料表
+)
+
+// SnapshotInfo 標示完整同步的訊息：Start 與 End 之間的 Chunk 組成資料表在同一時間點的完整資料
+type SnapshotInfo struct {
+	SnapshotID string    `json:"SnapshotID"`
+	TableName  string    `json:"TableName"`
+	Phase      string    `json:"Phase"`
+	Mode       string    `json:"Mode"`
+	Chunk      int       `json:"Chunk,omitempty"`  // Chunk 的序號，從 1 開始
+	Chunks     int       `json:"Chunks,omitempty"` // End 才有：Chunk 的總數
+	Rows       int64     `json:"Rows,omitempty"`   // Chunk 為該段筆數，End 為總筆數
+	TakenAt    time.Time `json:"TakenAt"`
+	// snapshot 時 FtyBiProducer DmlLog 最大的 SerialNo，舊版 Producer 不會帶
+	Watermark int64 `json:"Watermark,omitempty"`
 }
 
 // 用於封裝message
 type DdlMessage struct {
 	BatchID int      `json:"BatchID"`
 	XMLList []string `json:"XMLList"`
+	// 與 XMLList 一一對應的 EVENTDATA 摘要，舊版 FtyBiProducer 不會帶；不含 DDL 語法，執行時以 XML 為準
+	Events []DdlEvent `json:"Events,omitempty"`
+}
+
+// DdlEvent 為 FtyBiProducer 解析 EVENTDATA 後的摘要
+type DdlEvent struct {
+	SerialNo   int64  `json:"SerialNo"`
+	EventType  string `json:"EventType,omitempty"`
+	SchemaName string `json:"SchemaName,omitempty"`
+	ObjectName string `json:"ObjectName,omitempty"`
+	ObjectType string `json:"ObjectType,omitempty"`
+	LoginName  string `json:"LoginName,omitempty"`
 }
 
 // DdlData 對應 XML 結構
@@ -24,3 +68,65 @@ type DdlData struct {
 		} `xml:"EVENT_INSTANCE"`
 	} `xml:"EventData"`
 }
+
+// SupportedSchemaVersion 為此版本能處理的最高信封與訊息格式版本，需與 FtyBiProducer 的 EnvelopeSchemaVersion 對應
+const SupportedSchemaVersion = 1
+
+// 訊息 Body 的 ContentEncoding
+const (
+	ContentEncodingIdentity = "identity" // 未壓縮
+	ContentEncodingGzip     = "gzip"
+	ContentEncodingZstd     = "zstd"
+)
+
+// Envelope 是 FtyBiProducer 放在 AMQP properties 與 headers 的訊息信封；
+// 舊版 Producer 沒有 headers，SchemaVersion 為 0，只有 MessageID、FactoryID（AppId）
+type Envelope struct {
+	MessageID       string
+	FactoryID       string
+	SourceServer    string
+	SourceDatabase  string
+	MessageType     string // ddl 或 dml
+	SchemaVersion   int
+	BatchID         int64
+	Stream          string
+	SerialNoFrom    int64
+	SerialNoTo      int64
+	CreatedAt       time.Time
+	ContentEncoding string
+	ItemCount       int    // XMLList / JSONList 的筆數，0 表示未記錄
+	UncompressedLen int    // 解壓縮後 Body 的位元組數，0 表示未記錄
+	Sequence        int64  // 同一工廠、同一 stream 內遞增的批次序號，0 表示不需檢查順序（replay、舊版 Producer）
+	PrevSerialNoTo  int64  // 前一個批次的 SerialNoTo，0 表示沒有前一個批次
+	SnapshotID      string // 完整同步的識別碼，一般批次為空字串；完整同步的訊息不屬於任何批次
+}
+
+// ApplyResult 是 Processor 套用一個批次的結果
+type ApplyResult struct {
+	BatchID      int   `json:"BatchID"`
+	RowsDeleted  int64 `json:"RowsDeleted"`
+	RowsUpserted int64 `json:"RowsUpserted"`
+	DdlExecuted  int   `json:"DdlExecuted"`
+	DdlSkipped   int   `json:"DdlSkipped"`
+	// 略過的原因（重送的完整同步訊息、已包含在完整同步中的異動），由呼叫端記錄到 log
+	Skipped string `json:"Skipped,omitempty"`
+}
+
+// 回執的批次種類與結果
+const (
+	ReceiptKindDDL = "ddl"
+	ReceiptKindDML = "dml"
+
+	ReceiptOutcomeApplied  = "Applied"
+	ReceiptOutcomeRejected = "Rejected"
+)
+
+// ApplyReceipt 套用批次後回傳給 FtyBiProducer 的回執
+type ApplyReceipt struct {
+	ApplyResult
+	Kind      string    `json:"Kind"`
+	FactoryID string    `json:"FactoryID"`
+	Outcome   string    `json:"Outcome"`
+	Error     string    `json:"Error,omitempty"`
+	AppliedAt time.Time `json:"AppliedAt"`
+}
@@ -0,0 +1,20 @@
+package model
+
+import "time"
+
+// OrderState 記錄每個工廠、每個 stream（DDL 或 DML stream）已套用到的批次，用於偵測缺漏、重複與亂序
+// LastSerialNoTo 為已套用的批次鏈終點；Gaps 為套用時跳過、尚未收到的範圍，格式為 "from-to,from-to"（from 不含）
+type OrderState struct {
+	FactoryID      string    `gorm:"column:FactoryID;primaryKey;type:varchar(50)"`
+	Kind           string    `gorm:"column:Kind;primaryKey;type:varchar(10)"` // ddl 或 dml
+	Stream         string    `gorm:"column:Stream;primaryKey;type:varchar(50)"`
+	LastSequence   int64     `gorm:"column:LastSequence"`
+	LastSerialNoTo int64     `gorm:"column:LastSerialNoTo"`
+	LastBatchID    int64     `gorm:"column:LastBatchID"`
+	Gaps           string    `gorm:"column:Gaps;type:varchar(max)"`
+	UpdatedAt      time.Time `gorm:"column:UpdatedAt;autoUpdateTime"`
+}
+
+func (OrderState) TableName() string {
+	return "MessageOrderState"
+}
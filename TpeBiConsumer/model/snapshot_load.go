@@ -0,0 +1,61 @@
+package model
+
+import "time"
+
+// 完整同步的狀態
+const (
+	SnapshotStatusLoading    = "Loading"    // 載入 staging 中
+	SnapshotStatusApplied    = "Applied"    // 已套用到正式資料表，staging 已移除
+	SnapshotStatusSuperseded = "Superseded" // 同一張資料表開始了新的完整同步，之後收到的訊息略過
+	SnapshotStatusFailed     = "Failed"     // Chunk 未收齊或逾時未套用，staging 已移除，需重新執行完整同步
+)
+
+// SnapshotLoad 記錄每一次完整同步載入的 staging 與進度
+// Start 或第一個 Chunk 建立 staging 與此紀錄；End 在所有 Chunk 載入後套用並改為 Applied；
+// Loading 期間該資料表的 DML 異動暫存在 SnapshotHeldBatch，Applied 後略過 SerialNoTo 不超過 Watermark 的批次中該資料表的異動
+type SnapshotLoad struct {
+	SnapshotID   string     `gorm:"column:SnapshotID;primaryKey;type:varchar(200)"`
+	FactoryID    string     `gorm:"column:FactoryID;type:varchar(50)"`
+	Table        string     `gorm:"column:TableName;type:varchar(128);index"`
+	StagingTable string     `gorm:"column:StagingTable;type:varchar(160)"`
+	Mode         string     `gorm:"column:Mode;type:varchar(20)"`
+	Status       string     `gorm:"column:Status;type:varchar(20)"`
+	Chunks       int        `gorm:"column:Chunks"`
+	Rows         int64      `gorm:"column:TotalRows"` // ROWS 為 T-SQL 保留字
+	TakenAt      time.Time  `gorm:"column:TakenAt"`
+	Watermark    int64      `gorm:"column:Watermark"` // snapshot 時 Producer DmlLog 最大的 SerialNo
+	CreatedAt    time.Time  `gorm:"column:CreatedAt;autoCreateTime"`
+	AppliedAt    *time.Time `gorm:"column:AppliedAt"`
+}
+
+func (SnapshotLoad) TableName() string {
+	return "SnapshotLoad"
+}
+
+// SnapshotChunk 記錄已載入 staging 的 Chunk，重複收到時不必重新計算，End 據此確認是否已收齊
+type SnapshotChunk struct {
+	SnapshotID string    `gorm:"column:SnapshotID;primaryKey;type:varchar(200)"`
+	Chunk      int       `gorm:"column:Chunk;primaryKey;autoIncrement:false"`
+	Rows       int64     `gorm:"column:LoadedRows"`
+	LoadedAt   time.Time `gorm:"column:LoadedAt;autoCreateTime"`
+}
+
+func (SnapshotChunk) TableName() string {
+	return "SnapshotChunk"
+}
+
+// SnapshotHeldBatch 暫存完整同步載入期間收到的一般 DML 批次中該資料表的異動；
+// 完整同步套用、被取代或失敗時，在同一個 transaction 內依 ID 順序套用並刪除
+type SnapshotHeldBatch struct {
+	ID         int64     `gorm:"column:ID;primaryKey;autoIncrement"`
+	SnapshotID string    `gorm:"column:SnapshotID;type:varchar(200);index"`
+	FactoryID  string    `gorm:"column:FactoryID;type:varchar(50)"`
+	BatchID    int64     `gorm:"column:BatchID"`
+	SerialNoTo int64     `gorm:"column:SerialNoTo"`                  // 批次的 SerialNoTo，舊版 Producer 為 0
+	JSONList   string    `gorm:"column:JSONList;type:nvarchar(max)"` // 該資料表的異動，原始 JSONList 的 JSON 陣列
+	HeldAt     time.Time `gorm:"column:HeldAt;autoCreateTime"`
+}
+
+func (SnapshotHeldBatch) TableName() string {
+	return "SnapshotHeldBatch"
+}
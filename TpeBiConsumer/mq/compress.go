@@ -0,0 +1,76 @@
+// 訊息 Body 解壓縮與完整性檢查
+package mq
+
+import (
+	"TpeBiConsumer/model"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bytedance/sonic"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultMaxMessageBytes 為未設定 mq.max_message_bytes 時，解壓縮後 Body 的大小上限
+const DefaultMaxMessageBytes = 64 << 20
+
+// ErrCorruptPayload 表示 Body 無法解壓縮，或與信封記錄的大小、筆數不符
+var ErrCorruptPayload = errors.New("訊息內容不完整")
+
+// decodePayload 依信封的 ContentEncoding 解壓縮 body，並檢查大小與筆數；
+// 舊版 Producer 沒有記錄大小、筆數時只做解壓縮
+func decodePayload(env model.Envelope, body []byte, limit int) ([]byte, error) {
+	if limit <= 0 {
+		limit = DefaultMaxMessageBytes
+	}
+	if env.UncompressedLen > limit {
+		return nil, fmt.Errorf("%w：Body %d bytes 超過上限 %d", ErrCorruptPayload, env.UncompressedLen, limit)
+	}
+
+	// 1. 解壓縮，最多讀到上限多一個位元組，避免惡意或損壞的壓縮內容佔滿記憶體
+	var out []byte
+	var err error
+	switch env.ContentEncoding {
+	case "", model.ContentEncodingIdentity:
+		out = body
+	case model.ContentEncodingGzip:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(body)); err == nil {
+			out, err = io.ReadAll(io.LimitReader(r, int64(limit)+1))
+		}
+	case model.ContentEncodingZstd:
+		var r *zstd.Decoder
+		if r, err = zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1)); err == nil {
+			out, err = io.ReadAll(io.LimitReader(r, int64(limit)+1))
+			r.Close()
+		}
+	default:
+		return nil, fmt.Errorf("%w：不支援的 ContentEncoding %q", ErrInvalidEnvelope, env.ContentEncoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w：%s 解壓縮失敗：%v", ErrCorruptPayload, env.ContentEncoding, err)
+	}
+	if len(out) > limit {
+		return nil, fmt.Errorf("%w：解壓縮後超過上限 %d bytes", ErrCorruptPayload, limit)
+	}
+
+	// 2. 與信封比對大小與筆數，確認沒有被截斷
+	if env.UncompressedLen > 0 && len(out) != env.UncompressedLen {
+		return nil, fmt.Errorf("%w：Body %d bytes，信封記錄 %d bytes", ErrCorruptPayload, len(out), env.UncompressedLen)
+	}
+	if env.ItemCount > 0 {
+		var lists struct {
+			XMLList  []sonic.NoCopyRawMessage `json:"XMLList"`
+			JSONList []sonic.NoCopyRawMessage `json:"JSONList"`
+		}
+		if err := sonic.Unmarshal(out, &lists); err != nil {
+			return nil, fmt.Errorf("%w：解析 Body 失敗：%v", ErrCorruptPayload, err)
+		}
+		if n := len(lists.XMLList) + len(lists.JSONList); n != env.ItemCount {
+			return nil, fmt.Errorf("%w：Body 有 %d 筆，信封記錄 %d 筆", ErrCorruptPayload, n, env.ItemCount)
+		}
+	}
+	return out, nil
+}
@@ -2,14 +2,18 @@ package mq
 
 import (
 	config "TpeBiConsumer/config"
+	"TpeBiConsumer/metrics"
+	"TpeBiConsumer/model"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"os"
 	"sync"
 	"time"
 
+	"github.com/bytedance/sonic"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"go.uber.org/zap"
 )
@@ -20,7 +24,11 @@ type MQClient struct {
 	ch       *amqp.Channel
 	queue    *amqp.Queue
 	confirms <-chan amqp.Confirmation
+	verifier *verifier     // 未設定 signing_keys 時為 nil
+	ordering *orderTracker // 未呼叫 EnableOrdering 時為 nil，不檢查批次順序
 	mu       sync.Mutex
+	// 多個 Consumer 共用同一條 channel 發送回執，需序列化 Publish 與等待確認
+	pubMu sync.Mutex
 }
 
 // Consumer 依 RoutingKey 分流，並支援優雅關閉
@@ -31,6 +39,8 @@ type Consumer struct {
 	logger    *zap.SugaredLogger
 	wg        sync.WaitGroup
 	mu        sync.Mutex
+	stop      chan struct{} // Stop 時關閉
+	stopOnce  sync.Once
 }
 
 // ensureChannel creates or reuses the consumer's channel safely
@@ -51,18 +61,28 @@ func (c *Consumer) ensureChannel() error {
 		return err
 	}
 	c.ch = ch
-	c.queueName = c.client.queue.Name
+	if c.queueName == "" {
+		c.queueName = c.client.queue.Name
+	}
 	return nil
 }
 
 // HandlerFunc 處理訊息的 callback
+// env: 已檢查的信封（工廠、SerialNo 範圍…）
 // routingKey: 來源
 // body: 訊息內容
-type HandlerFunc func(ctx context.Context, routingKey string, body []byte) error
+// 回傳的 ApplyResult 會放進回執送回 Producer
+type HandlerFunc func(ctx context.Context, env model.Envelope, routingKey string, body []byte) (model.ApplyResult, error)
 
 // 建立 RabbitMQ TLS、連線、Channel、宣告 Exchange...
 func NewMQClient(cfg config.MQConfig) (*MQClient, error) {
 
+	// 簽章金鑰設定錯誤時在連線前就失敗
+	verifier, err := newVerifier(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("簽章設定錯誤: %w", err)
+	}
+
 	// 載入客戶端憑證與私鑰
 	clientCert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
 	if err != nil {
@@ -197,7 +217,98 @@ func NewMQClient(cfg config.MQConfig) (*MQClient, error) {
 		}
 	}
 
-	return &MQClient{conn: conn, ch: ch, cfg: cfg, queue: &q, confirms: confirms}, nil
+	// 4.1 每個 DML stream 一個 Queue（同樣帶 DLX 參數），只綁定自己的 RoutingKey
+	for _, stream := range cfg.DmlStreams {
+		sq, err := ch.QueueDeclare(
+			stream.QueueName(cfg.PrimaryQueue), // queue 名稱
+			true,                               // durable
+			false,                              // auto-delete
+			false,                              // exclusive
+			false,                              // no-wait
+			args,                               // 帶入 DLX 參數
+		)
+		if err != nil {
+			return nil, fmt.Errorf("宣告 Stream Queue(%s) 失敗: %w", stream.Name, err)
+		}
+		routingKey := DmlRoutingKey(stream.Name)
+		if err := ch.QueueBind(sq.Name, string(routingKey), cfg.PrimaryExchange, false, nil); err != nil {
+			return nil, fmt.Errorf("queue RoutingKey Bind(%s) 失敗：%v", string(routingKey), err)
+		}
+	}
+
+	// 5. 宣告回執 Exchange，Producer 端會把各自的回執 Queue 綁上來
+	if cfg.ReceiptExchange != "" {
+		if err := ch.ExchangeDeclare(
+			cfg.ReceiptExchange, // Exchange name
+			"direct",            // type
+			true,                // durable
+			false,               // auto-deleted
+			false,               // internal
+			false,               // no-wait
+			nil,                 // arguments
+		); err != nil {
+			return nil, fmt.Errorf("宣告 Receipt Exchange 失敗: %w", err)
+		}
+	}
+
+	return &MQClient{conn: conn, ch: ch, cfg: cfg, queue: &q, confirms: confirms, verifier: verifier}, nil
+}
+
+// SigningEnabled 回傳是否已設定 signing_keys 並驗證訊息簽章
+func (c *MQClient) SigningEnabled() bool {
+	return c.verifier != nil
+}
+
+// PublishReceipt 把回執送到回執 Exchange，routingKey 為訊息的 ReplyTo，並等待 broker 確認；
+// 設定 signing_keys 時以該工廠的金鑰簽章（keyID 為原訊息的 x-key-id），Producer 驗證後才處理
+func (c *MQClient) PublishReceipt(ctx context.Context, routingKey, keyID string, receipt model.ApplyReceipt) error {
+	body, err := sonic.Marshal(receipt)
+	if err != nil {
+		return fmt.Errorf("轉換回執 JSON 失敗: %w", err)
+	}
+	now := time.Now()
+	msg := amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		ContentType:  "application/json",
+		MessageId:    fmt.Sprintf("receipt-%s-%s-%d", receipt.FactoryID, receipt.Kind, receipt.BatchID),
+		Type:         ReceiptMessageType,
+		Timestamp:    now,
+		Headers: amqp.Table{
+			HeaderFactoryID: receipt.FactoryID,
+			HeaderBatchID:   int64(receipt.BatchID),
+		},
+		Body: body,
+	}
+	c.verifier.sealReceipt(&msg, receipt.FactoryID, keyID, now)
+
+	c.pubMu.Lock()
+	defer c.pubMu.Unlock()
+
+	c.mu.Lock()
+	ch, confirms := c.ch, c.confirms
+	c.mu.Unlock()
+
+	if err := ch.PublishWithContext(
+		ctx,
+		c.cfg.ReceiptExchange,
+		routingKey,
+		false, // mandatory
+		false, // immediate
+		msg); err != nil {
+		return err
+	}
+
+	select {
+	case confirm := <-confirms:
+		if confirm.Ack {
+			return nil
+		}
+		return fmt.Errorf("回執被 broker Nack, Tag=%d", confirm.DeliveryTag)
+	case <-time.After(c.cfg.Timeout):
+		return fmt.Errorf("回執 Confirm 超時")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (c *MQClient) Close() {
@@ -235,6 +346,21 @@ func NewConsumer(mqClient *MQClient, logger *zap.SugaredLogger) *Consumer {
 	c := &Consumer{
 		client: mqClient,
 		logger: logger,
+		stop:   make(chan struct{}),
+	}
+	if err := c.ensureChannel(); err != nil {
+		return nil
+	}
+	return c
+}
+
+// NewStreamConsumer 建立消費指定 Queue（DML stream）的 consumer
+func NewStreamConsumer(mqClient *MQClient, queueName string, logger *zap.SugaredLogger) *Consumer {
+	c := &Consumer{
+		client:    mqClient,
+		queueName: queueName,
+		logger:    logger,
+		stop:      make(chan struct{}),
 	}
 	if err := c.ensureChannel(); err != nil {
 		return nil
@@ -294,6 +420,12 @@ func (c *Consumer) Start(ctx context.Context, handler HandlerFunc) error {
 					c.logger.Info("Consumer received shutdown signal")
 					return
 
+				case <-c.stop:
+					// 關閉 channel，已預取但未 Ack 的訊息會回到 Queue 由其他 consumer 處理
+					c.logger.Info("Consumer stopped")
+					c.closeChannel()
+					return
+
 				case d, ok := <-msgs:
 					if !ok {
 						if err := c.reconnect(ctx); err != nil {
@@ -302,11 +434,77 @@ func (c *Consumer) Start(ctx context.Context, handler HandlerFunc) error {
 						}
 						break
 					}
-					if err := handler(ctx, d.RoutingKey, d.Body); err != nil {
+					env, ok := c.checkEnvelope(d)
+					if !ok {
+						d.Nack(false, false)
+						continue
+					}
+					body, err := c.client.verifier.open(d, env, time.Now())
+					if err == nil {
+						body, err = decodePayload(env, body, c.client.cfg.MaxMessageBytes)
+					}
+					if err != nil {
+						metrics.InvalidMessages.WithLabelValues(envelopeReason(err)).Inc()
+						c.logger.Errorw("Invalid message payload, message will be sent to Dead letter queue",
+							"routingKey", d.RoutingKey, "factory", env.FactoryID, "batchID", env.BatchID, "err", err)
+						d.Nack(false, false)
+						continue
+					}
+					// 依批次順序略過重複的批次，或等待前一個批次套用
+					verdict, ok := c.client.ordering.await(ctx, c.stop, env, c.logger, c.soleConsumer)
+					if !ok {
+						d.Nack(false, true)
+						continue
+					}
+					if verdict == orderDuplicate {
+						if rerr := c.sendReceipt(ctx, d, env, model.ApplyResult{BatchID: int(env.BatchID)}, nil); rerr != nil {
+							c.logger.Errorw("Send receipt failed, message will be requeued",
+								"routingKey", d.RoutingKey, "batchID", env.BatchID, "err", rerr)
+							d.Nack(false, true)
+							continue
+						}
+						d.Ack(false)
+						continue
+					}
+					result, err := handler(ctx, env, d.RoutingKey, body)
+					if err == nil {
+						if oerr := c.client.ordering.applied(ctx, env); oerr != nil {
+							c.logger.Errorw("Save batch order failed", "factory", env.FactoryID, "batchID", env.BatchID, "err", oerr)
+						}
+					}
+					if err == nil && env.BatchID != 0 && int64(result.BatchID) != env.BatchID {
+						c.logger.Warnw("BatchID in body does not match envelope",
+							"factory", env.FactoryID, "envelopeBatchID", env.BatchID, "bodyBatchID", result.BatchID)
+					}
+					// 暫時性錯誤（死結、逾時、斷線）或關機中斷時不送回執，等待後重新排入 Queue 再套用一次
+					if err != nil && (ctx.Err() != nil || IsTransient(err)) {
+						metrics.HandlerRequeues.WithLabelValues(receiptKind(d.RoutingKey)).Inc()
+						c.logger.Warnw("Handler transient error, message will be requeued",
+							"routingKey", d.RoutingKey,
+							"batchID", env.BatchID,
+							"err", err,
+						)
+						c.waitRetry(ctx)
+						d.Nack(false, true)
+						continue
+					}
+					if err != nil {
 						c.logger.Errorw("Handler error, message will be sent to Dead letter queue",
 							"routingKey", d.RoutingKey,
 							"err", err,
 						)
+					}
+					// 先送回執再 Ack；回執送不出去就重新排入，重新套用為冪等
+					if rerr := c.sendReceipt(ctx, d, env, result, err); rerr != nil {
+						c.logger.Errorw("Send receipt failed, message will be requeued",
+							"routingKey", d.RoutingKey,
+							"batchID", result.BatchID,
+							"err", rerr,
+						)
+						d.Nack(false, true)
+						continue
+					}
+					if err != nil {
 						d.Nack(false, false)
 					} else {
 						d.Ack(false)
@@ -318,6 +516,119 @@ func (c *Consumer) Start(ctx context.Context, handler HandlerFunc) error {
 	return nil
 }
 
+// sendReceipt 依處理結果回傳回執；未設定回執 Exchange、訊息未帶 ReplyTo、完整同步的訊息或無法得知 BatchID 時略過
+func (c *Consumer) sendReceipt(ctx context.Context, d amqp.Delivery, env model.Envelope, result model.ApplyResult, handlerErr error) error {
+	if c.client.cfg.ReceiptExchange == "" || d.ReplyTo == "" || env.SnapshotID != "" {
+		return nil
+	}
+	if result.BatchID == 0 {
+		c.logger.Warnw("Message has no BatchID, receipt skipped", "routingKey", d.RoutingKey, "appId", d.AppId)
+		return nil
+	}
+
+	receipt := model.ApplyReceipt{
+		ApplyResult: result,
+		Kind:        receiptKind(d.RoutingKey),
+		FactoryID:   env.FactoryID,
+		Outcome:     model.ReceiptOutcomeApplied,
+		AppliedAt:   time.Now(),
+	}
+	if handlerErr != nil {
+		receipt.Outcome = model.ReceiptOutcomeRejected
+		receipt.Error = handlerErr.Error()
+	}
+	keyID, _ := d.Headers[HeaderKeyID].(string)
+	return c.client.PublishReceipt(ctx, d.ReplyTo, keyID, receipt)
+}
+
+// checkEnvelope 驗證訊息信封並記錄 log；回傳 false 表示訊息不可套用，需送進 DLQ
+// 沒有信封的舊版訊息在 mq.require_envelope 未開啟時仍會處理
+func (c *Consumer) checkEnvelope(d amqp.Delivery) (model.Envelope, bool) {
+	env, err := parseEnvelope(d)
+	if err != nil {
+		metrics.InvalidMessages.WithLabelValues(envelopeReason(err)).Inc()
+	}
+	switch {
+	case errors.Is(err, ErrNoEnvelope) && !c.client.cfg.RequireEnvelope:
+		c.logger.Warnw("Message has no envelope (legacy producer)",
+			"routingKey", d.RoutingKey, "appId", d.AppId, "messageId", d.MessageId)
+		return env, true
+	case err != nil:
+		c.logger.Errorw("Invalid message envelope, message will be sent to Dead letter queue",
+			"routingKey", d.RoutingKey, "appId", d.AppId, "messageId", d.MessageId, "err", err)
+		return env, false
+	}
+	c.logger.Infow("Message received",
+		"routingKey", d.RoutingKey,
+		"messageId", env.MessageID,
+		"factory", env.FactoryID,
+		"server", env.SourceServer,
+		"database", env.SourceDatabase,
+		"type", env.MessageType,
+		"schemaVersion", env.SchemaVersion,
+		"batchID", env.BatchID,
+		"stream", env.Stream,
+		"serialNoFrom", env.SerialNoFrom,
+		"serialNoTo", env.SerialNoTo,
+		"sequence", env.Sequence,
+		"prevSerialNoTo", env.PrevSerialNoTo,
+		"snapshotID", env.SnapshotID,
+		"createdAt", env.CreatedAt,
+		"contentEncoding", env.ContentEncoding,
+		"items", env.ItemCount,
+		"bytes", len(d.Body),
+	)
+	return env, true
+}
+
+func receiptKind(routingKey string) string {
+	if routingKey == string(RoutingKeyDDL) {
+		return model.ReceiptKindDDL
+	}
+	return model.ReceiptKindDML
+}
+
+// waitRetry 在重新排入暫時性失敗的訊息前等待，收到關機或 Stop 時立即返回
+func (c *Consumer) waitRetry(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-c.stop:
+	case <-time.After(transientRetryDelay):
+	}
+}
+
+// soleConsumer 回傳此 consumer 是否為 Queue 上唯一的 consumer（含其他 TpeBiConsumer 程序）；
+// DML stream 的 Queue 與 consumer_count 為 1 時，等待中的批次會擋住前一個批次，hold 只會等到逾時。
+// 查詢失敗時視為有其他 consumer，維持 hold
+func (c *Consumer) soleConsumer() bool {
+	c.mu.Lock()
+	ch := c.ch
+	c.mu.Unlock()
+	if ch == nil || ch.IsClosed() {
+		return false
+	}
+	q, err := ch.QueueDeclarePassive(c.queueName, true, false, false, false, nil)
+	if err != nil {
+		c.logger.Warnw("Inspect queue consumers failed, holding", "queue", c.queueName, "err", err)
+		return false
+	}
+	return q.Consumers <= 1
+}
+
+// Stop 停止接收新訊息：處理中的訊息完成後結束，不影響其他 consumer；用於減少 consumer 數量
+func (c *Consumer) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// closeChannel 關閉 consumer 自己的 channel
+func (c *Consumer) closeChannel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ch != nil && !c.ch.IsClosed() {
+		c.ch.Close()
+	}
+}
+
 // Wait 等待所有 goroutine 完成
 func (c *Consumer) Wait() {
 	c.wg.Wait()
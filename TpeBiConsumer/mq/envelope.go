@@ -0,0 +1,188 @@
+// 訊息信封：從 AMQP properties 與 headers 讀出 FtyBiProducer 的 model.Envelope 並驗證
+package mq
+
+import (
+	"TpeBiConsumer/model"
+	"errors"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// 信封的 header 名稱，與 FtyBiProducer 一致
+const (
+	HeaderSchemaVersion  = "x-schema-version"
+	HeaderFactoryID      = "x-factory-id"
+	HeaderSourceServer   = "x-source-server"
+	HeaderSourceDatabase = "x-source-database"
+	HeaderBatchID        = "x-batch-id"
+	HeaderStream         = "x-stream"
+	HeaderSerialNoFrom   = "x-serial-no-from"
+	HeaderSerialNoTo     = "x-serial-no-to"
+	HeaderItemCount      = "x-item-count"
+	HeaderUncompressed   = "x-uncompressed-length"
+	HeaderSequence       = "x-sequence"
+	HeaderPrevSerialNoTo = "x-prev-serial-no-to"
+	HeaderSnapshotID     = "x-snapshot-id"
+)
+
+// 信封驗證失敗的原因，呼叫端可用 errors.Is 判斷，也作為 metrics 的 reason label
+var (
+	ErrNoEnvelope         = errors.New("訊息沒有信封")
+	ErrUnsupportedVersion = errors.New("不支援的訊息格式版本")
+	ErrInvalidEnvelope    = errors.New("訊息信封不合法")
+)
+
+// parseEnvelope 讀出訊息的信封；舊版 Producer 沒有 headers 時回傳 SchemaVersion 為 0 的信封與 ErrNoEnvelope
+func parseEnvelope(d amqp.Delivery) (model.Envelope, error) {
+	env := model.Envelope{
+		MessageID:       d.MessageId,
+		FactoryID:       d.AppId,
+		MessageType:     d.Type,
+		CreatedAt:       d.Timestamp,
+		ContentEncoding: d.ContentEncoding,
+	}
+	if _, ok := d.Headers[HeaderSchemaVersion]; !ok {
+		return env, ErrNoEnvelope
+	}
+
+	version, err := headerInt(d.Headers, HeaderSchemaVersion)
+	if err != nil {
+		return env, err
+	}
+	env.SchemaVersion = int(version)
+	if env.BatchID, err = headerInt(d.Headers, HeaderBatchID); err != nil {
+		return env, err
+	}
+	if env.SerialNoFrom, err = headerInt(d.Headers, HeaderSerialNoFrom); err != nil {
+		return env, err
+	}
+	if env.SerialNoTo, err = headerInt(d.Headers, HeaderSerialNoTo); err != nil {
+		return env, err
+	}
+	// 筆數與解壓縮後大小為選填，較早的 Producer 沒有帶
+	if _, ok := d.Headers[HeaderItemCount]; ok {
+		n, err := headerInt(d.Headers, HeaderItemCount)
+		if err != nil {
+			return env, err
+		}
+		env.ItemCount = int(n)
+	}
+	if _, ok := d.Headers[HeaderUncompressed]; ok {
+		n, err := headerInt(d.Headers, HeaderUncompressed)
+		if err != nil {
+			return env, err
+		}
+		env.UncompressedLen = int(n)
+	}
+	// 批次順序為選填，較早的 Producer 沒有帶，視為不需檢查順序
+	if _, ok := d.Headers[HeaderSequence]; ok {
+		if env.Sequence, err = headerInt(d.Headers, HeaderSequence); err != nil {
+			return env, err
+		}
+	}
+	if _, ok := d.Headers[HeaderPrevSerialNoTo]; ok {
+		if env.PrevSerialNoTo, err = headerInt(d.Headers, HeaderPrevSerialNoTo); err != nil {
+			return env, err
+		}
+	}
+	factoryID, _ := d.Headers[HeaderFactoryID].(string)
+	env.SourceServer, _ = d.Headers[HeaderSourceServer].(string)
+	env.SourceDatabase, _ = d.Headers[HeaderSourceDatabase].(string)
+	env.Stream, _ = d.Headers[HeaderStream].(string)
+	env.SnapshotID, _ = d.Headers[HeaderSnapshotID].(string)
+
+	// 1. 版本高於支援範圍：Body 格式可能不相容，不可套用
+	if env.SchemaVersion > model.SupportedSchemaVersion {
+		return env, fmt.Errorf("%w：%d（支援到 %d）", ErrUnsupportedVersion, env.SchemaVersion, model.SupportedSchemaVersion)
+	}
+	if env.SchemaVersion < 1 {
+		return env, fmt.Errorf("%w：%s = %d", ErrInvalidEnvelope, HeaderSchemaVersion, env.SchemaVersion)
+	}
+
+	// 2. 工廠必須存在且與 AppId 一致
+	if factoryID == "" {
+		return env, fmt.Errorf("%w：缺少 %s", ErrInvalidEnvelope, HeaderFactoryID)
+	}
+	if env.FactoryID != "" && env.FactoryID != factoryID {
+		return env, fmt.Errorf("%w：AppId %q 與 %s %q 不一致", ErrInvalidEnvelope, env.FactoryID, HeaderFactoryID, factoryID)
+	}
+	env.FactoryID = factoryID
+
+	// 3. 訊息種類需與 RoutingKey 一致
+	if want := receiptKind(d.RoutingKey); env.MessageType != want {
+		return env, fmt.Errorf("%w：Type %q 與 RoutingKey %s 不符", ErrInvalidEnvelope, env.MessageType, d.RoutingKey)
+	}
+	if want := DmlRoutingKey(env.Stream); env.MessageType == model.ReceiptKindDML && d.RoutingKey != string(want) {
+		return env, fmt.Errorf("%w：Stream %q 與 RoutingKey %s 不符", ErrInvalidEnvelope, env.Stream, d.RoutingKey)
+	}
+
+	// 4. 批次與範圍；完整同步的訊息不屬於任何批次，只能是 DML 且不排序
+	switch {
+	case env.SnapshotID != "":
+		if env.MessageType != model.ReceiptKindDML || env.Sequence != 0 {
+			return env, fmt.Errorf("%w：完整同步 %s 的 Type=%q, Sequence=%d", ErrInvalidEnvelope, env.SnapshotID, env.MessageType, env.Sequence)
+		}
+	case env.BatchID <= 0 || env.SerialNoFrom <= 0 || env.SerialNoFrom > env.SerialNoTo:
+		return env, fmt.Errorf("%w：BatchID=%d, SerialNo=%d~%d", ErrInvalidEnvelope, env.BatchID, env.SerialNoFrom, env.SerialNoTo)
+	case env.Sequence < 0 || env.PrevSerialNoTo < 0 || env.PrevSerialNoTo >= env.SerialNoFrom:
+		return env, fmt.Errorf("%w：Sequence=%d, PrevSerialNoTo=%d, SerialNoFrom=%d", ErrInvalidEnvelope, env.Sequence, env.PrevSerialNoTo, env.SerialNoFrom)
+	}
+
+	// 5. 壓縮方式
+	switch env.ContentEncoding {
+	case "", model.ContentEncodingIdentity, model.ContentEncodingGzip, model.ContentEncodingZstd:
+	default:
+		return env, fmt.Errorf("%w：不支援的 ContentEncoding %q", ErrInvalidEnvelope, env.ContentEncoding)
+	}
+	if env.ItemCount < 0 || env.UncompressedLen < 0 {
+		return env, fmt.Errorf("%w：筆數 %d、大小 %d 不可為負數", ErrInvalidEnvelope, env.ItemCount, env.UncompressedLen)
+	}
+	return env, nil
+}
+
+// envelopeReason 回傳信封錯誤的 metrics reason
+func envelopeReason(err error) string {
+	switch {
+	case errors.Is(err, ErrNoEnvelope):
+		return "no_envelope"
+	case errors.Is(err, ErrUnsupportedVersion):
+		return "unsupported_version"
+	case errors.Is(err, ErrCorruptPayload):
+		return "corrupt_payload"
+	case errors.Is(err, ErrUnsigned):
+		return "unsigned"
+	case errors.Is(err, ErrBadSignature):
+		return "bad_signature"
+	case errors.Is(err, ErrExpiredSignature):
+		return "expired"
+	default:
+		return "invalid_envelope"
+	}
+}
+
+// headerInt 讀出整數 header；AMQP table 解碼後可能是各種寬度的整數
+func headerInt(h amqp.Table, key string) (int64, error) {
+	switch v := h[key].(type) {
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case nil:
+		return 0, fmt.Errorf("%w：缺少 %s", ErrInvalidEnvelope, key)
+	default:
+		return 0, fmt.Errorf("%w：%s 應為整數，實際為 %T", ErrInvalidEnvelope, key, v)
+	}
+}
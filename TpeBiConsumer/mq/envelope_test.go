@@ -0,0 +1,294 @@
+package mq
+
+import (
+	"TpeBiConsumer/config"
+	"TpeBiConsumer/model"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// envelopeDelivery 回傳 FtyBiProducer 發出的合法 DML 訊息
+func envelopeDelivery() amqp.Delivery {
+	return amqp.Delivery{
+		RoutingKey:      "bi_dml.cutting.key",
+		MessageId:       "PH1-abc-1",
+		AppId:           "PH1",
+		Type:            model.ReceiptKindDML,
+		Timestamp:       time.Date(2025, 6, 1, 8, 0, 0, 0, time.UTC),
+		ContentEncoding: model.ContentEncodingIdentity,
+		Headers: amqp.Table{
+			HeaderSchemaVersion:  int32(1),
+			HeaderFactoryID:      "PH1",
+			HeaderSourceServer:   `SYSTEM2016\PH1`,
+			HeaderSourceDatabase: "Production",
+			HeaderBatchID:        int64(42),
+			HeaderStream:         "cutting",
+			HeaderSerialNoFrom:   int64(100),
+			HeaderSerialNoTo:     int64(180),
+			HeaderSequence:       int64(7),
+			HeaderPrevSerialNoTo: int64(95),
+		},
+	}
+}
+
+// TestParseEnvelope 驗證合法信封的解析，以及舊版訊息、版本過新與內容不一致的判斷
+func TestParseEnvelope(t *testing.T) {
+	env, err := parseEnvelope(envelopeDelivery())
+	if err != nil {
+		t.Fatalf("合法信封不應錯誤：%v", err)
+	}
+	if env.FactoryID != "PH1" || env.SourceServer != `SYSTEM2016\PH1` || env.SourceDatabase != "Production" ||
+		env.SchemaVersion != 1 || env.BatchID != 42 || env.Stream != "cutting" ||
+		env.SerialNoFrom != 100 || env.SerialNoTo != 180 || env.MessageID != "PH1-abc-1" ||
+		env.Sequence != 7 || env.PrevSerialNoTo != 95 {
+		t.Errorf("信封內容不符：%+v", env)
+	}
+
+	legacy := amqp.Delivery{RoutingKey: string(RoutingKeyDDL), AppId: "PH1"}
+	if env, err := parseEnvelope(legacy); !errors.Is(err, ErrNoEnvelope) || env.FactoryID != "PH1" {
+		t.Errorf("沒有 headers 應回傳 ErrNoEnvelope 並保留 AppId，實際 %+v：%v", env, err)
+	}
+
+	cases := []struct {
+		name   string
+		modify func(d *amqp.Delivery)
+		want   error
+	}{
+		{"版本過新", func(d *amqp.Delivery) { d.Headers[HeaderSchemaVersion] = int32(2) }, ErrUnsupportedVersion},
+		{"工廠不一致", func(d *amqp.Delivery) { d.AppId = "ESP" }, ErrInvalidEnvelope},
+		{"種類與 RoutingKey 不符", func(d *amqp.Delivery) { d.Type = model.ReceiptKindDDL }, ErrInvalidEnvelope},
+		{"Stream 與 RoutingKey 不符", func(d *amqp.Delivery) { d.Headers[HeaderStream] = "" }, ErrInvalidEnvelope},
+		{"範圍顛倒", func(d *amqp.Delivery) { d.Headers[HeaderSerialNoTo] = int64(99) }, ErrInvalidEnvelope},
+		{"前一個批次不在範圍之前", func(d *amqp.Delivery) { d.Headers[HeaderPrevSerialNoTo] = int64(100) }, ErrInvalidEnvelope},
+		{"缺少 BatchID", func(d *amqp.Delivery) { delete(d.Headers, HeaderBatchID) }, ErrInvalidEnvelope},
+		{"不支援的壓縮", func(d *amqp.Delivery) { d.ContentEncoding = "br" }, ErrInvalidEnvelope},
+	}
+	for _, c := range cases {
+		d := envelopeDelivery()
+		c.modify(&d)
+		if _, err := parseEnvelope(d); !errors.Is(err, c.want) {
+			t.Errorf("%s：預期 %v，實際 %v", c.name, c.want, err)
+		}
+	}
+}
+
+// TestParseEnvelope_Snapshot 驗證完整同步的訊息不需要批次與範圍，但不可帶批次序號
+func TestParseEnvelope_Snapshot(t *testing.T) {
+	snapshot := func() amqp.Delivery {
+		d := envelopeDelivery()
+		d.Headers[HeaderBatchID] = int64(0)
+		d.Headers[HeaderSerialNoFrom] = int64(0)
+		d.Headers[HeaderSerialNoTo] = int64(0)
+		d.Headers[HeaderSequence] = int64(0)
+		d.Headers[HeaderPrevSerialNoTo] = int64(0)
+		d.Headers[HeaderSnapshotID] = "PH1-Cutting-1"
+		return d
+	}
+	env, err := parseEnvelope(snapshot())
+	if err != nil {
+		t.Fatalf("完整同步的信封不應錯誤：%v", err)
+	}
+	if env.SnapshotID != "PH1-Cutting-1" || env.BatchID != 0 || env.Stream != "cutting" {
+		t.Errorf("信封內容不符：%+v", env)
+	}
+
+	d := snapshot()
+	d.Headers[HeaderSequence] = int64(3)
+	if _, err := parseEnvelope(d); !errors.Is(err, ErrInvalidEnvelope) {
+		t.Errorf("完整同步帶批次序號應為 ErrInvalidEnvelope，實際 %v", err)
+	}
+
+	// 沒有 x-snapshot-id 時仍需要批次與範圍
+	d = snapshot()
+	delete(d.Headers, HeaderSnapshotID)
+	if _, err := parseEnvelope(d); !errors.Is(err, ErrInvalidEnvelope) {
+		t.Errorf("一般批次缺少 BatchID 應為 ErrInvalidEnvelope，實際 %v", err)
+	}
+}
+
+// TestDecodePayload 驗證 gzip / zstd 解壓縮，以及大小、筆數與上限的檢查
+func TestDecodePayload(t *testing.T) {
+	body := []byte(`{"BatchID":42,"JSONList":["{\"Action\":\"Insert\"}","{\"Action\":\"Delete\"}"]}`)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(body)
+	w.Close()
+	enc, _ := zstd.NewWriter(nil)
+	zst := enc.EncodeAll(body, nil)
+	enc.Close()
+
+	env := model.Envelope{ItemCount: 2, UncompressedLen: len(body)}
+	for encoding, payload := range map[string][]byte{
+		model.ContentEncodingIdentity: body,
+		model.ContentEncodingGzip:     gz.Bytes(),
+		model.ContentEncodingZstd:     zst,
+	} {
+		env.ContentEncoding = encoding
+		out, err := decodePayload(env, payload, 0)
+		if err != nil || !bytes.Equal(out, body) {
+			t.Errorf("%s 解碼失敗：%v", encoding, err)
+		}
+	}
+
+	env.ContentEncoding = model.ContentEncodingGzip
+	cases := []struct {
+		name    string
+		env     model.Envelope
+		payload []byte
+		limit   int
+	}{
+		{"筆數不符", model.Envelope{ContentEncoding: model.ContentEncodingIdentity, ItemCount: 3}, body, 0},
+		{"大小不符", model.Envelope{ContentEncoding: model.ContentEncodingIdentity, UncompressedLen: len(body) + 1}, body, 0},
+		{"截斷的 gzip", env, gz.Bytes()[:gz.Len()/2], 0},
+		{"超過上限", model.Envelope{ContentEncoding: model.ContentEncodingGzip}, gz.Bytes(), 10},
+	}
+	for _, c := range cases {
+		if _, err := decodePayload(c.env, c.payload, c.limit); !errors.Is(err, ErrCorruptPayload) {
+			t.Errorf("%s：預期 ErrCorruptPayload，實際 %v", c.name, err)
+		}
+	}
+}
+
+// signedDelivery 以 key 簽章 envelopeDelivery，encKey 不為 nil 時先加密 Body
+func signedDelivery(key, encKey []byte, signedAt time.Time) amqp.Delivery {
+	d := envelopeDelivery()
+	d.Body = []byte(`{"BatchID":42}`)
+	if encKey != nil {
+		block, _ := aes.NewCipher(encKey)
+		gcm, _ := cipher.NewGCM(block)
+		nonce := make([]byte, gcm.NonceSize())
+		rand.Read(nonce)
+		d.Body = gcm.Seal(nonce, nonce, d.Body, nil)
+		d.Headers[HeaderEncryption] = EncryptionAESGCM
+	}
+	d.Headers[HeaderKeyID] = "ph1-2025"
+	d.Headers[HeaderSignedAt] = signedAt.Unix()
+	d.Headers[HeaderSignature] = base64.StdEncoding.EncodeToString(sign(key, d.MessageId, d.AppId, d.Type, d.ContentEncoding, d.Headers, d.Body))
+	return d
+}
+
+// TestVerifier_Open 驗證合法簽章與解密，以及未簽章、竄改、過期、工廠不符的拒絕
+func TestVerifier_Open(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	encKey := bytes.Repeat([]byte{9}, 32)
+	cfg := config.MQConfig{SigningKeys: []config.SigningKey{{
+		KeyID:            "ph1-2025",
+		FactoryID:        "PH1",
+		Secret:           base64.StdEncoding.EncodeToString(key),
+		EncryptionSecret: base64.StdEncoding.EncodeToString(encKey),
+	}}}
+	v, err := newVerifier(cfg)
+	if err != nil {
+		t.Fatalf("建立 verifier 失敗：%v", err)
+	}
+	now := time.Date(2025, 6, 1, 8, 0, 0, 0, time.UTC)
+	open := func(d amqp.Delivery) ([]byte, error) {
+		env, err := parseEnvelope(d)
+		if err != nil {
+			t.Fatalf("信封不應錯誤：%v", err)
+		}
+		return v.open(d, env, now)
+	}
+
+	for name, enc := range map[string][]byte{"未加密": nil, "加密": encKey} {
+		body, err := open(signedDelivery(key, enc, now.Add(-time.Minute)))
+		if err != nil || string(body) != `{"BatchID":42}` {
+			t.Errorf("%s：合法訊息應通過，實際 %q：%v", name, body, err)
+		}
+	}
+
+	cases := []struct {
+		name   string
+		modify func(d *amqp.Delivery)
+		want   error
+	}{
+		{"沒有簽章", func(d *amqp.Delivery) { delete(d.Headers, HeaderSignature) }, ErrUnsigned},
+		{"竄改 Body", func(d *amqp.Delivery) { d.Body = []byte(`{"BatchID":43}`) }, ErrBadSignature},
+		{"竄改範圍", func(d *amqp.Delivery) { d.Headers[HeaderSerialNoTo] = int64(181) }, ErrBadSignature},
+		{"未知金鑰", func(d *amqp.Delivery) { d.Headers[HeaderKeyID] = "esp-2025" }, ErrBadSignature},
+		{"冒用其他工廠", func(d *amqp.Delivery) { d.AppId, d.Headers[HeaderFactoryID] = "ESP", "ESP" }, ErrBadSignature},
+		{"過期", func(d *amqp.Delivery) { *d = signedDelivery(key, nil, now.Add(-25*time.Hour)) }, ErrExpiredSignature},
+		{"時間超前", func(d *amqp.Delivery) { *d = signedDelivery(key, nil, now.Add(time.Hour)) }, ErrExpiredSignature},
+		{"錯誤金鑰", func(d *amqp.Delivery) { *d = signedDelivery(bytes.Repeat([]byte{8}, 32), nil, now) }, ErrBadSignature},
+	}
+	for _, c := range cases {
+		d := signedDelivery(key, nil, now)
+		c.modify(&d)
+		if _, err := open(d); !errors.Is(err, c.want) {
+			t.Errorf("%s：預期 %v，實際 %v", c.name, c.want, err)
+		}
+	}
+
+	// 遷移期間允許未簽章，但加密的訊息仍需簽章
+	v.allowUnsigned = true
+	d := envelopeDelivery()
+	if _, err := open(d); err != nil {
+		t.Errorf("allow_unsigned 時應接受未簽章訊息：%v", err)
+	}
+	var none *verifier
+	if _, err := none.open(signedDelivery(key, encKey, now), model.Envelope{}, now); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("未設定金鑰時加密訊息應拒絕，實際 %v", err)
+	}
+}
+
+// TestVerifier_SealReceipt 驗證回執以原訊息的金鑰簽章，金鑰不屬於該工廠時改用該工廠的金鑰，沒有金鑰時不簽章
+func TestVerifier_SealReceipt(t *testing.T) {
+	ph1Old, ph1New, esp := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32), bytes.Repeat([]byte{3}, 32)
+	cfg := config.MQConfig{SigningKeys: []config.SigningKey{
+		{KeyID: "ph1-2024", FactoryID: "PH1", Secret: base64.StdEncoding.EncodeToString(ph1Old)},
+		{KeyID: "ph1-2025", FactoryID: "PH1", Secret: base64.StdEncoding.EncodeToString(ph1New)},
+		{KeyID: "esp-2025", FactoryID: "ESP", Secret: base64.StdEncoding.EncodeToString(esp)},
+	}}
+	v, err := newVerifier(cfg)
+	if err != nil {
+		t.Fatalf("建立 verifier 失敗：%v", err)
+	}
+	now := time.Date(2025, 6, 1, 8, 0, 0, 0, time.UTC)
+	receipt := func() amqp.Publishing {
+		return amqp.Publishing{
+			MessageId: "receipt-PH1-dml-42",
+			Type:      ReceiptMessageType,
+			Headers:   amqp.Table{HeaderFactoryID: "PH1", HeaderBatchID: int64(42)},
+			Body:      []byte(`{"BatchID":42}`),
+		}
+	}
+
+	cases := []struct {
+		name, factoryID, keyID, wantKeyID string
+		key                               []byte
+	}{
+		{"沿用原訊息金鑰", "PH1", "ph1-2025", "ph1-2025", ph1New},
+		{"原訊息金鑰屬於其他工廠", "PH1", "esp-2025", "ph1-2024", ph1Old},
+		{"原訊息未簽章", "PH1", "", "ph1-2024", ph1Old},
+	}
+	for _, c := range cases {
+		p := receipt()
+		v.sealReceipt(&p, c.factoryID, c.keyID, now)
+		if p.Headers[HeaderKeyID] != c.wantKeyID || p.Headers[HeaderSignedAt] != now.Unix() {
+			t.Errorf("%s：key id 或簽章時間不符：%v", c.name, p.Headers)
+			continue
+		}
+		want := base64.StdEncoding.EncodeToString(sign(c.key, p.MessageId, p.AppId, p.Type, p.ContentEncoding, p.Headers, p.Body))
+		if p.Headers[HeaderSignature] != want {
+			t.Errorf("%s：簽章不符", c.name)
+		}
+	}
+
+	p := receipt()
+	v.sealReceipt(&p, "TW1", "ph1-2025", now)
+	var none *verifier
+	none.sealReceipt(&p, "PH1", "ph1-2025", now)
+	if _, ok := p.Headers[HeaderSignature]; ok {
+		t.Errorf("沒有該工廠的金鑰或未設定 signing_keys 時不應簽章：%v", p.Headers)
+	}
+}
@@ -0,0 +1,53 @@
+// 錯誤分類：決定套用失敗的訊息要重新排入 Queue 稍後再試，還是送進 DLQ
+package mq
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	mssql "github.com/microsoft/go-mssqldb"
+)
+
+// transientRetryDelay 為暫時性錯誤重新排入 Queue 前的等待時間，避免同一則訊息立即重試造成空轉
+const transientRetryDelay = 5 * time.Second
+
+// SQL Server 的暫時性錯誤碼：死結、鎖定逾時、連線中斷、Azure SQL 暫時無法使用
+var transientErrorNumbers = map[int32]bool{
+	-2:    true, // Timeout expired
+	233:   true, // connection forcibly closed
+	1204:  true, // 無法取得鎖定資源
+	1205:  true, // 死結犧牲者
+	1222:  true, // Lock request time out period exceeded
+	10053: true, // 連線被主機中止
+	10054: true, // 連線被遠端重設
+	10060: true, // 連線逾時
+	40197: true, // 服務處理要求時發生錯誤
+	40501: true, // 服務忙碌中
+	40613: true, // 資料庫目前無法使用
+	49918: true, // 資源不足
+	49919: true,
+	49920: true,
+}
+
+// IsTransient 判斷套用失敗是否為暫時性錯誤（資料庫逾時、死結、斷線），重試可能成功；
+// 其他錯誤（資料格式、違反條件約束、資料表不存在）重試也不會成功，回傳 false
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var sqlErr mssql.Error
+	if errors.As(err, &sqlErr) {
+		return transientErrorNumbers[sqlErr.Number]
+	}
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
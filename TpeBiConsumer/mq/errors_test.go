@@ -0,0 +1,33 @@
+package mq
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+
+	mssql "github.com/microsoft/go-mssqldb"
+)
+
+func TestIsTransient(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"deadlock", fmt.Errorf("更新失敗 idx=1, table=Cutting: %w", mssql.Error{Number: 1205}), true},
+		{"lock timeout", mssql.Error{Number: 1222}, true},
+		{"duplicate key", fmt.Errorf(" Upsert 失敗 (table=Cutting): %w", mssql.Error{Number: 2627}), false},
+		{"invalid object", mssql.Error{Number: 208}, false},
+		{"bad conn", fmt.Errorf("commit 失敗：%w", driver.ErrBadConn), true},
+		{"deadline", fmt.Errorf("開啟 transaction 失敗：%w", context.DeadlineExceeded), true},
+		{"parse", errors.New("第 1 筆 JSON 解析失敗"), false},
+	}
+	for _, tc := range cases {
+		if got := IsTransient(tc.err); got != tc.want {
+			t.Errorf("%s: IsTransient = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
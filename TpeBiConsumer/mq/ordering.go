@@ -0,0 +1,300 @@
+// 批次順序：依 FtyBiProducer 信封的 x-sequence、x-prev-serial-no-to 偵測每個 stream 的缺漏、重複與亂序
+package mq
+
+import (
+	config "TpeBiConsumer/config"
+	"TpeBiConsumer/metrics"
+	"TpeBiConsumer/model"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultHoldTimeout 為未設定 mq.ordering.hold_timeout 時，等待前一個批次的最長時間
+const DefaultHoldTimeout = 30 * time.Second
+
+// maxOrderGaps 為每個 stream 最多記錄的缺漏範圍，超過時捨棄最舊的
+const maxOrderGaps = 100
+
+// OrderStore 保存各 stream 的批次順序，重新啟動後接續判斷；由 service.OrderStore 實作
+type OrderStore interface {
+	LoadOrderStates(ctx context.Context) ([]model.OrderState, error)
+	SaveOrderState(ctx context.Context, state model.OrderState) error
+}
+
+// orderVerdict 為批次相對於已套用批次鏈的位置
+type orderVerdict int
+
+const (
+	orderUnordered orderVerdict = iota // 沒有序號（replay、舊版 Producer），不檢查順序
+	orderInOrder                       // 前一個批次已套用，或是此 stream 的第一個批次
+	orderDuplicate                     // 範圍已套用過，略過
+	orderLate                          // 範圍落在先前跳過的缺漏中，晚到的批次照常套用
+	orderGap                           // 前一個批次尚未套用
+)
+
+type orderKey struct {
+	factory, kind, stream string
+}
+
+// serialRange 為 SerialNo 範圍 (from, to]，與批次的 (PrevSerialNoTo, SerialNoTo] 對應
+type serialRange struct {
+	from, to int64
+}
+
+// orderStream 為一個 stream 的批次鏈：state.LastSerialNoTo 之前除了 gaps 都已套用
+type orderStream struct {
+	state model.OrderState
+	gaps  []serialRange
+}
+
+// orderTracker 由同一個 MQClient 的所有 consumer 共用；consumer_count > 1 時，
+// 後一個批次可能比前一個先被取走，policy 為 hold 時等待另一個 consumer 套用前一個批次
+type orderTracker struct {
+	policy      string
+	holdTimeout time.Duration
+	store       OrderStore
+
+	mu      sync.Mutex
+	streams map[orderKey]*orderStream
+	changed chan struct{} // 任何 stream 前進時關閉並換新，喚醒等待中的批次
+}
+
+// newOrderTracker 以設定與已保存的批次順序建立 orderTracker
+func newOrderTracker(cfg config.OrderingConfig, store OrderStore, states []model.OrderState) (*orderTracker, error) {
+	t := &orderTracker{
+		policy:      cfg.Policy,
+		holdTimeout: cfg.HoldTimeout,
+		store:       store,
+		streams:     make(map[orderKey]*orderStream),
+		changed:     make(chan struct{}),
+	}
+	if t.policy == "" {
+		t.policy = config.OrderPolicyHold
+	}
+	if t.holdTimeout <= 0 {
+		t.holdTimeout = DefaultHoldTimeout
+	}
+	for _, state := range states {
+		gaps, err := parseGaps(state.Gaps)
+		if err != nil {
+			return nil, fmt.Errorf("工廠 %s %s stream %q 的缺漏範圍格式錯誤：%w", state.FactoryID, state.Kind, state.Stream, err)
+		}
+		t.streams[orderKey{state.FactoryID, state.Kind, state.Stream}] = &orderStream{state: state, gaps: gaps}
+	}
+	return t, nil
+}
+
+// EnableOrdering 讀取已保存的批次順序，之後收到的批次依 mq.ordering 檢查順序；需在啟動 consumer 前呼叫
+func (c *MQClient) EnableOrdering(ctx context.Context, store OrderStore) error {
+	states, err := store.LoadOrderStates(ctx)
+	if err != nil {
+		return err
+	}
+	t, err := newOrderTracker(c.cfg.Ordering, store, states)
+	if err != nil {
+		return err
+	}
+	c.ordering = t
+	return nil
+}
+
+// classify 判斷批次相對於 stream 批次鏈的位置，需持有 t.mu
+func (t *orderTracker) classify(env model.Envelope) orderVerdict {
+	s := t.streams[envOrderKey(env)]
+	if s == nil {
+		return orderInOrder
+	}
+	for _, g := range s.gaps {
+		if env.PrevSerialNoTo < g.to && env.SerialNoTo > g.from {
+			return orderLate
+		}
+	}
+	switch {
+	case env.SerialNoTo <= s.state.LastSerialNoTo:
+		return orderDuplicate
+	case env.PrevSerialNoTo <= s.state.LastSerialNoTo:
+		return orderInOrder
+	}
+	return orderGap
+}
+
+// await 判斷批次順序並記錄異常；前一個批次尚未套用且 policy 為 hold 時，等到前一個批次套用或 hold_timeout 逾時。
+// soleConsumer 回傳 true 時表示 Queue 上沒有其他 consumer：prefetch 為 1，前一個批次不可能在等待期間被取走，
+// 因此不等待，直接套用並記錄 Error；soleConsumer 只在發現缺漏時呼叫，nil 視為有其他 consumer
+// 回傳 false 表示等待中收到結束信號，訊息需重新排入
+func (t *orderTracker) await(ctx context.Context, stop <-chan struct{}, env model.Envelope, logger *zap.SugaredLogger, soleConsumer func() bool) (orderVerdict, bool) {
+	if t == nil || env.Sequence == 0 {
+		return orderUnordered, true
+	}
+	fields := []interface{}{
+		"factory", env.FactoryID, "kind", env.MessageType, "stream", env.Stream, "batchID", env.BatchID,
+		"sequence", env.Sequence, "prevSerialNoTo", env.PrevSerialNoTo, "serialNoFrom", env.SerialNoFrom, "serialNoTo", env.SerialNoTo,
+	}
+	var timeout <-chan time.Time
+	for {
+		t.mu.Lock()
+		verdict := t.classify(env)
+		lastTo := t.lastSerialNoTo(env)
+		changed := t.changed
+		t.mu.Unlock()
+
+		switch verdict {
+		case orderDuplicate:
+			t.count(env, "duplicate")
+			logger.Infow("Duplicate batch skipped", append(fields, "lastSerialNoTo", lastTo)...)
+			return verdict, true
+		case orderLate:
+			t.count(env, "out_of_order")
+			logger.Warnw("Batch arrived out of order, filling gap", append(fields, "lastSerialNoTo", lastTo)...)
+			return verdict, true
+		case orderGap:
+		default:
+			return verdict, true
+		}
+
+		// 前一個批次尚未套用
+		if timeout == nil {
+			t.count(env, "gap")
+		}
+		switch t.policy {
+		case config.OrderPolicyApply:
+			logger.Warnw("Previous batch not applied yet, applying anyway", append(fields, "lastSerialNoTo", lastTo)...)
+			return verdict, true
+		case config.OrderPolicyAlert:
+			logger.Errorw("Previous batch not applied yet, applying anyway", append(fields, "lastSerialNoTo", lastTo)...)
+			return verdict, true
+		}
+		if timeout == nil && soleConsumer != nil && soleConsumer() {
+			logger.Errorw("Previous batch not applied yet and no other consumer on the queue, applying anyway", append(fields, "lastSerialNoTo", lastTo)...)
+			return verdict, true
+		}
+		if timeout == nil {
+			logger.Infow("Previous batch not applied yet, holding", append(fields, "lastSerialNoTo", lastTo, "holdTimeout", t.holdTimeout)...)
+			timer := time.NewTimer(t.holdTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.count(env, "hold_timeout")
+			logger.Errorw("Previous batch not applied within hold timeout, applying anyway", append(fields, "lastSerialNoTo", lastTo)...)
+			return verdict, true
+		case <-ctx.Done():
+			return verdict, false
+		case <-stop:
+			return verdict, false
+		}
+	}
+}
+
+// applied 在批次套用成功後更新 stream 的批次鏈並保存：
+// 補上的範圍從缺漏中移除；前一個批次尚未套用時，跳過的範圍記為缺漏，晚到時仍會套用。
+// 第一次收到的批次也一樣，(0, PrevSerialNoTo] 記為缺漏
+func (t *orderTracker) applied(ctx context.Context, env model.Envelope) error {
+	if t == nil || env.Sequence == 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := envOrderKey(env)
+	s, ok := t.streams[key]
+	if !ok {
+		// 第一次收到此 stream 的批次，以它作為起點，之前的範圍記為缺漏
+		s = &orderStream{state: model.OrderState{FactoryID: key.factory, Kind: key.kind, Stream: key.stream}}
+		t.streams[key] = s
+	}
+	s.fill(serialRange{env.PrevSerialNoTo, env.SerialNoTo})
+	if env.SerialNoTo > s.state.LastSerialNoTo {
+		if env.PrevSerialNoTo > s.state.LastSerialNoTo {
+			s.gaps = append(s.gaps, serialRange{s.state.LastSerialNoTo, env.PrevSerialNoTo})
+			if len(s.gaps) > maxOrderGaps {
+				s.gaps = s.gaps[len(s.gaps)-maxOrderGaps:]
+			}
+		}
+		s.state.LastSerialNoTo = env.SerialNoTo
+	}
+	if env.Sequence > s.state.LastSequence {
+		s.state.LastSequence = env.Sequence
+		s.state.LastBatchID = env.BatchID
+	}
+	s.state.Gaps = formatGaps(s.gaps)
+
+	close(t.changed)
+	t.changed = make(chan struct{})
+	return t.store.SaveOrderState(ctx, s.state)
+}
+
+// lastSerialNoTo 回傳 stream 已套用到的 SerialNoTo，需持有 t.mu
+func (t *orderTracker) lastSerialNoTo(env model.Envelope) int64 {
+	if s := t.streams[envOrderKey(env)]; s != nil {
+		return s.state.LastSerialNoTo
+	}
+	return 0
+}
+
+func (t *orderTracker) count(env model.Envelope, event string) {
+	metrics.OrderEvents.WithLabelValues(env.FactoryID, env.MessageType, env.Stream, event).Inc()
+}
+
+// fill 從缺漏中移除 r 涵蓋的範圍
+func (s *orderStream) fill(r serialRange) {
+	gaps := s.gaps[:0]
+	for _, g := range s.gaps {
+		if r.from >= g.to || r.to <= g.from {
+			gaps = append(gaps, g)
+			continue
+		}
+		if r.from > g.from {
+			gaps = append(gaps, serialRange{g.from, r.from})
+		}
+		if r.to < g.to {
+			gaps = append(gaps, serialRange{r.to, g.to})
+		}
+	}
+	s.gaps = gaps
+}
+
+func envOrderKey(env model.Envelope) orderKey {
+	return orderKey{env.FactoryID, env.MessageType, env.Stream}
+}
+
+// formatGaps 把缺漏範圍寫成 "from-to,from-to"
+func formatGaps(gaps []serialRange) string {
+	parts := make([]string, len(gaps))
+	for i, g := range gaps {
+		parts[i] = strconv.FormatInt(g.from, 10) + "-" + strconv.FormatInt(g.to, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseGaps 解析 formatGaps 的結果
+func parseGaps(s string) ([]serialRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var gaps []serialRange
+	for _, part := range strings.Split(s, ",") {
+		from, to, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("%q 不是 from-to", part)
+		}
+		f, err := strconv.ParseInt(from, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q 不是 from-to：%w", part, err)
+		}
+		t, err := strconv.ParseInt(to, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q 不是 from-to：%w", part, err)
+		}
+		gaps = append(gaps, serialRange{f, t})
+	}
+	return gaps, nil
+}
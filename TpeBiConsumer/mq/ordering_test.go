@@ -0,0 +1,202 @@
+package mq
+
+import (
+	"TpeBiConsumer/config"
+	"TpeBiConsumer/model"
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// memOrderStore 為記憶體中的 OrderStore
+type memOrderStore struct {
+	states map[orderKey]model.OrderState
+}
+
+func (s *memOrderStore) LoadOrderStates(ctx context.Context) ([]model.OrderState, error) {
+	var states []model.OrderState
+	for _, state := range s.states {
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func (s *memOrderStore) SaveOrderState(ctx context.Context, state model.OrderState) error {
+	s.states[orderKey{state.FactoryID, state.Kind, state.Stream}] = state
+	return nil
+}
+
+// orderedEnv 回傳 cutting stream 的 DML 批次信封，涵蓋 (prev, to]
+func orderedEnv(batchID, seq, prev, from, to int64) model.Envelope {
+	return model.Envelope{
+		FactoryID: "PH1", MessageType: model.ReceiptKindDML, Stream: "cutting",
+		BatchID: batchID, Sequence: seq, PrevSerialNoTo: prev, SerialNoFrom: from, SerialNoTo: to,
+	}
+}
+
+// TestOrderTracker_Verdicts 驗證依序、重複、缺漏與晚到批次的判斷，以及缺漏範圍在重新啟動後保留
+func TestOrderTracker_Verdicts(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop().Sugar()
+	store := &memOrderStore{states: make(map[orderKey]model.OrderState)}
+	tracker, err := newOrderTracker(config.OrderingConfig{Policy: config.OrderPolicyApply}, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apply := func(env model.Envelope, want orderVerdict) {
+		t.Helper()
+		got, ok := tracker.await(ctx, nil, env, logger, nil)
+		if !ok || got != want {
+			t.Fatalf("批次 %d 預期 %d，實際 %d", env.BatchID, want, got)
+		}
+		if got == orderDuplicate {
+			return
+		}
+		if err := tracker.applied(ctx, env); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	apply(orderedEnv(1, 1, 0, 10, 20), orderInOrder)    // 第一個批次作為起點
+	apply(orderedEnv(2, 2, 20, 25, 30), orderInOrder)   // 接在批次 1 後面
+	apply(orderedEnv(2, 2, 20, 25, 30), orderDuplicate) // 重送
+	apply(orderedEnv(4, 4, 40, 41, 50), orderGap)       // 批次 3 (30, 40] 尚未到
+	apply(orderedEnv(9, 0, 0, 31, 40), orderUnordered)  // replay 不檢查順序
+
+	state := store.states[orderKey{"PH1", model.ReceiptKindDML, "cutting"}]
+	if state.LastSerialNoTo != 50 || state.LastSequence != 4 || state.LastBatchID != 4 || state.Gaps != "30-40" {
+		t.Fatalf("批次順序不符：%+v", state)
+	}
+
+	// 重新啟動後，晚到的批次 3 仍會套用並補上缺漏
+	tracker, err = newOrderTracker(config.OrderingConfig{Policy: config.OrderPolicyApply}, store, []model.OrderState{state})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply(orderedEnv(3, 3, 30, 31, 40), orderLate)
+	apply(orderedEnv(3, 3, 30, 31, 40), orderDuplicate)
+
+	state = store.states[orderKey{"PH1", model.ReceiptKindDML, "cutting"}]
+	if state.LastSerialNoTo != 50 || state.LastSequence != 4 || state.Gaps != "" {
+		t.Fatalf("補上缺漏後批次順序不符：%+v", state)
+	}
+}
+
+// TestOrderTracker_FirstBatchGap 驗證第一次收到的批次前面的範圍記為缺漏，晚到的重送仍會套用
+func TestOrderTracker_FirstBatchGap(t *testing.T) {
+	ctx := context.Background()
+	store := &memOrderStore{states: make(map[orderKey]model.OrderState)}
+	tracker, err := newOrderTracker(config.OrderingConfig{Policy: config.OrderPolicyApply}, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tracker.applied(ctx, orderedEnv(5, 5, 40, 41, 50)); err != nil {
+		t.Fatal(err)
+	}
+	state := store.states[orderKey{"PH1", model.ReceiptKindDML, "cutting"}]
+	if state.LastSerialNoTo != 50 || state.Gaps != "0-40" {
+		t.Fatalf("批次順序不符：%+v", state)
+	}
+
+	late := orderedEnv(4, 4, 30, 31, 40)
+	if got, ok := tracker.await(ctx, nil, late, zap.NewNop().Sugar(), nil); !ok || got != orderLate {
+		t.Fatalf("重送的批次 4 預期 %d，實際 %d", orderLate, got)
+	}
+	if err := tracker.applied(ctx, late); err != nil {
+		t.Fatal(err)
+	}
+	if state := store.states[orderKey{"PH1", model.ReceiptKindDML, "cutting"}]; state.Gaps != "0-30" {
+		t.Fatalf("補上缺漏後批次順序不符：%+v", state)
+	}
+}
+
+// TestOrderTracker_Hold 驗證 hold 會等到前一個批次套用，以及逾時後仍會套用
+func TestOrderTracker_Hold(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop().Sugar()
+	store := &memOrderStore{states: make(map[orderKey]model.OrderState)}
+	tracker, err := newOrderTracker(config.OrderingConfig{Policy: config.OrderPolicyHold, HoldTimeout: 5 * time.Second}, store, []model.OrderState{
+		{FactoryID: "PH1", Kind: model.ReceiptKindDML, Stream: "cutting", LastSequence: 1, LastSerialNoTo: 20},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1. 批次 3 先被取走，等另一個 consumer 套用批次 2
+	done := make(chan orderVerdict, 1)
+	go func() {
+		v, _ := tracker.await(ctx, nil, orderedEnv(3, 3, 30, 31, 40), logger, func() bool { return false })
+		done <- v
+	}()
+	select {
+	case v := <-done:
+		t.Fatalf("前一個批次未套用時不應放行，實際 %d", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := tracker.applied(ctx, orderedEnv(2, 2, 20, 21, 30)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-done:
+		if v != orderInOrder {
+			t.Fatalf("批次 2 套用後預期依序，實際 %d", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("批次 2 套用後未放行批次 3")
+	}
+
+	// 2. 前一個批次一直沒到，逾時後放行
+	tracker.holdTimeout = 20 * time.Millisecond
+	if v, ok := tracker.await(ctx, nil, orderedEnv(5, 5, 50, 51, 60), logger, nil); !ok || v != orderGap {
+		t.Fatalf("逾時後預期以缺漏放行，實際 %d %v", v, ok)
+	}
+
+	// 3. 等待中收到結束信號，訊息重新排入
+	stop := make(chan struct{})
+	close(stop)
+	tracker.holdTimeout = time.Minute
+	if _, ok := tracker.await(ctx, stop, orderedEnv(5, 5, 50, 51, 60), logger, nil); ok {
+		t.Fatal("結束時應回傳 false")
+	}
+}
+
+// TestOrderTracker_HoldSoleConsumer 驗證 Queue 上只有一個 consumer 時不等待，缺漏的批次直接套用；
+// 批次依序或重複時不查詢 consumer 數量
+func TestOrderTracker_HoldSoleConsumer(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop().Sugar()
+	store := &memOrderStore{states: make(map[orderKey]model.OrderState)}
+	tracker, err := newOrderTracker(config.OrderingConfig{Policy: config.OrderPolicyHold, HoldTimeout: time.Minute}, store, []model.OrderState{
+		{FactoryID: "PH1", Kind: model.ReceiptKindDML, Stream: "cutting", LastSequence: 1, LastSerialNoTo: 20},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	asked := 0
+	sole := func() bool {
+		asked++
+		return true
+	}
+
+	if v, ok := tracker.await(ctx, nil, orderedEnv(2, 2, 20, 21, 30), logger, sole); !ok || v != orderInOrder || asked != 0 {
+		t.Fatalf("依序的批次預期直接放行且不查詢，實際 %d %v 查詢 %d 次", v, ok, asked)
+	}
+
+	done := make(chan orderVerdict, 1)
+	go func() {
+		v, _ := tracker.await(ctx, nil, orderedEnv(4, 4, 40, 41, 50), logger, sole)
+		done <- v
+	}()
+	select {
+	case v := <-done:
+		if v != orderGap || asked != 1 {
+			t.Fatalf("唯一的 consumer 預期以缺漏放行並查詢一次，實際 %d 查詢 %d 次", v, asked)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("唯一的 consumer 不應等待 hold_timeout")
+	}
+}
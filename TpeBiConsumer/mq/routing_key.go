@@ -1,6 +1,8 @@
 // routing_key.go
 package mq
 
+import "strings"
+
 // RoutingKey 是我們自訂的字串型別
 type RoutingKey string
 
@@ -16,3 +18,19 @@ var AllRoutingKeys = []RoutingKey{
 	RoutingKeyDDL,
 	RoutingKeyDML,
 }
+
+// DmlRoutingKey 回傳 DML stream 使用的 RoutingKey，預設 stream（空字串）沿用 RoutingKeyDML
+func DmlRoutingKey(stream string) RoutingKey {
+	if stream == "" {
+		return RoutingKeyDML
+	}
+	return RoutingKey("bi_dml." + stream + ".key")
+}
+
+// IsDmlRoutingKey 判斷 routingKey 是否為 DML（含各 stream）
+func IsDmlRoutingKey(routingKey string) bool {
+	if routingKey == string(RoutingKeyDML) {
+		return true
+	}
+	return strings.HasPrefix(routingKey, "bi_dml.") && strings.HasSuffix(routingKey, ".key")
+}
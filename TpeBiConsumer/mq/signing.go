@@ -0,0 +1,249 @@
+// 訊息簽章驗證與解密：拒絕沒有簽章、簽章不符或過期的訊息，規則與 FtyBiProducer 一致
+package mq
+
+import (
+	"TpeBiConsumer/config"
+	"TpeBiConsumer/model"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// 簽章與加密的 header 名稱，與 FtyBiProducer 一致
+const (
+	HeaderKeyID      = "x-key-id"
+	HeaderSignedAt   = "x-signed-at"
+	HeaderSignature  = "x-signature"
+	HeaderEncryption = "x-encryption"
+)
+
+// EncryptionAESGCM 為 Body 以 AES-256-GCM 加密，內容為 nonce + 密文
+const EncryptionAESGCM = "aes-256-gcm"
+
+// ReceiptMessageType 為回執的 AMQP Type，與 FtyBiProducer 一致
+const ReceiptMessageType = "receipt"
+
+// MinSigningKeyLen 為 HMAC 金鑰的最小長度（bytes）
+const MinSigningKeyLen = 32
+
+// DefaultSignatureMaxAge 為未設定 mq.signature_max_age 時的簽章有效期間
+const DefaultSignatureMaxAge = 24 * time.Hour
+
+// maxClockSkew 為容許 Producer 時鐘超前的時間
+const maxClockSkew = 5 * time.Minute
+
+// 簽章驗證失敗的原因，也作為 metrics 的 reason label
+var (
+	ErrUnsigned         = errors.New("訊息沒有簽章")
+	ErrBadSignature     = errors.New("訊息簽章不符")
+	ErrExpiredSignature = errors.New("訊息簽章已過期")
+)
+
+// signedHeaders 為列入簽章的 header，順序需與 FtyBiProducer 相同
+var signedHeaders = []string{
+	HeaderSchemaVersion,
+	HeaderFactoryID,
+	HeaderSourceServer,
+	HeaderSourceDatabase,
+	HeaderBatchID,
+	HeaderStream,
+	HeaderSerialNoFrom,
+	HeaderSerialNoTo,
+	HeaderItemCount,
+	HeaderUncompressed,
+	HeaderSequence,
+	HeaderPrevSerialNoTo,
+	HeaderSnapshotID,
+	HeaderKeyID,
+	HeaderSignedAt,
+	HeaderEncryption,
+}
+
+// signingKey 為解碼後的 config.SigningKey
+type signingKey struct {
+	factoryID string
+	key       []byte
+	aead      cipher.AEAD // 該廠未加密時為 nil
+}
+
+// verifier 依 key id 查金鑰驗證簽章並解密 Body
+type verifier struct {
+	keys          map[string]signingKey
+	allowUnsigned bool
+	maxAge        time.Duration
+}
+
+// newVerifier 依 mq.signing_keys 建立 verifier，未設定金鑰時回傳 nil（不驗證）
+func newVerifier(cfg config.MQConfig) (*verifier, error) {
+	if len(cfg.SigningKeys) == 0 {
+		return nil, nil
+	}
+	v := &verifier{
+		keys:          make(map[string]signingKey, len(cfg.SigningKeys)),
+		allowUnsigned: cfg.AllowUnsigned,
+		maxAge:        cfg.SignatureMaxAge,
+	}
+	if v.maxAge <= 0 {
+		v.maxAge = DefaultSignatureMaxAge
+	}
+	for _, k := range cfg.SigningKeys {
+		if _, dup := v.keys[k.KeyID]; dup {
+			return nil, fmt.Errorf("signing_keys 的 key_id %q 重複", k.KeyID)
+		}
+		key, err := base64.StdEncoding.DecodeString(k.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("signing_keys[%s].secret 不是合法的 base64：%w", k.KeyID, err)
+		}
+		if len(key) < MinSigningKeyLen {
+			return nil, fmt.Errorf("signing_keys[%s].secret 至少需 %d bytes，實際 %d bytes", k.KeyID, MinSigningKeyLen, len(key))
+		}
+		sk := signingKey{factoryID: k.FactoryID, key: key}
+		if k.EncryptionSecret != "" {
+			encKey, err := base64.StdEncoding.DecodeString(k.EncryptionSecret)
+			if err != nil {
+				return nil, fmt.Errorf("signing_keys[%s].encryption_secret 不是合法的 base64：%w", k.KeyID, err)
+			}
+			block, err := aes.NewCipher(encKey)
+			if err != nil || len(encKey) != 32 {
+				return nil, fmt.Errorf("signing_keys[%s].encryption_secret 必須是 32 bytes 的 AES-256 金鑰，實際 %d bytes", k.KeyID, len(encKey))
+			}
+			if sk.aead, err = cipher.NewGCM(block); err != nil {
+				return nil, fmt.Errorf("建立 AES-GCM 失敗：%w", err)
+			}
+		}
+		v.keys[k.KeyID] = sk
+	}
+	return v, nil
+}
+
+// open 驗證訊息簽章並回傳解密後（仍可能是壓縮）的 Body；v 為 nil 時不驗證。
+// 沒有簽章的訊息只在 mq.allow_unsigned 開啟時接受
+func (v *verifier) open(d amqp.Delivery, env model.Envelope, now time.Time) ([]byte, error) {
+	encryption, _ := d.Headers[HeaderEncryption].(string)
+	if v == nil {
+		if encryption != "" {
+			return nil, fmt.Errorf("%w：Body 已加密（%s），但未設定 signing_keys", ErrBadSignature, encryption)
+		}
+		return d.Body, nil
+	}
+
+	// 1. 沒有簽章
+	signature, _ := d.Headers[HeaderSignature].(string)
+	if signature == "" {
+		if v.allowUnsigned && encryption == "" {
+			return d.Body, nil
+		}
+		return nil, ErrUnsigned
+	}
+
+	// 2. 金鑰需存在，且屬於訊息宣稱的工廠
+	keyID, _ := d.Headers[HeaderKeyID].(string)
+	k, ok := v.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w：未知的 key id %q", ErrBadSignature, keyID)
+	}
+	if k.factoryID != env.FactoryID {
+		return nil, fmt.Errorf("%w：key id %q 屬於工廠 %s，訊息來自 %s", ErrBadSignature, keyID, k.factoryID, env.FactoryID)
+	}
+
+	// 3. 比對 HMAC
+	got, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w：簽章不是合法的 base64", ErrBadSignature)
+	}
+	if !hmac.Equal(got, sign(k.key, d.MessageId, d.AppId, d.Type, d.ContentEncoding, d.Headers, d.Body)) {
+		return nil, ErrBadSignature
+	}
+
+	// 4. 簽章時間需在有效期間內
+	signedAt, err := headerInt(d.Headers, HeaderSignedAt)
+	if err != nil {
+		return nil, fmt.Errorf("%w：%v", ErrBadSignature, err)
+	}
+	at := time.Unix(signedAt, 0)
+	if age := now.Sub(at); age > v.maxAge {
+		return nil, fmt.Errorf("%w：簽章於 %s，已超過 %s", ErrExpiredSignature, at.Format(time.RFC3339), v.maxAge)
+	}
+	if at.Sub(now) > maxClockSkew {
+		return nil, fmt.Errorf("%w：簽章時間 %s 晚於目前時間", ErrExpiredSignature, at.Format(time.RFC3339))
+	}
+
+	// 5. 解密
+	switch encryption {
+	case "":
+		return d.Body, nil
+	case EncryptionAESGCM:
+		if k.aead == nil {
+			return nil, fmt.Errorf("%w：key id %q 未設定 encryption_secret", ErrBadSignature, keyID)
+		}
+		n := k.aead.NonceSize()
+		if len(d.Body) < n {
+			return nil, fmt.Errorf("%w：加密內容過短", ErrCorruptPayload)
+		}
+		body, err := k.aead.Open(nil, d.Body[:n], d.Body[n:], nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w：解密失敗：%v", ErrBadSignature, err)
+		}
+		return body, nil
+	default:
+		return nil, fmt.Errorf("%w：不支援的加密方式 %q", ErrInvalidEnvelope, encryption)
+	}
+}
+
+// sealReceipt 以訊息所屬工廠的金鑰簽章回執，FtyBiProducer 以自己的 signing_secret 驗證：
+// 優先使用原訊息的 key id（金鑰輪替期間與 Producer 目前的金鑰一致），否則使用該工廠任一把金鑰；
+// v 為 nil 或沒有該工廠的金鑰時不簽章
+func (v *verifier) sealReceipt(p *amqp.Publishing, factoryID, keyID string, now time.Time) {
+	if v == nil {
+		return
+	}
+	k, ok := v.keys[keyID]
+	if !ok || k.factoryID != factoryID {
+		ok = false
+		ids := make([]string, 0, len(v.keys))
+		for id := range v.keys {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			if v.keys[id].factoryID == factoryID {
+				keyID, k, ok = id, v.keys[id], true
+				break
+			}
+		}
+	}
+	if !ok {
+		return
+	}
+	p.Headers[HeaderKeyID] = keyID
+	p.Headers[HeaderSignedAt] = now.Unix()
+	p.Headers[HeaderSignature] = base64.StdEncoding.EncodeToString(sign(k.key, p.MessageId, p.AppId, p.Type, p.ContentEncoding, p.Headers, p.Body))
+}
+
+// sign 計算訊息的 HMAC-SHA256，與 FtyBiProducer 的規則相同
+func sign(key []byte, messageID, appID, msgType, contentEncoding string, headers amqp.Table, body []byte) []byte {
+	var b strings.Builder
+	b.WriteString("v1\n")
+	fmt.Fprintf(&b, "message-id=%s\napp-id=%s\ntype=%s\ncontent-encoding=%s\n", messageID, appID, msgType, contentEncoding)
+	for _, h := range signedHeaders {
+		if v, ok := headers[h]; ok {
+			fmt.Fprintf(&b, "%s=%v\n", h, v)
+		}
+	}
+	sum := sha256.Sum256(body)
+	fmt.Fprintf(&b, "body-sha256=%s\n", hex.EncodeToString(sum[:]))
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(b.String()))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,127 @@
+// 設定檔熱重載：設定檔變更時重新載入，套用 consumer 數量與 log 級別，需重新連線的設定記錄後待重新啟動
+package main
+
+import (
+	"TpeBiConsumer/config"
+	mq "TpeBiConsumer/mq"
+	scilog "TpeBiConsumer/scilog"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// consumerPool 管理消費主 Queue 的 consumer，可依 consumer_count 增減
+type consumerPool struct {
+	mu         sync.Mutex
+	ctx        context.Context
+	client     *mq.MQClient
+	newHandler func(name string) mq.HandlerFunc
+	sugar      *zap.SugaredLogger
+	consumers  []*mq.Consumer
+	stopped    []*mq.Consumer // 已停止但關機時仍需等待處理中的訊息
+	next       int            // 下一個 consumer 的編號
+}
+
+// Len 回傳執行中的 consumer 數量
+func (p *consumerPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.consumers)
+}
+
+// Resize 把 consumer 增減到 n 個：增加時啟動新的 consumer，減少時停止最後啟動的，
+// 被停止的 consumer 會先處理完手上的訊息
+func (p *consumerPool) Resize(n int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// 關機中不再調整，避免 Wait 之後才啟動的 consumer
+	if p.ctx.Err() != nil {
+		return nil
+	}
+	for len(p.consumers) < n {
+		name := strconv.Itoa(p.next)
+		c := mq.NewConsumer(p.client, p.sugar)
+		if c == nil {
+			return fmt.Errorf("建立 Consumer[%s] 失敗", name)
+		}
+		if err := c.Start(p.ctx, p.newHandler(name)); err != nil {
+			return fmt.Errorf("啟動 Consumer[%s] 失敗：%w", name, err)
+		}
+		p.sugar.Infof("Consumer[%s] 已啟動", name)
+		p.consumers = append(p.consumers, c)
+		p.next++
+	}
+	for len(p.consumers) > n {
+		last := len(p.consumers) - 1
+		c := p.consumers[last]
+		c.Stop()
+		p.consumers = p.consumers[:last]
+		p.stopped = append(p.stopped, c)
+		p.sugar.Infof("已停止一個 Consumer，剩 %d 個", len(p.consumers))
+	}
+	return nil
+}
+
+// Wait 等待所有 consumer（含已停止的）結束
+func (p *consumerPool) Wait() {
+	p.mu.Lock()
+	all := append(append([]*mq.Consumer{}, p.consumers...), p.stopped...)
+	p.mu.Unlock()
+	for _, c := range all {
+		c.Wait()
+	}
+}
+
+// configReloader 在設定檔變更時重新載入，只套用可即時變更的設定
+type configReloader struct {
+	mu     sync.Mutex
+	files  []string
+	cfg    config.Config // 目前生效的設定
+	loaded config.Config // 最後一次載入的設定，需重新啟動的差異只在與上一次不同時回報
+	pool   *consumerPool
+	sugar  *zap.SugaredLogger
+}
+
+// reload 重新載入設定檔；載入或驗證失敗時維持目前的設定
+func (r *configReloader) reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// 1. 載入並驗證
+	next, err := config.LoadConfig(r.files...)
+	if err != nil {
+		r.sugar.Errorf("設定檔已變更但載入失敗，維持目前設定：%v", err)
+		return
+	}
+	changes := config.Diff(r.loaded, *next)
+	r.loaded = *next
+	if changes.Empty() {
+		return
+	}
+
+	// 2. 套用可即時變更的設定
+	if next.LogLevel != r.cfg.LogLevel {
+		if err := scilog.SetLevel(next.LogLevel); err != nil {
+			r.sugar.Errorf("套用 log_level 失敗：%v", err)
+		}
+	}
+	if next.ConsumerCount != r.cfg.ConsumerCount {
+		if err := r.pool.Resize(next.ConsumerCount); err != nil {
+			r.sugar.Errorf("調整 consumer 數量為 %d 失敗，目前 %d 個：%v", next.ConsumerCount, r.pool.Len(), err)
+		}
+	}
+	applied := r.cfg.WithReloadable(*next)
+	applied.ConsumerCount = r.pool.Len()
+	r.cfg = applied
+
+	// 3. 記錄
+	if len(changes.Live) > 0 {
+		r.sugar.Infof("設定檔已重新載入，已套用：%v", changes.Live)
+	}
+	if len(changes.Deferred) > 0 {
+		r.sugar.Warnf("下列設定需重新連線，已略過，重新啟動後才會生效：%v", changes.Deferred)
+	}
+}
@@ -0,0 +1,44 @@
+// 批次順序狀態的保存
+package service
+
+import (
+	model "TpeBiConsumer/model"
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OrderStore 以 MessageOrderState 資料表保存各 stream 的批次順序，供 mq 在重新啟動後接續判斷
+type OrderStore struct {
+	db *gorm.DB
+}
+
+// NewOrderStore 建立 OrderStore，並確保 MessageOrderState 資料表存在
+func NewOrderStore(db *gorm.DB) (*OrderStore, error) {
+	if err := db.AutoMigrate(&model.OrderState{}); err != nil {
+		return nil, fmt.Errorf("建立 MessageOrderState 失敗：%w", err)
+	}
+	return &OrderStore{db: db}, nil
+}
+
+// LoadOrderStates 讀取所有 stream 的批次順序
+func (s *OrderStore) LoadOrderStates(ctx context.Context) ([]model.OrderState, error) {
+	var states []model.OrderState
+	if err := s.db.WithContext(ctx).Find(&states).Error; err != nil {
+		return nil, fmt.Errorf("讀取 MessageOrderState 失敗：%w", err)
+	}
+	return states, nil
+}
+
+// SaveOrderState 新增或更新一個 stream 的批次順序
+func (s *OrderStore) SaveOrderState(ctx context.Context, state model.OrderState) error {
+	err := s.db.WithContext(ctx).
+		Clauses(clause.OnConflict{UpdateAll: true}).
+		Create(&state).Error
+	if err != nil {
+		return fmt.Errorf("更新 MessageOrderState 失敗：%w", err)
+	}
+	return nil
+}
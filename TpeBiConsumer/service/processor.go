@@ -5,6 +5,7 @@ import (
 	model "TpeBiConsumer/model"
 	"context"
 	"crypto/sha1"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
@@ -30,6 +31,8 @@ type Processor struct {
 	// 已執行過的 DDL 指令，用於避免重複執行
 	executedDDL map[string]struct{}
 	ddlMu       sync.RWMutex
+	// 建立或更換 staging 時互斥，避免多個 consumer 同時處理同一個完整同步的 Start 與 Chunk
+	snapshotMu sync.Mutex
 }
 
 // 建立只需要 db 的 Processor
@@ -39,8 +42,8 @@ func NewProcessor(db *gorm.DB) *Processor {
 		colTypeCache: make(map[string][]gorm.ColumnType),
 		executedDDL:  make(map[string]struct{}),
 	}
-	// 確保 ExecutedDDL 資料表存在
-	_ = db.AutoMigrate(&model.ExecutedDDL{})
+	// 確保 ExecutedDDL 與完整同步的進度資料表存在
+	_ = db.AutoMigrate(&model.ExecutedDDL{}, &model.SnapshotLoad{}, &model.SnapshotChunk{}, &model.SnapshotHeldBatch{})
 	return p
 }
 
@@ -57,11 +60,14 @@ func (p *Processor) getColumnTypesOnce(ctx context.Context, tableName string) ([
 }
 
 // convertValue 將 raw 任意型別轉成符合 ct（gorm.ColumnType）所對應的 Go 原生型別
-
+// 型別化的值（見 applyTypes）依來源型別無損還原，其餘沿用 JSON 解析後的型別轉換
 func convertValue(raw interface{}, ct gorm.ColumnType) (interface{}, error) {
 	if raw == nil {
 		return nil, nil
 	}
+	if tv, ok := raw.(typedValue); ok {
+		return decodeTyped(tv, ct)
+	}
 
 	dbType := strings.ToUpper(ct.DatabaseTypeName())
 
@@ -173,58 +179,70 @@ func convertValue(raw interface{}, ct gorm.ColumnType) (interface{}, error) {
 	}
 }
 
-// batchUpsertWithMerge：在同一條 *mssql.Conn 底下完成
+// batchUpsertWithMerge 在一條專屬連線的 transaction 內以 mergeRows 把資料 MERGE 進 tableName，回傳影響的筆數
+func (p *Processor) batchUpsertWithMerge(ctx context.Context, tableName string, rawDatas []map[string]interface{}) (int64, error) {
+	var affected int64
+	err := p.withBulkTx(ctx, func(tx *gorm.DB, conn *mssql.Conn) error {
+		var err error
+		affected, err = p.mergeRows(ctx, tx, conn, tableName, rawDatas)
+		return err
+	})
+	return affected, err
+}
+
+// withBulkTx 取得一條專屬連線並在其上開啟 transaction：tx 與 BulkCopy 用的 conn 是同一個 session，
+// temp table、BulkCopy 與其他異動都在同一個 transaction 內，fc 回傳錯誤時整個 rollback
+func (p *Processor) withBulkTx(ctx context.Context, fc func(tx *gorm.DB, conn *mssql.Conn) error) error {
+	return p.db.WithContext(ctx).Connection(func(db *gorm.DB) error {
+		// 1. 取得這條連線底下的 *mssql.Conn，以利後續 BulkCopy
+		sqlConn, ok := db.Statement.ConnPool.(*sql.Conn)
+		if !ok {
+			return fmt.Errorf("預期連線是 *sql.Conn，但實際是 %T", db.Statement.ConnPool)
+		}
+		//    其他驅動（例如測試用的 sqlmock）沒有 BulkCopy，conn 為 nil，mergeRows 會回傳錯誤
+		var mssqlConn *mssql.Conn
+		if err := sqlConn.Raw(func(driverConn interface{}) error {
+			mssqlConn, _ = driverConn.(*mssql.Conn)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("從 *sql.Conn 取得 *mssql.Conn 失敗: %w", err)
+		}
+
+		// 2. 在同一條連線上開啟 transaction
+		return db.Transaction(func(tx *gorm.DB) error {
+			return fc(tx, mssqlConn)
+		})
+	})
+}
+
+// mergeRows：在 withBulkTx 的 transaction 內完成
 // 1) 建 temp table (#…)
 // 2) BulkCopy 寫入 temp table
 // 3) MERGE 回正式 table
 // 4) DROP temp table
-func (p *Processor) batchUpsertWithMerge(ctx context.Context, tableName string, rawDatas []map[string]interface{}) error {
-	// 1. 先從 GORM 拿到 *sql.DB
-	sqlDB, err := p.db.DB()
-	if err != nil {
-		return fmt.Errorf("無法從 GORM 拿到 *sql.DB: %w", err)
-	}
-
-	// 2. 要求一條專屬 *sql.Conn，保證 temp table 存活在這個 session 裡
-	sqlConn, err := sqlDB.Conn(ctx)
-	if err != nil {
-		return fmt.Errorf("建立 *sql.Conn 失敗: %w", err)
+// 回傳 MERGE 影響的筆數
+func (p *Processor) mergeRows(ctx context.Context, tx *gorm.DB, conn *mssql.Conn, tableName string, rawDatas []map[string]interface{}) (int64, error) {
+	// 1. 如果 rawDatas 為空，直接結束
+	if len(rawDatas) == 0 {
+		return 0, nil
 	}
-	defer sqlConn.Close()
-
-	// 3. 把 *sql.Conn 轉成 *mssql.Conn，以利後續 BulkCopy、ExecContext 等操作
-	var mssqlConn *mssql.Conn
-	if err := sqlConn.Raw(func(driverConn interface{}) error {
-		c, ok := driverConn.(*mssql.Conn)
-		if !ok {
-			return fmt.Errorf("預期 driverConn 是 *mssql.Conn，但實際是 %T", driverConn)
-		}
-		mssqlConn = c
-		return nil
-	}); err != nil {
-		return fmt.Errorf("從 *sql.Conn 取得 *mssql.Conn 失敗: %w", err)
+	if conn == nil {
+		return 0, fmt.Errorf("連線不是 SQL Server，無法以 BulkCopy 寫入 %s", tableName)
 	}
 
-	// 4. 在同一個 mssqlConn session 上，用 ExecContext 建立 temp table
+	// 2. 在同一個 session 裡建立 temp table
 	rawUUID := uuid.New().String()
 	uid := strings.ReplaceAll(rawUUID, "-", "")
 	tempTable := fmt.Sprintf("#%s_Stagin_%s", tableName, uid)
 	createTempSQL := fmt.Sprintf("SELECT TOP 0 * INTO %s FROM %s;", tempTable, tableName)
-	if _, err := sqlConn.ExecContext(ctx, createTempSQL); err != nil {
-		return fmt.Errorf("建立 temp table %s 失敗: %w", tempTable, err)
-	}
-	// 5. 如果 rawDatas 為空，直接 drop temp table 並結束
-	if len(rawDatas) == 0 {
-		if _, err := sqlConn.ExecContext(ctx, fmt.Sprintf("DROP TABLE %s;", tempTable)); err != nil {
-			return fmt.Errorf("刪除 temp table %s 失敗: %w", tempTable, err)
-		}
-		return nil
+	if err := tx.Exec(createTempSQL).Error; err != nil {
+		return 0, fmt.Errorf("建立 temp table %s 失敗: %w", tempTable, err)
 	}
 
-	// 6. 準備 BulkCopy：先取得正式表 (tableName) 的欄位清單
+	// 3. 準備 BulkCopy：先取得正式表 (tableName) 的欄位清單
 	columnTypes, err := p.getColumnTypesOnce(ctx, tableName)
 	if err != nil {
-		return fmt.Errorf("取得 %s 欄位資訊失敗: %w", tableName, err)
+		return 0, fmt.Errorf("取得 %s 欄位資訊失敗: %w", tableName, err)
 	}
 	sort.Slice(columnTypes, func(i, j int) bool {
 		return columnTypes[i].Name() < columnTypes[j].Name()
@@ -233,17 +251,15 @@ func (p *Processor) batchUpsertWithMerge(ctx context.Context, tableName string,
 	// 排除無法 INSERT 的自動遞增欄位（例如 IDENTITY）
 	cols := make([]string, 0, len(columnTypes))
 	colTypeMap := make(map[string]gorm.ColumnType, len(columnTypes))
-	skipCols := make(map[string]struct{})
 	for _, ct := range columnTypes {
 		if isAI, ok := ct.AutoIncrement(); ok && isAI {
-			skipCols[ct.Name()] = struct{}{}
 			continue
 		}
 		cols = append(cols, ct.Name())
 		colTypeMap[ct.Name()] = ct
 	}
 
-	// 7. 把 rawDatas 轉成 [][]interface{} 以供 BulkCopy 使用
+	// 4. 把 rawDatas 轉成 [][]interface{} 以供 BulkCopy 使用
 	convertedRows := make([][]interface{}, 0, len(rawDatas))
 	for rowIdx, row := range rawDatas {
 		vals := make([]interface{}, len(cols))
@@ -256,7 +272,7 @@ func (p *Processor) batchUpsertWithMerge(ctx context.Context, tableName string,
 			}
 			conv, convErr := convertValue(rawVal, colTypeMap[col])
 			if convErr != nil {
-				return fmt.Errorf("第 %d 筆，欄位 %s 轉換失敗: %w", rowIdx, col, convErr)
+				return 0, fmt.Errorf("第 %d 筆，欄位 %s 轉換失敗: %w", rowIdx, col, convErr)
 			}
 			if conv != nil {
 				anyValue = true
@@ -268,21 +284,37 @@ func (p *Processor) batchUpsertWithMerge(ctx context.Context, tableName string,
 		}
 	}
 
-	// 8. 建立 BulkCopy 物件，把資料寫進 tempTable
-	bulk := mssqlConn.CreateBulk(tempTable, cols)
+	// 5. 建立 BulkCopy 物件，把資料寫進 tempTable
+	bulk := conn.CreateBulkContext(ctx, tempTable, cols)
 	for idx, rowVals := range convertedRows {
 		if err := bulk.AddRow(rowVals); err != nil {
-			return fmt.Errorf(" Bulk AddRow 第 %d 筆失敗: %w", idx, err)
+			return 0, fmt.Errorf(" Bulk AddRow 第 %d 筆失敗: %w", idx, err)
 		}
 	}
 	if _, err := bulk.Done(); err != nil {
-		return fmt.Errorf(" Bulk Done 失敗: %w", err)
+		return 0, fmt.Errorf(" Bulk Done 失敗: %w", err)
+	}
+
+	// 6. 組合 MERGE 語法並執行
+	res := tx.Exec(buildMergeSQL(tableName, tempTable, columnTypes))
+	if res.Error != nil {
+		return 0, fmt.Errorf("執行 MERGE 失敗: %w", res.Error)
 	}
 
-	// 9. 組合 MERGE 語法並執行
+	// 7. Merge 完後，DROP 掉這張 temp table
+	dropSQL := fmt.Sprintf("DROP TABLE %s;", tempTable)
+	if err := tx.Exec(dropSQL).Error; err != nil {
+		return 0, fmt.Errorf("DROP temp table %s 失敗: %w", tempTable, err)
+	}
+
+	return res.RowsAffected, nil
+}
+
+// buildMergeSQL 組出以主鍵把 source 合併到 target 的 MERGE：相同主鍵更新非主鍵欄位，其餘新增；IDENTITY 欄位不寫入
+func buildMergeSQL(target, source string, columnTypes []gorm.ColumnType) string {
 	var allCols, keyCols []string
 	for _, ct := range columnTypes {
-		if _, skip := skipCols[ct.Name()]; skip {
+		if isAI, ok := ct.AutoIncrement(); ok && isAI {
 			continue
 		}
 		allCols = append(allCols, ct.Name())
@@ -293,14 +325,14 @@ func (p *Processor) batchUpsertWithMerge(ctx context.Context, tableName string,
 	sort.Strings(allCols)
 	sort.Strings(keyCols)
 
-	// 9.1 ON 條件：T.PK = S.PK
+	// 1. ON 條件：T.PK = S.PK
 	var joinConds []string
 	for _, k := range keyCols {
 		joinConds = append(joinConds, fmt.Sprintf("T.%s = S.%s", k, k))
 	}
 	onClause := strings.Join(joinConds, " AND ")
 
-	// 9.2 UPDATE 子句：非 PK 欄位全部更新
+	// 2. UPDATE 子句：非 PK 欄位全部更新
 	var updateCols []string
 	for _, col := range allCols {
 		isPrimary := false
@@ -317,7 +349,7 @@ func (p *Processor) batchUpsertWithMerge(ctx context.Context, tableName string,
 	}
 	updateClause := strings.Join(updateCols, ", ")
 
-	// 9.3 INSERT 欄位列表與 VALUES 列表
+	// 3. INSERT 欄位列表與 VALUES 列表
 	insertCols := strings.Join(allCols, ", ")
 	var insertVals []string
 	for _, col := range allCols {
@@ -325,7 +357,7 @@ func (p *Processor) batchUpsertWithMerge(ctx context.Context, tableName string,
 	}
 	insertValsClause := strings.Join(insertVals, ", ")
 
-	mergeSQL := fmt.Sprintf(`
+	return fmt.Sprintf(`
 MERGE INTO %s AS T
 USING %s AS S
 ON %s
@@ -333,22 +365,11 @@ WHEN MATCHED THEN
     UPDATE SET %s
 WHEN NOT MATCHED THEN
     INSERT (%s) VALUES (%s);`,
-		tableName, tempTable,
+		target, source,
 		onClause,
 		updateClause,
 		insertCols, insertValsClause,
 	)
-	if _, err := sqlConn.ExecContext(ctx, mergeSQL); err != nil {
-		return fmt.Errorf("執行 MERGE 失敗: %w", err)
-	}
-
-	// 10. Merge 完後，DROP 掉這張 temp table
-	dropSQL := fmt.Sprintf("DROP TABLE %s;", tempTable)
-	if _, err := sqlConn.ExecContext(ctx, dropSQL); err != nil {
-		return fmt.Errorf("DROP temp table %s 失敗: %w", tempTable, err)
-	}
-
-	return nil
 }
 
 func sanitizeEscape(raw string) string {
@@ -358,27 +379,182 @@ func sanitizeEscape(raw string) string {
 	return re.ReplaceAllString(raw, `\\\\$1`)
 }
 
-func (p *Processor) DmlLogProcess(ctx context.Context, body []byte) error {
+func (p *Processor) DmlLogProcess(ctx context.Context, env model.Envelope, body []byte) (model.ApplyResult, error) {
+	var result model.ApplyResult
+
 	// 解析 JSON
 	var msg model.DmlMessage
 	if err := sonic.Unmarshal(body, &msg); err != nil {
-		return fmt.Errorf("解析 DdlMessage 失敗: %w", err)
+		return result, fmt.Errorf("解析 DdlMessage 失敗: %w", err)
+	}
+	result.BatchID = msg.BatchID
+
+	// 完整同步的訊息載入 staging，不直接套用到正式資料表
+	if msg.Snapshot != nil {
+		return p.snapshotProcess(ctx, env, msg)
+	}
+
+	entries, err := parseDmlEntries(msg.JSONList)
+	if err != nil {
+		return result, err
+	}
+
+	// 已套用的完整同步略過 Watermark 以前的異動；逾時未套用的完整同步改為 Failed
+	entries, skipped, err := p.filterSnapshotEntries(ctx, env, entries)
+	if err != nil {
+		return result, err
+	}
+
+	// 完整同步載入中的資料表：該表的異動暫存，完整同步結束時再依序套用；其他資料表在同一個 transaction 內照常套用
+	var held string
+	err = p.withBulkTx(ctx, func(tx *gorm.DB, conn *mssql.Conn) error {
+		var rest []dmlEntry
+		var err error
+		rest, held, err = p.holdSnapshotEntries(tx, env, msg.BatchID, entries)
+		if err != nil {
+			return err
+		}
+		return p.applyDmlEntries(ctx, tx, conn, rest, &result)
+	})
+	if err != nil {
+		// 整個 transaction 已 rollback，不回報部分筆數
+		result.RowsDeleted, result.RowsUpserted = 0, 0
+		return result, err
+	}
+	result.Skipped = joinNotes(skipped, held)
+	return result, nil
+}
+
+// applyDmlEntries 在 tx 內依訊息順序套用；連續的同表 Insert 合併成一次 MERGE，Action 或資料表改變時先套用前一組
+func (p *Processor) applyDmlEntries(ctx context.Context, tx *gorm.DB, conn *mssql.Conn, entries []dmlEntry, result *model.ApplyResult) error {
+	steps, err := groupDmlSteps(entries)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		switch step.Action {
+		case "Delete":
+			affected, err := p.applyDelete(ctx, tx, step.TableName, step.Rows[0])
+			if err != nil {
+				return fmt.Errorf("刪除失敗 idx=%d, table=%s: %w", step.Index, step.TableName, err)
+			}
+			result.RowsDeleted += affected
+		case "Update":
+			affected, err := p.applyUpdate(ctx, tx, step.TableName, step.Before, step.Rows[0])
+			if err != nil {
+				return fmt.Errorf("更新失敗 idx=%d, table=%s: %w", step.Index, step.TableName, err)
+			}
+			result.RowsUpserted += affected
+		case "Insert":
+			datas := make([]map[string]interface{}, len(step.Rows))
+			for i, raw := range step.Rows {
+				datas[i] = rowData(raw)
+			}
+			affected, err := p.mergeRows(ctx, tx, conn, step.TableName, datas)
+			if err != nil {
+				return fmt.Errorf(" Upsert 失敗 (table=%s): %w", step.TableName, err)
+			}
+			result.RowsUpserted += affected
+		}
+	}
+	return nil
+}
+
+// dmlStep 為依訊息順序套用的一個步驟：Delete、Update 各一筆，連續的同表 Insert 合併為一組
+type dmlStep struct {
+	Action    string
+	TableName string
+	Index     int                      // 第一筆在 JSONList 中的位置，錯誤訊息用
+	Before    map[string]interface{}   // Update 的舊主鍵
+	Rows      []map[string]interface{} // 各筆的 Data（含 TableName）
+}
+
+// groupDmlSteps 依訊息順序把 entries 分成步驟，未知的 Action 略過
+func groupDmlSteps(entries []dmlEntry) ([]dmlStep, error) {
+	var steps []dmlStep
+	for idx, e := range entries {
+		switch e.Action {
+		case "Delete", "Update", "Insert":
+		default:
+			// 忽略其他 Action
+			continue
+		}
+		tableName, ok := e.Data["TableName"].(string)
+		if !ok || tableName == "" {
+			return nil, fmt.Errorf("第 %d 筆 %s 未指定 TableName", idx, e.Action)
+		}
+		if last := len(steps) - 1; e.Action == "Insert" && last >= 0 &&
+			steps[last].Action == "Insert" && steps[last].TableName == tableName {
+			steps[last].Rows = append(steps[last].Rows, e.Data)
+			continue
+		}
+		steps = append(steps, dmlStep{
+			Action:    e.Action,
+			TableName: tableName,
+			Index:     idx,
+			Before:    e.Before,
+			Rows:      []map[string]interface{}{e.Data},
+		})
+	}
+	return steps, nil
+}
+
+// applyDelete 依主鍵刪除一筆資料列（利用 p.getColumnTypesOnce 取 primary key）
+func (p *Processor) applyDelete(ctx context.Context, tx *gorm.DB, tableName string, raw map[string]interface{}) (int64, error) {
+	// ① 從緩存或第一次查詢取得該表的 ColumnTypes
+	columnTypes, err := p.getColumnTypesOnce(ctx, tableName)
+	if err != nil {
+		return 0, fmt.Errorf("取得 %s 欄位資訊失敗: %w", tableName, err)
+	}
+
+	// ② 從 columnTypes 裡面篩出所有 PrimaryKey()
+	cond := make(map[string]interface{})
+	for _, ct := range columnTypes {
+		isPK, _ := ct.PrimaryKey()
+		if !isPK {
+			continue
+		}
+		pkName := ct.Name()
+		if val, exists := raw[pkName]; exists {
+			conv, err := convertValue(val, ct)
+			if err != nil {
+				return 0, fmt.Errorf("主鍵 %s 轉換失敗: %w", pkName, err)
+			}
+			cond[pkName] = conv
+		}
+	}
+	if len(cond) == 0 {
+		return 0, fmt.Errorf("Delete 找不到主鍵欄位或對應資料 (table=%s)", tableName)
 	}
 
-	// 定義一個簡單的結構來存放 Action + Data，解析各筆 JSON 物件
-	type dmlEntry struct {
-		Action string                 `json:"Action"`
-		Data   map[string]interface{} `json:"Data"`
+	// ③ 執行刪除
+	res := tx.Table(tableName).Where(cond).Delete(nil)
+	if res.Error != nil {
+		return 0, res.Error
 	}
+	return res.RowsAffected, nil
+}
+
+// dmlEntry 為 DmlLog.JSON 的一筆 Action + Data
+type dmlEntry struct {
+	Action string                 `json:"Action"`
+	Before map[string]interface{} `json:"Before"` // Update 才有：舊主鍵
+	Data   map[string]interface{} `json:"Data"`
+	Types  map[string]string      `json:"Types"` // 以字串編碼的欄位 -> 來源型別，舊版訊息沒有
+	raw    string                 // 解析的原始字串，暫存到 SnapshotHeldBatch 時使用
+}
 
+// parseDmlEntries 解析 JSONList 的每一筆，型別化的欄位包裝成 typedValue
+func parseDmlEntries(jsonList []string) ([]dmlEntry, error) {
 	// 把 JSONList 裡的每筆字串都解成 dmlEntry
 	var entries []dmlEntry
-	for idx, raw := range msg.JSONList {
+	for idx, raw := range jsonList {
 		var e dmlEntry
 		err := sonic.Unmarshal([]byte(raw), &e)
 
 		if err == nil {
 			// 直接解析成功，存下結果
+			e.raw = raw
 			entries = append(entries, e)
 			continue
 		}
@@ -386,13 +562,13 @@ func (p *Processor) DmlLogProcess(ctx context.Context, body []byte) error {
 		// 2) 如果錯誤訊息裡面包含「invalid escape」或類似，就做 sanitize，再重試
 		if _, ok := err.(*json.UnmarshalTypeError); ok {
 			// 如果是型別不符，可能不是跳脫字元問題，可直接回傳
-			return fmt.Errorf("第 %d 筆 JSON 型別錯誤: %w", idx, err)
+			return nil, fmt.Errorf("第 %d 筆 JSON 型別錯誤: %w", idx, err)
 		}
 		// 判別錯誤訊息裡面是否有「invalid escape」這段字串（可能依 JSON library 而定）
 		msg := err.Error()
 		if !regexp.MustCompile(`invalid escape`).MatchString(msg) {
 			// 如果不是跳脫字元錯誤，就直接回傳
-			return fmt.Errorf("第 %d 筆 JSON 解析失敗: %w", idx, err)
+			return nil, fmt.Errorf("第 %d 筆 JSON 解析失敗: %w", idx, err)
 		}
 
 		// 3) 要 sanitize 了
@@ -406,146 +582,133 @@ func (p *Processor) DmlLogProcess(ctx context.Context, body []byte) error {
 			continue
 		}
 		// sanitize 成功，再把結果存進 entries
+		e2.raw = sanitized
 		entries = append(entries, e2)
 	}
 
-	// 分類： Delete 、 Insert
-	var deletes, inserts []dmlEntry
-
-	for _, e := range entries {
-		switch e.Action {
-		case "Delete":
-			deletes = append(deletes, e)
-		case "Insert":
-			inserts = append(inserts, e)
-		default:
-			// 忽略其他 Action
+	// 型別化的欄位包裝成 typedValue，寫入前依目的欄位型別還原
+	for idx, e := range entries {
+		if err := applyTypes(e.Data, e.Types); err != nil {
+			return nil, fmt.Errorf("第 %d 筆 Types 不合法: %w", idx, err)
+		}
+		if err := applyTypes(e.Before, e.Types); err != nil {
+			return nil, fmt.Errorf("第 %d 筆 Types 不合法: %w", idx, err)
 		}
 	}
 
-	/*------------------ Delete Start-----------------------*/
-	// 開啟 transaction
-	tx := p.db.WithContext(ctx).Begin()
-	if err := tx.Error; err != nil {
-		return fmt.Errorf("開啟 transaction 失敗：%w", err)
-	}
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-			panic(r)
-		} else if tx.Error != nil {
-			// 如果中途有錯誤（tx.Error 被設過），就 rollback
-			tx.Rollback()
-		}
-	}()
+	return entries, nil
+}
 
-	// 執行 Delete (利用 p.getColumnTypesOnce 取 primary key )
-	for idx, e := range deletes {
-		tableName, ok := e.Data["TableName"].(string)
-		if !ok || tableName == "" {
-			return fmt.Errorf("第 %d 筆 Delete 未指定 TableName", idx)
+// rowData 把 "TableName" 欄位移除，其他欄位都留下來，字串中的 \n 還原為換行
+func rowData(raw map[string]interface{}) map[string]interface{} {
+	data := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		if k == "TableName" {
+			continue
 		}
-
-		// ① 從緩存或第一次查詢取得該表的 ColumnTypes
-		columnTypes, err := p.getColumnTypesOnce(ctx, tableName)
-		if err != nil {
-			tx.Rollback()
-			return fmt.Errorf("取得 %s 欄位資訊失敗: %w", tableName, err)
+		if str, ok := v.(string); ok {
+			data[k] = strings.ReplaceAll(str, `\n`, "\r\n")
+		} else {
+			data[k] = v
 		}
+	}
+	return data
+}
 
-		// ② 從 columnTypes 裡面篩出所有 PrimaryKey()
-		cond := make(map[string]interface{})
-		for _, ct := range columnTypes {
-			isPK, _ := ct.PrimaryKey()
-			if !isPK {
-				continue
-			}
-			pkName := ct.Name()
-			if val, exists := e.Data[pkName]; exists {
-				cond[pkName] = val
+// applyUpdate 以舊主鍵 (before) 找到資料列並更新為 raw 的內容（含新主鍵）；
+// 找不到舊資料列時（例如先前漏收），改以新主鍵更新，仍不存在則新增
+func (p *Processor) applyUpdate(ctx context.Context, tx *gorm.DB, tableName string, before, raw map[string]interface{}) (int64, error) {
+	columnTypes, err := p.getColumnTypesOnce(ctx, tableName)
+	if err != nil {
+		return 0, fmt.Errorf("取得 %s 欄位資訊失敗: %w", tableName, err)
+	}
+
+	// ① 依欄位型別轉換，排除 IDENTITY 欄位
+	data := rowData(raw)
+	values := make(map[string]interface{}, len(data))
+	oldKey := make(map[string]interface{})
+	newKey := make(map[string]interface{})
+	for _, ct := range columnTypes {
+		name := ct.Name()
+		isPK, _ := ct.PrimaryKey()
+		if isPK {
+			if v, ok := before[name]; ok {
+				conv, err := convertValue(v, ct)
+				if err != nil {
+					return 0, err
+				}
+				oldKey[name] = conv
 			}
 		}
-
-		if len(cond) == 0 {
-			tx.Rollback()
-			return fmt.Errorf("第 %d 筆 Delete 找不到主鍵欄位或對應資料 (table=%s)", idx, tableName)
+		rawVal, ok := data[name]
+		if !ok {
+			continue
 		}
-
-		// ③ 執行刪除
-		if err := tx.
-			Table(tableName).
-			Where(cond).
-			Delete(nil).
-			Error; err != nil {
-			tx.Rollback()
-			return fmt.Errorf("刪除失敗 idx=%d, table=%s: %w", idx, tableName, err)
+		conv, err := convertValue(rawVal, ct)
+		if err != nil {
+			return 0, err
 		}
-	}
-
-	// Commit
-	if err := tx.Commit().Error; err != nil {
-		return fmt.Errorf("commit 失敗：%w", err)
-	}
-	/*------------------ Delete End-----------------------*/
-
-	/*------------------ Insert Start-----------------------*/
-	// 注意，Upsert 是在完全不同的 mssqlConn 連線，所以跟 Delete 不會綁一起
-	// 把所有要 Insert 的依照 tableName 分組
-	insertGroups := make(map[string][]map[string]interface{})
-
-	for _, e := range inserts {
-		tableName, ok := e.Data["TableName"].(string)
-		if !ok || tableName == "" {
-			tx.Rollback()
-			return fmt.Errorf("插入前找不到 TableName")
+		if isPK {
+			newKey[name] = conv
 		}
-
-		// 把 "TableName" 欄位移除，其他欄位都留下來
-		data := make(map[string]interface{}, len(e.Data))
-		for k, v := range e.Data {
-			if k == "TableName" {
-				continue
-			}
-			if str, ok := v.(string); ok {
-				data[k] = strings.ReplaceAll(str, `\n`, "\r\n")
-			} else {
-				data[k] = v
-			}
+		if isAI, ok := ct.AutoIncrement(); ok && isAI {
+			continue
 		}
-
-		insertGroups[tableName] = append(insertGroups[tableName], data)
+		values[name] = conv
 	}
-
-	// 針對每個 tableName，一次批次先寫 staging，再 MERGE，再清空 staging
-	for tableName, datas := range insertGroups {
-		if err := p.batchUpsertWithMerge(ctx, tableName, datas); err != nil {
-			return fmt.Errorf(" Upsert 失敗 (table=%s): %w", tableName, err)
-		}
+	if len(oldKey) == 0 || len(newKey) == 0 {
+		return 0, fmt.Errorf("Update 找不到主鍵欄位或對應資料 (table=%s)", tableName)
 	}
-	/*------------------ Insert End-----------------------*/
 
-	return nil
+	// ② 以舊主鍵更新
+	res := tx.Table(tableName).Where(oldKey).Updates(values)
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	if res.RowsAffected > 0 {
+		return res.RowsAffected, nil
+	}
 
+	// ③ 舊資料列不存在：以新主鍵更新，仍不存在則新增
+	res = tx.Table(tableName).Where(newKey).Updates(values)
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	if res.RowsAffected > 0 {
+		return res.RowsAffected, nil
+	}
+	res = tx.Table(tableName).Create(values)
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	return res.RowsAffected, nil
 }
 
-func (p *Processor) DdlLogProcess(ctx context.Context, body []byte) error {
+func (p *Processor) DdlLogProcess(ctx context.Context, body []byte) (model.ApplyResult, error) {
+	var result model.ApplyResult
+
 	// 1. 解析 JSON 取得 XMLList
 	var message model.DdlMessage
 	if err := sonic.Unmarshal([]byte(body), &message); err != nil {
-		return fmt.Errorf(" XML 解析失敗: %w", err)
+		return result, fmt.Errorf(" XML 解析失敗: %w", err)
 	}
+	result.BatchID = message.BatchID
 
-	// 2. 用迴圈處理每個 XML 串
-	for _, xmlStr := range message.XMLList {
-		// 2.1 解析單筆 XML
+	// 2. 用迴圈處理每個 XML 串；EVENTDATA 摘要只用於錯誤訊息，執行的 DDL 一律取自 XML 的 TSQLCommand
+	withEvents := len(message.Events) == len(message.XMLList)
+	for i, xmlStr := range message.XMLList {
+		var event model.DdlEvent
+		if withEvents {
+			event = message.Events[i]
+		}
 		var data model.DdlData
 		if err := xml.Unmarshal([]byte(xmlStr), &data); err != nil {
-			return fmt.Errorf(" XML 解析失敗: %w", err)
+			return result, fmt.Errorf(" XML 解析失敗: %w", err)
 		}
-		// 2.2 取出 DDL 語法，並去除多餘空白
+		// 2.1 取出 DDL 語法，並去除多餘空白
 		sqlText := strings.TrimSpace(data.EventData.Instance.TSQLCommand.CommandText)
 		if sqlText == "" {
-			return fmt.Errorf(" XML 未包含 CommandText")
+			return result, fmt.Errorf(" XML 未包含 CommandText")
 		}
 		normalized := strings.ToUpper(strings.Join(strings.Fields(sqlText), " "))
 		hash := sha1.Sum([]byte(normalized))
@@ -562,7 +725,7 @@ func (p *Processor) DdlLogProcess(ctx context.Context, body []byte) error {
 				Model(&model.ExecutedDDL{}).
 				Where("SQLHash = ?", hashHex).
 				Count(&cnt).Error; err != nil {
-				return fmt.Errorf("查詢 DDL 執行紀錄失敗: %w", err)
+				return result, fmt.Errorf("查詢 DDL 執行紀錄失敗: %w", err)
 			}
 			if cnt > 0 {
 				p.ddlMu.Lock()
@@ -573,6 +736,7 @@ func (p *Processor) DdlLogProcess(ctx context.Context, body []byte) error {
 		}
 
 		if done {
+			result.DdlSkipped++
 			continue
 		}
 
@@ -580,7 +744,7 @@ func (p *Processor) DdlLogProcess(ctx context.Context, body []byte) error {
 		res := p.db.WithContext(ctx).Exec(sqlText)
 		if err := res.Error; err != nil {
 			// 把原始錯誤與 SQL 都印出來
-			return fmt.Errorf("執行 DDL 失敗: %v; SQL: %s", err, sqlText)
+			return result, fmt.Errorf("執行 DDL 失敗: %w; %s; SQL: %s", err, describeDdlEvent(event), sqlText)
 		}
 
 		// 5. 記錄此 DDL 已成功執行（寫入 DB + 快取）
@@ -589,12 +753,21 @@ func (p *Processor) DdlLogProcess(ctx context.Context, body []byte) error {
 			SQLText: normalized,
 		}
 		if err := p.db.WithContext(ctx).Create(&rec).Error; err != nil {
-			return fmt.Errorf("記錄 DDL 執行失敗: %w", err)
+			return result, fmt.Errorf("記錄 DDL 執行失敗: %w", err)
 		}
 		p.ddlMu.Lock()
 		p.executedDDL[hashHex] = struct{}{}
 		p.ddlMu.Unlock()
+		result.DdlExecuted++
 	}
 
-	return nil
+	return result, nil
+}
+
+// describeDdlEvent 以 EVENTDATA 摘要描述 DDL，供錯誤訊息使用
+func describeDdlEvent(event model.DdlEvent) string {
+	if event.EventType == "" {
+		return "DdlLog 未附摘要"
+	}
+	return fmt.Sprintf("DdlLog %d %s %s.%s (%s)", event.SerialNo, event.EventType, event.SchemaName, event.ObjectName, event.LoginName)
 }
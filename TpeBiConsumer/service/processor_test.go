@@ -2,13 +2,18 @@ package service
 
 import (
 	model "TpeBiConsumer/model"
+	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"gorm.io/driver/sqlserver"
 	"gorm.io/gorm"
+	"gorm.io/gorm/migrator"
 )
 
 func setupDB(t *testing.T) (*gorm.DB, sqlmock.Sqlmock, func()) {
@@ -59,7 +64,7 @@ func TestDdlLogProcess_With_Testing_SQLServer(t *testing.T) {
 
 	// 3. 目的是要測 DdlLogProcess
 	proc := NewProcessor(gormDB)
-	err := proc.DdlLogProcess(context.Background(), jsonBytes)
+	_, err := proc.DdlLogProcess(context.Background(), jsonBytes)
 	if err != nil {
 		t.Errorf("預期不會錯誤，實際: %v", err)
 	}
@@ -79,6 +84,35 @@ func TestDdlLogProcess_With_Testing_SQLServer(t *testing.T) {
 	}
 }
 
+// TestDdlLogProcess_ExecutesXMLCommand 驗證執行的 DDL 取自 XML 的 TSQLCommand，不採用摘要中夾帶的語法
+func TestDdlLogProcess_ExecutesXMLCommand(t *testing.T) {
+	db, mock := setupMockDB(t)
+	p := &Processor{db: db, executedDDL: make(map[string]struct{})}
+
+	xml := `<DDLData><EventData><EVENT_INSTANCE><EventType>ALTER_TABLE</EventType><SchemaName>dbo</SchemaName><ObjectName>Orders</ObjectName>` +
+		`<TSQLCommand><CommandText>ALTER TABLE [dbo].[Orders] ADD Note nvarchar(50)</CommandText></TSQLCommand></EVENT_INSTANCE></EventData></DDLData>`
+	xmlJSON, _ := json.Marshal(xml)
+	body := `{"BatchID":7,"XMLList":[` + string(xmlJSON) + `],` +
+		`"Events":[{"SerialNo":11,"EventType":"ALTER_TABLE","SchemaName":"dbo","ObjectName":"Orders","CommandText":"DROP TABLE [dbo].[Orders]"}]}`
+
+	mock.ExpectQuery(`SELECT count\(\*\) FROM "ExecutedDDL"`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec(`ALTER TABLE \[dbo\]\.\[Orders\] ADD Note nvarchar\(50\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO "ExecutedDDL"`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	result, err := p.DdlLogProcess(context.Background(), []byte(body))
+	if err != nil {
+		t.Fatalf("預期不會錯誤，實際: %v", err)
+	}
+	if result.DdlExecuted != 1 {
+		t.Errorf("預期執行 1 筆 DDL，實際 %d 筆", result.DdlExecuted)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("SQL 執行與預期不符: %v", err)
+	}
+}
+
 // TestDmlLogProcess 使用 MS SQL 測試 DML Delete 與 Insert
 func TestDmlLogProcess_Success_MockSQLServer(t *testing.T) {
 	gormDB, _, cleanup := setupDB(t)
@@ -101,7 +135,7 @@ func TestDmlLogProcess_Success_MockSQLServer(t *testing.T) {
 
 	// consumer 接收並處理
 	proc := NewProcessor(gormDB)
-	err := proc.DmlLogProcess(context.Background(), jsonBytes)
+	_, err := proc.DmlLogProcess(context.Background(), model.Envelope{}, jsonBytes)
 	if err != nil {
 		t.Errorf("預期不會錯誤，實際: %v", err)
 	}
@@ -120,3 +154,144 @@ and BIInsertDate='2025-04-27 16:00:31.450'
 		t.Errorf("資料沒有異動，cnt = %d", cnt)
 	}
 }
+
+// TestConvertValue_TypedValues 驗證 Types 標示的欄位依來源與目的型別無損還原（不需資料庫）
+func TestConvertValue_TypedValues(t *testing.T) {
+	col := func(name, dbType string) gorm.ColumnType {
+		return migrator.ColumnType{
+			NameValue:     sql.NullString{String: name, Valid: true},
+			DataTypeValue: sql.NullString{String: dbType, Valid: true},
+		}
+	}
+	row := map[string]interface{}{
+		"Qty":      "12345678901234.5600",
+		"QtyF":     "1.25",
+		"UpdTime":  "2025-06-01T08:30:00.1234567",
+		"SyncTime": "2025-06-01T08:30:00+08:00",
+		"Shift":    "07:45:00",
+		"Photo":    "AP8Q",
+		"RowGuid":  "6F9619FF-8B86-D011-B42D-00C04FC964FF",
+		"Name":     "不受影響",
+	}
+	types := map[string]string{
+		"Qty": "decimal(18,4)", "QtyF": "decimal(18,2)", "UpdTime": "datetime2", "SyncTime": "datetimeoffset",
+		"Shift": "time", "Photo": "varbinary", "RowGuid": "uniqueidentifier",
+	}
+	if err := applyTypes(row, types); err != nil {
+		t.Fatalf("applyTypes 失敗: %v", err)
+	}
+
+	convert := func(name, dbType string) interface{} {
+		t.Helper()
+		v, err := convertValue(row[name], col(name, dbType))
+		if err != nil {
+			t.Fatalf("%s 轉換失敗: %v", name, err)
+		}
+		return v
+	}
+
+	if v := convert("Qty", "DECIMAL"); v != "12345678901234.5600" {
+		t.Errorf("decimal 應維持完整精度字串，實際 %#v", v)
+	}
+	if v := convert("QtyF", "FLOAT"); v != 1.25 {
+		t.Errorf("decimal 寫入 FLOAT 應轉為 float64，實際 %#v", v)
+	}
+	if v := convert("UpdTime", "DATETIME2"); !v.(time.Time).Equal(time.Date(2025, 6, 1, 8, 30, 0, 123456700, time.UTC)) {
+		t.Errorf("datetime2 還原錯誤，實際 %v", v)
+	}
+	if v := convert("SyncTime", "DATETIMEOFFSET").(time.Time); v.Format(time.RFC3339) != "2025-06-01T08:30:00+08:00" {
+		t.Errorf("datetimeoffset 應保留時區，實際 %v", v)
+	}
+	if v := convert("Shift", "TIME"); v != "07:45:00" {
+		t.Errorf("time 寫入 TIME 欄位應維持字串，避免年份 0 超出範圍，實際 %#v", v)
+	}
+	if v := convert("Shift", "DATETIME").(time.Time); !v.Equal(time.Date(1900, 1, 1, 7, 45, 0, 0, time.UTC)) {
+		t.Errorf("time 寫入 DATETIME 欄位應以 1900-01-01 為日期，實際 %v", v)
+	}
+	if v := convert("Photo", "VARBINARY"); !bytes.Equal(v.([]byte), []byte{0x00, 0xff, 0x10}) {
+		t.Errorf("binary 還原錯誤，實際 %#v", v)
+	}
+	wantGUID := []byte{0xff, 0x19, 0x96, 0x6f, 0x86, 0x8b, 0x11, 0xd0, 0xb4, 0x2d, 0x00, 0xc0, 0x4f, 0xc9, 0x64, 0xff}
+	if v := convert("RowGuid", "UNIQUEIDENTIFIER"); !bytes.Equal(v.([]byte), wantGUID) {
+		t.Errorf("uniqueidentifier 應轉為 SQL Server 位元組順序，實際 % x", v)
+	}
+	if v := convert("RowGuid", "NVARCHAR"); v != "6F9619FF-8B86-D011-B42D-00C04FC964FF" {
+		t.Errorf("uniqueidentifier 寫入字串欄位應為標準格式，實際 %#v", v)
+	}
+	if v := convert("Name", "NVARCHAR"); v != "不受影響" {
+		t.Errorf("未列在 Types 的欄位應沿用原值，實際 %#v", v)
+	}
+
+	if err := applyTypes(map[string]interface{}{"Qty": 1.5}, map[string]string{"Qty": "decimal(18,4)"}); err == nil {
+		t.Error("Types 欄位不是字串時應回傳錯誤")
+	}
+}
+
+// TestBuildMergeSQL 驗證 MERGE 以主鍵關聯、只更新非主鍵欄位，並略過 IDENTITY 欄位
+func TestBuildMergeSQL(t *testing.T) {
+	cols := []gorm.ColumnType{
+		migrator.ColumnType{NameValue: sql.NullString{String: "Seq", Valid: true}, AutoIncrementValue: sql.NullBool{Bool: true, Valid: true}},
+		migrator.ColumnType{NameValue: sql.NullString{String: "Qty", Valid: true}},
+		migrator.ColumnType{NameValue: sql.NullString{String: "ID", Valid: true}, PrimaryKeyValue: sql.NullBool{Bool: true, Valid: true}},
+	}
+	got := buildMergeSQL("Cutting", "Cutting_Snapshot", cols)
+	for _, want := range []string{
+		"MERGE INTO Cutting AS T",
+		"USING Cutting_Snapshot AS S",
+		"ON T.ID = S.ID",
+		"UPDATE SET T.Qty = S.Qty",
+		"INSERT (ID, Qty) VALUES (S.ID, S.Qty);",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("MERGE 缺少 %q：%s", want, got)
+		}
+	}
+	if strings.Contains(got, "Seq") {
+		t.Errorf("MERGE 不應包含 IDENTITY 欄位：%s", got)
+	}
+}
+
+// TestGroupDmlSteps 驗證依訊息順序分組：只合併連續的同表 Insert，Action 或資料表改變時分成新的步驟
+func TestGroupDmlSteps(t *testing.T) {
+	entry := func(action, table, id string) dmlEntry {
+		return dmlEntry{Action: action, Data: map[string]interface{}{"TableName": table, "ID": id}}
+	}
+	entries := []dmlEntry{
+		entry("Insert", "A", "1"),
+		entry("Insert", "A", "2"),
+		entry("Update", "A", "3"),
+		entry("Delete", "A", "3"),
+		entry("Insert", "A", "4"),
+		entry("Insert", "B", "5"),
+		entry("Insert", "A", "6"),
+		entry("Unknown", "A", "7"),
+	}
+	steps, err := groupDmlSteps(entries)
+	if err != nil {
+		t.Fatalf("groupDmlSteps 失敗: %v", err)
+	}
+	want := []struct {
+		action, table string
+		index, rows   int
+	}{
+		{"Insert", "A", 0, 2},
+		{"Update", "A", 2, 1},
+		{"Delete", "A", 3, 1},
+		{"Insert", "A", 4, 1},
+		{"Insert", "B", 5, 1},
+		{"Insert", "A", 6, 1},
+	}
+	if len(steps) != len(want) {
+		t.Fatalf("預期 %d 個步驟，實際 %d: %+v", len(want), len(steps), steps)
+	}
+	for i, w := range want {
+		s := steps[i]
+		if s.Action != w.action || s.TableName != w.table || s.Index != w.index || len(s.Rows) != w.rows {
+			t.Errorf("第 %d 個步驟不符: %s %s idx=%d rows=%d", i, s.Action, s.TableName, s.Index, len(s.Rows))
+		}
+	}
+
+	if _, err := groupDmlSteps([]dmlEntry{{Action: "Delete", Data: map[string]interface{}{"ID": "1"}}}); err == nil {
+		t.Fatal("未指定 TableName 應回傳錯誤")
+	}
+}
@@ -0,0 +1,525 @@
+// 完整同步：把 FtyBiProducer snapshot 子命令的 Chunk 載入 staging，收到 End 後一次套用到正式資料表
+package service
+
+import (
+	model "TpeBiConsumer/model"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+	mssql "github.com/microsoft/go-mssqldb"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// snapshotEndTimeout 為 End 等待其他 consumer 載入剩餘 Chunk 的最長時間，逾時視為失敗，需重新執行完整同步
+const snapshotEndTimeout = 5 * time.Minute
+
+// snapshotPollInterval 為 End 檢查 Chunk 是否收齊的間隔
+const snapshotPollInterval = time.Second
+
+// snapshotHoldTimeout 為完整同步暫存 DML 異動的最長時間（從建立 staging 起算），
+// 逾時視為中斷（例如 Producer 未送出 End），改為 Failed 並套用暫存的異動，之後收到的 End 略過
+const snapshotHoldTimeout = 2 * time.Hour
+
+// errSnapshotIncomplete 表示 End 時 Chunk 未收齊或筆數不符，完整同步改為 Failed
+var errSnapshotIncomplete = errors.New("完整同步未收齊")
+
+// snapshotProcess 依階段處理完整同步的訊息：
+//   - Start：建立這一次專用的 staging（同一張資料表先前未完成的完整同步改為 Superseded，移除其 staging）
+//   - Chunk：以主鍵 MERGE 進 staging，重複收到為冪等
+//   - End：所有 Chunk 載入後，在同一個 transaction 內依 Mode 套用到正式資料表並移除 staging
+//
+// 已套用、被取代或失敗的完整同步，重送的訊息略過，原因放在 ApplyResult.Skipped
+func (p *Processor) snapshotProcess(ctx context.Context, env model.Envelope, msg model.DmlMessage) (model.ApplyResult, error) {
+	var result model.ApplyResult
+	info := *msg.Snapshot
+	if info.SnapshotID == "" || info.TableName == "" {
+		return result, fmt.Errorf("完整同步訊息缺少 SnapshotID 或 TableName")
+	}
+	if info.Mode != model.SnapshotModeReconcile && info.Mode != model.SnapshotModeSwap {
+		return result, fmt.Errorf("完整同步 %s 不支援的 Mode: %q", info.SnapshotID, info.Mode)
+	}
+
+	load, err := p.ensureSnapshotLoad(ctx, env.FactoryID, info)
+	if err != nil {
+		return result, err
+	}
+	if load.Status != model.SnapshotStatusLoading {
+		result.Skipped = snapshotSkipped(info, load.Status)
+		return result, nil
+	}
+
+	switch info.Phase {
+	case model.SnapshotPhaseStart:
+		return result, nil
+	case model.SnapshotPhaseChunk:
+		return p.loadSnapshotChunk(ctx, load, info, msg.JSONList)
+	case model.SnapshotPhaseEnd:
+		return p.applySnapshot(ctx, load, info)
+	default:
+		return result, fmt.Errorf("完整同步 %s 不支援的 Phase: %q", info.SnapshotID, info.Phase)
+	}
+}
+
+// snapshotSkipped 為略過已結束的完整同步訊息的說明
+func snapshotSkipped(info model.SnapshotInfo, status string) string {
+	return fmt.Sprintf("完整同步 %s 已為 %s，略過 %s 訊息", info.SnapshotID, status, info.Phase)
+}
+
+// ensureSnapshotLoad 取得完整同步的紀錄；第一次收到時建立 staging 與紀錄
+func (p *Processor) ensureSnapshotLoad(ctx context.Context, factoryID string, info model.SnapshotInfo) (model.SnapshotLoad, error) {
+	p.snapshotMu.Lock()
+	defer p.snapshotMu.Unlock()
+
+	// 1. 已建立
+	var load model.SnapshotLoad
+	err := p.db.WithContext(ctx).Where("SnapshotID = ?", info.SnapshotID).Take(&load).Error
+	if err == nil {
+		return load, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return load, fmt.Errorf("查詢完整同步 %s 失敗：%w", info.SnapshotID, err)
+	}
+
+	// 2. 同一張資料表未完成的完整同步由這一次取代，並移除其 staging
+	var stale []model.SnapshotLoad
+	if err := p.db.WithContext(ctx).
+		Where("TableName = ? AND Status = ?", info.TableName, model.SnapshotStatusLoading).
+		Find(&stale).Error; err != nil {
+		return load, fmt.Errorf("查詢 %s 先前的完整同步失敗：%w", info.TableName, err)
+	}
+	for _, old := range stale {
+		if _, err := p.endSnapshotLoad(ctx, old, model.SnapshotStatusSuperseded); err != nil {
+			return load, fmt.Errorf("取代 %s 先前的完整同步失敗：%w", info.TableName, err)
+		}
+	}
+
+	// 3. 重建 staging：與正式資料表相同的欄位，加上主鍵供 MERGE 使用
+	columnTypes, err := p.getColumnTypesOnce(ctx, info.TableName)
+	if err != nil {
+		return load, fmt.Errorf("取得 %s 欄位資訊失敗: %w", info.TableName, err)
+	}
+	var keyCols []string
+	for _, ct := range columnTypes {
+		if isPK, _ := ct.PrimaryKey(); isPK {
+			keyCols = append(keyCols, quoteIdent(ct.Name()))
+		}
+	}
+	if len(keyCols) == 0 {
+		return load, fmt.Errorf("%s 沒有主鍵，無法完整同步", info.TableName)
+	}
+	// 每次完整同步各自一張 staging：被取代的完整同步遲到的 Chunk 不會載入到新的 staging；
+	// 主鍵名稱在 schema 內必須唯一，swap 後會留在正式資料表上，也隨 SnapshotID 命名
+	sum := sha1.Sum([]byte(info.SnapshotID))
+	staging := info.TableName + "_Snapshot_" + hex.EncodeToString(sum[:4])
+	pkName := "PK_" + staging
+	stmts := []string{
+		fmt.Sprintf("IF OBJECT_ID(N'%s', N'U') IS NOT NULL DROP TABLE %s", strings.ReplaceAll(quoteIdent(staging), "'", "''"), quoteIdent(staging)),
+		fmt.Sprintf("SELECT TOP 0 * INTO %s FROM %s", quoteIdent(staging), quoteIdent(info.TableName)),
+		fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s PRIMARY KEY (%s)", quoteIdent(staging), quoteIdent(pkName), strings.Join(keyCols, ", ")),
+	}
+	for _, stmt := range stmts {
+		if err := p.db.WithContext(ctx).Exec(stmt).Error; err != nil {
+			return load, fmt.Errorf("建立 staging %s 失敗：%w", staging, err)
+		}
+	}
+
+	// 4. 建立紀錄
+	load = model.SnapshotLoad{
+		SnapshotID:   info.SnapshotID,
+		FactoryID:    factoryID,
+		Table:        info.TableName,
+		StagingTable: staging,
+		Mode:         info.Mode,
+		Status:       model.SnapshotStatusLoading,
+		TakenAt:      info.TakenAt,
+		Watermark:    info.Watermark,
+	}
+	if err := p.db.WithContext(ctx).Create(&load).Error; err != nil {
+		return load, fmt.Errorf("建立完整同步 %s 紀錄失敗：%w", info.SnapshotID, err)
+	}
+	return load, nil
+}
+
+// loadSnapshotChunk 把一個 Chunk 以主鍵 MERGE 進 staging 並記錄
+func (p *Processor) loadSnapshotChunk(ctx context.Context, load model.SnapshotLoad, info model.SnapshotInfo, jsonList []string) (model.ApplyResult, error) {
+	var result model.ApplyResult
+	entries, err := parseDmlEntries(jsonList)
+	if err != nil {
+		return result, err
+	}
+	rows := make([]map[string]interface{}, 0, len(entries))
+	for idx, e := range entries {
+		if e.Action != "Insert" {
+			return result, fmt.Errorf("完整同步 %s 第 %d 段第 %d 筆的 Action 應為 Insert，實際為 %q", info.SnapshotID, info.Chunk, idx, e.Action)
+		}
+		rows = append(rows, rowData(e.Data))
+	}
+
+	// 在同一個 transaction 內以共用鎖確認紀錄仍為 Loading：取代或套用需等這一段載入完成，
+	// 已結束的完整同步（staging 已移除或已套用）不再載入
+	var status string
+	err = p.withBulkTx(ctx, func(tx *gorm.DB, conn *mssql.Conn) error {
+		if err := tx.Raw("SELECT Status FROM SnapshotLoad WITH (HOLDLOCK, ROWLOCK) WHERE SnapshotID = ?", info.SnapshotID).
+			Scan(&status).Error; err != nil {
+			return fmt.Errorf("查詢完整同步 %s 失敗：%w", info.SnapshotID, err)
+		}
+		if status != model.SnapshotStatusLoading {
+			return nil
+		}
+		affected, err := p.mergeRows(ctx, tx, conn, load.StagingTable, rows)
+		if err != nil {
+			return fmt.Errorf("載入 staging 失敗 (table=%s): %w", load.StagingTable, err)
+		}
+		result.RowsUpserted = affected
+
+		chunk := model.SnapshotChunk{SnapshotID: info.SnapshotID, Chunk: info.Chunk, Rows: int64(len(rows))}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&chunk).Error; err != nil {
+			return fmt.Errorf("記錄完整同步 %s 第 %d 段失敗：%w", info.SnapshotID, info.Chunk, err)
+		}
+		return nil
+	})
+	if err != nil {
+		result.RowsUpserted = 0
+		return result, err
+	}
+	if status != model.SnapshotStatusLoading {
+		result.Skipped = snapshotSkipped(info, status)
+	}
+	return result, nil
+}
+
+// applySnapshot 等所有 Chunk 載入後，在同一個 transaction 內把 staging 套用到正式資料表：
+//   - reconcile：刪除 staging 中沒有的資料列，再以主鍵 MERGE；正式資料表的索引、trigger 與權限不變
+//   - swap：以 sp_rename 把 staging 換成正式資料表；新資料表只有欄位與主鍵（SELECT INTO 不會複製索引、預設值與 trigger）
+func (p *Processor) applySnapshot(ctx context.Context, load model.SnapshotLoad, info model.SnapshotInfo) (model.ApplyResult, error) {
+	var result model.ApplyResult
+
+	// 1. 其他 consumer 可能仍在載入前面的 Chunk；未收齊時改為 Failed 並移除 staging，恢復套用 DML
+	if err := p.waitSnapshotChunks(ctx, info); err != nil {
+		if errors.Is(err, errSnapshotIncomplete) {
+			if _, ferr := p.endSnapshotLoad(context.WithoutCancel(ctx), load, model.SnapshotStatusFailed); ferr != nil {
+				return result, errors.Join(err, ferr)
+			}
+		}
+		return result, err
+	}
+
+	columnTypes, err := p.getColumnTypesOnce(ctx, load.Table)
+	if err != nil {
+		return result, fmt.Errorf("取得 %s 欄位資訊失敗: %w", load.Table, err)
+	}
+	var keyConds []string
+	for _, ct := range columnTypes {
+		if isPK, _ := ct.PrimaryKey(); isPK {
+			col := quoteIdent(ct.Name())
+			keyConds = append(keyConds, fmt.Sprintf("S.%s = T.%s", col, col))
+		}
+	}
+	table, staging := quoteIdent(load.Table), quoteIdent(load.StagingTable)
+
+	// 2. 先在同一個 transaction 內把紀錄由 Loading 改為 Applied（鎖住紀錄，取代、遲到的 Chunk 與暫存 DML 需等待），
+	//    已被取代或失敗時不套用；再套用、移除 staging，並依序套用載入期間暫存的 DML 異動
+	var status string
+	err = p.withBulkTx(ctx, func(tx *gorm.DB, conn *mssql.Conn) error {
+		now := time.Now()
+		res := tx.Model(&model.SnapshotLoad{}).
+			Where("SnapshotID = ? AND Status = ?", load.SnapshotID, model.SnapshotStatusLoading).
+			Updates(map[string]interface{}{
+				"Status":    model.SnapshotStatusApplied,
+				"Chunks":    info.Chunks,
+				"TotalRows": info.Rows,
+				"AppliedAt": now,
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return tx.Model(&model.SnapshotLoad{}).Select("Status").
+				Where("SnapshotID = ?", load.SnapshotID).Scan(&status).Error
+		}
+		status = model.SnapshotStatusApplied
+
+		switch load.Mode {
+		case model.SnapshotModeSwap:
+			old := load.Table + "_SnapshotOld"
+			stmts := []string{
+				fmt.Sprintf("EXEC sp_rename N'%s', N'%s'", strings.ReplaceAll(load.Table, "'", "''"), strings.ReplaceAll(old, "'", "''")),
+				fmt.Sprintf("EXEC sp_rename N'%s', N'%s'", strings.ReplaceAll(load.StagingTable, "'", "''"), strings.ReplaceAll(load.Table, "'", "''")),
+				fmt.Sprintf("DROP TABLE %s", quoteIdent(old)),
+			}
+			for _, stmt := range stmts {
+				if err := tx.Exec(stmt).Error; err != nil {
+					return fmt.Errorf("交換 %s 與 staging 失敗：%w", load.Table, err)
+				}
+			}
+			result.RowsUpserted = info.Rows
+		default:
+			res := tx.Exec(fmt.Sprintf("DELETE T FROM %s AS T WHERE NOT EXISTS (SELECT 1 FROM %s AS S WHERE %s)",
+				table, staging, strings.Join(keyConds, " AND ")))
+			if res.Error != nil {
+				return fmt.Errorf("刪除 %s 中 staging 沒有的資料列失敗：%w", load.Table, res.Error)
+			}
+			result.RowsDeleted = res.RowsAffected
+			res = tx.Exec(buildMergeSQL(load.Table, load.StagingTable, columnTypes))
+			if res.Error != nil {
+				return fmt.Errorf("執行 MERGE 失敗: %w", res.Error)
+			}
+			result.RowsUpserted = res.RowsAffected
+			if err := tx.Exec("DROP TABLE " + staging).Error; err != nil {
+				return fmt.Errorf("刪除 staging %s 失敗：%w", load.StagingTable, err)
+			}
+		}
+		return p.releaseHeldBatches(ctx, tx, conn, load, true, &result)
+	})
+	if err != nil {
+		return model.ApplyResult{}, fmt.Errorf("套用完整同步 %s 失敗：%w", info.SnapshotID, err)
+	}
+	if status != model.SnapshotStatusApplied {
+		return model.ApplyResult{Skipped: snapshotSkipped(info, status)}, nil
+	}
+	return result, nil
+}
+
+// endSnapshotLoad 把仍為 Loading 的完整同步改為 status（Superseded、Failed）、移除其 staging，
+// 並套用載入期間暫存的 DML 異動；都在同一個 transaction 內，正在載入的 Chunk 與暫存完成後才會執行。
+// 已不是 Loading 時回傳 false
+func (p *Processor) endSnapshotLoad(ctx context.Context, load model.SnapshotLoad, status string) (bool, error) {
+	var ended bool
+	err := p.withBulkTx(ctx, func(tx *gorm.DB, conn *mssql.Conn) error {
+		res := tx.Model(&model.SnapshotLoad{}).
+			Where("SnapshotID = ? AND Status = ?", load.SnapshotID, model.SnapshotStatusLoading).
+			Update("Status", status)
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		ended = true
+		if err := tx.Exec(fmt.Sprintf("IF OBJECT_ID(N'%s', N'U') IS NOT NULL DROP TABLE %s",
+			strings.ReplaceAll(quoteIdent(load.StagingTable), "'", "''"), quoteIdent(load.StagingTable))).Error; err != nil {
+			return err
+		}
+		var result model.ApplyResult
+		return p.releaseHeldBatches(ctx, tx, conn, load, false, &result)
+	})
+	if err != nil {
+		return false, fmt.Errorf("將完整同步 %s 改為 %s 失敗：%w", load.SnapshotID, status, err)
+	}
+	return ended, nil
+}
+
+// releaseHeldBatches 在 tx 內依 ID 順序套用完整同步載入期間暫存的 DML 異動並刪除暫存；
+// applied 為 true（完整同步已套用）時，同一工廠 SerialNoTo 不超過 Watermark 的暫存已包含在完整資料中，只刪除不套用
+func (p *Processor) releaseHeldBatches(ctx context.Context, tx *gorm.DB, conn *mssql.Conn, load model.SnapshotLoad, applied bool, result *model.ApplyResult) error {
+	var held []model.SnapshotHeldBatch
+	if err := tx.Where("SnapshotID = ?", load.SnapshotID).Order("ID").Find(&held).Error; err != nil {
+		return fmt.Errorf("查詢完整同步 %s 暫存的批次失敗：%w", load.SnapshotID, err)
+	}
+	for _, h := range held {
+		if applied && h.FactoryID == load.FactoryID && h.SerialNoTo > 0 && h.SerialNoTo <= load.Watermark {
+			continue
+		}
+		var jsonList []string
+		if err := sonic.UnmarshalString(h.JSONList, &jsonList); err != nil {
+			return fmt.Errorf("解析暫存的批次 %d 失敗：%w", h.BatchID, err)
+		}
+		entries, err := parseDmlEntries(jsonList)
+		if err != nil {
+			return fmt.Errorf("解析暫存的批次 %d 失敗：%w", h.BatchID, err)
+		}
+		if err := p.applyDmlEntries(ctx, tx, conn, entries, result); err != nil {
+			return fmt.Errorf("套用暫存的批次 %d 失敗：%w", h.BatchID, err)
+		}
+	}
+	if len(held) == 0 {
+		return nil
+	}
+	if err := tx.Where("SnapshotID = ?", load.SnapshotID).Delete(&model.SnapshotHeldBatch{}).Error; err != nil {
+		return fmt.Errorf("刪除完整同步 %s 暫存的批次失敗：%w", load.SnapshotID, err)
+	}
+	return nil
+}
+
+// holdSnapshotEntries 在 tx 內以共用鎖查詢批次中資料表的 Loading 完整同步（套用、取代需等這個 transaction 結束），
+// 把這些資料表的異動依訊息順序暫存到 SnapshotHeldBatch，回傳其餘要照常套用的異動與暫存的說明。
+// 直接套用會在 End 時被 snapshot 的舊資料覆蓋；也不重新排入 Queue，否則單一 consumer 的 Queue 會一直重送同一個批次，
+// 卡住排在後面的 Chunk 與 End
+func (p *Processor) holdSnapshotEntries(tx *gorm.DB, env model.Envelope, batchID int, entries []dmlEntry) ([]dmlEntry, string, error) {
+	names := entryTables(entries)
+	if len(names) == 0 {
+		return entries, "", nil
+	}
+	var loads []model.SnapshotLoad
+	if err := tx.Raw("SELECT * FROM SnapshotLoad WITH (HOLDLOCK, ROWLOCK) WHERE TableName IN ? AND Status = ?",
+		names, model.SnapshotStatusLoading).Scan(&loads).Error; err != nil {
+		return entries, "", fmt.Errorf("查詢完整同步狀態失敗：%w", err)
+	}
+	if len(loads) == 0 {
+		return entries, "", nil
+	}
+	loading := make(map[string]string, len(loads))
+	for _, load := range loads {
+		loading[load.Table] = load.SnapshotID
+	}
+
+	rest := entries[:0:0]
+	held := make(map[string][]string)
+	for _, e := range entries {
+		name, _ := e.Data["TableName"].(string)
+		if _, ok := loading[name]; ok {
+			held[name] = append(held[name], e.raw)
+			continue
+		}
+		rest = append(rest, e)
+	}
+	var notes []string
+	for _, name := range names {
+		list, ok := held[name]
+		if !ok {
+			continue
+		}
+		jsonList, err := sonic.MarshalString(list)
+		if err != nil {
+			return entries, "", fmt.Errorf("轉換 JSON 失敗：%w", err)
+		}
+		h := model.SnapshotHeldBatch{
+			SnapshotID: loading[name],
+			FactoryID:  env.FactoryID,
+			BatchID:    int64(batchID),
+			SerialNoTo: env.SerialNoTo,
+			JSONList:   jsonList,
+		}
+		if err := tx.Create(&h).Error; err != nil {
+			return entries, "", fmt.Errorf("暫存 %s 的異動失敗：%w", name, err)
+		}
+		notes = append(notes, fmt.Sprintf("%s %d 筆（完整同步 %s）", name, len(list), loading[name]))
+	}
+	return rest, "完整同步載入中，暫存 " + strings.Join(notes, "、") + "，完整同步結束時再套用", nil
+}
+
+// entryTables 依出現順序回傳異動涉及的資料表
+func entryTables(entries []dmlEntry) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, e := range entries {
+		if name, ok := e.Data["TableName"].(string); ok && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// joinNotes 串接非空白的說明
+func joinNotes(notes ...string) string {
+	var kept []string
+	for _, n := range notes {
+		if n != "" {
+			kept = append(kept, n)
+		}
+	}
+	return strings.Join(kept, "；")
+}
+
+// filterSnapshotEntries 在套用一般 DML 批次前依完整同步的狀態處理：
+//   - 超過 snapshotHoldTimeout 仍為 Loading 的完整同步視為中斷，改為 Failed 並套用其暫存的異動
+//   - 同一工廠已 Applied 的完整同步 Watermark 不小於批次的 SerialNoTo：該資料表的異動已包含在完整資料中，略過
+//
+// 跨越 Watermark 的批次照常套用，之後的異動會把資料列更新到最新狀態；仍在載入中的資料表由 holdSnapshotEntries 暫存
+func (p *Processor) filterSnapshotEntries(ctx context.Context, env model.Envelope, entries []dmlEntry) ([]dmlEntry, string, error) {
+	names := entryTables(entries)
+	if len(names) == 0 {
+		return entries, "", nil
+	}
+
+	// 1. 查詢相關的完整同步；舊版 Producer 的批次沒有 SerialNo 範圍，只檢查 Loading
+	query := p.db.WithContext(ctx).Where("TableName IN ?", names)
+	if env.SerialNoTo > 0 {
+		query = query.Where("Status = ? OR (Status = ? AND FactoryID = ? AND Watermark >= ?)",
+			model.SnapshotStatusLoading, model.SnapshotStatusApplied, env.FactoryID, env.SerialNoTo)
+	} else {
+		query = query.Where("Status = ?", model.SnapshotStatusLoading)
+	}
+	var loads []model.SnapshotLoad
+	if err := query.Find(&loads).Error; err != nil {
+		return entries, "", fmt.Errorf("查詢完整同步狀態失敗：%w", err)
+	}
+
+	// 2. 逾時的完整同步改為 Failed；已套用的記下要略過的資料表
+	covered := make(map[string]string)
+	for _, load := range loads {
+		if load.Status == model.SnapshotStatusApplied {
+			covered[load.Table] = load.SnapshotID
+			continue
+		}
+		if time.Since(load.CreatedAt) <= snapshotHoldTimeout {
+			continue
+		}
+		if _, err := p.endSnapshotLoad(ctx, load, model.SnapshotStatusFailed); err != nil {
+			return entries, "", err
+		}
+	}
+	if len(covered) == 0 {
+		return entries, "", nil
+	}
+
+	// 3. 略過已包含在完整資料中的異動
+	kept := entries[:0:0]
+	skipped := make(map[string]int)
+	for _, e := range entries {
+		name, _ := e.Data["TableName"].(string)
+		if _, ok := covered[name]; ok {
+			skipped[name]++
+			continue
+		}
+		kept = append(kept, e)
+	}
+	var notes []string
+	for _, name := range names {
+		if n := skipped[name]; n > 0 {
+			notes = append(notes, fmt.Sprintf("%s %d 筆（完整同步 %s）", name, n, covered[name]))
+		}
+	}
+	return kept, fmt.Sprintf("批次 SerialNoTo %d 不超過完整同步的 Watermark，略過 %s", env.SerialNoTo, strings.Join(notes, "、")), nil
+}
+
+// waitSnapshotChunks 等到 SnapshotChunk 收齊 End 所記錄的段數與筆數
+func (p *Processor) waitSnapshotChunks(ctx context.Context, info model.SnapshotInfo) error {
+	deadline := time.Now().Add(snapshotEndTimeout)
+	for {
+		var loaded struct {
+			Chunks     int64
+			LoadedRows int64
+		}
+		if err := p.db.WithContext(ctx).Model(&model.SnapshotChunk{}).
+			Select("COUNT(*) AS Chunks, COALESCE(SUM(LoadedRows), 0) AS LoadedRows").
+			Where("SnapshotID = ?", info.SnapshotID).
+			Scan(&loaded).Error; err != nil {
+			return fmt.Errorf("查詢完整同步 %s 的進度失敗：%w", info.SnapshotID, err)
+		}
+		if loaded.Chunks >= int64(info.Chunks) {
+			if loaded.LoadedRows != info.Rows {
+				return fmt.Errorf("%w：%s 筆數不符，預期 %d，已載入 %d", errSnapshotIncomplete, info.SnapshotID, info.Rows, loaded.LoadedRows)
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w：%s 在 %s 內只收到 %d / %d 段", errSnapshotIncomplete, info.SnapshotID, snapshotEndTimeout, loaded.Chunks, info.Chunks)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(snapshotPollInterval):
+		}
+	}
+}
+
+// quoteIdent 以中括號包住 SQL Server 識別字
+func quoteIdent(name string) string {
+	return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+}
@@ -0,0 +1,235 @@
+package service
+
+import (
+	model "TpeBiConsumer/model"
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/bytedance/sonic"
+	"gorm.io/driver/sqlserver"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/migrator"
+)
+
+// setupMockDB 以 sqlmock 建立 SQL Server 方言的 gorm.DB，不需要真實資料庫
+func setupMockDB(t *testing.T) (*gorm.DB, sqlmock.Sqlmock) {
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("建立 sqlmock 失敗: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	db, err := gorm.Open(sqlserver.New(sqlserver.Config{Conn: sqlDB}), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("建立 gorm.DB 失敗: %v", err)
+	}
+	return db, mock
+}
+
+var snapshotLoadColumns = []string{"SnapshotID", "FactoryID", "TableName", "StagingTable", "Status", "Watermark", "CreatedAt"}
+
+var heldBatchColumns = []string{"ID", "SnapshotID", "FactoryID", "BatchID", "SerialNoTo", "JSONList"}
+
+// newSnapshotTestProcessor 建立已快取 Cutting、Orders 欄位資訊（主鍵 ID）的 Processor
+func newSnapshotTestProcessor(db *gorm.DB) *Processor {
+	pk := func(name string) gorm.ColumnType {
+		return migrator.ColumnType{NameValue: sql.NullString{String: name, Valid: true}, DataTypeValue: sql.NullString{String: "nvarchar", Valid: true}, PrimaryKeyValue: sql.NullBool{Bool: true, Valid: true}}
+	}
+	qty := migrator.ColumnType{NameValue: sql.NullString{String: "Qty", Valid: true}, DataTypeValue: sql.NullString{String: "int", Valid: true}}
+	return &Processor{db: db, colTypeCache: map[string][]gorm.ColumnType{
+		"Cutting": {pk("ID"), qty},
+		"Orders":  {pk("ID"), qty},
+	}}
+}
+
+func snapshotTestEntries() []dmlEntry {
+	return []dmlEntry{
+		{Action: "Insert", Data: map[string]interface{}{"TableName": "Cutting", "ID": 1}},
+		{Action: "Delete", Data: map[string]interface{}{"TableName": "Orders", "ID": 2}},
+		{Action: "Insert", Data: map[string]interface{}{"TableName": "Cutting", "ID": 3}},
+	}
+}
+
+// TestFilterSnapshotEntries_Loading 驗證載入中的完整同步不在套用前處理，批次照常進入 transaction 由 holdSnapshotEntries 暫存
+func TestFilterSnapshotEntries_Loading(t *testing.T) {
+	db, mock := setupMockDB(t)
+	p := &Processor{db: db}
+	mock.ExpectQuery(`SELECT \* FROM "SnapshotLoad"`).
+		WillReturnRows(sqlmock.NewRows(snapshotLoadColumns).
+			AddRow("PH1-Cutting-1", "PH1", "Cutting", "Cutting_Snapshot_0a1b2c3d", model.SnapshotStatusLoading, 100, time.Now().Add(-time.Minute)))
+
+	env := model.Envelope{FactoryID: "PH1", SerialNoFrom: 101, SerialNoTo: 120}
+	kept, skipped, err := p.filterSnapshotEntries(context.Background(), env, snapshotTestEntries())
+	if err != nil || len(kept) != 3 || skipped != "" {
+		t.Fatalf("預期全部保留，實際保留 %d 筆，略過 %q，錯誤 %v", len(kept), skipped, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestFilterSnapshotEntries_Expired 驗證超過 snapshotHoldTimeout 的完整同步改為 Failed、移除 staging 後照常套用
+func TestFilterSnapshotEntries_Expired(t *testing.T) {
+	db, mock := setupMockDB(t)
+	p := newSnapshotTestProcessor(db)
+	mock.ExpectQuery(`SELECT \* FROM "SnapshotLoad"`).
+		WillReturnRows(sqlmock.NewRows(snapshotLoadColumns).
+			AddRow("PH1-Cutting-1", "PH1", "Cutting", "Cutting_Snapshot_0a1b2c3d", model.SnapshotStatusLoading, 100, time.Now().Add(-snapshotHoldTimeout-time.Minute)))
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE "SnapshotLoad" SET "Status"`).
+		WithArgs(model.SnapshotStatusFailed, "PH1-Cutting-1", model.SnapshotStatusLoading).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DROP TABLE \[Cutting_Snapshot_0a1b2c3d\]`).WillReturnResult(sqlmock.NewResult(0, 0))
+	// 中斷的完整同步不套用，暫存的異動照常套用
+	mock.ExpectQuery(`SELECT \* FROM "SnapshotHeldBatch"`).
+		WillReturnRows(sqlmock.NewRows(heldBatchColumns).AddRow(1, "PH1-Cutting-1", "PH1", 7, 90, `["{\"Action\":\"Delete\",\"Data\":{\"TableName\":\"Cutting\",\"ID\":\"A01\"}}"]`))
+	mock.ExpectExec(`DELETE FROM "Cutting"`).WithArgs("A01").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM "SnapshotHeldBatch"`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	env := model.Envelope{FactoryID: "PH1", SerialNoFrom: 101, SerialNoTo: 120}
+	kept, skipped, err := p.filterSnapshotEntries(context.Background(), env, snapshotTestEntries())
+	if err != nil {
+		t.Fatalf("filterSnapshotEntries 失敗: %v", err)
+	}
+	if len(kept) != 3 || skipped != "" {
+		t.Fatalf("預期全部照常套用，實際保留 %d 筆，略過 %q", len(kept), skipped)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestFilterSnapshotEntries_Watermark 驗證已套用的完整同步略過 Watermark 以前該資料表的異動，其他資料表照常套用
+func TestFilterSnapshotEntries_Watermark(t *testing.T) {
+	db, mock := setupMockDB(t)
+	p := &Processor{db: db}
+	mock.ExpectQuery(`SELECT \* FROM "SnapshotLoad"`).
+		WithArgs("Cutting", "Orders", model.SnapshotStatusLoading, model.SnapshotStatusApplied, "PH1", int64(90)).
+		WillReturnRows(sqlmock.NewRows(snapshotLoadColumns).
+			AddRow("PH1-Cutting-1", "PH1", "Cutting", "Cutting_Snapshot_0a1b2c3d", model.SnapshotStatusApplied, 100, time.Now()))
+
+	env := model.Envelope{FactoryID: "PH1", SerialNoFrom: 81, SerialNoTo: 90}
+	kept, skipped, err := p.filterSnapshotEntries(context.Background(), env, snapshotTestEntries())
+	if err != nil {
+		t.Fatalf("filterSnapshotEntries 失敗: %v", err)
+	}
+	if len(kept) != 1 || kept[0].Data["TableName"] != "Orders" {
+		t.Fatalf("預期只保留 Orders，實際 %+v", kept)
+	}
+	if !strings.Contains(skipped, "Cutting 2 筆") {
+		t.Fatalf("略過說明應包含 Cutting 的筆數，實際 %q", skipped)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestFilterSnapshotEntries_NoRange 驗證舊版 Producer 沒有 SerialNo 範圍的批次只檢查載入中的完整同步
+func TestFilterSnapshotEntries_NoRange(t *testing.T) {
+	db, mock := setupMockDB(t)
+	p := &Processor{db: db}
+	mock.ExpectQuery(`SELECT \* FROM "SnapshotLoad"`).
+		WithArgs("Cutting", "Orders", model.SnapshotStatusLoading).
+		WillReturnRows(sqlmock.NewRows(snapshotLoadColumns))
+
+	kept, skipped, err := p.filterSnapshotEntries(context.Background(), model.Envelope{}, snapshotTestEntries())
+	if err != nil || len(kept) != 3 || skipped != "" {
+		t.Fatalf("預期全部照常套用，實際保留 %d 筆，略過 %q，錯誤 %v", len(kept), skipped, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDmlLogProcess_SnapshotInterleaved 模擬只有一個 consumer 的 stream Queue 依序收到 Start、同一張資料表的 DML 批次與 End：
+// DML 批次中該資料表的異動暫存、其他資料表照常套用，不會重新排入 Queue 卡住 End；End 套用後再套用暫存的異動
+func TestDmlLogProcess_SnapshotInterleaved(t *testing.T) {
+	db, mock := setupMockDB(t)
+	p := newSnapshotTestProcessor(db)
+	ctx := context.Background()
+	env := model.Envelope{FactoryID: "PH1", SnapshotID: "PH1-Cutting-1"}
+	info := model.SnapshotInfo{SnapshotID: "PH1-Cutting-1", TableName: "Cutting", Mode: model.SnapshotModeReconcile, Watermark: 100}
+	loadRow := func(status string) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"SnapshotID", "FactoryID", "TableName", "StagingTable", "Mode", "Status", "Watermark", "CreatedAt"}).
+			AddRow(info.SnapshotID, "PH1", "Cutting", "Cutting_Snapshot_0a1b2c3d", model.SnapshotModeReconcile, status, 100, time.Now())
+	}
+	snapshotBody := func(phase string) []byte {
+		msg := info
+		msg.Phase = phase
+		body, err := sonic.Marshal(model.DmlMessage{Snapshot: &msg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	// 1. Start：建立 staging 與紀錄
+	mock.ExpectQuery(`SELECT \* FROM "SnapshotLoad" WHERE SnapshotID = @p1`).WillReturnRows(sqlmock.NewRows(snapshotLoadColumns))
+	mock.ExpectQuery(`SELECT \* FROM "SnapshotLoad" WHERE TableName = @p1 AND Status = @p2`).WillReturnRows(sqlmock.NewRows(snapshotLoadColumns))
+	mock.ExpectExec(`IF OBJECT_ID`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`SELECT TOP 0 \* INTO \[Cutting_Snapshot_[0-9a-f]{8}\] FROM \[Cutting\]`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`ALTER TABLE \[Cutting_Snapshot_[0-9a-f]{8}\] ADD CONSTRAINT`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO "SnapshotLoad"`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if _, err := p.DmlLogProcess(ctx, env, snapshotBody(model.SnapshotPhaseStart)); err != nil {
+		t.Fatalf("Start 失敗: %v", err)
+	}
+
+	// 2. 同一張資料表的 DML 批次：Cutting 暫存，Orders 照常套用，整個批次在同一個 transaction 內
+	dml := model.Envelope{FactoryID: "PH1", BatchID: 7, SerialNoFrom: 101, SerialNoTo: 102}
+	body, err := sonic.Marshal(model.DmlMessage{BatchID: 7, JSONList: []string{
+		`{"Action":"Delete","Data":{"TableName":"Cutting","ID":"A01"}}`,
+		`{"Action":"Delete","Data":{"TableName":"Orders","ID":"B01"}}`,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(`SELECT \* FROM "SnapshotLoad"`).WillReturnRows(loadRow(model.SnapshotStatusLoading))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT \* FROM SnapshotLoad WITH \(HOLDLOCK, ROWLOCK\)`).WillReturnRows(loadRow(model.SnapshotStatusLoading))
+	mock.ExpectQuery(`INSERT INTO "SnapshotHeldBatch"`).
+		WithArgs(info.SnapshotID, "PH1", int64(7), int64(102), `["{\"Action\":\"Delete\",\"Data\":{\"TableName\":\"Cutting\",\"ID\":\"A01\"}}"]`, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"ID"}).AddRow(1))
+	mock.ExpectExec(`DELETE FROM "Orders"`).WithArgs("B01").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	result, err := p.DmlLogProcess(ctx, dml, body)
+	if err != nil {
+		t.Fatalf("DML 批次不應失敗或重新排入 Queue: %v", err)
+	}
+	if result.RowsDeleted != 1 || !strings.Contains(result.Skipped, "暫存 Cutting 1 筆") {
+		t.Fatalf("DML 批次結果不符: %+v", result)
+	}
+
+	// 3. End：沒有資料列的 reconcile，套用後依序套用暫存的 Cutting 異動（SerialNoTo 102 大於 Watermark 100）
+	mock.ExpectQuery(`SELECT \* FROM "SnapshotLoad" WHERE SnapshotID = @p1`).WillReturnRows(loadRow(model.SnapshotStatusLoading))
+	mock.ExpectQuery(`SELECT COUNT\(\*\) AS Chunks`).WillReturnRows(sqlmock.NewRows([]string{"Chunks", "LoadedRows"}).AddRow(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE "SnapshotLoad" SET`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE T FROM \[Cutting\] AS T`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`MERGE`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DROP TABLE \[Cutting_Snapshot_0a1b2c3d\]`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT \* FROM "SnapshotHeldBatch"`).
+		WillReturnRows(sqlmock.NewRows(heldBatchColumns).AddRow(1, info.SnapshotID, "PH1", 7, 102, `["{\"Action\":\"Delete\",\"Data\":{\"TableName\":\"Cutting\",\"ID\":\"A01\"}}"]`))
+	mock.ExpectExec(`DELETE FROM "Cutting"`).WithArgs("A01").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM "SnapshotHeldBatch"`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	result, err = p.DmlLogProcess(ctx, env, snapshotBody(model.SnapshotPhaseEnd))
+	if err != nil {
+		t.Fatalf("End 失敗: %v", err)
+	}
+	if result.RowsDeleted != 1 || result.Skipped != "" {
+		t.Fatalf("End 結果不符: %+v", result)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
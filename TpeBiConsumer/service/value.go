@@ -0,0 +1,157 @@
+// 欄位值解碼：還原 FtyBiProducer 以字串編碼的 decimal、日期時間、binary… 欄位（DmlLog 的 Types）
+package service
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	mssql "github.com/microsoft/go-mssqldb"
+	"gorm.io/gorm"
+)
+
+// 型別化欄位的種類，由 Types 中的來源型別決定，與 FtyBiProducer 一致
+const (
+	valueKindDecimal        = "decimal"          // 完整精度的十進位字串，例如 "12.3400"
+	valueKindDate           = "date"             // 2006-01-02
+	valueKindTime           = "time"             // 15:04:05.9999999
+	valueKindDateTime       = "datetime"         // 2006-01-02T15:04:05.9999999，不帶時區（牆上時間）
+	valueKindDateTimeOffset = "datetimeoffset"   // 2006-01-02T15:04:05.9999999+08:00
+	valueKindBinary         = "binary"           // base64
+	valueKindGUID           = "uniqueidentifier" // 8-4-4-4-12 十六進位
+	valueKindXML            = "xml"              // 原始 XML 字串
+)
+
+// 型別化欄位的時間格式
+const (
+	layoutDate           = "2006-01-02"
+	layoutTime           = "15:04:05.9999999"
+	layoutDateTime       = "2006-01-02T15:04:05.9999999"
+	layoutDateTimeOffset = "2006-01-02T15:04:05.9999999Z07:00"
+)
+
+// valueKind 回傳來源型別（不分大小寫，可帶精度）對應的編碼種類，JSON 原生型別回傳空字串
+func valueKind(srcType string) string {
+	name := strings.ToUpper(srcType)
+	if i := strings.IndexByte(name, '('); i >= 0 {
+		name = name[:i]
+	}
+	switch strings.TrimSpace(name) {
+	case "DECIMAL", "NUMERIC", "MONEY", "SMALLMONEY":
+		return valueKindDecimal
+	case "DATE":
+		return valueKindDate
+	case "TIME":
+		return valueKindTime
+	case "DATETIME", "DATETIME2", "SMALLDATETIME":
+		return valueKindDateTime
+	case "DATETIMEOFFSET":
+		return valueKindDateTimeOffset
+	case "BINARY", "VARBINARY", "IMAGE", "TIMESTAMP", "ROWVERSION":
+		return valueKindBinary
+	case "UNIQUEIDENTIFIER":
+		return valueKindGUID
+	case "XML":
+		return valueKindXML
+	}
+	return ""
+}
+
+// typedValue 為需要依來源型別還原的欄位值，由 convertValue 依目的欄位型別轉換
+type typedValue struct {
+	srcType string // Types 中的來源型別，例如 decimal(18,4)、datetimeoffset
+	raw     string
+}
+
+// applyTypes 把 types 中列出的欄位包裝成 typedValue；舊版訊息沒有 Types 時不做任何事
+func applyTypes(row map[string]interface{}, types map[string]string) error {
+	for col, srcType := range types {
+		v, ok := row[col]
+		if !ok || v == nil {
+			continue
+		}
+		if valueKind(srcType) == "" {
+			return fmt.Errorf("欄位 %s 的來源型別 %q 不支援", col, srcType)
+		}
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("欄位 %s (%s) 應為字串，實際為 %T", col, srcType, v)
+		}
+		row[col] = typedValue{srcType: srcType, raw: s}
+	}
+	return nil
+}
+
+// decodeTyped 依來源型別解析字串，再依目的欄位型別決定 Go 型別：
+// decimal 寫入 DECIMAL / NUMERIC / MONEY 時維持字串（BulkCopy 與參數都以完整精度轉換），
+// uniqueidentifier 寫入 UNIQUEIDENTIFIER 時轉為 SQL Server 位元組順序
+func decodeTyped(v typedValue, ct gorm.ColumnType) (interface{}, error) {
+	dbType := strings.ToUpper(ct.DatabaseTypeName())
+	kind := valueKind(v.srcType)
+	switch kind {
+	case valueKindDecimal:
+		if strings.HasPrefix(dbType, "DECIMAL") || strings.HasPrefix(dbType, "NUMERIC") || strings.HasSuffix(dbType, "MONEY") {
+			return v.raw, nil
+		}
+		// 其他目的型別（FLOAT、INT、字串）沿用一般轉換
+		return convertValue(v.raw, ct)
+
+	case valueKindDate, valueKindTime, valueKindDateTime, valueKindDateTimeOffset:
+		layout := layoutDateTime
+		switch kind {
+		case valueKindDate:
+			layout = layoutDate
+		case valueKindTime:
+			layout = layoutTime
+		case valueKindDateTimeOffset:
+			layout = layoutDateTimeOffset
+		}
+		t, err := time.Parse(layout, v.raw)
+		if err != nil {
+			return nil, fmt.Errorf("欄位 %s (%s) 轉 time 失敗: %w", ct.Name(), v.srcType, err)
+		}
+		if isStringColumn(dbType) {
+			return v.raw, nil
+		}
+		if kind == valueKindTime {
+			// time.Parse 只有時間時年份為 0，超出 SQL Server 日期範圍：TIME 欄位以字串寫入（BulkCopy 與參數都會轉換），
+			// 其他日期時間欄位比照 SQL Server 的隱含轉換以 1900-01-01 為日期
+			if strings.HasPrefix(dbType, "TIME") {
+				return v.raw, nil
+			}
+			return time.Date(1900, 1, 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC), nil
+		}
+		return t, nil
+
+	case valueKindBinary:
+		b, err := base64.StdEncoding.DecodeString(v.raw)
+		if err != nil {
+			return nil, fmt.Errorf("欄位 %s (%s) base64 解碼失敗: %w", ct.Name(), v.srcType, err)
+		}
+		return b, nil
+
+	case valueKindGUID:
+		var u mssql.UniqueIdentifier
+		if err := u.Scan(v.raw); err != nil {
+			return nil, fmt.Errorf("欄位 %s (%s) 解析失敗: %w", ct.Name(), v.srcType, err)
+		}
+		if dbType != "UNIQUEIDENTIFIER" {
+			return u.String(), nil
+		}
+		return u.Value()
+
+	case valueKindXML:
+		return v.raw, nil
+	}
+	return nil, fmt.Errorf("欄位 %s 的來源型別 %q 不支援", ct.Name(), v.srcType)
+}
+
+// isStringColumn 判斷目的欄位是否為字串型別
+func isStringColumn(dbType string) bool {
+	switch dbType {
+	case "CHAR", "VARCHAR", "NCHAR", "NVARCHAR", "TEXT", "NTEXT":
+		return true
+	}
+	return false
+}